@@ -0,0 +1,250 @@
+// Command redrive re-runs the events in a Lambda's dead-letter queue, once whatever made them
+// fail has been fixed. The queue URLs are in the deadLetterQueues stack output:
+//
+//	go run ./cmd/redrive -queue "$(cd infra && pulumi stack output deadLetterQueues --json | jq -r .email_ingest)" -dry-run
+//
+// S3 notifications for a queue-fed stage are sent back to the stage's queue. Other events are
+// invoked asynchronously, the way the schedules invoke them. Either way, one that fails again
+// is retried and dead-lettered as before.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// sqsAPI captures the subset of the SQS client API we use. This enables unit testing with a mock.
+type sqsAPI interface {
+	ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error)
+	ChangeMessageVisibilityWithContext(ctx aws.Context, input *sqs.ChangeMessageVisibilityInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error)
+	SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error)
+	ListDeadLetterSourceQueuesWithContext(ctx aws.Context, input *sqs.ListDeadLetterSourceQueuesInput, opts ...request.Option) (*sqs.ListDeadLetterSourceQueuesOutput, error)
+}
+
+// lambdaAPI captures the subset of the Lambda client API we use.
+type lambdaAPI interface {
+	InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error)
+}
+
+// visibilityTimeout hides received messages from other consumers, and from this run's later
+// receives, while they are redriven. Messages that are not deleted are released at the end.
+const visibilityTimeout = 300
+
+func main() {
+	if err := run(context.Background(), os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "redrive:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("redrive", flag.ContinueOnError)
+	queue := flags.String("queue", "", "dead-letter queue URL")
+	function := flags.String("function", "", "function to invoke (default: the one each message failed in)")
+	limit := flags.Int("max", 0, "redrive at most this many messages (default: all)")
+	dryRun := flags.Bool("dry-run", false, "list the events that would be redriven without invoking anything")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *queue == "" {
+		return fmt.Errorf("-queue is required")
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return fmt.Errorf("failed to create AWS session: %w", err)
+	}
+	return redrive(ctx, sqs.New(sess), lambda.New(sess), redriveOptions{
+		Queue:    *queue,
+		Function: *function,
+		Max:      *limit,
+		DryRun:   *dryRun,
+	}, stdout)
+}
+
+type redriveOptions struct {
+	Queue    string
+	Function string // overrides the function named in each message; unused for stage queues
+	Max      int    // zero for no limit
+	DryRun   bool
+}
+
+// redrive re-runs the event in each message in the queue, deleting the messages it re-ran.
+func redrive(ctx context.Context, q sqsAPI, fn lambdaAPI, opts redriveOptions, stdout io.Writer) error {
+	// A stage queue's dead-letter queue names it as a source; its messages go back there
+	sources, err := q.ListDeadLetterSourceQueuesWithContext(ctx, &sqs.ListDeadLetterSourceQueuesInput{QueueUrl: aws.String(opts.Queue)})
+	if err != nil {
+		return fmt.Errorf("sqs list source queues of %s: %w", opts.Queue, err)
+	}
+	if len(sources.QueueUrls) > 1 {
+		return fmt.Errorf("%s is the dead-letter queue of %d queues; cannot tell which to send messages back to", opts.Queue, len(sources.QueueUrls))
+	}
+	var sourceQueue string
+	if len(sources.QueueUrls) == 1 {
+		sourceQueue = aws.StringValue(sources.QueueUrls[0])
+	}
+
+	var redriven, failed int
+	var keep []*string // receipt handles of messages left in the queue
+	defer func() {
+		// Make messages that were not redriven visible again straight away
+		for _, h := range keep {
+			_, _ = q.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          aws.String(opts.Queue),
+				ReceiptHandle:     h,
+				VisibilityTimeout: aws.Int64(0),
+			})
+		}
+	}()
+
+	for opts.Max == 0 || redriven+failed < opts.Max {
+		batch := int64(10)
+		if opts.Max > 0 {
+			batch = min(batch, int64(opts.Max-redriven-failed))
+		}
+		out, err := q.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(opts.Queue),
+			MaxNumberOfMessages:   aws.Int64(batch),
+			VisibilityTimeout:     aws.Int64(visibilityTimeout),
+			WaitTimeSeconds:       aws.Int64(1),
+			MessageAttributeNames: aws.StringSlice([]string{"All"}),
+		})
+		if err != nil {
+			return fmt.Errorf("sqs receive %s: %w", opts.Queue, err)
+		}
+		if len(out.Messages) == 0 {
+			break
+		}
+
+		for _, msg := range out.Messages {
+			id := aws.StringValue(msg.MessageId)
+			if sourceQueue != "" {
+				if opts.DryRun {
+					fmt.Fprintf(stdout, "%s -> %s: %s\n", id, sourceQueue, aws.StringValue(msg.Body))
+					keep = append(keep, msg.ReceiptHandle)
+					redriven++
+					continue
+				}
+				if _, err := q.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+					QueueUrl:          aws.String(sourceQueue),
+					MessageBody:       msg.Body,
+					MessageAttributes: msg.MessageAttributes,
+				}); err != nil {
+					fmt.Fprintf(stdout, "failed %s: send to %s: %v\n", id, sourceQueue, err)
+					keep = append(keep, msg.ReceiptHandle)
+					failed++
+					continue
+				}
+				if err := deleteMessage(ctx, q, opts.Queue, msg, sourceQueue); err != nil {
+					return err
+				}
+				fmt.Fprintf(stdout, "redrove %s -> %s\n", id, sourceQueue)
+				redriven++
+				continue
+			}
+
+			dl, err := parseDeadLetter(msg)
+			if err == nil && opts.Function != "" {
+				dl.Function = opts.Function
+			}
+			if err == nil && dl.Function == "" {
+				err = fmt.Errorf("the message does not say which function failed; pass -function")
+			}
+			if err != nil {
+				fmt.Fprintf(stdout, "skipped %s: %v\n", id, err)
+				keep = append(keep, msg.ReceiptHandle)
+				failed++
+				continue
+			}
+
+			if opts.DryRun {
+				fmt.Fprintf(stdout, "%s -> %s: %s\n", id, dl.Function, dl.Payload)
+				keep = append(keep, msg.ReceiptHandle)
+				redriven++
+				continue
+			}
+			if _, err := fn.InvokeWithContext(ctx, &lambda.InvokeInput{
+				FunctionName:   aws.String(dl.Function),
+				InvocationType: aws.String(lambda.InvocationTypeEvent),
+				Payload:        dl.Payload,
+			}); err != nil {
+				fmt.Fprintf(stdout, "failed %s: invoke %s: %v\n", id, dl.Function, err)
+				keep = append(keep, msg.ReceiptHandle)
+				failed++
+				continue
+			}
+			if err := deleteMessage(ctx, q, opts.Queue, msg, dl.Function); err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "redrove %s -> %s\n", id, dl.Function)
+			redriven++
+		}
+	}
+
+	verb := "Redrove"
+	if opts.DryRun {
+		verb = "Would redrive"
+	}
+	fmt.Fprintf(stdout, "%s %d event(s)\n", verb, redriven)
+	if failed > 0 {
+		return fmt.Errorf("%d message(s) were not redriven and are still in the queue", failed)
+	}
+	return nil
+}
+
+// deleteMessage removes a message that has been redriven to target.
+func deleteMessage(ctx context.Context, q sqsAPI, queue string, msg *sqs.Message, target string) error {
+	if _, err := q.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queue),
+		ReceiptHandle: msg.ReceiptHandle,
+	}); err != nil {
+		// The event was redriven; leaving the message would redrive it twice
+		return fmt.Errorf("sqs delete %s after redriving it to %s: %w", aws.StringValue(msg.MessageId), target, err)
+	}
+	return nil
+}
+
+// deadLetter is the event in a dead-letter message and the function it was meant for.
+type deadLetter struct {
+	Function string
+	Payload  []byte
+}
+
+// destinationRecord is what Lambda sends to an on-failure destination.
+type destinationRecord struct {
+	RequestContext struct {
+		FunctionArn string `json:"functionArn"`
+	} `json:"requestContext"`
+	RequestPayload json.RawMessage `json:"requestPayload"`
+}
+
+// parseDeadLetter reads the two kinds of message the queues hold: Lambda on-failure records,
+// which wrap the original event in requestPayload, and events EventBridge Scheduler could not
+// deliver, which are the schedule's input with the function in the TARGET_ARN attribute.
+func parseDeadLetter(msg *sqs.Message) (deadLetter, error) {
+	body := []byte(aws.StringValue(msg.Body))
+	var record destinationRecord
+	if err := json.Unmarshal(body, &record); err != nil {
+		return deadLetter{}, fmt.Errorf("message body is not JSON: %w", err)
+	}
+	if record.RequestContext.FunctionArn != "" && len(record.RequestPayload) > 0 {
+		return deadLetter{Function: record.RequestContext.FunctionArn, Payload: record.RequestPayload}, nil
+	}
+
+	dl := deadLetter{Payload: body}
+	if attr, ok := msg.MessageAttributes["TARGET_ARN"]; ok {
+		dl.Function = aws.StringValue(attr.StringValue)
+	}
+	return dl, nil
+}
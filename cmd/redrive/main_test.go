@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const ingestARN = "arn:aws:lambda:eu-west-2:123456789012:function:mailmunch-dev-loseit-ingest"
+
+// mockSQS is a queue holding messages; received messages stay hidden until deleted or released.
+type mockSQS struct {
+	messages []*sqs.Message
+	sources  []string // queues this is the dead-letter queue of
+	hidden   map[string]bool
+	deleted  []string
+	released []string
+	sent     []*sqs.SendMessageInput
+}
+
+func (m *mockSQS) ListDeadLetterSourceQueuesWithContext(_ aws.Context, _ *sqs.ListDeadLetterSourceQueuesInput, _ ...request.Option) (*sqs.ListDeadLetterSourceQueuesOutput, error) {
+	return &sqs.ListDeadLetterSourceQueuesOutput{QueueUrls: aws.StringSlice(m.sources)}, nil
+}
+
+func (m *mockSQS) SendMessageWithContext(_ aws.Context, input *sqs.SendMessageInput, _ ...request.Option) (*sqs.SendMessageOutput, error) {
+	m.sent = append(m.sent, input)
+	return &sqs.SendMessageOutput{MessageId: aws.String("new")}, nil
+}
+
+func (m *mockSQS) ReceiveMessageWithContext(_ aws.Context, input *sqs.ReceiveMessageInput, _ ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	if m.hidden == nil {
+		m.hidden = map[string]bool{}
+	}
+	out := &sqs.ReceiveMessageOutput{}
+	for _, msg := range m.messages {
+		if int64(len(out.Messages)) == aws.Int64Value(input.MaxNumberOfMessages) {
+			break
+		}
+		h := aws.StringValue(msg.ReceiptHandle)
+		if m.hidden[h] || slices.Contains(m.deleted, h) {
+			continue
+		}
+		m.hidden[h] = true
+		out.Messages = append(out.Messages, msg)
+	}
+	return out, nil
+}
+
+func (m *mockSQS) DeleteMessageWithContext(_ aws.Context, input *sqs.DeleteMessageInput, _ ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	m.deleted = append(m.deleted, aws.StringValue(input.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (m *mockSQS) ChangeMessageVisibilityWithContext(_ aws.Context, input *sqs.ChangeMessageVisibilityInput, _ ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	m.released = append(m.released, aws.StringValue(input.ReceiptHandle))
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+type mockLambda struct {
+	invoked []*lambda.InvokeInput
+	err     error
+}
+
+func (m *mockLambda) InvokeWithContext(_ aws.Context, input *lambda.InvokeInput, _ ...request.Option) (*lambda.InvokeOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.invoked = append(m.invoked, input)
+	return &lambda.InvokeOutput{StatusCode: aws.Int64(202)}, nil
+}
+
+func message(id, body string, attrs map[string]string) *sqs.Message {
+	msg := &sqs.Message{MessageId: aws.String(id), ReceiptHandle: aws.String("handle-" + id), Body: aws.String(body)}
+	if len(attrs) > 0 {
+		msg.MessageAttributes = map[string]*sqs.MessageAttributeValue{}
+		for k, v := range attrs {
+			msg.MessageAttributes[k] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+		}
+	}
+	return msg
+}
+
+// destinationMessage is an on-failure record as Lambda writes it.
+func destinationMessage(id, payload string) *sqs.Message {
+	return message(id, `{"version":"1.0","timestamp":"2025-09-20T18:00:03.000Z",`+
+		`"requestContext":{"requestId":"abc","functionArn":"`+ingestARN+`:$LATEST","condition":"RetriesExhausted","approximateInvokeCount":3},`+
+		`"requestPayload":`+payload+`,"responseContext":{"statusCode":200,"functionError":"Unhandled"},`+
+		`"responsePayload":{"errorMessage":"boom"}}`, nil)
+}
+
+func TestParseDeadLetter(t *testing.T) {
+	payload := `{"Records":[{"s3":{"bucket":{"name":"mailmunch-data"},"object":{"key":"raw/email/incoming/abc"}}}]}`
+	dl, err := parseDeadLetter(destinationMessage("1", payload))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dl.Function != ingestARN+":$LATEST" || string(dl.Payload) != payload {
+		t.Errorf("unexpected dead letter from an on-failure record: %s %s", dl.Function, dl.Payload)
+	}
+
+	input := `{"source":"aws.scheduler","detail-type":"Weekly Report Trigger"}`
+	dl, err = parseDeadLetter(message("2", input, map[string]string{
+		"ERROR_CODE": "AWS.Lambda.TooManyRequestsException",
+		"TARGET_ARN": "arn:aws:lambda:eu-west-2:123456789012:function:mailmunch-dev-weekly-report",
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dl.Function != "arn:aws:lambda:eu-west-2:123456789012:function:mailmunch-dev-weekly-report" || string(dl.Payload) != input {
+		t.Errorf("unexpected dead letter from the scheduler: %s %s", dl.Function, dl.Payload)
+	}
+
+	if _, err := parseDeadLetter(message("3", "not json", nil)); err == nil {
+		t.Error("expected a message that is not JSON to be rejected")
+	}
+}
+
+func TestRedriveInvokesAndDeletes(t *testing.T) {
+	q := &mockSQS{}
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"} {
+		q.messages = append(q.messages, destinationMessage(id, `{"id":"`+id+`"}`))
+	}
+	fn := &mockLambda{}
+	var out bytes.Buffer
+	if err := redrive(context.Background(), q, fn, redriveOptions{Queue: "dlq"}, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(fn.invoked) != 12 || len(q.deleted) != 12 {
+		t.Fatalf("invoked %d and deleted %d of 12 messages", len(fn.invoked), len(q.deleted))
+	}
+	for _, in := range fn.invoked {
+		if aws.StringValue(in.InvocationType) != lambda.InvocationTypeEvent {
+			t.Errorf("expected an async invocation, got %s", aws.StringValue(in.InvocationType))
+		}
+	}
+	if string(fn.invoked[0].Payload) != `{"id":"a"}` {
+		t.Errorf("invoked with %s rather than the original event", fn.invoked[0].Payload)
+	}
+	if !strings.Contains(out.String(), "Redrove 12 event(s)") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestRedriveDryRunLeavesMessages(t *testing.T) {
+	q := &mockSQS{messages: []*sqs.Message{destinationMessage("a", `{}`), destinationMessage("b", `{}`)}}
+	fn := &mockLambda{}
+	var out bytes.Buffer
+	if err := redrive(context.Background(), q, fn, redriveOptions{Queue: "dlq", DryRun: true}, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fn.invoked) != 0 || len(q.deleted) != 0 {
+		t.Errorf("dry run invoked %d and deleted %d messages", len(fn.invoked), len(q.deleted))
+	}
+	if len(q.released) != 2 {
+		t.Errorf("expected both messages to be made visible again, released %v", q.released)
+	}
+	if !strings.Contains(out.String(), "Would redrive 2 event(s)") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestRedriveKeepsFailures(t *testing.T) {
+	q := &mockSQS{messages: []*sqs.Message{
+		destinationMessage("a", `{}`),
+		message("plain", `{"Records":[]}`, nil), // no function to send it to
+	}}
+	fn := &mockLambda{err: errors.New("throttled")}
+	var out bytes.Buffer
+	err := redrive(context.Background(), q, fn, redriveOptions{Queue: "dlq"}, &out)
+	if err == nil {
+		t.Fatal("expected an error when messages could not be redriven")
+	}
+	if len(q.deleted) != 0 || len(q.released) != 2 {
+		t.Errorf("deleted %v and released %v; failures should stay in the queue", q.deleted, q.released)
+	}
+
+	// -function names the function for messages that do not
+	q = &mockSQS{messages: []*sqs.Message{message("plain", `{"Records":[]}`, nil)}}
+	fn = &mockLambda{}
+	if err := redrive(context.Background(), q, fn, redriveOptions{Queue: "dlq", Function: "loseit-ingest"}, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fn.invoked) != 1 || aws.StringValue(fn.invoked[0].FunctionName) != "loseit-ingest" {
+		t.Errorf("unexpected invocations %v", fn.invoked)
+	}
+}
+
+func TestRedriveStopsAtMax(t *testing.T) {
+	q := &mockSQS{}
+	for _, id := range []string{"a", "b", "c"} {
+		q.messages = append(q.messages, destinationMessage(id, `{}`))
+	}
+	fn := &mockLambda{}
+	if err := redrive(context.Background(), q, fn, redriveOptions{Queue: "dlq", Max: 2}, &bytes.Buffer{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fn.invoked) != 2 {
+		t.Errorf("expected 2 invocations, got %d", len(fn.invoked))
+	}
+}
+
+func TestRedriveReturnsStageMessagesToTheirQueue(t *testing.T) {
+	notification := `{"Records":[{"s3":{"bucket":{"name":"mailmunch-data"},"object":{"key":"raw/loseit_csv/user_id=alex/year=2025/month=09/day=20/loseit-daily.csv"}}}]}`
+	stage := "https://sqs.eu-west-2.amazonaws.com/123456789012/mailmunch-dev-loseit-transform-queue"
+	q := &mockSQS{sources: []string{stage}, messages: []*sqs.Message{message("a", notification, nil)}}
+	fn := &mockLambda{}
+	var out bytes.Buffer
+	if err := redrive(context.Background(), q, fn, redriveOptions{Queue: "dlq", Function: "ignored"}, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fn.invoked) != 0 {
+		t.Errorf("stage notifications should go back to the queue, not to the function: %v", fn.invoked)
+	}
+	if len(q.sent) != 1 || aws.StringValue(q.sent[0].QueueUrl) != stage || aws.StringValue(q.sent[0].MessageBody) != notification {
+		t.Errorf("unexpected sends %v", q.sent)
+	}
+	if !slices.Equal(q.deleted, []string{"handle-a"}) {
+		t.Errorf("expected the redriven message to be deleted, deleted %v", q.deleted)
+	}
+}
@@ -3,3 +3,7 @@ module github.com/duderman/mailmunch
 go 1.24
 
 replace github.com/duderman/mailmunch/infra => ./infra
+
+require github.com/aws/aws-sdk-go v1.55.5
+
+require github.com/jmespath/go-jmespath v0.4.0 // indirect
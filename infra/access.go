@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// accessManifest is lambda/<package>/access.json: the AWS APIs a Lambda calls and what it
+// calls them on. The function's IAM policy is generated from it, and
+// TestAccessManifestsCoverCode fails when the code calls an API the manifest does not grant.
+type accessManifest struct {
+	S3            []s3Grant    `json:"s3,omitempty"`
+	ListBucket    []string     `json:"list_bucket,omitempty"` // prefixes; "" is the whole bucket, which also turns missing keys into NoSuchKey instead of AccessDenied
+	Secrets       []string     `json:"secrets,omitempty"`     // keys of accessResources.Secrets
+	SES           []string     `json:"ses,omitempty"`         // sending actions, on this account's identities
+	Athena        *athenaGrant `json:"athena,omitempty"`
+	AppConfig     bool         `json:"appconfig,omitempty"`      // read the stack's configuration profile
+	Templates     bool         `json:"templates,omitempty"`      // list and read report templates under accessResources.TemplatesPrefix
+	InvokeSelf    bool         `json:"invoke_self,omitempty"`    // invoke its own function; granted by newFunction, which knows its ARN
+	OperatorFiles []string     `json:"operator_files,omitempty"` // commands run with operator credentials rather than the Lambda role
+}
+
+// s3Grant allows object actions under Prefix in the data bucket.
+type s3Grant struct {
+	Prefix  string   `json:"prefix"`
+	Actions []string `json:"actions"`
+}
+
+// athenaGrant allows queries in the stack's workgroup against Tables, with results under
+// ResultsPrefix in the data bucket.
+type athenaGrant struct {
+	Tables        []string `json:"tables"` // keys of accessResources.Tables
+	ResultsPrefix string   `json:"results_prefix"`
+}
+
+var (
+	athenaQueryActions = []string{"athena:StartQueryExecution", "athena:GetQueryExecution", "athena:GetQueryResults", "athena:StopQueryExecution"}
+	glueReadActions    = []string{"glue:GetDatabase", "glue:GetTable", "glue:GetPartitions"}
+	appConfigActions   = []string{"appconfig:StartConfigurationSession", "appconfig:GetLatestConfiguration"}
+)
+
+func loadAccessManifest(pkg string) (*accessManifest, error) {
+	return readAccessManifest(fmt.Sprintf("../lambda/%s/access.json", pkg))
+}
+
+func readAccessManifest(path string) (*accessManifest, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	var m accessManifest
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	for _, g := range m.S3 {
+		if g.Prefix == "" {
+			return nil, fmt.Errorf("%s: s3 grants need a prefix", path)
+		}
+		for _, a := range g.Actions {
+			if !strings.HasPrefix(a, "s3:") || strings.Contains(a, "*") {
+				return nil, fmt.Errorf("%s: invalid s3 action %q", path, a)
+			}
+		}
+	}
+	for _, a := range m.SES {
+		if !strings.HasPrefix(a, "ses:") || strings.Contains(a, "*") {
+			return nil, fmt.Errorf("%s: invalid ses action %q", path, a)
+		}
+	}
+	return &m, nil
+}
+
+// actions lists every IAM action the manifest grants.
+func (m *accessManifest) actions() []string {
+	var out []string
+	for _, g := range m.S3 {
+		out = append(out, g.Actions...)
+	}
+	if len(m.ListBucket) > 0 {
+		out = append(out, "s3:ListBucket")
+	}
+	if len(m.Secrets) > 0 {
+		out = append(out, "secretsmanager:GetSecretValue")
+	}
+	out = append(out, m.SES...)
+	if m.Athena != nil {
+		out = append(out, athenaQueryActions...)
+		out = append(out, glueReadActions...)
+		out = append(out, "s3:GetBucketLocation", "s3:GetObject", "s3:PutObject", "s3:AbortMultipartUpload", "s3:ListBucket")
+	}
+	if m.AppConfig {
+		out = append(out, appConfigActions...)
+	}
+	if m.Templates {
+		out = append(out, "s3:GetObject", "s3:ListBucket")
+	}
+	if m.InvokeSelf {
+		out = append(out, "lambda:InvokeFunction")
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// athenaTable is a Glue table Lambdas may query and where its data lives in the data bucket.
+type athenaTable struct {
+	Name   string
+	Prefix string
+}
+
+// accessResources are the stack's resources that manifests refer to.
+type accessResources struct {
+	Region    pulumi.StringInput
+	Account   pulumi.StringInput
+	BucketArn pulumi.StringOutput
+	DataKey   pulumi.StringInput // KMS key ARN encrypting the data bucket and the secrets
+	Secrets   map[string]pulumi.StringInput
+	Database  string
+	Tables    map[string]athenaTable
+	Workgroup string
+	AppConfig pulumi.StringInput // configuration profile ARN
+	// TemplatesPrefix is where report templates are read from, empty when they are not in S3
+	TemplatesPrefix string
+}
+
+// policy generates the inline policy for pkg from its manifest.
+func (r *accessResources) policy(ctx *pulumi.Context, pkg string) (RolePolicy, error) {
+	m, err := loadAccessManifest(pkg)
+	if err != nil {
+		return RolePolicy{}, err
+	}
+
+	var statements iam.GetPolicyDocumentStatementArray
+	allow := func(actions []string, resources pulumi.StringArray) {
+		statements = append(statements, iam.GetPolicyDocumentStatementArgs{
+			Effect:    pulumi.String("Allow"),
+			Actions:   pulumi.ToStringArray(actions),
+			Resources: resources,
+		})
+	}
+	object := func(prefix string) pulumi.StringInput {
+		return pulumi.Sprintf("%s/%s*", r.BucketArn, prefix)
+	}
+	listPrefixes := slices.Clone(m.ListBucket)
+
+	for _, g := range m.S3 {
+		allow(g.Actions, pulumi.StringArray{object(g.Prefix)})
+	}
+	for _, name := range m.Secrets {
+		arn, ok := r.Secrets[name]
+		if !ok {
+			return RolePolicy{}, fmt.Errorf("%s: unknown secret %q", pkg, name)
+		}
+		allow([]string{"secretsmanager:GetSecretValue"}, pulumi.StringArray{arn})
+	}
+	if len(m.SES) > 0 {
+		allow(m.SES, pulumi.StringArray{pulumi.Sprintf("arn:aws:ses:%s:%s:identity/*", r.Region, r.Account)})
+	}
+	if a := m.Athena; a != nil {
+		allow(athenaQueryActions, pulumi.StringArray{pulumi.Sprintf("arn:aws:athena:%s:%s:workgroup/%s", r.Region, r.Account, r.Workgroup)})
+		glue := pulumi.StringArray{
+			pulumi.Sprintf("arn:aws:glue:%s:%s:catalog", r.Region, r.Account),
+			pulumi.Sprintf("arn:aws:glue:%s:%s:database/%s", r.Region, r.Account, r.Database),
+		}
+		var data pulumi.StringArray
+		for _, name := range a.Tables {
+			table, ok := r.Tables[name]
+			if !ok {
+				return RolePolicy{}, fmt.Errorf("%s: unknown table %q", pkg, name)
+			}
+			glue = append(glue, pulumi.Sprintf("arn:aws:glue:%s:%s:table/%s/%s", r.Region, r.Account, r.Database, table.Name))
+			data = append(data, object(table.Prefix))
+			listPrefixes = append(listPrefixes, table.Prefix)
+		}
+		allow(glueReadActions, glue)
+		// Athena reads the table data and writes results with the caller's credentials
+		allow([]string{"s3:GetObject"}, data)
+		allow([]string{"s3:GetObject", "s3:PutObject", "s3:AbortMultipartUpload"}, pulumi.StringArray{object(a.ResultsPrefix)})
+		allow([]string{"s3:GetBucketLocation"}, pulumi.StringArray{r.BucketArn})
+		listPrefixes = append(listPrefixes, a.ResultsPrefix)
+	}
+	if m.AppConfig {
+		allow(appConfigActions, pulumi.StringArray{r.AppConfig})
+	}
+	readsTemplates := m.Templates && r.TemplatesPrefix != ""
+	if readsTemplates {
+		allow([]string{"s3:GetObject"}, pulumi.StringArray{object(r.TemplatesPrefix)})
+		listPrefixes = append(listPrefixes, r.TemplatesPrefix)
+	}
+
+	// Objects and secrets are encrypted with the data key. Reading them needs kms:Decrypt and
+	// writing objects kms:GenerateDataKey (and kms:Decrypt for multipart uploads), each only
+	// through the service holding the data
+	readsObjects, writesObjects := readsTemplates, false
+	for _, g := range m.S3 {
+		readsObjects = readsObjects || slices.Contains(g.Actions, "s3:GetObject")
+		writesObjects = writesObjects || slices.Contains(g.Actions, "s3:PutObject")
+	}
+	if m.Athena != nil {
+		readsObjects, writesObjects = true, true
+	}
+	var via pulumi.StringArray
+	if readsObjects || writesObjects {
+		via = append(via, pulumi.Sprintf("s3.%s.amazonaws.com", r.Region))
+	}
+	if len(m.Secrets) > 0 {
+		via = append(via, pulumi.Sprintf("secretsmanager.%s.amazonaws.com", r.Region))
+	}
+	if len(via) > 0 {
+		kmsActions := []string{"kms:Decrypt"}
+		if writesObjects {
+			kmsActions = append(kmsActions, "kms:GenerateDataKey")
+		}
+		statements = append(statements, iam.GetPolicyDocumentStatementArgs{
+			Effect:    pulumi.String("Allow"),
+			Actions:   pulumi.ToStringArray(kmsActions),
+			Resources: pulumi.StringArray{r.DataKey},
+			Conditions: iam.GetPolicyDocumentStatementConditionArray{
+				iam.GetPolicyDocumentStatementConditionArgs{
+					Test:     pulumi.String("StringEquals"),
+					Variable: pulumi.String("kms:ViaService"),
+					Values:   via,
+				},
+			},
+		})
+	}
+
+	if slices.Contains(listPrefixes, "") {
+		allow([]string{"s3:ListBucket"}, pulumi.StringArray{r.BucketArn})
+	} else if len(listPrefixes) > 0 {
+		var patterns []string
+		for _, p := range listPrefixes {
+			patterns = append(patterns, p+"*")
+		}
+		statements = append(statements, iam.GetPolicyDocumentStatementArgs{
+			Effect:    pulumi.String("Allow"),
+			Actions:   pulumi.ToStringArray([]string{"s3:ListBucket"}),
+			Resources: pulumi.StringArray{r.BucketArn},
+			Conditions: iam.GetPolicyDocumentStatementConditionArray{
+				iam.GetPolicyDocumentStatementConditionArgs{
+					Test:     pulumi.String("StringLike"),
+					Variable: pulumi.String("s3:prefix"),
+					Values:   pulumi.ToStringArray(patterns),
+				},
+			},
+		})
+	}
+
+	doc := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{Statements: statements})
+	return RolePolicy{Name: "access", Document: doc.Json()}, nil
+}
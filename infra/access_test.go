@@ -0,0 +1,142 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// iamPrefixes maps AWS SDK service packages to their IAM action prefix.
+var iamPrefixes = map[string]string{
+	"s3":             "s3",
+	"ses":            "ses",
+	"secretsmanager": "secretsmanager",
+	"athena":         "athena",
+	"appconfigdata":  "appconfig",
+	"lambda":         "lambda",
+}
+
+// iamActionFor covers the operations whose IAM action is not named after them.
+var iamActionFor = map[string]string{
+	"s3:ListObjectsV2": "s3:ListBucket",
+	"s3:HeadObject":    "s3:GetObject",
+	"lambda:Invoke":    "lambda:InvokeFunction",
+}
+
+// sdkCalls finds the AWS operations a Lambda package calls, as IAM actions, by the
+// <service>.<Operation>Input values it builds.
+func sdkCalls(t *testing.T, dir string, skip []string) map[string]string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := map[string]string{} // action -> first position it is used at
+	fset := token.NewFileSet()
+	for _, path := range files {
+		if strings.HasSuffix(path, "_test.go") || slices.Contains(skip, filepath.Base(path)) {
+			continue
+		}
+		f, err := parser.ParseFile(fset, path, nil, parser.SkipObjectResolution)
+		if err != nil {
+			t.Fatal(err)
+		}
+		services := map[string]string{} // local import name -> service package
+		for _, imp := range f.Imports {
+			p, _ := strconv.Unquote(imp.Path.Value)
+			_, service, ok := strings.Cut(p, "/service/")
+			if !strings.HasPrefix(p, "github.com/aws/aws-sdk-go") || !ok || strings.Contains(service, "/") {
+				continue // not an SDK service client, or a subpackage such as s3/types
+			}
+			name := filepath.Base(p)
+			if imp.Name != nil {
+				name = imp.Name.Name
+			}
+			services[name] = service
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			lit, ok := n.(*ast.CompositeLit)
+			if !ok {
+				return true
+			}
+			sel, ok := lit.Type.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			pkg, ok := sel.X.(*ast.Ident)
+			if !ok || services[pkg.Name] == "" || !strings.HasSuffix(sel.Sel.Name, "Input") {
+				return true
+			}
+			service := services[pkg.Name]
+			prefix, ok := iamPrefixes[service]
+			if !ok {
+				t.Errorf("%s: no IAM prefix for service package %q; add it to iamPrefixes", fset.Position(lit.Pos()), service)
+				return true
+			}
+			action := prefix + ":" + strings.TrimSuffix(sel.Sel.Name, "Input")
+			if mapped, ok := iamActionFor[action]; ok {
+				action = mapped
+			}
+			if _, seen := calls[action]; !seen {
+				calls[action] = fset.Position(lit.Pos()).String()
+			}
+			return true
+		})
+	}
+	return calls
+}
+
+// TestAccessManifestsCoverCode fails when a Lambda calls an AWS API its access.json does not
+// grant, which would otherwise only show up as AccessDenied after deploying.
+func TestAccessManifestsCoverCode(t *testing.T) {
+	dirs, err := os.ReadDir("../lambda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		pkg := d.Name()
+		t.Run(pkg, func(t *testing.T) {
+			m, err := loadAccessManifest(pkg)
+			if err != nil {
+				t.Fatalf("every Lambda needs an access manifest: %v", err)
+			}
+			calls := sdkCalls(t, filepath.Join("../lambda", pkg), m.OperatorFiles)
+			if len(calls) == 0 {
+				t.Fatal("found no AWS calls; is the scanner still recognising the SDK?")
+			}
+			granted := m.actions()
+			for action, pos := range calls {
+				if !slices.Contains(granted, action) {
+					t.Errorf("%s calls %s, which lambda/%s/access.json does not grant", pos, action, pkg)
+				}
+			}
+		})
+	}
+}
+
+func TestReadAccessManifestRejectsWildcards(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.json")
+	for name, manifest := range map[string]string{
+		"s3 wildcard":   `{"s3": [{"prefix": "raw/", "actions": ["s3:*"]}]}`,
+		"other service": `{"s3": [{"prefix": "raw/", "actions": ["dynamodb:GetItem"]}]}`,
+		"no prefix":     `{"s3": [{"prefix": "", "actions": ["s3:GetObject"]}]}`,
+		"ses wildcard":  `{"ses": ["ses:*"]}`,
+		"unknown field": `{"dynamodb": ["table"]}`,
+	} {
+		if err := os.WriteFile(path, []byte(manifest), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readAccessManifest(path); err == nil {
+			t.Errorf("%s: expected the manifest to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/s3"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+func TestIngestPipelineComponent(t *testing.T) {
+	m := &mocks{}
+	var triggers []string
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		bucket, err := s3.NewBucket(ctx, "data", &s3.BucketArgs{Bucket: pulumi.String("data")})
+		if err != nil {
+			return err
+		}
+		pipeline, err := NewIngestPipeline(ctx, "mfp", &IngestPipelineArgs{
+			Bucket:         bucket,
+			IncomingPrefix: "raw/email/mfp/",
+			RawPrefix:      "raw/mfp_csv/",
+			Ingest:         FunctionArgs{Package: "mfp_ingest"},
+			Transform:      FunctionArgs{Package: "mfp_transform", Timeout: 60},
+		})
+		if err != nil {
+			return err
+		}
+		for _, n := range pipeline.Notifications() {
+			triggers = append(triggers, string(n.(*s3.BucketNotificationQueueArgs).FilterPrefix.(pulumi.String)))
+		}
+		return nil
+	}, pulumi.WithMocks(testProject, testStack, m))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(triggers) != 2 || triggers[0] != "raw/email/mfp/" || triggers[1] != "raw/mfp_csv/" {
+		t.Errorf("unexpected triggers %v", triggers)
+	}
+	for _, name := range []string{"mfp-ingest", "mfp-transform"} {
+		var found bool
+		for _, r := range m.all("aws:lambda/function:Function") {
+			if r.Name == name {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no function %s", name)
+		}
+	}
+	if n := len(m.all("aws:lambda/eventSourceMapping:EventSourceMapping")); n != 2 {
+		t.Errorf("expected a queue feeding each stage, got %d", n)
+	}
+}
+
+func TestTransformStageRequiresTriggerPrefix(t *testing.T) {
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		_, err := NewTransformStage(ctx, "stage", &TransformStageArgs{FunctionArgs: FunctionArgs{Package: "x"}})
+		return err
+	}, pulumi.WithMocks(testProject, testStack, &mocks{}))
+	if err == nil {
+		t.Error("expected a stage without a trigger prefix to be rejected")
+	}
+}
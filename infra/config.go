@@ -0,0 +1,211 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// stackConfig is the mailmunch:* configuration of a stack, validated and with defaults applied.
+// Defaults that name AWS resources are derived from the project and stack, so dev, staging and
+// prod stacks can be deployed side by side in one account. The Lambdas get every value they
+// need from their environment rather than from defaults of their own.
+type stackConfig struct {
+	DataBucketName           string // raw and curated layers, reports and query results
+	AthenaDatabaseName       string
+	AthenaTableName          string // curated LoseIt entries
+	AthenaWorkgroup          string
+	AthenaBytesScannedCutoff int // bytes a single query may scan
+
+	SesEmailIdentity    string // domain or address SES sends from, imported when set
+	RecipientAddress    string // address SES receives LoseIt exports on; no inbox when empty
+	AllowedSenderDomain string
+	ReportEmail         string
+	SenderEmail         string
+	AlarmEmail          string // subscribed to the alarm topic when set
+
+	PagesDistributionArn string // CloudFront distribution allowed to read and decrypt pages/ when set
+
+	// SES has one active receipt rule set per account and region, shared by every stack in
+	// it; exactly one of them opts in to manage (create and activate) the set, so a new stack
+	// cannot take the set over by default
+	ReceiptRuleSetName   string
+	ManageReceiptRuleSet bool
+
+	Schedule             reportSchedule
+	Users                []householdUser
+	Goals                json.RawMessage // passed through to AppConfig; weekly_report owns the schema
+	Templates            json.RawMessage // likewise
+	TemplatesPrefix      string          // s3_prefix of Templates, the only prefix weekly_report reads them from
+	DailyCalorieTarget   int             // 0 when unset
+	FreshnessWindowHours int
+	NudgeAfterDays       int // 0 turns reminders off
+
+	OpenAIAPIKey    string
+	NotifierSecrets string // JSON object of delivery channel credentials
+}
+
+var (
+	bucketNamePattern    = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+	athenaNamePattern    = regexp.MustCompile(`^[a-z0-9_]{1,255}$`)
+	workgroupNamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,128}$`)
+	ruleSetNamePattern   = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+	distributionPattern  = regexp.MustCompile(`^arn:aws:cloudfront::[0-9]{12}:distribution/[A-Z0-9]+$`)
+)
+
+// loadConfig reads and validates the stack's mailmunch:* configuration.
+func loadConfig(ctx *pulumi.Context) (*stackConfig, error) {
+	project, stack := ctx.Project(), ctx.Stack()
+	get := func(key string) string {
+		v, _ := ctx.GetConfig("mailmunch:" + key)
+		return strings.TrimSpace(v)
+	}
+
+	c := &stackConfig{
+		// S3 bucket names are global and Athena names only take lower case and underscores
+		DataBucketName:           cmp.Or(get("dataBucketName"), strings.ToLower(strings.ReplaceAll(project+"-"+stack+"-data", "_", "-"))),
+		AthenaDatabaseName:       cmp.Or(get("athenaDatabaseName"), strings.ToLower(strings.NewReplacer("-", "_", ".", "_").Replace(project+"_"+stack))),
+		AthenaTableName:          cmp.Or(get("athenaTableName"), "loseit_loseit_parquet"),
+		AthenaWorkgroup:          cmp.Or(get("athenaWorkgroup"), project+"-"+stack),
+		AthenaBytesScannedCutoff: 1 << 30,
+		SesEmailIdentity:         get("sesEmailIdentity"),
+		RecipientAddress:         get("recipientAddress"),
+		ReceiptRuleSetName:       cmp.Or(get("receiptRuleSetName"), project+"-receipt-set"),
+		AllowedSenderDomain:      cmp.Or(get("allowedSenderDomain"), "loseit.com"),
+		ReportEmail:              get("reportEmail"),
+		SenderEmail:              get("senderEmail"),
+		AlarmEmail:               get("alarmEmail"),
+		PagesDistributionArn:     get("pagesDistributionArn"),
+		FreshnessWindowHours:     48,
+		NudgeAfterDays:           2,
+		OpenAIAPIKey:             get("openaiApiKey"),
+		NotifierSecrets:          get("notifierSecrets"),
+	}
+
+	if !bucketNamePattern.MatchString(c.DataBucketName) {
+		return nil, fmt.Errorf("mailmunch:dataBucketName %q is not a valid S3 bucket name", c.DataBucketName)
+	}
+	if !athenaNamePattern.MatchString(c.AthenaDatabaseName) {
+		return nil, fmt.Errorf("mailmunch:athenaDatabaseName %q may only contain lower-case letters, digits and _", c.AthenaDatabaseName)
+	}
+	if !athenaNamePattern.MatchString(c.AthenaTableName) {
+		return nil, fmt.Errorf("mailmunch:athenaTableName %q may only contain lower-case letters, digits and _", c.AthenaTableName)
+	}
+	if !workgroupNamePattern.MatchString(c.AthenaWorkgroup) {
+		return nil, fmt.Errorf("mailmunch:athenaWorkgroup %q may only contain letters, digits, '.', '_' and '-'", c.AthenaWorkgroup)
+	}
+	if !ruleSetNamePattern.MatchString(c.ReceiptRuleSetName) {
+		return nil, fmt.Errorf("mailmunch:receiptRuleSetName %q may only contain letters, digits, '.', '_' and '-'", c.ReceiptRuleSetName)
+	}
+	if v := get("manageReceiptRuleSet"); v != "" {
+		manage, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("mailmunch:manageReceiptRuleSet must be true or false, got %q", v)
+		}
+		c.ManageReceiptRuleSet = manage
+	}
+	if v := c.PagesDistributionArn; v != "" && !distributionPattern.MatchString(v) {
+		return nil, fmt.Errorf("mailmunch:pagesDistributionArn %q is not a CloudFront distribution ARN", v)
+	}
+	if strings.ContainsAny(c.AllowedSenderDomain, "@ ") {
+		return nil, fmt.Errorf("mailmunch:allowedSenderDomain must be a domain such as loseit.com, got %q", c.AllowedSenderDomain)
+	}
+	for key, v := range map[string]string{
+		"recipientAddress": c.RecipientAddress,
+		"reportEmail":      c.ReportEmail,
+		"senderEmail":      c.SenderEmail,
+		"alarmEmail":       c.AlarmEmail,
+	} {
+		if _, err := mail.ParseAddress(v); v != "" && err != nil {
+			return nil, fmt.Errorf("mailmunch:%s %q is not an email address", key, v)
+		}
+	}
+
+	// Numbers are bounded by what the resources they configure accept
+	var err error
+	if c.AthenaBytesScannedCutoff, err = intConfig(get, "athenaBytesScannedCutoff", c.AthenaBytesScannedCutoff, 10<<20, -1,
+		"a number of bytes of at least 10 MiB"); err != nil {
+		return nil, err
+	}
+	// CloudWatch evaluates at most seven days of hourly periods
+	if c.FreshnessWindowHours, err = intConfig(get, "freshnessWindowHours", c.FreshnessWindowHours, 1, 168,
+		"a number of hours from 1 to 168"); err != nil {
+		return nil, err
+	}
+	// weekly_report looks back 60 days, so longer gaps are never reminded about
+	if c.NudgeAfterDays, err = intConfig(get, "nudgeAfterDays", c.NudgeAfterDays, 0, 59,
+		"a number of days from 0 to 59"); err != nil {
+		return nil, err
+	}
+	if c.DailyCalorieTarget, err = intConfig(get, "dailyCalorieTarget", 0, 1, 20000,
+		"a number of calories from 1 to 20000"); err != nil {
+		return nil, err
+	}
+
+	for key, dst := range map[string]*json.RawMessage{"goals": &c.Goals, "templates": &c.Templates} {
+		if v := get(key); v != "" {
+			if !json.Valid([]byte(v)) {
+				return nil, fmt.Errorf("mailmunch:%s is not valid JSON", key)
+			}
+			*dst = json.RawMessage(v)
+		}
+	}
+	if c.Templates != nil {
+		var templates struct {
+			S3Prefix string `json:"s3_prefix"`
+		}
+		if err := json.Unmarshal(c.Templates, &templates); err != nil {
+			return nil, fmt.Errorf("mailmunch:templates must be a JSON object: %w", err)
+		}
+		if p := templates.S3Prefix; p != "" {
+			if strings.HasPrefix(p, "/") || strings.Trim(p, "/") == "" || strings.ContainsAny(p, "*?") {
+				return nil, fmt.Errorf("mailmunch:templates s3_prefix %q must be a key prefix such as templates/v1/", p)
+			}
+			c.TemplatesPrefix = strings.TrimSuffix(p, "/") + "/"
+		}
+	}
+	if v := c.NotifierSecrets; v != "" && (!json.Valid([]byte(v)) || !strings.HasPrefix(v, "{")) {
+		return nil, fmt.Errorf("mailmunch:notifierSecrets must be a JSON object")
+	}
+
+	if c.Schedule, err = loadReportSchedule(ctx); err != nil {
+		return nil, err
+	}
+	if c.Users, err = loadUsers(ctx); err != nil {
+		return nil, err
+	}
+	// Replies to reports are routed to report_reply by the sender address, so it cannot be one
+	// the LoseIt exports arrive on
+	if sender := bareAddress(c.SenderEmail); c.RecipientAddress != "" && receivesExports(sender, c.RecipientAddress, c.Users) {
+		return nil, fmt.Errorf("mailmunch:senderEmail %q must differ from mailmunch:recipientAddress, its plus-addresses and the users' ingest addresses", c.SenderEmail)
+	}
+	return c, nil
+}
+
+// intConfig parses an optional whole-number key, returning def when it is unset. hi < 0 means
+// no upper bound; want describes the accepted values for the error.
+func intConfig(get func(string) string, key string, def, lo, hi int, want string) (int, error) {
+	v := get(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lo || (hi >= 0 && n > hi) {
+		return 0, fmt.Errorf("mailmunch:%s must be %s, got %q", key, want, v)
+	}
+	return n, nil
+}
+
+// dailyCalorieTarget is the DAILY_CALORIE_TARGET value for weekly_report, empty when unset.
+func (c *stackConfig) dailyCalorieTarget() string {
+	if c.DailyCalorieTarget == 0 {
+		return ""
+	}
+	return strconv.Itoa(c.DailyCalorieTarget)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// loadStackConfig runs loadConfig for the given stack with the given mailmunch:* config.
+func loadStackConfig(t *testing.T, stack string, config map[string]string) *stackConfig {
+	t.Helper()
+	full := map[string]string{}
+	for k, v := range config {
+		full["mailmunch:"+k] = v
+	}
+	b, err := json.Marshal(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(pulumi.EnvConfig, string(b))
+
+	var cfg *stackConfig
+	err = pulumi.RunErr(func(ctx *pulumi.Context) error {
+		cfg, err = loadConfig(ctx)
+		return err
+	}, pulumi.WithMocks(testProject, stack, &mocks{}))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return cfg
+}
+
+func TestConfigNamesFollowStack(t *testing.T) {
+	staging := loadStackConfig(t, "eu_Staging", nil)
+	if staging.DataBucketName != "mailmunch-eu-staging-data" {
+		t.Errorf("unexpected data bucket %q", staging.DataBucketName)
+	}
+	if staging.AthenaDatabaseName != "mailmunch_eu_staging" {
+		t.Errorf("unexpected Athena database %q", staging.AthenaDatabaseName)
+	}
+	if staging.AthenaWorkgroup != "mailmunch-eu_Staging" {
+		t.Errorf("unexpected Athena workgroup %q", staging.AthenaWorkgroup)
+	}
+	if staging.FreshnessWindowHours != 48 || staging.NudgeAfterDays != 2 || staging.AthenaBytesScannedCutoff != 1<<30 {
+		t.Errorf("unexpected defaults %+v", staging)
+	}
+
+	prod := loadStackConfig(t, "prod", nil)
+	if prod.DataBucketName == staging.DataBucketName || prod.AthenaDatabaseName == staging.AthenaDatabaseName ||
+		prod.AthenaWorkgroup == staging.AthenaWorkgroup {
+		t.Errorf("stacks share resource names: %+v and %+v", prod, staging)
+	}
+
+	// An existing stack can keep the names it was deployed with
+	dev := loadStackConfig(t, "dev", map[string]string{"dataBucketName": "mailmunch-data", "dailyCalorieTarget": "2000"})
+	if dev.DataBucketName != "mailmunch-data" {
+		t.Errorf("mailmunch:dataBucketName not used, got %q", dev.DataBucketName)
+	}
+	if dev.DailyCalorieTarget != 2000 || dev.dailyCalorieTarget() != "2000" || prod.dailyCalorieTarget() != "" {
+		t.Errorf("unexpected calorie targets %d %q %q", dev.DailyCalorieTarget, dev.dailyCalorieTarget(), prod.dailyCalorieTarget())
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/ses"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// InboxRoute stores mail for Recipients in the inbox bucket under Prefix.
+type InboxRoute struct {
+	Name       string // created as <component>-<Name>-receipt-rule
+	Recipients []string
+	Prefix     string
+}
+
+// SesInboxArgs configures SES receiving. Only one receipt rule set can be active per
+// account and region, so every stack adds its rules to one shared set and exactly one stack
+// sets ManageRuleSet to create and activate it.
+type SesInboxArgs struct {
+	Bucket        pulumi.StringInput
+	Routes        []InboxRoute
+	RuleSetName   string
+	ManageRuleSet bool // create the rule set and make it the active one
+}
+
+// SesInbox is a rule per route in the active receipt rule set.
+type SesInbox struct {
+	pulumi.ResourceState
+
+	RuleSetName pulumi.StringOutput
+}
+
+func NewSesInbox(ctx *pulumi.Context, name string, args *SesInboxArgs, opts ...pulumi.ResourceOption) (*SesInbox, error) {
+	inbox := &SesInbox{}
+	if err := ctx.RegisterComponentResource("mailmunch:index:SesInbox", name, inbox, opts...); err != nil {
+		return nil, err
+	}
+
+	child := childOpts(inbox)
+	inbox.RuleSetName = pulumi.String(args.RuleSetName).ToStringOutput()
+	if args.ManageRuleSet {
+		ruleSet, err := ses.NewReceiptRuleSet(ctx, name+"-receipt-set", &ses.ReceiptRuleSetArgs{
+			RuleSetName: pulumi.String(args.RuleSetName),
+		}, child...)
+		if err != nil {
+			return nil, err
+		}
+		inbox.RuleSetName = ruleSet.RuleSetName
+
+		_, err = ses.NewActiveReceiptRuleSet(ctx, name+"-receipt-active", &ses.ActiveReceiptRuleSetArgs{
+			RuleSetName: ruleSet.RuleSetName,
+		}, child...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range args.Routes {
+		if len(r.Recipients) == 0 {
+			return nil, fmt.Errorf("%s: route %q has no recipients", name, r.Name)
+		}
+		_, err := ses.NewReceiptRule(ctx, fmt.Sprintf("%s-%s-receipt-rule", name, r.Name), &ses.ReceiptRuleArgs{
+			RuleSetName: inbox.RuleSetName,
+			Recipients:  pulumi.ToStringArray(r.Recipients),
+			Enabled:     pulumi.Bool(true),
+			ScanEnabled: pulumi.Bool(true),
+			S3Actions: ses.ReceiptRuleS3ActionArray{
+				&ses.ReceiptRuleS3ActionArgs{
+					BucketName:      args.Bucket,
+					ObjectKeyPrefix: pulumi.String(r.Prefix),
+					Position:        pulumi.Int(1),
+				},
+			},
+			TlsPolicy: pulumi.String("Optional"),
+		}, child...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ctx.RegisterResourceOutputs(inbox, pulumi.Map{
+		"ruleSetName": inbox.RuleSetName,
+	}); err != nil {
+		return nil, err
+	}
+	return inbox, nil
+}
@@ -1,854 +1,997 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 
 	aws "github.com/pulumi/pulumi-aws/sdk/v6/go/aws"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/appconfig"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/athena"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/cloudwatch"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/ecr"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/glue"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
-	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/lambda"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/kms"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/s3"
-	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/scheduler"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/secretsmanager"
-	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/ses"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/sesv2"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/sns"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 )
 
 func main() {
-	pulumi.Run(func(ctx *pulumi.Context) error {
-		project := ctx.Project()
-		stack := ctx.Stack()
-
-		// Create a single AWS provider with default tags applied to all supported resources.
-		prov, err := aws.NewProvider(ctx, "prov", &aws.ProviderArgs{
-			DefaultTags: &aws.ProviderDefaultTagsArgs{
-				Tags: pulumi.StringMap{
-					"Project":   pulumi.String(project),
-					"Stack":     pulumi.String(stack),
-					"ManagedBy": pulumi.String("Pulumi"),
-				},
-			},
-		})
-		if err != nil {
-			return err
-		}
-		awsOpts := pulumi.Provider(prov)
-
-		bucket, err := s3.NewBucket(ctx, fmt.Sprintf("%s-%s-artifacts", project, stack), &s3.BucketArgs{}, awsOpts)
-		if err != nil {
-			return err
-		}
-		_, err = s3.NewBucketPublicAccessBlock(ctx, fmt.Sprintf("%s-%s-artifacts-pab", project, stack), &s3.BucketPublicAccessBlockArgs{
-			Bucket:                bucket.ID(),
-			BlockPublicAcls:       pulumi.Bool(true),
-			BlockPublicPolicy:     pulumi.Bool(true),
-			IgnorePublicAcls:      pulumi.Bool(true),
-			RestrictPublicBuckets: pulumi.Bool(true),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Data bucket for raw and curated layers (configurable; default "mailmunch-data")
-		dataBucketName := "mailmunch-data"
-		if v, ok := ctx.GetConfig("mailmunch:dataBucketName"); ok && v != "" {
-			dataBucketName = v
-		}
-
-		// Allowed sender domain for email filtering (configurable; default "loseit.com")
-		allowedSenderDomain := "loseit.com"
-		if v, ok := ctx.GetConfig("mailmunch:allowedSenderDomain"); ok && v != "" {
-			allowedSenderDomain = v
-		}
-
-		// Data catalog settings for Athena queries.
-		athenaDatabaseName := fmt.Sprintf("%s_%s", project, stack)
-		if v, ok := ctx.GetConfig("mailmunch:athenaDatabaseName"); ok && v != "" {
-			athenaDatabaseName = v
-		}
-
-		athenaTableName := "loseit_loseit_parquet"
-		if v, ok := ctx.GetConfig("mailmunch:athenaTableName"); ok && v != "" {
-			athenaTableName = v
-		}
-
-		emailsBucket, err := s3.NewBucket(ctx, dataBucketName, &s3.BucketArgs{
-			Bucket: pulumi.String(dataBucketName),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-		_, err = s3.NewBucketPublicAccessBlock(ctx, fmt.Sprintf("%s-%s-emails-pab", project, stack), &s3.BucketPublicAccessBlockArgs{
-			Bucket:                emailsBucket.ID(),
-			BlockPublicAcls:       pulumi.Bool(true),
-			BlockPublicPolicy:     pulumi.Bool(true),
-			IgnorePublicAcls:      pulumi.Bool(true),
-			RestrictPublicBuckets: pulumi.Bool(true),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
+	pulumi.Run(run)
+}
 
-		// S3 lifecycle rules for email retention
-		_, err = s3.NewBucketLifecycleConfigurationV2(ctx, fmt.Sprintf("%s-%s-emails-lifecycle", project, stack), &s3.BucketLifecycleConfigurationV2Args{
-			Bucket: emailsBucket.ID(),
-			Rules: s3.BucketLifecycleConfigurationV2RuleArray{
-				&s3.BucketLifecycleConfigurationV2RuleArgs{
-					Id:     pulumi.String("expire-raw-incoming-emails"),
-					Status: pulumi.String("Enabled"),
-					Filter: &s3.BucketLifecycleConfigurationV2RuleFilterArgs{
-						Prefix: pulumi.String("raw/email/incoming/"),
-					},
-					Expiration: &s3.BucketLifecycleConfigurationV2RuleExpirationArgs{
-						Days: pulumi.Int(90), // Expire raw incoming emails after 90 days
-					},
-				},
+// run declares the stack. Lambdas, their triggers and SES receiving are components (see
+// stage.go, pipeline.go, report.go and inbox.go); shared storage and configuration live here.
+func run(ctx *pulumi.Context) error {
+	project := ctx.Project()
+	stack := ctx.Stack()
+
+	// Create a single AWS provider with default tags applied to all supported resources.
+	prov, err := aws.NewProvider(ctx, "prov", &aws.ProviderArgs{
+		DefaultTags: &aws.ProviderDefaultTagsArgs{
+			Tags: pulumi.StringMap{
+				"Project":   pulumi.String(project),
+				"Stack":     pulumi.String(stack),
+				"ManagedBy": pulumi.String("Pulumi"),
 			},
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		repo, err := ecr.NewRepository(ctx, fmt.Sprintf("%s-%s-repo", project, stack), &ecr.RepositoryArgs{
-			ImageScanningConfiguration: &ecr.RepositoryImageScanningConfigurationArgs{
-				ScanOnPush: pulumi.Bool(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	awsOpts := pulumi.Provider(prov)
+
+	bucket, err := s3.NewBucket(ctx, fmt.Sprintf("%s-%s-artifacts", project, stack), &s3.BucketArgs{}, awsOpts)
+	if err != nil {
+		return err
+	}
+	_, err = s3.NewBucketPublicAccessBlock(ctx, fmt.Sprintf("%s-%s-artifacts-pab", project, stack), &s3.BucketPublicAccessBlockArgs{
+		Bucket:                bucket.ID(),
+		BlockPublicAcls:       pulumi.Bool(true),
+		BlockPublicPolicy:     pulumi.Bool(true),
+		IgnorePublicAcls:      pulumi.Bool(true),
+		RestrictPublicBuckets: pulumi.Bool(true),
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// Every mailmunch:* setting, validated before any resource is declared
+	cfg, err := loadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	userAddressesJSON, err := userAddresses(cfg.Users)
+	if err != nil {
+		return err
+	}
+
+	// Food diaries are health data, so the data bucket and the secrets are encrypted with a
+	// customer-managed key. The key policy defers to IAM; Lambda roles get kms:Decrypt and
+	// kms:GenerateDataKey from their access manifests (access.go), and only through S3 and
+	// Secrets Manager
+	caller := aws.GetCallerIdentityOutput(ctx, aws.GetCallerIdentityOutputArgs{})
+	region := aws.GetRegionOutput(ctx, aws.GetRegionOutputArgs{}).Name()
+	dataKeyStatements := iam.GetPolicyDocumentStatementArray{
+		iam.GetPolicyDocumentStatementArgs{
+			Sid: pulumi.String("AccountAdministersKey"),
+			Principals: iam.GetPolicyDocumentStatementPrincipalArray{
+				iam.GetPolicyDocumentStatementPrincipalArgs{
+					Type:        pulumi.String("AWS"),
+					Identifiers: pulumi.StringArray{pulumi.Sprintf("arn:aws:iam::%s:root", caller.AccountId())},
+				},
 			},
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		secret, err := secretsmanager.NewSecret(ctx, fmt.Sprintf("%s-%s-secret", project, stack), &secretsmanager.SecretArgs{}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		app, err := appconfig.NewApplication(ctx, fmt.Sprintf("%s-%s-appcfg", project, stack), &appconfig.ApplicationArgs{}, awsOpts)
-		if err != nil {
-			return err
-		}
-		profile, err := appconfig.NewConfigurationProfile(ctx, fmt.Sprintf("%s-%s-profile", project, stack), &appconfig.ConfigurationProfileArgs{
-			ApplicationId: app.ID(),
-			LocationUri:   pulumi.String("hosted"),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-		// Read the prompt from the text file
-		promptContent, err := os.ReadFile("weekly_report_prompt.txt")
-		if err != nil {
-			return fmt.Errorf("failed to read weekly_report_prompt.txt: %w", err)
-		}
-
-		const defaultSystemPrompt = "Act as a nutritionist and fitness coach. Provide detailed, actionable advice based on provided food diary data."
-
-		// Create JSON configuration with the prompt
-		configJSON := fmt.Sprintf(`{
-			"weekly_report_base_prompt": %q,
-			"weekly_report_system_prompt": %q
-		}`, string(promptContent), defaultSystemPrompt)
-
-		configVersion, err := appconfig.NewHostedConfigurationVersion(ctx, fmt.Sprintf("%s-%s-configv1", project, stack), &appconfig.HostedConfigurationVersionArgs{
-			ApplicationId:          app.ID(),
-			ConfigurationProfileId: profile.ConfigurationProfileId,
-			Content:                pulumi.String(configJSON),
-			ContentType:            pulumi.String("application/json"),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Create AppConfig environment
-		env, err := appconfig.NewEnvironment(ctx, fmt.Sprintf("%s-%s-env-prod", project, stack), &appconfig.EnvironmentArgs{
-			Name:          pulumi.String("prod"),
-			ApplicationId: app.ID(),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Create AppConfig deployment to make the configuration available
-		_, err = appconfig.NewDeployment(ctx, fmt.Sprintf("%s-%s-deployment", project, stack), &appconfig.DeploymentArgs{
-			ApplicationId:          app.ID(),
-			ConfigurationProfileId: profile.ConfigurationProfileId,
-			ConfigurationVersion:   pulumi.Sprintf("%d", configVersion.VersionNumber),
-			EnvironmentId:          env.EnvironmentId,
-			DeploymentStrategyId:   pulumi.String("AppConfig.AllAtOnce"),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Lambda assume role policy
-		lambdaAssumeRolePolicy, err := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
-			Statements: []iam.GetPolicyDocumentStatement{
-				{
-					Effect: pulumi.StringRef("Allow"),
-					Principals: []iam.GetPolicyDocumentStatementPrincipal{
-						{
-							Type: "Service",
-							Identifiers: []string{
-								"lambda.amazonaws.com",
-							},
-						},
-					},
-					Actions: []string{
-						"sts:AssumeRole",
-					},
+			Actions:   pulumi.ToStringArray([]string{"kms:*"}),
+			Resources: pulumi.ToStringArray([]string{"*"}),
+		},
+		// SES receipt rules store mail in the bucket, which S3 encrypts with this key on
+		// SES's behalf. The S3 action's own KmsKeyArn is not used: that is client-side
+		// encryption, which email_ingest could not read
+		iam.GetPolicyDocumentStatementArgs{
+			Sid: pulumi.String("SESStoresMail"),
+			Principals: iam.GetPolicyDocumentStatementPrincipalArray{
+				iam.GetPolicyDocumentStatementPrincipalArgs{
+					Type:        pulumi.String("Service"),
+					Identifiers: pulumi.ToStringArray([]string{"ses.amazonaws.com"}),
 				},
 			},
-		}, nil)
-		if err != nil {
-			return err
-		}
-
-		// Optionally create SES email identity if configured
-		if email, ok := ctx.GetConfig("mailmunch:sesEmailIdentity"); ok && email != "" {
-			sesOpts := []pulumi.ResourceOption{awsOpts, pulumi.Import(pulumi.ID(email))}
-			_, err = sesv2.NewEmailIdentity(ctx, fmt.Sprintf("%s-%s-ses-identity", project, stack), &sesv2.EmailIdentityArgs{
-				EmailIdentity: pulumi.String(email),
-			}, sesOpts...)
-			if err != nil {
-				return err
-			}
-		}
-
-		// Lambda that parses incoming EML and writes raw + CSV to partitioned prefixes
-		ingestRole, err := iam.NewRole(ctx, fmt.Sprintf("%s-%s-email-ingest-role", project, stack), &iam.RoleArgs{
-			AssumeRolePolicy: pulumi.String(lambdaAssumeRolePolicy.Json),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-		_, err = iam.NewRolePolicyAttachment(ctx, fmt.Sprintf("%s-%s-email-ingest-basic", project, stack), &iam.RolePolicyAttachmentArgs{
-			Role:      ingestRole.Name,
-			PolicyArn: pulumi.String("arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Create S3 access policy for email ingest Lambda
-		s3PolicyDoc, err := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
-			Statements: []iam.GetPolicyDocumentStatement{
-				{
-					Effect: pulumi.StringRef("Allow"),
-					Actions: []string{
-						"s3:GetObject",
-						"s3:PutObject",
-					},
-					Resources: []string{"arn:aws:s3:::" + dataBucketName + "/*"},
+			Actions:   pulumi.ToStringArray([]string{"kms:GenerateDataKey"}),
+			Resources: pulumi.ToStringArray([]string{"*"}),
+			Conditions: iam.GetPolicyDocumentStatementConditionArray{
+				iam.GetPolicyDocumentStatementConditionArgs{
+					Test:     pulumi.String("StringEquals"),
+					Variable: pulumi.String("aws:SourceAccount"),
+					Values:   pulumi.StringArray{caller.AccountId()},
 				},
-				{
-					Effect: pulumi.StringRef("Allow"),
-					Actions: []string{
-						"s3:ListBucket",
-					},
-					Resources: []string{"arn:aws:s3:::" + dataBucketName},
+				iam.GetPolicyDocumentStatementConditionArgs{
+					Test:     pulumi.String("StringEquals"),
+					Variable: pulumi.String("kms:ViaService"),
+					Values:   pulumi.StringArray{pulumi.Sprintf("s3.%s.amazonaws.com", region)},
 				},
 			},
-		}, nil)
-		if err != nil {
-			return err
-		}
-
-		_, err = iam.NewRolePolicy(ctx, fmt.Sprintf("%s-%s-email-ingest-s3", project, stack), &iam.RolePolicyArgs{
-			Role:   ingestRole.ID(),
-			Policy: pulumi.String(s3PolicyDoc.Json),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		emailIngestZip := pulumi.NewFileArchive("../dist/email_ingest.zip")
-		emailIngestFn, err := lambda.NewFunction(ctx, fmt.Sprintf("%s-%s-email-ingest", project, stack), &lambda.FunctionArgs{
-			Role:          ingestRole.Arn,
-			Runtime:       pulumi.String("provided.al2"),
-			Handler:       pulumi.String("bootstrap"),
-			Architectures: pulumi.ToStringArray([]string{"arm64"}),
-			Code:          emailIngestZip,
-			Environment: &lambda.FunctionEnvironmentArgs{
-				Variables: pulumi.StringMap{
-					"EMAIL_BUCKET":          emailsBucket.Bucket,
-					"INCOMING_PREFIX":       pulumi.String("raw/email/incoming/"),
-					"RAW_EMAIL_BASE":        pulumi.String("raw/email/"),
-					"RAW_CSV_BASE":          pulumi.String("raw/loseit_csv/"),
-					"ALLOWED_SENDER_DOMAIN": pulumi.String(allowedSenderDomain),
+		},
+	}
+	// A CloudFront distribution serving pages/ reads them through origin access control, which
+	// needs to decrypt them. S3 bucket keys give every object the bucket as its encryption
+	// context, so the bucket policy is what limits the distribution to pages/
+	if cfg.PagesDistributionArn != "" {
+		dataKeyStatements = append(dataKeyStatements, iam.GetPolicyDocumentStatementArgs{
+			Sid: pulumi.String("CloudFrontReadsPages"),
+			Principals: iam.GetPolicyDocumentStatementPrincipalArray{
+				iam.GetPolicyDocumentStatementPrincipalArgs{
+					Type:        pulumi.String("Service"),
+					Identifiers: pulumi.ToStringArray([]string{"cloudfront.amazonaws.com"}),
 				},
 			},
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Allow S3 to invoke the email ingest Lambda
-		_, err = lambda.NewPermission(ctx, fmt.Sprintf("%s-%s-email-ingest-perm", project, stack), &lambda.PermissionArgs{
-			Action:    pulumi.String("lambda:InvokeFunction"),
-			Function:  emailIngestFn.Name,
-			Principal: pulumi.String("s3.amazonaws.com"),
-			SourceArn: emailsBucket.Arn,
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// S3 event notifications are configured later in a single resource
-
-		// Permit SES to write to the emails bucket (for S3 action)
-		caller := aws.GetCallerIdentityOutput(ctx, aws.GetCallerIdentityOutputArgs{})
-		_, err = s3.NewBucketPolicy(ctx, fmt.Sprintf("%s-%s-emails-policy", project, stack), &s3.BucketPolicyArgs{
-			Bucket: emailsBucket.ID(),
-			Policy: pulumi.All(emailsBucket.Arn, caller.AccountId()).ApplyT(func(vals []interface{}) string {
-				arn := vals[0].(string)
-				acct := vals[1].(string)
-				// Use a static policy template to avoid gRPC issues
-				policyJson := fmt.Sprintf(`{
-					"Version": "2008-10-17",
-					"Statement": [
-						{
-							"Sid": "AllowSESPuts",
-							"Effect": "Allow",
-							"Principal": {
-								"Service": "ses.amazonaws.com"
-							},
-							"Action": "s3:PutObject",
-							"Resource": "%s/*",
-							"Condition": {
-								"StringEquals": {
-									"aws:Referer": "%s"
-								}
-							}
-						}
-					]
-				}`, arn, acct)
-				return policyJson
-			}).(pulumi.StringOutput),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Weekly Report Lambda Function
-		weeklyReportRole, err := iam.NewRole(ctx, fmt.Sprintf("%s-%s-weekly-report-role", project, stack), &iam.RoleArgs{
-			AssumeRolePolicy: pulumi.String(`{
-				"Version": "2012-10-17",
-				"Statement": [
-					{
-						"Effect": "Allow",
-						"Principal": {
-							"Service": "lambda.amazonaws.com"
-						},
-						"Action": "sts:AssumeRole"
-					}
-				]
-			}`),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		_, err = iam.NewRolePolicyAttachment(ctx, fmt.Sprintf("%s-%s-weekly-report-basic", project, stack), &iam.RolePolicyAttachmentArgs{
-			Role:      weeklyReportRole.Name,
-			PolicyArn: pulumi.String("arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// SES policy for weekly report Lambda to send emails
-		weeklyReportSESPolicyDoc := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
-			Statements: iam.GetPolicyDocumentStatementArray{
-				iam.GetPolicyDocumentStatementArgs{
-					Effect: pulumi.String("Allow"),
-					Actions: pulumi.ToStringArray([]string{
-						"ses:SendEmail",
-						"ses:SendRawEmail",
-					}),
-					Resources: pulumi.StringArray{
-						pulumi.String("*"),
-					},
+			Actions:   pulumi.ToStringArray([]string{"kms:Decrypt"}),
+			Resources: pulumi.ToStringArray([]string{"*"}),
+			Conditions: iam.GetPolicyDocumentStatementConditionArray{
+				iam.GetPolicyDocumentStatementConditionArgs{
+					Test:     pulumi.String("StringEquals"),
+					Variable: pulumi.String("aws:SourceArn"),
+					Values:   pulumi.ToStringArray([]string{cfg.PagesDistributionArn}),
 				},
 			},
 		})
-
-		_, err = iam.NewRolePolicy(ctx, fmt.Sprintf("%s-%s-weekly-report-ses", project, stack), &iam.RolePolicyArgs{
-			Role:   weeklyReportRole.ID(),
-			Policy: weeklyReportSESPolicyDoc.Json(),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Create OpenAI API key secret
-		openaiSecret, err := secretsmanager.NewSecret(ctx, fmt.Sprintf("%s-%s-openai-secret", project, stack), &secretsmanager.SecretArgs{
-			Description: pulumi.String("OpenAI API key for weekly nutrition reports"),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Get OpenAI API key from config and store in Secrets Manager
-		openaiApiKey := ""
-		if v, ok := ctx.GetConfig("mailmunch:openaiApiKey"); ok {
-			openaiApiKey = v
-		}
-
-		// Only create secret version if API key is provided
-		if openaiApiKey != "" {
-			_, err = secretsmanager.NewSecretVersion(ctx, fmt.Sprintf("%s-%s-openai-secret-version", project, stack), &secretsmanager.SecretVersionArgs{
-				SecretId:     openaiSecret.ID(),
-				SecretString: pulumi.String(openaiApiKey),
-			}, awsOpts)
-			if err != nil {
-				return err
-			}
-		}
-
-		// Add Secrets Manager policy for weekly report Lambda
-		weeklyReportSecretsPolicy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
-			Statements: iam.GetPolicyDocumentStatementArray{
-				iam.GetPolicyDocumentStatementArgs{
-					Effect: pulumi.String("Allow"),
-					Actions: pulumi.ToStringArray([]string{
-						"secretsmanager:GetSecretValue",
-					}),
-					Resources: pulumi.StringArray{
-						openaiSecret.Arn,
-					},
+	}
+	dataKeyPolicy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: dataKeyStatements,
+	})
+	dataKey, err := kms.NewKey(ctx, fmt.Sprintf("%s-%s-data-key", project, stack), &kms.KeyArgs{
+		Description:          pulumi.Sprintf("%s-%s food diaries, reports and secrets", project, stack),
+		EnableKeyRotation:    pulumi.Bool(true),
+		DeletionWindowInDays: pulumi.Int(30),
+		Policy:               dataKeyPolicy.Json(),
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+	_, err = kms.NewAlias(ctx, fmt.Sprintf("%s-%s-data-key-alias", project, stack), &kms.AliasArgs{
+		Name:        pulumi.Sprintf("alias/%s-%s-data", project, stack),
+		TargetKeyId: dataKey.KeyId,
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// Data bucket for raw and curated layers, reports and query results
+	emailsBucket, err := s3.NewBucket(ctx, cfg.DataBucketName, &s3.BucketArgs{
+		Bucket: pulumi.String(cfg.DataBucketName),
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+	// Objects written without encryption headers, by SES and the Lambdas, get SSE-KMS under
+	// the data key; the bucket key keeps KMS requests to one per object prefix rather than
+	// one per object
+	_, err = s3.NewBucketServerSideEncryptionConfigurationV2(ctx, fmt.Sprintf("%s-%s-emails-sse", project, stack), &s3.BucketServerSideEncryptionConfigurationV2Args{
+		Bucket: emailsBucket.ID(),
+		Rules: s3.BucketServerSideEncryptionConfigurationV2RuleArray{
+			&s3.BucketServerSideEncryptionConfigurationV2RuleArgs{
+				ApplyServerSideEncryptionByDefault: &s3.BucketServerSideEncryptionConfigurationV2RuleApplyServerSideEncryptionByDefaultArgs{
+					SseAlgorithm:   pulumi.String("aws:kms"),
+					KmsMasterKeyId: dataKey.Arn,
 				},
+				BucketKeyEnabled: pulumi.Bool(true),
 			},
-		})
-
-		_, err = iam.NewRolePolicy(ctx, fmt.Sprintf("%s-%s-weekly-report-secrets", project, stack), &iam.RolePolicyArgs{
-			Role:   weeklyReportRole.ID(),
-			Policy: weeklyReportSecretsPolicy.Json(),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Add Athena policy for weekly report Lambda
-		weeklyReportAthenaPolicy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
-			Statements: iam.GetPolicyDocumentStatementArray{
-				iam.GetPolicyDocumentStatementArgs{
-					Effect: pulumi.String("Allow"),
-					Actions: pulumi.ToStringArray([]string{
-						"athena:StartQueryExecution",
-						"athena:GetQueryExecution",
-						"athena:GetQueryResults",
-						"athena:StopQueryExecution",
-						"glue:GetDatabase",
-						"glue:GetTable",
-						"glue:GetPartitions",
-					}),
-					Resources: pulumi.ToStringArray([]string{
-						"*", // Athena and Glue resources don't support fine-grained ARNs
-					}),
+		},
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+	_, err = s3.NewBucketPublicAccessBlock(ctx, fmt.Sprintf("%s-%s-emails-pab", project, stack), &s3.BucketPublicAccessBlockArgs{
+		Bucket:                emailsBucket.ID(),
+		BlockPublicAcls:       pulumi.Bool(true),
+		BlockPublicPolicy:     pulumi.Bool(true),
+		IgnorePublicAcls:      pulumi.Bool(true),
+		RestrictPublicBuckets: pulumi.Bool(true),
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// S3 lifecycle rules for email retention
+	_, err = s3.NewBucketLifecycleConfigurationV2(ctx, fmt.Sprintf("%s-%s-emails-lifecycle", project, stack), &s3.BucketLifecycleConfigurationV2Args{
+		Bucket: emailsBucket.ID(),
+		Rules: s3.BucketLifecycleConfigurationV2RuleArray{
+			&s3.BucketLifecycleConfigurationV2RuleArgs{
+				Id:     pulumi.String("expire-raw-incoming-emails"),
+				Status: pulumi.String("Enabled"),
+				Filter: &s3.BucketLifecycleConfigurationV2RuleFilterArgs{
+					Prefix: pulumi.String("raw/email/incoming/"),
 				},
-				iam.GetPolicyDocumentStatementArgs{
-					Effect: pulumi.String("Allow"),
-					Actions: pulumi.ToStringArray([]string{
-						"s3:GetBucketLocation",
-						"s3:GetObject",
-						"s3:ListBucket",
-						"s3:PutObject",
-						"s3:DeleteObject",
-					}),
-					Resources: pulumi.StringArray{
-						emailsBucket.Arn,
-						pulumi.Sprintf("%s/*", emailsBucket.Arn),
-					},
+				Expiration: &s3.BucketLifecycleConfigurationV2RuleExpirationArgs{
+					Days: pulumi.Int(90), // Expire raw incoming emails after 90 days
 				},
 			},
-		})
-
-		_, err = iam.NewRolePolicy(ctx, fmt.Sprintf("%s-%s-weekly-report-athena", project, stack), &iam.RolePolicyArgs{
-			Role:   weeklyReportRole.ID(),
-			Policy: weeklyReportAthenaPolicy.Json(),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Add AppConfig policy for weekly report Lambda
-		weeklyReportAppConfigPolicy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
-			Statements: iam.GetPolicyDocumentStatementArray{
-				iam.GetPolicyDocumentStatementArgs{
-					Effect: pulumi.String("Allow"),
-					Actions: pulumi.ToStringArray([]string{
-						"appconfig:GetConfiguration",
-						"appconfig:GetLatestConfiguration",
-						"appconfig:StartConfigurationSession",
-					}),
-					Resources: pulumi.ToStringArray([]string{
-						"*", // AppConfig permissions require broad access
-					}),
+			&s3.BucketLifecycleConfigurationV2RuleArgs{
+				Id:     pulumi.String("expire-raw-report-replies"),
+				Status: pulumi.String("Enabled"),
+				Filter: &s3.BucketLifecycleConfigurationV2RuleFilterArgs{
+					Prefix: pulumi.String("raw/email/replies/"),
+				},
+				Expiration: &s3.BucketLifecycleConfigurationV2RuleExpirationArgs{
+					Days: pulumi.Int(90), // Questions and answers are kept with the report
 				},
 			},
-		})
-
-		_, err = iam.NewRolePolicy(ctx, fmt.Sprintf("%s-%s-weekly-report-appconfig", project, stack), &iam.RolePolicyArgs{
-			Role:   weeklyReportRole.ID(),
-			Policy: weeklyReportAppConfigPolicy.Json(),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Get email configuration
-		reportEmail := ""
-		if v, ok := ctx.GetConfig("mailmunch:reportEmail"); ok {
-			reportEmail = v
-		}
-
-		senderEmail := ""
-		if v, ok := ctx.GetConfig("mailmunch:senderEmail"); ok {
-			senderEmail = v
-		}
-
-		weeklyReportZip := pulumi.NewFileArchive("../dist/weekly_report.zip")
-		weeklyReportFn, err := lambda.NewFunction(ctx, fmt.Sprintf("%s-%s-weekly-report", project, stack), &lambda.FunctionArgs{
-			Role:          weeklyReportRole.Arn,
-			Runtime:       pulumi.String("provided.al2"),
-			Handler:       pulumi.String("bootstrap"),
-			Architectures: pulumi.ToStringArray([]string{"arm64"}),
-			Code:          weeklyReportZip,
-			Timeout:       pulumi.Int(300), // 5 minutes for OpenAI API calls
-			Environment: &lambda.FunctionEnvironmentArgs{
-				Variables: pulumi.StringMap{
-					"OPENAI_SECRET_ARN":       openaiSecret.Arn,
-					"REPORT_EMAIL":            pulumi.String(reportEmail),
-					"SENDER_EMAIL":            pulumi.String(senderEmail),
-					"ATHENA_DATABASE":         pulumi.String(athenaDatabaseName),
-					"ATHENA_TABLE":            pulumi.String(athenaTableName),
-					"ATHENA_WORKGROUP":        pulumi.String("primary"),
-					"ATHENA_RESULTS_BUCKET":   emailsBucket.Bucket,
-					"APPCONFIG_APPLICATION":   app.ID(),
-					"APPCONFIG_ENVIRONMENT":   pulumi.String("prod"),
-					"APPCONFIG_CONFIGURATION": profile.ConfigurationProfileId,
+			&s3.BucketLifecycleConfigurationV2RuleArgs{
+				Id:     pulumi.String("expire-athena-results"),
+				Status: pulumi.String("Enabled"),
+				Filter: &s3.BucketLifecycleConfigurationV2RuleFilterArgs{
+					Prefix: pulumi.String("athena-results/"),
+				},
+				Expiration: &s3.BucketLifecycleConfigurationV2RuleExpirationArgs{
+					Days: pulumi.Int(7), // Results are read once, straight after the query
+				},
+				AbortIncompleteMultipartUpload: &s3.BucketLifecycleConfigurationV2RuleAbortIncompleteMultipartUploadArgs{
+					DaysAfterInitiation: pulumi.Int(1),
 				},
 			},
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// EventBridge Scheduler role
-		schedulerRole, err := iam.NewRole(ctx, fmt.Sprintf("%s-%s-scheduler-role", project, stack), &iam.RoleArgs{
-			AssumeRolePolicy: pulumi.String(`{
+		},
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// Server access logs record every request to the data bucket. S3 cannot deliver them to a
+	// bucket encrypted with a customer-managed key, so the log bucket uses SSE-S3
+	logsBucket, err := s3.NewBucket(ctx, fmt.Sprintf("%s-%s-access-logs", project, stack), &s3.BucketArgs{}, awsOpts)
+	if err != nil {
+		return err
+	}
+	_, err = s3.NewBucketPublicAccessBlock(ctx, fmt.Sprintf("%s-%s-access-logs-pab", project, stack), &s3.BucketPublicAccessBlockArgs{
+		Bucket:                logsBucket.ID(),
+		BlockPublicAcls:       pulumi.Bool(true),
+		BlockPublicPolicy:     pulumi.Bool(true),
+		IgnorePublicAcls:      pulumi.Bool(true),
+		RestrictPublicBuckets: pulumi.Bool(true),
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+	_, err = s3.NewBucketServerSideEncryptionConfigurationV2(ctx, fmt.Sprintf("%s-%s-access-logs-sse", project, stack), &s3.BucketServerSideEncryptionConfigurationV2Args{
+		Bucket: logsBucket.ID(),
+		Rules: s3.BucketServerSideEncryptionConfigurationV2RuleArray{
+			&s3.BucketServerSideEncryptionConfigurationV2RuleArgs{
+				ApplyServerSideEncryptionByDefault: &s3.BucketServerSideEncryptionConfigurationV2RuleApplyServerSideEncryptionByDefaultArgs{
+					SseAlgorithm: pulumi.String("AES256"),
+				},
+			},
+		},
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+	_, err = s3.NewBucketLifecycleConfigurationV2(ctx, fmt.Sprintf("%s-%s-access-logs-lifecycle", project, stack), &s3.BucketLifecycleConfigurationV2Args{
+		Bucket: logsBucket.ID(),
+		Rules: s3.BucketLifecycleConfigurationV2RuleArray{
+			&s3.BucketLifecycleConfigurationV2RuleArgs{
+				Id:     pulumi.String("expire-access-logs"),
+				Status: pulumi.String("Enabled"),
+				Filter: &s3.BucketLifecycleConfigurationV2RuleFilterArgs{},
+				Expiration: &s3.BucketLifecycleConfigurationV2RuleExpirationArgs{
+					Days: pulumi.Int(365), // A year of who read which diary
+				},
+			},
+		},
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+	logsPolicy, err := s3.NewBucketPolicy(ctx, fmt.Sprintf("%s-%s-access-logs-policy", project, stack), &s3.BucketPolicyArgs{
+		Bucket: logsBucket.ID(),
+		Policy: pulumi.All(logsBucket.Arn, emailsBucket.Arn, caller.AccountId()).ApplyT(func(vals []interface{}) string {
+			arn, source, acct := vals[0].(string), vals[1].(string), vals[2].(string)
+			return fmt.Sprintf(`{
 				"Version": "2012-10-17",
 				"Statement": [
 					{
+						"Sid": "AllowS3Logging",
 						"Effect": "Allow",
 						"Principal": {
-							"Service": "scheduler.amazonaws.com"
+							"Service": "logging.s3.amazonaws.com"
 						},
-						"Action": "sts:AssumeRole"
-					}
-				]
-			}`),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Lambda invoke policy for scheduler
-		schedulerLambdaPolicyDoc := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
-			Statements: iam.GetPolicyDocumentStatementArray{
-				iam.GetPolicyDocumentStatementArgs{
-					Effect: pulumi.String("Allow"),
-					Actions: pulumi.ToStringArray([]string{
-						"lambda:InvokeFunction",
-					}),
-					Resources: pulumi.StringArray{
-						weeklyReportFn.Arn,
-					},
-				},
-			},
-		})
-
-		_, err = iam.NewRolePolicy(ctx, fmt.Sprintf("%s-%s-scheduler-lambda", project, stack), &iam.RolePolicyArgs{
-			Role:   schedulerRole.ID(),
-			Policy: schedulerLambdaPolicyDoc.Json(),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// EventBridge Scheduler - every Sunday at 6 PM London time
-		_, err = scheduler.NewSchedule(ctx, fmt.Sprintf("%s-%s-weekly-report-schedule", project, stack), &scheduler.ScheduleArgs{
-			Description:        pulumi.String("Trigger weekly nutrition report every Sunday at 6 PM London time"),
-			ScheduleExpression: pulumi.String("cron(0 18 ? * SUN *)"), // 6 PM UTC on Sundays (7 PM London time during DST, 6 PM during standard time)
-			FlexibleTimeWindow: &scheduler.ScheduleFlexibleTimeWindowArgs{
-				Mode: pulumi.String("OFF"),
-			},
-			Target: &scheduler.ScheduleTargetArgs{
-				Arn:     weeklyReportFn.Arn,
-				RoleArn: schedulerRole.Arn,
-				Input:   pulumi.String(`{"source":"aws.scheduler","detail-type":"Weekly Report Trigger"}`),
-			},
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		ctx.Export("bucketName", bucket.Bucket)
-		ctx.Export("dataBucket", emailsBucket.Bucket)
-		ctx.Export("ecrRepositoryUrl", repo.RepositoryUrl)
-		ctx.Export("secretArn", secret.Arn)
-		ctx.Export("emailIngestLambda", emailIngestFn.Name)
-		ctx.Export("weeklyReportLambda", weeklyReportFn.Name)
-		ctx.Export("region", aws.GetRegionOutput(ctx, aws.GetRegionOutputArgs{}).Name())
-		ctx.Export("allowedSenderDomain", pulumi.String(allowedSenderDomain))
-
-		if v, ok := ctx.GetConfig("mailmunch:sesEmailIdentity"); ok {
-			ctx.Export("sesEmailIdentity", pulumi.String(v))
-		}
-
-		// Glue database and crawler for curated Parquet
-		glueDb, err := glue.NewCatalogDatabase(ctx, fmt.Sprintf("%s_%s_db", project, stack), &glue.CatalogDatabaseArgs{
-			Name: pulumi.String(athenaDatabaseName),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Glue assume role policy
-		glueAssumeRolePolicy, err := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
-			Statements: []iam.GetPolicyDocumentStatement{
-				{
-					Effect: pulumi.StringRef("Allow"),
-					Principals: []iam.GetPolicyDocumentStatementPrincipal{
-						{
-							Type: "Service",
-							Identifiers: []string{
-								"glue.amazonaws.com",
+						"Action": "s3:PutObject",
+						"Resource": "%s/data/*",
+						"Condition": {
+							"ArnEquals": {
+								"aws:SourceArn": "%s"
 							},
-						},
-					},
-					Actions: []string{
-						"sts:AssumeRole",
+							"StringEquals": {
+								"aws:SourceAccount": "%s"
+							}
+						}
 					},
-				},
-			},
-		}, nil)
-		if err != nil {
-			return err
-		}
-
-		glueRole, err := iam.NewRole(ctx, fmt.Sprintf("%s-%s-glue-role", project, stack), &iam.RoleArgs{
-			AssumeRolePolicy: pulumi.String(glueAssumeRolePolicy.Json),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-		_, err = iam.NewRolePolicyAttachment(ctx, fmt.Sprintf("%s-%s-glue-managed", project, stack), &iam.RolePolicyAttachmentArgs{
-			Role:      glueRole.Name,
-			PolicyArn: pulumi.String("arn:aws:iam::aws:policy/service-role/AWSGlueServiceRole"),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Create S3 access policy for Glue (curated data access only)
-		glueS3PolicyDoc, err := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
-			Statements: []iam.GetPolicyDocumentStatement{
-				{
-					Effect: pulumi.StringRef("Allow"),
-					Actions: []string{
-						"s3:GetObject",
+					%s
+				]
+			}`, arn, source, acct, denyInsecureTransport(arn))
+		}).(pulumi.StringOutput),
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+	_, err = s3.NewBucketLoggingV2(ctx, fmt.Sprintf("%s-%s-emails-logging", project, stack), &s3.BucketLoggingV2Args{
+		Bucket:       emailsBucket.ID(),
+		TargetBucket: logsBucket.ID(),
+		TargetPrefix: pulumi.String("data/"),
+	}, awsOpts, pulumi.DependsOn([]pulumi.Resource{logsPolicy}))
+	if err != nil {
+		return err
+	}
+
+	repo, err := ecr.NewRepository(ctx, fmt.Sprintf("%s-%s-repo", project, stack), &ecr.RepositoryArgs{
+		ImageScanningConfiguration: &ecr.RepositoryImageScanningConfigurationArgs{
+			ScanOnPush: pulumi.Bool(true),
+		},
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	secret, err := secretsmanager.NewSecret(ctx, fmt.Sprintf("%s-%s-secret", project, stack), &secretsmanager.SecretArgs{
+		KmsKeyId: dataKey.Arn,
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	app, err := appconfig.NewApplication(ctx, fmt.Sprintf("%s-%s-appcfg", project, stack), &appconfig.ApplicationArgs{}, awsOpts)
+	if err != nil {
+		return err
+	}
+	profile, err := appconfig.NewConfigurationProfile(ctx, fmt.Sprintf("%s-%s-profile", project, stack), &appconfig.ConfigurationProfileArgs{
+		ApplicationId: app.ID(),
+		LocationUri:   pulumi.String("hosted"),
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+	// Read the prompt from the text file
+	promptContent, err := os.ReadFile("weekly_report_prompt.txt")
+	if err != nil {
+		return fmt.Errorf("failed to read weekly_report_prompt.txt: %w", err)
+	}
+
+	const defaultSystemPrompt = "Act as a nutritionist and fitness coach. Provide detailed, actionable advice based on provided food diary data."
+
+	// Create JSON configuration with the prompts, the user registry and default nutrition goals
+	appConfigContent := map[string]any{
+		"weekly_report_base_prompt":   string(promptContent),
+		"weekly_report_system_prompt": defaultSystemPrompt,
+		"users":                       registry(cfg.Users),
+	}
+	if cfg.Goals != nil {
+		appConfigContent["goals"] = cfg.Goals
+	}
+	// Report templates: {"version": ..., "html"/"text"/"subject": ...} or {"version": ..., "s3_prefix": ...}
+	if cfg.Templates != nil {
+		appConfigContent["templates"] = cfg.Templates
+	}
+	configJSON, err := json.Marshal(appConfigContent)
+	if err != nil {
+		return err
+	}
+
+	configVersion, err := appconfig.NewHostedConfigurationVersion(ctx, fmt.Sprintf("%s-%s-configv1", project, stack), &appconfig.HostedConfigurationVersionArgs{
+		ApplicationId:          app.ID(),
+		ConfigurationProfileId: profile.ConfigurationProfileId,
+		Content:                pulumi.String(string(configJSON)),
+		ContentType:            pulumi.String("application/json"),
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// Create AppConfig environment
+	env, err := appconfig.NewEnvironment(ctx, fmt.Sprintf("%s-%s-env-prod", project, stack), &appconfig.EnvironmentArgs{
+		Name:          pulumi.String("prod"),
+		ApplicationId: app.ID(),
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// Create AppConfig deployment to make the configuration available
+	_, err = appconfig.NewDeployment(ctx, fmt.Sprintf("%s-%s-deployment", project, stack), &appconfig.DeploymentArgs{
+		ApplicationId:          app.ID(),
+		ConfigurationProfileId: profile.ConfigurationProfileId,
+		ConfigurationVersion:   pulumi.Sprintf("%d", configVersion.VersionNumber),
+		EnvironmentId:          env.EnvironmentId,
+		DeploymentStrategyId:   pulumi.String("AppConfig.AllAtOnce"),
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// Optionally import the SES email identity if configured. Every stack in an account sends
+	// from the same verified identity, so removing one stack must not delete it
+	if email := cfg.SesEmailIdentity; email != "" {
+		sesOpts := []pulumi.ResourceOption{awsOpts, pulumi.Import(pulumi.ID(email)), pulumi.RetainOnDelete(true)}
+		_, err = sesv2.NewEmailIdentity(ctx, fmt.Sprintf("%s-%s-ses-identity", project, stack), &sesv2.EmailIdentityArgs{
+			EmailIdentity: pulumi.String(email),
+		}, sesOpts...)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Permit SES to write to the emails bucket (for S3 action), and a CloudFront distribution
+	// serving report pages to read pages/. Every request must use TLS, and a put that asks for
+	// any encryption but the data key is refused; puts without encryption headers get it from
+	// the bucket default
+	_, err = s3.NewBucketPolicy(ctx, fmt.Sprintf("%s-%s-emails-policy", project, stack), &s3.BucketPolicyArgs{
+		Bucket: emailsBucket.ID(),
+		Policy: pulumi.All(emailsBucket.Arn, caller.AccountId(), dataKey.Arn).ApplyT(func(vals []interface{}) string {
+			arn := vals[0].(string)
+			acct := vals[1].(string)
+			key := vals[2].(string)
+			// Use a static policy template to avoid gRPC issues
+			policyJson := fmt.Sprintf(`{
+				"Version": "2008-10-17",
+				"Statement": [
+					{
+						"Sid": "AllowSESPuts",
+						"Effect": "Allow",
+						"Principal": {
+							"Service": "ses.amazonaws.com"
+						},
+						"Action": "s3:PutObject",
+						"Resource": "%s/*",
+						"Condition": {
+							"StringEquals": {
+								"aws:Referer": "%s"
+							}
+						}
 					},
-					Resources: []string{"arn:aws:s3:::" + dataBucketName + "/*"},
-				},
-				{
-					Effect: pulumi.StringRef("Allow"),
-					Actions: []string{
-						"s3:ListBucket",
+					{
+						"Sid": "DenyOtherEncryption",
+						"Effect": "Deny",
+						"Principal": {
+							"AWS": "*"
+						},
+						"Action": "s3:PutObject",
+						"Resource": "%s/*",
+						"Condition": {
+							"Null": {
+								"s3:x-amz-server-side-encryption": "false"
+							},
+							"StringNotEquals": {
+								"s3:x-amz-server-side-encryption": "aws:kms"
+							}
+						}
 					},
-					Resources: []string{"arn:aws:s3:::" + dataBucketName},
-					Conditions: []iam.GetPolicyDocumentStatementCondition{
-						{
-							Test:     "StringLike",
-							Variable: "s3:prefix",
-							Values:   []string{"curated/*"},
+					{
+						"Sid": "DenyOtherKeys",
+						"Effect": "Deny",
+						"Principal": {
+							"AWS": "*"
 						},
+						"Action": "s3:PutObject",
+						"Resource": "%s/*",
+						"Condition": {
+							"Null": {
+								"s3:x-amz-server-side-encryption-aws-kms-key-id": "false"
+							},
+							"StringNotEquals": {
+								"s3:x-amz-server-side-encryption-aws-kms-key-id": "%s"
+							}
+						}
 					},
+					%s%s
+				]
+			}`, arn, acct, arn, arn, key, allowPageReads(arn, cfg.PagesDistributionArn), denyInsecureTransport(arn))
+			return policyJson
+		}).(pulumi.StringOutput),
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// Create OpenAI API key secret
+	openaiSecret, err := secretsmanager.NewSecret(ctx, fmt.Sprintf("%s-%s-openai-secret", project, stack), &secretsmanager.SecretArgs{
+		Description: pulumi.String("OpenAI API key for weekly nutrition reports"),
+		KmsKeyId:    dataKey.Arn,
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// Store the OpenAI API key from config in Secrets Manager, if provided
+	if cfg.OpenAIAPIKey != "" {
+		_, err = secretsmanager.NewSecretVersion(ctx, fmt.Sprintf("%s-%s-openai-secret-version", project, stack), &secretsmanager.SecretVersionArgs{
+			SecretId:     openaiSecret.ID(),
+			SecretString: pulumi.String(cfg.OpenAIAPIKey),
+		}, awsOpts)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Credentials for Slack, Telegram and webhook delivery channels, as a JSON object keyed
+	// by the secret names used in each user's channels
+	notifierSecret, err := secretsmanager.NewSecret(ctx, fmt.Sprintf("%s-%s-notifier-secret", project, stack), &secretsmanager.SecretArgs{
+		Description: pulumi.String("Delivery channel credentials for weekly nutrition reports"),
+		KmsKeyId:    dataKey.Arn,
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	if cfg.NotifierSecrets != "" {
+		_, err = secretsmanager.NewSecretVersion(ctx, fmt.Sprintf("%s-%s-notifier-secret-version", project, stack), &secretsmanager.SecretVersionArgs{
+			SecretId:     notifierSecret.ID(),
+			SecretString: pulumi.ToSecret(pulumi.String(cfg.NotifierSecrets)).(pulumi.StringOutput),
+		}, awsOpts)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Glue database for curated Parquet and report metadata
+	glueDb, err := glue.NewCatalogDatabase(ctx, fmt.Sprintf("%s_%s_db", project, stack), &glue.CatalogDatabaseArgs{
+		Name: pulumi.String(cfg.AthenaDatabaseName),
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// Workgroup for the report queries. Its settings override the client's, so results always
+	// land encrypted under athena-results/ and a runaway query is cancelled at the cutoff.
+	athenaWorkgroup, err := athena.NewWorkgroup(ctx, fmt.Sprintf("%s-%s-workgroup", project, stack), &athena.WorkgroupArgs{
+		Name: pulumi.String(cfg.AthenaWorkgroup),
+		Configuration: &athena.WorkgroupConfigurationArgs{
+			EnforceWorkgroupConfiguration:   pulumi.Bool(true),
+			PublishCloudwatchMetricsEnabled: pulumi.Bool(true),
+			BytesScannedCutoffPerQuery:      pulumi.Int(cfg.AthenaBytesScannedCutoff),
+			ResultConfiguration: &athena.WorkgroupConfigurationResultConfigurationArgs{
+				OutputLocation: pulumi.Sprintf("s3://%s/athena-results/", emailsBucket.Bucket),
+				EncryptionConfiguration: &athena.WorkgroupConfigurationResultConfigurationEncryptionConfigurationArgs{
+					EncryptionOption: pulumi.String("SSE_KMS"),
+					KmsKeyArn:        dataKey.Arn,
 				},
 			},
-		}, nil)
-		if err != nil {
-			return err
-		}
-
-		_, err = iam.NewRolePolicy(ctx, fmt.Sprintf("%s-%s-glue-s3", project, stack), &iam.RolePolicyArgs{
-			Role:   glueRole.ID(),
-			Policy: pulumi.String(glueS3PolicyDoc.Json),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		_, err = glue.NewCrawler(ctx, fmt.Sprintf("%s-%s-loseit-crawler", project, stack), &glue.CrawlerArgs{
-			DatabaseName: glueDb.Name,
-			Role:         glueRole.Arn,
-			S3Targets: glue.CrawlerS3TargetArray{
-				&glue.CrawlerS3TargetArgs{
-					Path: emailsBucket.Bucket.ApplyT(func(b string) string { return fmt.Sprintf("s3://%s/curated/loseit_parquet/", b) }).(pulumi.StringOutput),
+		},
+		ForceDestroy: pulumi.Bool(true), // query history only; results are in the data bucket
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// LoseIt entries table with an explicit schema. Partition projection computes partitions
+	// from the S3 layout, so Parquet written by loseit_transform is queryable as soon as it
+	// lands instead of after a crawler run. Columns match LoseItLog in loseit_transform.
+	loseitColumns := glue.CatalogTableStorageDescriptorColumnArray{}
+	for _, c := range []struct{ name, typ string }{
+		{"record_type", "string"},
+		{"date", "string"},
+		{"meal", "string"},
+		{"name", "string"},
+		{"icon", "string"},
+		{"quantity", "double"},
+		{"units", "string"},
+		{"calories", "double"},
+		{"deleted", "boolean"},
+		{"protein_g", "double"},
+		{"fat_g", "double"},
+		{"carbs_g", "double"},
+		{"saturated_fat_g", "double"},
+		{"fiber_g", "double"},
+		{"cholesterol_mg", "double"},
+		{"sodium_mg", "double"},
+		{"sugar_g", "double"},
+		{"duration_minutes", "double"},
+		{"distance_km", "double"},
+	} {
+		loseitColumns = append(loseitColumns, &glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String(c.name), Type: pulumi.String(c.typ)})
+	}
+	loseitTable, err := glue.NewCatalogTable(ctx, fmt.Sprintf("%s-%s-loseit-table", project, stack), &glue.CatalogTableArgs{
+		Name:         pulumi.String(cfg.AthenaTableName),
+		DatabaseName: glueDb.Name,
+		TableType:    pulumi.String("EXTERNAL_TABLE"),
+		Parameters: pulumi.StringMap{
+			"classification":            pulumi.String("parquet"),
+			"projection.enabled":        pulumi.String("true"),
+			"projection.user_id.type":   pulumi.String("enum"),
+			"projection.user_id.values": pulumi.String(userIDs(cfg.Users)),
+			"projection.year.type":      pulumi.String("integer"),
+			"projection.year.range":     pulumi.String("2020,2100"),
+			"projection.month.type":     pulumi.String("integer"),
+			"projection.month.range":    pulumi.String("1,12"),
+			"projection.month.digits":   pulumi.String("2"),
+			"projection.day.type":       pulumi.String("integer"),
+			"projection.day.range":      pulumi.String("1,31"),
+			"projection.day.digits":     pulumi.String("2"),
+			"storage.location.template": pulumi.Sprintf("s3://%s/curated/loseit_parquet/user_id=${user_id}/year=${year}/month=${month}/day=${day}/", emailsBucket.Bucket),
+		},
+		PartitionKeys: glue.CatalogTablePartitionKeyArray{
+			&glue.CatalogTablePartitionKeyArgs{Name: pulumi.String("user_id"), Type: pulumi.String("string")},
+			&glue.CatalogTablePartitionKeyArgs{Name: pulumi.String("year"), Type: pulumi.String("int")},
+			&glue.CatalogTablePartitionKeyArgs{Name: pulumi.String("month"), Type: pulumi.String("int")},
+			&glue.CatalogTablePartitionKeyArgs{Name: pulumi.String("day"), Type: pulumi.String("int")},
+		},
+		StorageDescriptor: &glue.CatalogTableStorageDescriptorArgs{
+			Location:     pulumi.Sprintf("s3://%s/curated/loseit_parquet/", emailsBucket.Bucket),
+			InputFormat:  pulumi.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetInputFormat"),
+			OutputFormat: pulumi.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetOutputFormat"),
+			SerDeInfo: &glue.CatalogTableStorageDescriptorSerDeInfoArgs{
+				SerializationLibrary: pulumi.String("org.apache.hadoop.hive.ql.io.parquet.serde.ParquetHiveSerDe"),
+			},
+			Columns: loseitColumns,
+		},
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// Report history table: one JSON metadata document per weekly report run.
+	// Partition projection avoids running a crawler over reports/.
+	reportMetricsType := "struct<entries:int,days_logged:int,total_calories:double,avg_calories:double," +
+		"avg_protein_g:double,avg_carbs_g:double,avg_fat_g:double,avg_fiber_g:double,avg_sugar_g:double,avg_sodium_mg:double>"
+	_, err = glue.NewCatalogTable(ctx, fmt.Sprintf("%s-%s-weekly-reports-table", project, stack), &glue.CatalogTableArgs{
+		Name:         pulumi.String("weekly_reports"),
+		DatabaseName: glueDb.Name,
+		TableType:    pulumi.String("EXTERNAL_TABLE"),
+		Parameters: pulumi.StringMap{
+			"classification":            pulumi.String("json"),
+			"projection.enabled":        pulumi.String("true"),
+			"projection.user_id.type":   pulumi.String("enum"),
+			"projection.user_id.values": pulumi.String(userIDs(cfg.Users)),
+			"projection.year.type":      pulumi.String("integer"),
+			"projection.year.range":     pulumi.String("2025,2100"),
+			"projection.week.type":      pulumi.String("integer"),
+			"projection.week.range":     pulumi.String("1,53"),
+			"projection.week.digits":    pulumi.String("2"),
+			"storage.location.template": pulumi.Sprintf("s3://%s/reports/user_id=${user_id}/year=${year}/week=${week}/metadata/", emailsBucket.Bucket),
+		},
+		PartitionKeys: glue.CatalogTablePartitionKeyArray{
+			&glue.CatalogTablePartitionKeyArgs{Name: pulumi.String("user_id"), Type: pulumi.String("string")},
+			&glue.CatalogTablePartitionKeyArgs{Name: pulumi.String("year"), Type: pulumi.String("int")},
+			&glue.CatalogTablePartitionKeyArgs{Name: pulumi.String("week"), Type: pulumi.String("int")},
+		},
+		StorageDescriptor: &glue.CatalogTableStorageDescriptorArgs{
+			Location:     pulumi.Sprintf("s3://%s/reports/", emailsBucket.Bucket),
+			InputFormat:  pulumi.String("org.apache.hadoop.mapred.TextInputFormat"),
+			OutputFormat: pulumi.String("org.apache.hadoop.hive.ql.io.HiveIgnoreKeyTextOutputFormat"),
+			SerDeInfo: &glue.CatalogTableStorageDescriptorSerDeInfoArgs{
+				SerializationLibrary: pulumi.String("org.openx.data.jsonserde.JsonSerDe"),
+				Parameters: pulumi.StringMap{
+					"ignore.malformed.json": pulumi.String("true"),
 				},
 			},
-			TablePrefix: pulumi.String("loseit_"),
-			// Run every Sunday one hour before the weekly report (17:00 UTC / 6 pm London during DST).
-			Schedule: pulumi.String("cron(0 17 ? * SUN *)"),
-			SchemaChangePolicy: &glue.CrawlerSchemaChangePolicyArgs{
-				DeleteBehavior: pulumi.String("LOG"),
+			Columns: glue.CatalogTableStorageDescriptorColumnArray{
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("run_id"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("generated_at"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("period"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("period_start"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("period_end"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("previous_period_start"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("previous_period_end"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("recipient"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("model"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("prompt_strategy"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("prompt_tokens_estimate"), Type: pulumi.String("int")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("usage"), Type: pulumi.String("struct<prompt_tokens:bigint,completion_tokens:bigint,total_tokens:bigint,requests:int>")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("ai_status"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("ai_error"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("template_version"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("email_message_id"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("deliveries"), Type: pulumi.String("array<struct<channel:string,delivery_id:string,error:string>>")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("current_metrics"), Type: pulumi.String(reportMetricsType)},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("previous_metrics"), Type: pulumi.String(reportMetricsType)},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("analysis"), Type: pulumi.String("struct<summary:string,wins:array<string>,concerns:array<string>," +
+					"food_swaps:array<struct<instead_of:string,try:string,reason:string>>," +
+					"protein_timing:struct<assessment:string,recommendations:array<string>>,action_plan:array<string>>")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("analysis_markdown"), Type: pulumi.String("string")},
+				&glue.CatalogTableStorageDescriptorColumnArgs{Name: pulumi.String("artifacts_prefix"), Type: pulumi.String("string")},
 			},
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Transform Lambda: CSV -> Parquet (Snappy)
-		transformRole, err := iam.NewRole(ctx, fmt.Sprintf("%s-%s-transform-role", project, stack), &iam.RoleArgs{
-			AssumeRolePolicy: pulumi.String(lambdaAssumeRolePolicy.Json),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-		_, err = iam.NewRolePolicyAttachment(ctx, fmt.Sprintf("%s-%s-transform-basic", project, stack), &iam.RolePolicyAttachmentArgs{
-			Role:      transformRole.Name,
-			PolicyArn: pulumi.String("arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// Create S3 access policy for transform Lambda
-		transformS3PolicyDoc, err := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
-			Statements: []iam.GetPolicyDocumentStatement{
-				{
-					Effect: pulumi.StringRef("Allow"),
-					Actions: []string{
-						"s3:GetObject",
-						"s3:PutObject",
-					},
-					Resources: []string{"arn:aws:s3:::" + dataBucketName + "/*"},
-				},
-				{
-					Effect: pulumi.StringRef("Allow"),
-					Actions: []string{
-						"s3:ListBucket",
-					},
-					Resources: []string{"arn:aws:s3:::" + dataBucketName},
-				},
+		},
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// Each Lambda's IAM policy is generated from lambda/<package>/access.json
+	access := &accessResources{
+		Region:    region,
+		Account:   caller.AccountId(),
+		BucketArn: emailsBucket.Arn,
+		DataKey:   dataKey.Arn,
+		Secrets: map[string]pulumi.StringInput{
+			"openai":   openaiSecret.Arn,
+			"notifier": notifierSecret.Arn,
+		},
+		Database: cfg.AthenaDatabaseName,
+		Tables: map[string]athenaTable{
+			"loseit":         {Name: cfg.AthenaTableName, Prefix: "curated/loseit_parquet/"},
+			"weekly_reports": {Name: "weekly_reports", Prefix: "reports/"},
+		},
+		Workgroup:       cfg.AthenaWorkgroup,
+		TemplatesPrefix: cfg.TemplatesPrefix,
+		AppConfig: pulumi.Sprintf("arn:aws:appconfig:%s:%s:application/%s/environment/%s/configuration/%s",
+			region, caller.AccountId(), app.ID(), env.EnvironmentId, profile.ConfigurationProfileId),
+	}
+	policies := map[string]RolePolicy{}
+	for _, pkg := range []string{"email_ingest", "loseit_transform", "weekly_report", "report_reply"} {
+		if policies[pkg], err = access.policy(ctx, pkg); err != nil {
+			return err
+		}
+	}
+
+	// Every Lambda's error and dead-letter alarms notify this topic; subscribe to it by email
+	// with mailmunch:alarmEmail or add other subscriptions outside the stack
+	alarmTopic, err := sns.NewTopic(ctx, fmt.Sprintf("%s-%s-alarms", project, stack), &sns.TopicArgs{}, awsOpts)
+	if err != nil {
+		return err
+	}
+	if cfg.AlarmEmail != "" {
+		_, err = sns.NewTopicSubscription(ctx, fmt.Sprintf("%s-%s-alarms-email", project, stack), &sns.TopicSubscriptionArgs{
+			Topic:    alarmTopic.Arn,
+			Protocol: pulumi.String("email"),
+			Endpoint: pulumi.String(cfg.AlarmEmail),
+		}, awsOpts)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The Lambdas write throughput metrics in Embedded Metric Format under this namespace
+	metricsNamespace := fmt.Sprintf("%s/%s", project, stack)
+
+	// LoseIt exports: EML -> raw CSV (email_ingest), CSV -> Parquet (loseit_transform)
+	loseit, err := NewIngestPipeline(ctx, fmt.Sprintf("%s-%s-loseit", project, stack), &IngestPipelineArgs{
+		Bucket:         emailsBucket,
+		IncomingPrefix: "raw/email/incoming/",
+		RawPrefix:      "raw/loseit_csv/",
+		Ingest: FunctionArgs{
+			Package: "email_ingest",
+			Environment: pulumi.StringMap{
+				"EMAIL_BUCKET":          emailsBucket.Bucket,
+				"INCOMING_PREFIX":       pulumi.String("raw/email/incoming/"),
+				"RAW_EMAIL_BASE":        pulumi.String("raw/email/"),
+				"RAW_CSV_BASE":          pulumi.String("raw/loseit_csv/"),
+				"ALLOWED_SENDER_DOMAIN": pulumi.String(cfg.AllowedSenderDomain),
+				"RECIPIENT_ADDRESS":     pulumi.String(cfg.RecipientAddress),
+				"USER_ADDRESSES":        pulumi.String(userAddressesJSON),
+				"METRICS_NAMESPACE":     pulumi.String(metricsNamespace),
 			},
-		}, nil)
-		if err != nil {
-			return err
-		}
-
-		_, err = iam.NewRolePolicy(ctx, fmt.Sprintf("%s-%s-transform-s3", project, stack), &iam.RolePolicyArgs{
-			Role:   transformRole.ID(),
-			Policy: pulumi.String(transformS3PolicyDoc.Json),
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		transformZip := pulumi.NewFileArchive("../dist/loseit_transform.zip")
-		transformFn, err := lambda.NewFunction(ctx, fmt.Sprintf("%s-%s-loseit-transform", project, stack), &lambda.FunctionArgs{
-			Role:          transformRole.Arn,
-			Runtime:       pulumi.String("provided.al2"),
-			Handler:       pulumi.String("bootstrap"),
-			Architectures: pulumi.ToStringArray([]string{"arm64"}),
-			Code:          transformZip,
-			Environment: &lambda.FunctionEnvironmentArgs{
-				Variables: pulumi.StringMap{
-					"DATA_BUCKET":  emailsBucket.Bucket,
-					"RAW_CSV_BASE": pulumi.String("raw/loseit_csv/"),
-					"CURATED_BASE": pulumi.String("curated/loseit_parquet/"),
-				},
+			Policies:   []RolePolicy{policies["email_ingest"]},
+			AlarmTopic: alarmTopic.Arn,
+		},
+		Transform: FunctionArgs{
+			Package: "loseit_transform",
+			Environment: pulumi.StringMap{
+				"DATA_BUCKET":       emailsBucket.Bucket,
+				"RAW_CSV_BASE":      pulumi.String("raw/loseit_csv/"),
+				"CURATED_BASE":      pulumi.String("curated/loseit_parquet/"),
+				"METRICS_NAMESPACE": pulumi.String(metricsNamespace),
 			},
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		ctx.Export("transformLambda", transformFn.Name)
-
-		_, err = lambda.NewPermission(ctx, fmt.Sprintf("%s-%s-transform-perm", project, stack), &lambda.PermissionArgs{
-			Action:    pulumi.String("lambda:InvokeFunction"),
-			Function:  transformFn.Name,
-			Principal: pulumi.String("s3.amazonaws.com"),
-			SourceArn: emailsBucket.Arn,
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
-
-		// S3 BucketNotification with both email ingest and transform Lambda triggers
-		_, err = s3.NewBucketNotification(ctx, fmt.Sprintf("%s-%s-data-notify", project, stack), &s3.BucketNotificationArgs{
-			Bucket: emailsBucket.ID(),
-			LambdaFunctions: s3.BucketNotificationLambdaFunctionArray{
-				&s3.BucketNotificationLambdaFunctionArgs{
-					LambdaFunctionArn: emailIngestFn.Arn,
-					Events:            pulumi.ToStringArray([]string{"s3:ObjectCreated:*"}),
-					FilterPrefix:      pulumi.String("raw/email/incoming/"),
-				},
-				&s3.BucketNotificationLambdaFunctionArgs{
-					LambdaFunctionArn: transformFn.Arn,
-					Events:            pulumi.ToStringArray([]string{"s3:ObjectCreated:*"}),
-					FilterPrefix:      pulumi.String("raw/loseit_csv/"),
-				},
+			Policies:   []RolePolicy{policies["loseit_transform"]},
+			AlarmTopic: alarmTopic.Arn,
+		},
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// Missing data breaches, so the alarm fires once every hour of the window has passed
+	// without loseit_transform writing a partition
+	alarmActions := pulumi.Array{alarmTopic.Arn}
+	_, err = cloudwatch.NewMetricAlarm(ctx, fmt.Sprintf("%s-%s-freshness-alarm", project, stack), &cloudwatch.MetricAlarmArgs{
+		AlarmDescription:   pulumi.Sprintf("No new curated LoseIt partition in %d hours; check that exports are still arriving", cfg.FreshnessWindowHours),
+		Namespace:          pulumi.String(metricsNamespace),
+		MetricName:         pulumi.String("CuratedPartitionsWritten"),
+		Statistic:          pulumi.String("Sum"),
+		Period:             pulumi.Int(3600),
+		EvaluationPeriods:  pulumi.Int(cfg.FreshnessWindowHours),
+		DatapointsToAlarm:  pulumi.Int(cfg.FreshnessWindowHours),
+		Threshold:          pulumi.Float64(1),
+		ComparisonOperator: pulumi.String("LessThanThreshold"),
+		TreatMissingData:   pulumi.String("breaching"),
+		AlarmActions:       alarmActions,
+		OkActions:          alarmActions,
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// Weekly report, plus monthly and quarterly trend reports covering the period that has just
+	// ended. On the 1st of a quarter only the quarterly report is sent, not both
+	triggers := []ReportTrigger{
+		{
+			Name:        "weekly",
+			Description: fmt.Sprintf("Trigger weekly nutrition report at 6 PM %s on the last day of the week", cfg.Schedule.Timezone),
+			Expression:  cfg.Schedule.endOfWeekCron(18),
+			Input:       `{"source":"aws.scheduler","detail-type":"Weekly Report Trigger"}`,
+		},
+		{
+			Name:        "monthly",
+			Description: "Trigger monthly trend report on the 1st of each month that does not start a quarter",
+			Expression:  "cron(0 9 1 2,3,5,6,8,9,11,12 ? *)",
+			Input:       `{"source":"aws.scheduler","detail-type":"Monthly Report Trigger","detail":{"period":"month","offset":-1}}`,
+		},
+		{
+			Name:        "quarterly",
+			Description: "Trigger quarterly trend report on the 1st of each quarter",
+			Expression:  "cron(0 10 1 1,4,7,10 ? *)",
+			Input:       `{"source":"aws.scheduler","detail-type":"Quarterly Report Trigger","detail":{"period":"quarter","offset":-1}}`,
+		},
+	}
+	// A daily check for LoseIt exports that have stopped arriving, at noon so that day's is not expected yet
+	if cfg.NudgeAfterDays > 0 {
+		triggers = append(triggers, ReportTrigger{
+			Name:        "nudge",
+			Description: fmt.Sprintf("Remind users when no LoseIt export has arrived for %d days", cfg.NudgeAfterDays),
+			Expression:  "cron(0 12 * * ? *)",
+			Input:       `{"source":"aws.scheduler","detail-type":"Missing Data Check","detail":{"mode":"nudge"}}`,
+		})
+	}
+
+	weeklyReport, err := NewScheduledReport(ctx, fmt.Sprintf("%s-%s-weekly-report", project, stack), &ScheduledReportArgs{
+		FunctionArgs: FunctionArgs{
+			Package: "weekly_report",
+			Timeout: 300, // 5 minutes for OpenAI API calls
+			Environment: pulumi.StringMap{
+				"OPENAI_SECRET_ARN":       openaiSecret.Arn,
+				"NOTIFIER_SECRET_ARN":     notifierSecret.Arn,
+				"REPORT_EMAIL":            pulumi.String(cfg.ReportEmail),
+				"SENDER_EMAIL":            pulumi.String(cfg.SenderEmail),
+				"ATHENA_DATABASE":         glueDb.Name,
+				"ATHENA_TABLE":            loseitTable.Name,
+				"ATHENA_WORKGROUP":        athenaWorkgroup.Name,
+				"ATHENA_RESULTS_BUCKET":   emailsBucket.Bucket,
+				"REPORTS_BUCKET":          emailsBucket.Bucket,
+				"REPORTS_PREFIX":          pulumi.String("reports/"),
+				"DATA_BUCKET":             emailsBucket.Bucket,
+				"RAW_CSV_BASE":            pulumi.String("raw/loseit_csv/"),
+				"NUDGE_AFTER_DAYS":        pulumi.String(strconv.Itoa(cfg.NudgeAfterDays)),
+				"DAILY_CALORIE_TARGET":    pulumi.String(cfg.dailyCalorieTarget()),
+				"APPCONFIG_APPLICATION":   app.ID(),
+				"APPCONFIG_ENVIRONMENT":   env.Name,
+				"APPCONFIG_CONFIGURATION": profile.ConfigurationProfileId,
+				"REPORT_TIMEZONE":         pulumi.String(cfg.Schedule.Timezone),
+				"WEEK_START_DAY":          pulumi.String(cfg.Schedule.weekStartDay()),
+				"METRICS_NAMESPACE":       pulumi.String(metricsNamespace),
 			},
-		}, awsOpts)
-		if err != nil {
-			return err
-		}
+			Policies:   []RolePolicy{policies["weekly_report"]},
+			InvokeSelf: true, // runs each user's report in an invocation of its own
+			AlarmTopic: alarmTopic.Arn,
+		},
+		Timezone: cfg.Schedule.Timezone,
+		Triggers: triggers,
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// Report reply Lambda: answers replies to report emails in the same thread
+	reportReply, err := NewTransformStage(ctx, fmt.Sprintf("%s-%s-report-reply", project, stack), &TransformStageArgs{
+		FunctionArgs: FunctionArgs{
+			Package: "report_reply",
+			Timeout: 120,
+			Environment: pulumi.StringMap{
+				"OPENAI_SECRET_ARN": openaiSecret.Arn,
+				"SENDER_EMAIL":      pulumi.String(cfg.SenderEmail),
+				"REPLIES_PREFIX":    pulumi.String("raw/email/replies/"),
+				"REPORTS_BUCKET":    emailsBucket.Bucket,
+				"REPORTS_PREFIX":    pulumi.String("reports/"),
+			},
+			Policies:   []RolePolicy{policies["report_reply"]},
+			AlarmTopic: alarmTopic.Arn,
+		},
+		Bucket:        emailsBucket,
+		TriggerPrefix: "raw/email/replies/",
+	}, awsOpts)
+	if err != nil {
+		return err
+	}
+
+	// One notification configuration per bucket, so every stage's trigger is declared here
+	_, err = s3.NewBucketNotification(ctx, fmt.Sprintf("%s-%s-data-notify", project, stack), &s3.BucketNotificationArgs{
+		Bucket: emailsBucket.ID(),
+		Queues: append(loseit.Notifications(), reportReply.Notification()),
+	}, awsOpts, pulumi.DependsOn([]pulumi.Resource{loseit, reportReply}))
+	if err != nil {
+		return err
+	}
+
+	// Optional: set up SES receiving to S3 for a specific recipient address
+	if cfg.RecipientAddress != "" {
+		routes := []InboxRoute{
+			{Name: "loseit", Recipients: receiptRecipients(cfg.RecipientAddress, cfg.Users), Prefix: loseit.Ingest.TriggerPrefix},
+		}
+		// Replies to reports arrive at the sender address and are answered by report_reply
+		replyAddress := bareAddress(cfg.SenderEmail)
+		if replyAddress != "" {
+			routes = append(routes, InboxRoute{Name: "reply", Recipients: []string{replyAddress}, Prefix: reportReply.TriggerPrefix})
+		}
+		inbox, err := NewSesInbox(ctx, fmt.Sprintf("%s-%s", project, stack), &SesInboxArgs{
+			Bucket:        emailsBucket.Bucket,
+			Routes:        routes,
+			RuleSetName:   cfg.ReceiptRuleSetName,
+			ManageRuleSet: cfg.ManageReceiptRuleSet,
+		}, awsOpts)
+		if err != nil {
+			return err
+		}
+
+		if replyAddress != "" {
+			ctx.Export("sesReplyAddress", pulumi.String(replyAddress))
+		}
+		ctx.Export("sesRecipient", pulumi.String(cfg.RecipientAddress))
+		ctx.Export("sesRuleSet", inbox.RuleSetName)
+	}
+
+	ctx.Export("bucketName", bucket.Bucket)
+	ctx.Export("dataBucket", emailsBucket.Bucket)
+	ctx.Export("dataKey", dataKey.Arn)
+	ctx.Export("accessLogsBucket", logsBucket.Bucket)
+	ctx.Export("ecrRepositoryUrl", repo.RepositoryUrl)
+	ctx.Export("secretArn", secret.Arn)
+	ctx.Export("emailIngestLambda", loseit.Ingest.Function.Name)
+	ctx.Export("transformLambda", loseit.Transform.Function.Name)
+	ctx.Export("weeklyReportLambda", weeklyReport.Function.Name)
+	ctx.Export("reportReplyLambda", reportReply.Function.Name)
+	ctx.Export("deadLetterQueues", pulumi.StringMap{
+		"email_ingest":     loseit.Ingest.DeadLetterQueue.Url,
+		"loseit_transform": loseit.Transform.DeadLetterQueue.Url,
+		"weekly_report":    weeklyReport.DeadLetterQueue.Url,
+		"report_reply":     reportReply.DeadLetterQueue.Url,
+	})
+	ctx.Export("alarmTopic", alarmTopic.Arn)
+	ctx.Export("region", region)
+	ctx.Export("athenaDatabase", glueDb.Name)
+	ctx.Export("athenaWorkgroup", athenaWorkgroup.Name)
+	ctx.Export("allowedSenderDomain", pulumi.String(cfg.AllowedSenderDomain))
+
+	if cfg.SesEmailIdentity != "" {
+		ctx.Export("sesEmailIdentity", pulumi.String(cfg.SesEmailIdentity))
+	}
+	return nil
+}
 
-		// Optional: set up SES receiving to S3 for a specific recipient address
-		if recipient, ok := ctx.GetConfig("mailmunch:recipientAddress"); ok && recipient != "" {
-			// Create (or ensure) a receipt rule set and rule to write to S3 prefix raw/email/incoming/
-			ruleSetName := fmt.Sprintf("%s-%s-receipt-set", project, stack)
-			ruleSet, err := ses.NewReceiptRuleSet(ctx, ruleSetName, &ses.ReceiptRuleSetArgs{
-				RuleSetName: pulumi.String(ruleSetName),
-			}, awsOpts)
-			if err != nil {
-				return err
-			}
-
-			// Activate the rule set
-			_, err = ses.NewActiveReceiptRuleSet(ctx, fmt.Sprintf("%s-%s-receipt-active", project, stack), &ses.ActiveReceiptRuleSetArgs{
-				RuleSetName: ruleSet.RuleSetName,
-			}, awsOpts)
-			if err != nil {
-				return err
-			}
-
-			_, err = ses.NewReceiptRule(ctx, fmt.Sprintf("%s-%s-receipt-rule", project, stack), &ses.ReceiptRuleArgs{
-				RuleSetName: ruleSet.RuleSetName,
-				Recipients:  pulumi.ToStringArray([]string{recipient}),
-				Enabled:     pulumi.Bool(true),
-				ScanEnabled: pulumi.Bool(true),
-				S3Actions: ses.ReceiptRuleS3ActionArray{
-					&ses.ReceiptRuleS3ActionArgs{
-						BucketName:      emailsBucket.Bucket,
-						ObjectKeyPrefix: pulumi.String("raw/email/incoming/"),
-						Position:        pulumi.Int(1),
+// denyInsecureTransport is a bucket policy statement refusing every request to the bucket
+// that is not made over TLS.
+// allowPageReads returns a bucket policy statement, followed by a comma, letting the
+// distribution read pages/, or "" when there is no distribution.
+func allowPageReads(bucketArn, distributionArn string) string {
+	if distributionArn == "" {
+		return ""
+	}
+	return fmt.Sprintf(`{
+						"Sid": "CloudFrontReadsPages",
+						"Effect": "Allow",
+						"Principal": {
+							"Service": "cloudfront.amazonaws.com"
+						},
+						"Action": "s3:GetObject",
+						"Resource": "%s/pages/*",
+						"Condition": {
+							"StringEquals": {
+								"aws:SourceArn": "%s"
+							}
+						}
 					},
-				},
-				TlsPolicy: pulumi.String("Optional"),
-			}, awsOpts)
-			if err != nil {
-				return err
-			}
-
-			ctx.Export("sesRecipient", pulumi.String(recipient))
-			ctx.Export("sesRuleSet", ruleSet.RuleSetName)
-		}
-		return nil
-	})
+					`, bucketArn, distributionArn)
+}
+
+func denyInsecureTransport(bucketArn string) string {
+	return fmt.Sprintf(`{
+						"Sid": "DenyInsecureTransport",
+						"Effect": "Deny",
+						"Principal": {
+							"AWS": "*"
+						},
+						"Action": "s3:*",
+						"Resource": ["%s", "%s/*"],
+						"Condition": {
+							"Bool": {
+								"aws:SecureTransport": "false"
+							}
+						}
+					}`, bucketArn, bucketArn)
 }
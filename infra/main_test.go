@@ -0,0 +1,785 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const (
+	dataBucketARN = "arn:aws:s3:::mailmunch-test-data"
+	dataKeyARN    = "arn:aws:kms:" + testRegion + ":" + testAccount + ":key/mailmunch-test-data-key-id"
+)
+
+var testConfig = map[string]string{
+	"recipientAddress": "loseit@example.com",
+	"senderEmail":      "Mailmunch <reports@example.com>",
+	"reportEmail":      "me@example.com",
+	"timezone":         "America/New_York",
+	"weekStartDay":     "sunday",
+	"users":            `[{"id":"alex","report_email":"alex@example.com","ingest_address":"alex@example.org"}]`,
+}
+
+func TestDataBucketPolicyOnlyAllowsSES(t *testing.T) {
+	m := runProgram(t, testConfig)
+
+	var allows []policyStatement
+	for _, s := range parsePolicy(t, m.get(t, "aws:s3/bucketPolicy:BucketPolicy", "emails-policy")).Statement {
+		if s.Effect != "Deny" {
+			allows = append(allows, s)
+		}
+	}
+	if len(allows) != 1 {
+		t.Fatalf("expected a single grant, got %+v", allows)
+	}
+	s := allows[0]
+	if s.Effect != "Allow" || !slices.Equal(s.Action, stringList{"s3:PutObject"}) {
+		t.Errorf("unexpected grant %s %v", s.Effect, s.Action)
+	}
+	if !slices.Equal(s.Principal["Service"], stringList{"ses.amazonaws.com"}) {
+		t.Errorf("unexpected principal %v", s.Principal)
+	}
+	if !slices.Equal(s.Resource, stringList{dataBucketARN + "/*"}) {
+		t.Errorf("unexpected resource %v", s.Resource)
+	}
+	if got := s.Condition["StringEquals"]["aws:Referer"]; !slices.Equal(got, stringList{testAccount}) {
+		t.Errorf("SES puts should be limited to this account, got referer %q", got)
+	}
+}
+
+// TestDataEncryptedWithStackKey checks the data bucket and secrets use the stack's KMS key,
+// the bucket refuses other encryption and plain HTTP, and every request to it is logged.
+func TestDataEncryptedWithStackKey(t *testing.T) {
+	m := runProgram(t, testConfig)
+
+	if key := m.get(t, "aws:kms/key:Key", "data-key"); key.Inputs["enableKeyRotation"] != true {
+		t.Error("data key is not rotated")
+	}
+	sse := asList(m.get(t, "aws:s3/bucketServerSideEncryptionConfigurationV2:BucketServerSideEncryptionConfigurationV2", "emails-sse").Inputs["rules"])
+	if len(sse) != 1 {
+		t.Fatalf("expected one encryption rule, got %v", sse)
+	}
+	rule := sse[0].(map[string]any)
+	byDefault := rule["applyServerSideEncryptionByDefault"].(map[string]any)
+	if byDefault["sseAlgorithm"] != "aws:kms" || byDefault["kmsMasterKeyId"] != dataKeyARN || rule["bucketKeyEnabled"] != true {
+		t.Errorf("data bucket is not encrypted with the data key: %v", rule)
+	}
+	for _, suffix := range []string{"secret", "openai-secret", "notifier-secret"} {
+		if got := m.get(t, "aws:secretsmanager/secret:Secret", suffix).Inputs["kmsKeyId"]; got != dataKeyARN {
+			t.Errorf("%s: encrypted with %v", suffix, got)
+		}
+	}
+
+	var tlsOnly, kmsOnly, keyPinned bool
+	for _, s := range parsePolicy(t, m.get(t, "aws:s3/bucketPolicy:BucketPolicy", "emails-policy")).Statement {
+		if s.Effect != "Deny" {
+			continue
+		}
+		tlsOnly = tlsOnly || slices.Equal(s.Condition["Bool"]["aws:SecureTransport"], stringList{"false"}) &&
+			slices.Equal(s.Action, stringList{"s3:*"}) && slices.Contains(s.Resource, dataBucketARN)
+		kmsOnly = kmsOnly || slices.Equal(s.Condition["StringNotEquals"]["s3:x-amz-server-side-encryption"], stringList{"aws:kms"})
+		keyPinned = keyPinned || slices.Equal(s.Condition["StringNotEquals"]["s3:x-amz-server-side-encryption-aws-kms-key-id"], stringList{dataKeyARN})
+	}
+	if !tlsOnly || !kmsOnly || !keyPinned {
+		t.Errorf("bucket policy does not refuse plain HTTP (%t), other encryption (%t) or other keys (%t)", !tlsOnly, !kmsOnly, !keyPinned)
+	}
+
+	logging := m.get(t, "aws:s3/bucketLoggingV2:BucketLoggingV2", "emails-logging")
+	if logging.Inputs["bucket"] != "mailmunch-test-data" || logging.Inputs["targetBucket"] != "mailmunch-test-access-logs" {
+		t.Errorf("data bucket access is not logged: %v", logging.Inputs)
+	}
+	for _, s := range parsePolicy(t, m.get(t, "aws:s3/bucketPolicy:BucketPolicy", "access-logs-policy")).Statement {
+		if s.Effect == "Allow" && !slices.Equal(s.Condition["ArnEquals"]["aws:SourceArn"], stringList{dataBucketARN}) {
+			t.Errorf("log bucket accepts logs from %v", s.Condition["ArnEquals"]["aws:SourceArn"])
+		}
+	}
+}
+
+func TestPagesDistributionReadsPages(t *testing.T) {
+	const distribution = "arn:aws:cloudfront::123456789012:distribution/E2EXAMPLE"
+	cloudFront := func(m *mocks) (key, bucket []policyStatement) {
+		for _, s := range parsePolicy(t, m.get(t, "aws:kms/key:Key", "data-key")).Statement {
+			if slices.Contains(s.Principal["Service"], "cloudfront.amazonaws.com") {
+				key = append(key, s)
+			}
+		}
+		for _, s := range parsePolicy(t, m.get(t, "aws:s3/bucketPolicy:BucketPolicy", "emails-policy")).Statement {
+			if slices.Contains(s.Principal["Service"], "cloudfront.amazonaws.com") {
+				bucket = append(bucket, s)
+			}
+		}
+		return key, bucket
+	}
+
+	if key, bucket := cloudFront(runProgram(t, testConfig)); len(key)+len(bucket) != 0 {
+		t.Errorf("CloudFront has access without mailmunch:pagesDistributionArn: %v %v", key, bucket)
+	}
+
+	config := maps.Clone(testConfig)
+	config["pagesDistributionArn"] = distribution
+	key, bucket := cloudFront(runProgram(t, config))
+	if len(key) != 1 || !slices.Equal(key[0].Action, stringList{"kms:Decrypt"}) ||
+		!slices.Equal(key[0].Condition["StringEquals"]["aws:SourceArn"], stringList{distribution}) {
+		t.Errorf("data key policy: %v", key)
+	}
+	if len(bucket) != 1 || !slices.Equal(bucket[0].Action, stringList{"s3:GetObject"}) ||
+		!slices.Equal(bucket[0].Resource, stringList{dataBucketARN + "/pages/*"}) ||
+		!slices.Equal(bucket[0].Condition["StringEquals"]["aws:SourceArn"], stringList{distribution}) {
+		t.Errorf("bucket policy: %v", bucket)
+	}
+}
+
+// TestKMSOnlyThroughDataServices checks each role may use the data key only as far as its
+// manifest needs, and only through S3 and Secrets Manager.
+func TestKMSOnlyThroughDataServices(t *testing.T) {
+	m := runProgram(t, testConfig)
+
+	for suffix, want := range map[string]struct {
+		actions stringList
+		via     stringList
+	}{
+		"loseit-ingest-access":    {stringList{"kms:Decrypt", "kms:GenerateDataKey"}, stringList{"s3.eu-west-2.amazonaws.com"}},
+		"loseit-transform-access": {stringList{"kms:Decrypt", "kms:GenerateDataKey"}, stringList{"s3.eu-west-2.amazonaws.com"}},
+		"weekly-report-access":    {stringList{"kms:Decrypt", "kms:GenerateDataKey"}, stringList{"s3.eu-west-2.amazonaws.com", "secretsmanager.eu-west-2.amazonaws.com"}},
+		"report-reply-access":     {stringList{"kms:Decrypt", "kms:GenerateDataKey"}, stringList{"s3.eu-west-2.amazonaws.com", "secretsmanager.eu-west-2.amazonaws.com"}},
+	} {
+		var found bool
+		for _, s := range parsePolicy(t, m.get(t, "aws:iam/rolePolicy:RolePolicy", suffix)).Statement {
+			if !strings.HasPrefix(s.Action[0], "kms:") {
+				continue
+			}
+			found = true
+			if !slices.Equal(s.Action, want.actions) || !slices.Equal(s.Resource, stringList{dataKeyARN}) ||
+				!slices.Equal(s.Condition["StringEquals"]["kms:ViaService"], want.via) {
+				t.Errorf("%s: unexpected key grant %+v", suffix, s)
+			}
+		}
+		if !found {
+			t.Errorf("%s: no key grant", suffix)
+		}
+	}
+
+	// The key policy leaves Lambda access to IAM and lets SES encrypt only through S3
+	for _, s := range parsePolicy(t, m.get(t, "aws:kms/key:Key", "data-key")).Statement {
+		if slices.Contains(s.Principal["Service"], "ses.amazonaws.com") &&
+			(!slices.Equal(s.Action, stringList{"kms:GenerateDataKey"}) || !slices.Equal(s.Condition["StringEquals"]["aws:SourceAccount"], stringList{testAccount})) {
+			t.Errorf("unexpected SES grant %+v", s)
+		}
+		if len(s.Principal["AWS"]) > 0 && !slices.Equal(s.Principal["AWS"], stringList{"arn:aws:iam::" + testAccount + ":root"}) {
+			t.Errorf("key policy grants %v directly", s.Principal["AWS"])
+		}
+	}
+}
+
+func TestPublicAccessBlocked(t *testing.T) {
+	m := runProgram(t, testConfig)
+
+	blocks := m.all("aws:s3/bucketPublicAccessBlock:BucketPublicAccessBlock")
+	if len(blocks) != len(m.all("aws:s3/bucket:Bucket")) {
+		t.Fatalf("expected a public access block per bucket, got %d", len(blocks))
+	}
+	for _, b := range blocks {
+		for _, k := range []string{"blockPublicAcls", "blockPublicPolicy", "ignorePublicAcls", "restrictPublicBuckets"} {
+			if b.Inputs[k] != true {
+				t.Errorf("%s: %s is not set", b.Name, k)
+			}
+		}
+	}
+}
+
+func TestLifecycleExpiresRawEmailAndQueryResults(t *testing.T) {
+	m := runProgram(t, testConfig)
+
+	lc := m.get(t, "aws:s3/bucketLifecycleConfigurationV2:BucketLifecycleConfigurationV2", "emails-lifecycle")
+	expiry := map[string]float64{}
+	for _, r := range asList(lc.Inputs["rules"]) {
+		rule := r.(map[string]any)
+		prefix := rule["filter"].(map[string]any)["prefix"].(string)
+		expiry[prefix] = rule["expiration"].(map[string]any)["days"].(float64)
+	}
+	want := map[string]float64{"raw/email/incoming/": 90, "raw/email/replies/": 90, "athena-results/": 7}
+	if len(expiry) != len(want) {
+		t.Fatalf("unexpected lifecycle rules %v", expiry)
+	}
+	for prefix, days := range want {
+		if expiry[prefix] != days {
+			t.Errorf("%s: expected expiry after %v days, got %v", prefix, days, expiry[prefix])
+		}
+	}
+}
+
+// TestNotificationFilters checks each Lambda is triggered on the prefix the previous step
+// writes to, so a typo in a prefix fails here rather than silently after pulumi up.
+func TestNotificationFilters(t *testing.T) {
+	m := runProgram(t, testConfig)
+
+	notify := m.get(t, "aws:s3/bucketNotification:BucketNotification", "data-notify")
+	if fns := asList(notify.Inputs["lambdaFunctions"]); len(fns) != 0 {
+		t.Errorf("S3 should notify the stage queues, not invoke functions directly: %v", fns)
+	}
+	queues := asList(notify.Inputs["queues"])
+	for _, q := range queues {
+		if events := asList(q.(map[string]any)["events"]); len(events) != 1 || events[0] != "s3:ObjectCreated:*" {
+			t.Errorf("unexpected events %v", events)
+		}
+	}
+	triggers := m.triggers(t)
+	if len(triggers) != 3 || len(queues) != 3 {
+		t.Fatalf("expected three triggers, got %v", triggers)
+	}
+
+	ingest, transform, reply := m.env(t, "loseit-ingest"), m.env(t, "loseit-transform"), m.env(t, "report-reply")
+	for fn, want := range map[string]any{
+		"loseit-ingest":    ingest["INCOMING_PREFIX"],
+		"loseit-transform": ingest["RAW_CSV_BASE"],
+		"report-reply":     reply["REPLIES_PREFIX"],
+	} {
+		if got := triggers[functionARN(fn)]; got != want {
+			t.Errorf("%s: triggered on %q, expected %q", fn, got, want)
+		}
+	}
+	if transform["RAW_CSV_BASE"] != ingest["RAW_CSV_BASE"] {
+		t.Errorf("transform reads %q but ingest writes %q", transform["RAW_CSV_BASE"], ingest["RAW_CSV_BASE"])
+	}
+
+	// Only the data bucket may send to the queues
+	policies := m.all("aws:sqs/queuePolicy:QueuePolicy")
+	if len(policies) != len(queues) {
+		t.Errorf("expected a policy per queue, got %d", len(policies))
+	}
+	for _, p := range policies {
+		for _, s := range parsePolicy(t, p).Statement {
+			if !slices.Equal(s.Principal["Service"], stringList{"s3.amazonaws.com"}) ||
+				!slices.Equal(s.Condition["ArnEquals"]["aws:SourceArn"], stringList{dataBucketARN}) {
+				t.Errorf("%s: unexpected statement %+v", p.Name, s)
+			}
+		}
+	}
+}
+
+// TestStageQueuesRetryFailedRecords checks the stage queues report failures per record and
+// dead-letter notifications that keep failing.
+func TestStageQueuesRetryFailedRecords(t *testing.T) {
+	m := runProgram(t, testConfig)
+
+	for _, fn := range []string{"loseit-ingest", "loseit-transform", "report-reply"} {
+		esm := m.get(t, "aws:lambda/eventSourceMapping:EventSourceMapping", fn+"-events")
+		if !slices.Equal(asList(esm.Inputs["functionResponseTypes"]), []any{"ReportBatchItemFailures"}) {
+			t.Errorf("%s: batch item failures are not reported: %v", fn, esm.Inputs["functionResponseTypes"])
+		}
+		if esm.Inputs["scalingConfig"].(map[string]any)["maximumConcurrency"] != float64(stageMaxConcurrency) {
+			t.Errorf("%s: unexpected scaling %v", fn, esm.Inputs["scalingConfig"])
+		}
+
+		queue := m.get(t, "aws:sqs/queue:Queue", fn+"-queue")
+		var redrive struct {
+			DeadLetterTargetArn string `json:"deadLetterTargetArn"`
+			MaxReceiveCount     int    `json:"maxReceiveCount"`
+		}
+		if err := json.Unmarshal([]byte(queue.Inputs["redrivePolicy"].(string)), &redrive); err != nil {
+			t.Fatalf("%s: invalid redrive policy: %v", fn, err)
+		}
+		if redrive.DeadLetterTargetArn != queueARN(fn+"-dlq") || redrive.MaxReceiveCount != stageMaxReceives {
+			t.Errorf("%s: unexpected redrive policy %+v", fn, redrive)
+		}
+
+		timeout, _ := m.get(t, "aws:lambda/function:Function", fn).Inputs["timeout"].(float64)
+		if visibility := queue.Inputs["visibilityTimeoutSeconds"].(float64); visibility < 6*timeout {
+			t.Errorf("%s: visibility timeout %vs is less than six times the function timeout %vs", fn, visibility, timeout)
+		}
+
+		consume := parsePolicy(t, m.get(t, "aws:iam/rolePolicy:RolePolicy", fn+"-queue-consume")).Statement
+		if len(consume) != 1 || !slices.Equal(consume[0].Resource, stringList{queueARN(fn + "-queue")}) {
+			t.Errorf("%s: unexpected queue policy %+v", fn, consume)
+		}
+	}
+}
+
+func TestLambdaEnvironment(t *testing.T) {
+	m := runProgram(t, testConfig)
+
+	for fn, want := range map[string]map[string]string{
+		"loseit-ingest": {
+			"EMAIL_BUCKET":          "mailmunch-test-data",
+			"ALLOWED_SENDER_DOMAIN": "loseit.com",
+			"RECIPIENT_ADDRESS":     "loseit@example.com",
+			"USER_ADDRESSES":        `{"alex@example.org":"alex"}`,
+			"METRICS_NAMESPACE":     "mailmunch/test",
+		},
+		"loseit-transform": {
+			"DATA_BUCKET":       "mailmunch-test-data",
+			"CURATED_BASE":      "curated/loseit_parquet/",
+			"METRICS_NAMESPACE": "mailmunch/test",
+		},
+		"weekly-report": {
+			"ATHENA_DATABASE":       "mailmunch_test",
+			"ATHENA_TABLE":          "loseit_loseit_parquet",
+			"ATHENA_WORKGROUP":      "mailmunch-test",
+			"ATHENA_RESULTS_BUCKET": "mailmunch-test-data",
+			"REPORTS_BUCKET":        "mailmunch-test-data",
+			"REPORT_EMAIL":          "me@example.com",
+			"SENDER_EMAIL":          "Mailmunch <reports@example.com>",
+			"REPORT_TIMEZONE":       "America/New_York",
+			"WEEK_START_DAY":        "sunday",
+			"METRICS_NAMESPACE":     "mailmunch/test",
+			"OPENAI_SECRET_ARN":     "arn:aws:secretsmanager:" + testRegion + ":" + testAccount + ":secret:mailmunch-test-openai-secret",
+		},
+		"report-reply": {
+			"REPORTS_BUCKET": "mailmunch-test-data",
+			"REPORTS_PREFIX": "reports/",
+			"SENDER_EMAIL":   "Mailmunch <reports@example.com>",
+		},
+	} {
+		env := m.env(t, fn)
+		for k, v := range want {
+			if env[k] != v {
+				t.Errorf("%s: %s = %v, expected %q", fn, k, env[k], v)
+			}
+		}
+	}
+
+	fn := m.get(t, "aws:lambda/function:Function", "weekly-report")
+	if fn.Inputs["timeout"] != float64(300) {
+		t.Errorf("weekly report timeout = %v", fn.Inputs["timeout"])
+	}
+}
+
+// TestLambdaPoliciesLeastPrivilege checks the inline policies on every Lambda role: no
+// wildcard actions or resources, S3 limited to the data bucket and secrets limited to their ARNs.
+func TestLambdaPoliciesLeastPrivilege(t *testing.T) {
+	m := runProgram(t, testConfig)
+
+	policies := m.all("aws:iam/rolePolicy:RolePolicy")
+	if len(policies) == 0 {
+		t.Fatal("no role policies")
+	}
+	for _, p := range policies {
+		for _, s := range parsePolicy(t, p).Statement {
+			for _, action := range s.Action {
+				if action == "*" || strings.HasSuffix(action, ":*") {
+					t.Errorf("%s: wildcard action %q", p.Name, action)
+				}
+			}
+			if slices.Contains(s.Resource, "*") {
+				t.Errorf("%s: %v on any resource", p.Name, s.Action)
+			}
+			for _, action := range s.Action {
+				switch service, _, _ := strings.Cut(action, ":"); service {
+				case "s3":
+					for _, r := range s.Resource {
+						if r != dataBucketARN && !strings.HasPrefix(r, dataBucketARN+"/") {
+							t.Errorf("%s: %s on %q outside the data bucket", p.Name, action, r)
+						}
+					}
+				case "secretsmanager":
+					for _, r := range s.Resource {
+						if !strings.HasPrefix(r, "arn:aws:secretsmanager:") {
+							t.Errorf("%s: %s on %q rather than a specific secret", p.Name, action, r)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// report_reply only reads replies and reports and only writes reports
+	for _, s := range parsePolicy(t, m.get(t, "aws:iam/rolePolicy:RolePolicy", "report-reply-access")).Statement {
+		if slices.Contains(s.Action, "s3:PutObject") && !slices.Equal(s.Resource, stringList{dataBucketARN + "/reports/*"}) {
+			t.Errorf("report_reply may write to %v", s.Resource)
+		}
+		if slices.Contains(s.Action, "secretsmanager:GetSecretValue") && len(s.Resource) != 1 {
+			t.Errorf("report_reply may read secrets %v", s.Resource)
+		}
+	}
+
+	// The scheduler can invoke the report Lambda and send to its dead-letter queue, nothing else
+	scheduler := map[string]stringList{}
+	for _, s := range parsePolicy(t, m.get(t, "aws:iam/rolePolicy:RolePolicy", "weekly-report-scheduler-lambda")).Statement {
+		for _, a := range s.Action {
+			scheduler[a] = append(scheduler[a], s.Resource...)
+		}
+	}
+	if len(scheduler) != 2 ||
+		!slices.Equal(scheduler["lambda:InvokeFunction"], stringList{functionARN("weekly-report")}) ||
+		!slices.Equal(scheduler["sqs:SendMessage"], stringList{queueARN("weekly-report-dlq")}) {
+		t.Errorf("unexpected scheduler policy %v", scheduler)
+	}
+}
+
+// TestFailedEventsGoToDeadLetterQueues checks every Lambda sends events it gives up on to its
+// own queue, and that the queues and errors alarm on the alarm topic.
+func TestFailedEventsGoToDeadLetterQueues(t *testing.T) {
+	m := runProgram(t, testConfig)
+	topic := "arn:aws:sns:" + testRegion + ":" + testAccount + ":mailmunch-test-alarms"
+
+	for _, fn := range []string{"loseit-ingest", "loseit-transform", "weekly-report", "report-reply"} {
+		async := m.get(t, "aws:lambda/functionEventInvokeConfig:FunctionEventInvokeConfig", fn+"-async")
+		if async.Inputs["functionName"] != testProject+"-"+testStack+"-"+fn {
+			t.Errorf("%s: async config is for %v", fn, async.Inputs["functionName"])
+		}
+		// A report that failed part-way may already have been delivered, so it is not retried
+		retries := asyncRetries
+		if fn == "weekly-report" {
+			retries = 0
+		}
+		if async.Inputs["maximumRetryAttempts"] != float64(retries) {
+			t.Errorf("%s: %v retries, expected %d", fn, async.Inputs["maximumRetryAttempts"], retries)
+		}
+		dest := async.Inputs["destinationConfig"].(map[string]any)["onFailure"].(map[string]any)["destination"]
+		if dest != queueARN(fn+"-dlq") {
+			t.Errorf("%s: failed events go to %v", fn, dest)
+		}
+
+		send := parsePolicy(t, m.get(t, "aws:iam/rolePolicy:RolePolicy", fn+"-dlq-send")).Statement
+		if len(send) != 1 || !slices.Equal(send[0].Action, stringList{"sqs:SendMessage"}) || !slices.Equal(send[0].Resource, stringList{queueARN(fn + "-dlq")}) {
+			t.Errorf("%s: unexpected dead-letter policy %+v", fn, send)
+		}
+
+		for _, alarm := range []string{fn + "-errors-alarm", fn + "-dlq-alarm"} {
+			a := m.get(t, "aws:cloudwatch/metricAlarm:MetricAlarm", alarm)
+			if actions := asList(a.Inputs["alarmActions"]); len(actions) != 1 || actions[0] != topic {
+				t.Errorf("%s notifies %v, expected the alarm topic", alarm, actions)
+			}
+		}
+		dims := m.get(t, "aws:cloudwatch/metricAlarm:MetricAlarm", fn+"-dlq-alarm").Inputs["dimensions"].(map[string]any)
+		if dims["QueueName"] != testProject+"-"+testStack+"-"+fn+"-dlq" {
+			t.Errorf("%s: dead-letter alarm watches %v", fn, dims)
+		}
+	}
+
+	for _, s := range m.all("aws:scheduler/schedule:Schedule") {
+		target := s.Inputs["target"].(map[string]any)
+		if dlq, _ := target["deadLetterConfig"].(map[string]any); dlq["arn"] != queueARN("weekly-report-dlq") {
+			t.Errorf("%s: undeliverable events go to %v", s.Name, target["deadLetterConfig"])
+		}
+		if retry, _ := target["retryPolicy"].(map[string]any); retry["maximumRetryAttempts"] != float64(scheduleRetries) {
+			t.Errorf("%s: unexpected retry policy %v", s.Name, target["retryPolicy"])
+		}
+	}
+}
+
+// TestAccessPoliciesFollowManifests checks the policies generated from lambda/*/access.json.
+func TestAccessPoliciesFollowManifests(t *testing.T) {
+	m := runProgram(t, testConfig)
+
+	// grants maps each action to the resources a Lambda's policy allows it on
+	grants := func(suffix string) map[string][]string {
+		out := map[string][]string{}
+		for _, s := range parsePolicy(t, m.get(t, "aws:iam/rolePolicy:RolePolicy", suffix)).Statement {
+			for _, a := range s.Action {
+				out[a] = append(out[a], s.Resource...)
+			}
+		}
+		return out
+	}
+	arn := func(service, resource string) string {
+		return "arn:aws:" + service + ":" + testRegion + ":" + testAccount + ":" + resource
+	}
+
+	ingest := grants("loseit-ingest-access")
+	if want := []string{dataBucketARN + "/raw/email/user_id=*", dataBucketARN + "/raw/loseit_csv/*"}; !slices.Equal(ingest["s3:PutObject"], want) {
+		t.Errorf("email_ingest may write to %v, expected %v", ingest["s3:PutObject"], want)
+	}
+	if _, ok := ingest["s3:ListBucket"]; ok {
+		t.Error("email_ingest should not list the bucket")
+	}
+
+	transform := grants("loseit-transform-access")
+	if !slices.Equal(transform["s3:GetObject"], []string{dataBucketARN + "/raw/loseit_csv/*"}) ||
+		!slices.Equal(transform["s3:PutObject"], []string{dataBucketARN + "/curated/loseit_parquet/*"}) {
+		t.Errorf("unexpected transform grants %v", transform)
+	}
+
+	report := grants("weekly-report-access")
+	for action, want := range map[string]string{
+		"athena:StartQueryExecution":          arn("athena", "workgroup/mailmunch-test"),
+		"glue:GetTable":                       arn("glue", "table/mailmunch_test/loseit_loseit_parquet"),
+		"appconfig:GetLatestConfiguration":    arn("appconfig", "application/mailmunch-test-appcfg-id/environment/mailmunch-test-env-prod-id/configuration/mailmunch-test-profile-id"),
+		"ses:SendRawEmail":                    arn("ses", "identity/*"),
+		"s3:AbortMultipartUpload":             dataBucketARN + "/athena-results/*",
+		"secretsmanager:GetSecretValue":       arn("secretsmanager", "secret:mailmunch-test-notifier-secret"),
+		"appconfig:StartConfigurationSession": arn("appconfig", "application/mailmunch-test-appcfg-id/environment/mailmunch-test-env-prod-id/configuration/mailmunch-test-profile-id"),
+	} {
+		if !slices.Contains(report[action], want) {
+			t.Errorf("weekly_report: %s not allowed on %s (got %v)", action, want, report[action])
+		}
+	}
+	if slices.Contains(report["glue:GetTable"], arn("glue", "table/mailmunch_test/weekly_reports")) {
+		t.Error("weekly_report does not query the weekly_reports table")
+	}
+}
+
+// TestReportInvokesItselfPerUser checks weekly_report may start its own per-user runs and no
+// other function may invoke anything.
+func TestReportInvokesItselfPerUser(t *testing.T) {
+	m := runProgram(t, testConfig)
+
+	invoke := parsePolicy(t, m.get(t, "aws:iam/rolePolicy:RolePolicy", "weekly-report-invoke-self")).Statement
+	if len(invoke) != 1 || !slices.Equal(invoke[0].Action, stringList{"lambda:InvokeFunction"}) ||
+		!slices.Equal(invoke[0].Resource, stringList{functionARN("weekly-report")}) {
+		t.Errorf("unexpected invoke policy %+v", invoke)
+	}
+	for _, fn := range []string{"loseit-ingest", "loseit-transform", "report-reply"} {
+		for _, p := range m.all("aws:iam/rolePolicy:RolePolicy") {
+			if strings.HasSuffix(p.Name, fn+"-invoke-self") {
+				t.Errorf("%s may invoke itself", fn)
+			}
+		}
+	}
+}
+
+// TestWeeklyReportBucketAccess checks weekly_report lists only the prefixes it reads and
+// reads templates only from the s3_prefix in mailmunch:templates.
+func TestWeeklyReportBucketAccess(t *testing.T) {
+	access := func(config map[string]string) (list, get stringList) {
+		m := runProgram(t, config)
+		for _, s := range parsePolicy(t, m.get(t, "aws:iam/rolePolicy:RolePolicy", "weekly-report-access")).Statement {
+			if slices.Contains(s.Action, "s3:ListBucket") {
+				if len(s.Condition["StringLike"]["s3:prefix"]) == 0 {
+					t.Errorf("weekly_report may list the whole bucket")
+				}
+				list = append(list, s.Condition["StringLike"]["s3:prefix"]...)
+			}
+			if slices.Contains(s.Action, "s3:GetObject") {
+				get = append(get, s.Resource...)
+			}
+		}
+		slices.Sort(list)
+		return list, get
+	}
+
+	list, get := access(testConfig)
+	if want := (stringList{"athena-results/*", "curated/loseit_parquet/*", "raw/loseit_csv/*", "reports/*"}); !slices.Equal(list, want) {
+		t.Errorf("weekly_report lists %v, expected %v", list, want)
+	}
+	for _, r := range get {
+		if strings.Contains(r, "templates") {
+			t.Errorf("weekly_report reads templates from %s without templates in S3", r)
+		}
+	}
+
+	cfg := maps.Clone(testConfig)
+	cfg["templates"] = `{"version": "v2", "s3_prefix": "email-templates/v2"}`
+	list, get = access(cfg)
+	if !slices.Contains(list, "email-templates/v2/*") || !slices.Contains(get, dataBucketARN+"/email-templates/v2/*") {
+		t.Errorf("weekly_report cannot read templates under s3_prefix: list %v, get %v", list, get)
+	}
+}
+
+// TestReceiptRulesMatchTriggers checks SES stores mail where the Lambdas listen for it.
+func TestReceiptRulesMatchTriggers(t *testing.T) {
+	m := runProgram(t, testConfig)
+
+	for rule, fn := range map[string]string{"loseit-receipt-rule": "loseit-ingest", "reply-receipt-rule": "report-reply"} {
+		r := m.get(t, "aws:ses/receiptRule:ReceiptRule", rule)
+		actions := asList(r.Inputs["s3Actions"])
+		if len(actions) != 1 {
+			t.Fatalf("%s: expected one S3 action, got %v", rule, actions)
+		}
+		action := actions[0].(map[string]any)
+		if action["bucketName"] != "mailmunch-test-data" {
+			t.Errorf("%s: writes to bucket %v", rule, action["bucketName"])
+		}
+
+		if trigger := m.triggers(t)[functionARN(fn)]; action["objectKeyPrefix"] != trigger {
+			t.Errorf("%s: stores mail under %v but %s listens on %q", rule, action["objectKeyPrefix"], fn, trigger)
+		}
+	}
+
+	recipients := asList(m.get(t, "aws:ses/receiptRule:ReceiptRule", "loseit-receipt-rule").Inputs["recipients"])
+	for _, want := range []string{"loseit@example.com", "loseit+alex@example.com", "alex@example.org"} {
+		if !slices.Contains(recipients, any(want)) {
+			t.Errorf("LoseIt rule does not accept %s: %v", want, recipients)
+		}
+	}
+	reply := asList(m.get(t, "aws:ses/receiptRule:ReceiptRule", "reply-receipt-rule").Inputs["recipients"])
+	if !slices.Equal(reply, []any{"reports@example.com"}) {
+		t.Errorf("unexpected reply recipients %v", reply)
+	}
+}
+
+// TestSharedReceiptRuleSet checks only the stack that opts in to manage the account's receipt
+// rule set creates and activates it, and every stack adds its rules to that set.
+func TestSharedReceiptRuleSet(t *testing.T) {
+	cfg := maps.Clone(testConfig)
+	cfg["manageReceiptRuleSet"] = "true"
+	owner := runProgram(t, cfg)
+	set := owner.get(t, "aws:ses/receiptRuleSet:ReceiptRuleSet", "receipt-set")
+	if set.Inputs["ruleSetName"] != "mailmunch-receipt-set" {
+		t.Errorf("unexpected rule set name %v", set.Inputs["ruleSetName"])
+	}
+	if active := owner.get(t, "aws:ses/activeReceiptRuleSet:ActiveReceiptRuleSet", "receipt-active"); active.Inputs["ruleSetName"] != "mailmunch-receipt-set" {
+		t.Errorf("active rule set is %v", active.Inputs["ruleSetName"])
+	}
+
+	other := runProgram(t, testConfig)
+	if sets := other.all("aws:ses/receiptRuleSet:ReceiptRuleSet"); len(sets) != 0 {
+		t.Errorf("expected no rule set from a stack that does not manage it, got %d", len(sets))
+	}
+	if active := other.all("aws:ses/activeReceiptRuleSet:ActiveReceiptRuleSet"); len(active) != 0 {
+		t.Errorf("expected no active rule set from a stack that does not manage it, got %d", len(active))
+	}
+	for _, rule := range []string{"loseit-receipt-rule", "reply-receipt-rule"} {
+		if r := other.get(t, "aws:ses/receiptRule:ReceiptRule", rule); r.Inputs["ruleSetName"] != "mailmunch-receipt-set" {
+			t.Errorf("%s: added to rule set %v", rule, r.Inputs["ruleSetName"])
+		}
+	}
+}
+
+func TestNoInboxWithoutRecipient(t *testing.T) {
+	m := runProgram(t, map[string]string{})
+
+	if rules := m.all("aws:ses/receiptRule:ReceiptRule"); len(rules) != 0 {
+		t.Errorf("expected no receipt rules without mailmunch:recipientAddress, got %d", len(rules))
+	}
+	if sets := m.all("aws:ses/receiptRuleSet:ReceiptRuleSet"); len(sets) != 0 {
+		t.Errorf("expected no receipt rule set, got %d", len(sets))
+	}
+}
+
+// TestAthenaWorkgroupEnforcesResults checks queries cannot write results anywhere but the
+// lifecycle-managed, encrypted prefix, or scan more than the cutoff.
+func TestAthenaWorkgroupEnforcesResults(t *testing.T) {
+	cfg := maps.Clone(testConfig)
+	cfg["athenaBytesScannedCutoff"] = "104857600"
+	m := runProgram(t, cfg)
+
+	wg := m.get(t, "aws:athena/workgroup:Workgroup", "workgroup")
+	if wg.Inputs["name"] != "mailmunch-test" {
+		t.Errorf("unexpected workgroup name %v", wg.Inputs["name"])
+	}
+	conf := wg.Inputs["configuration"].(map[string]any)
+	if conf["enforceWorkgroupConfiguration"] != true || conf["publishCloudwatchMetricsEnabled"] != true {
+		t.Errorf("workgroup settings are not enforced or metrics are off: %v", conf)
+	}
+	if conf["bytesScannedCutoffPerQuery"] != float64(100<<20) {
+		t.Errorf("unexpected bytes scanned cutoff %v", conf["bytesScannedCutoffPerQuery"])
+	}
+	results := conf["resultConfiguration"].(map[string]any)
+	if results["outputLocation"] != "s3://mailmunch-test-data/athena-results/" {
+		t.Errorf("unexpected output location %v", results["outputLocation"])
+	}
+	if enc, _ := results["encryptionConfiguration"].(map[string]any); enc["encryptionOption"] != "SSE_KMS" || enc["kmsKeyArn"] != dataKeyARN {
+		t.Errorf("query results are not encrypted: %v", results["encryptionConfiguration"])
+	}
+}
+
+// TestFreshnessAlarm checks the alarm fires when loseit_transform has written no partition for
+// the configured window, including when it writes no metrics at all.
+func TestFreshnessAlarm(t *testing.T) {
+	cfg := maps.Clone(testConfig)
+	cfg["freshnessWindowHours"] = "72"
+	m := runProgram(t, cfg)
+
+	a := m.get(t, "aws:cloudwatch/metricAlarm:MetricAlarm", "freshness-alarm")
+	if a.Inputs["namespace"] != "mailmunch/test" || a.Inputs["metricName"] != "CuratedPartitionsWritten" {
+		t.Errorf("freshness alarm watches %v/%v", a.Inputs["namespace"], a.Inputs["metricName"])
+	}
+	if a.Inputs["period"] != float64(3600) || a.Inputs["evaluationPeriods"] != float64(72) || a.Inputs["datapointsToAlarm"] != float64(72) {
+		t.Errorf("expected a 72 hour window, got %v periods of %vs", a.Inputs["evaluationPeriods"], a.Inputs["period"])
+	}
+	if a.Inputs["comparisonOperator"] != "LessThanThreshold" || a.Inputs["treatMissingData"] != "breaching" {
+		t.Errorf("alarm does not fire on missing data: %v, %v", a.Inputs["comparisonOperator"], a.Inputs["treatMissingData"])
+	}
+	topic := "arn:aws:sns:" + testRegion + ":" + testAccount + ":mailmunch-test-alarms"
+	if actions := asList(a.Inputs["alarmActions"]); len(actions) != 1 || actions[0] != topic {
+		t.Errorf("freshness alarm notifies %v, expected the alarm topic", actions)
+	}
+}
+
+func TestSchedulesUseConfiguredTimezone(t *testing.T) {
+	m := runProgram(t, testConfig)
+
+	schedules := m.all("aws:scheduler/schedule:Schedule")
+	if len(schedules) != 4 {
+		t.Fatalf("expected weekly, monthly, quarterly and nudge schedules, got %d", len(schedules))
+	}
+	for _, s := range schedules {
+		if s.Inputs["scheduleExpressionTimezone"] != "America/New_York" {
+			t.Errorf("%s: timezone %v", s.Name, s.Inputs["scheduleExpressionTimezone"])
+		}
+		if target := s.Inputs["target"].(map[string]any); target["arn"] != functionARN("weekly-report") {
+			t.Errorf("%s: targets %v", s.Name, target["arn"])
+		}
+	}
+	// Weeks start on Sunday, so the weekly report runs on Saturday evening
+	weekly := m.get(t, "aws:scheduler/schedule:Schedule", "weekly-report-weekly-schedule")
+	if weekly.Inputs["scheduleExpression"] != "cron(0 18 ? * SAT *)" {
+		t.Errorf("unexpected weekly schedule %v", weekly.Inputs["scheduleExpression"])
+	}
+	// A quarter start gets the quarterly report alone rather than a monthly one too
+	monthly := m.get(t, "aws:scheduler/schedule:Schedule", "weekly-report-monthly-schedule")
+	quarterly := m.get(t, "aws:scheduler/schedule:Schedule", "weekly-report-quarterly-schedule")
+	if monthly.Inputs["scheduleExpression"] != "cron(0 9 1 2,3,5,6,8,9,11,12 ? *)" ||
+		quarterly.Inputs["scheduleExpression"] != "cron(0 10 1 1,4,7,10 ? *)" {
+		t.Errorf("unexpected monthly %v and quarterly %v schedules", monthly.Inputs["scheduleExpression"], quarterly.Inputs["scheduleExpression"])
+	}
+}
+
+func TestNudgeScheduleFollowsConfig(t *testing.T) {
+	m := runProgram(t, testConfig)
+	nudge := m.get(t, "aws:scheduler/schedule:Schedule", "weekly-report-nudge-schedule")
+	if nudge.Inputs["scheduleExpression"] != "cron(0 12 * * ? *)" {
+		t.Errorf("unexpected nudge schedule %v", nudge.Inputs["scheduleExpression"])
+	}
+	if input := nudge.Inputs["target"].(map[string]any)["input"].(string); !strings.Contains(input, `"detail":{"mode":"nudge"}`) {
+		t.Errorf("nudge schedule sends %s", input)
+	}
+	if env := m.env(t, "weekly-report"); env["NUDGE_AFTER_DAYS"] != "2" || env["DATA_BUCKET"] != "mailmunch-test-data" || env["RAW_CSV_BASE"] != "raw/loseit_csv/" {
+		t.Errorf("unexpected nudge environment %v", env)
+	}
+
+	cfg := maps.Clone(testConfig)
+	cfg["nudgeAfterDays"] = "0"
+	m = runProgram(t, cfg)
+	for _, s := range m.all("aws:scheduler/schedule:Schedule") {
+		if strings.Contains(s.Name, "nudge") {
+			t.Errorf("nudgeAfterDays 0 should turn the reminder off, found %s", s.Name)
+		}
+	}
+}
+
+func TestSenderMustNotReceiveExports(t *testing.T) {
+	for _, sender := range []string{"loseit@example.com", "Mailmunch <LoseIt+alice@example.com>", "alice@example.com"} {
+		t.Run(sender, func(t *testing.T) {
+			_, err := runStack(t, map[string]string{
+				"recipientAddress": "loseit@example.com",
+				"senderEmail":      sender,
+				"users":            `[{"id":"alice","report_email":"alice@example.com","ingest_address":"alice@example.com"}]`,
+			})
+			if err == nil {
+				t.Errorf("expected mailmunch:senderEmail %q to be rejected", sender)
+			}
+		})
+	}
+}
+
+func TestInvalidConfigFails(t *testing.T) {
+	for key, value := range map[string]string{
+		"goals":                    "{not json",
+		"timezone":                 "Mars/Olympus",
+		"weekStartDay":             "someday",
+		"users":                    `[{"id":"Bad ID","report_email":"x@example.com"}]`,
+		"athenaBytesScannedCutoff": "1000",
+		"freshnessWindowHours":     "200",
+		"nudgeAfterDays":           "60",
+		"dataBucketName":           "Mailmunch_Data",
+		"athenaDatabaseName":       "mailmunch-db",
+		"athenaWorkgroup":          "mailmunch workgroup",
+		"reportEmail":              "not an address",
+		"dailyCalorieTarget":       "lots",
+		"notifierSecrets":          `["not", "an", "object"]`,
+		"receiptRuleSetName":       "mailmunch rules",
+		"manageReceiptRuleSet":     "sometimes",
+		"pagesDistributionArn":     "E2EXAMPLE",
+		"templates":                `{"version": "v2", "s3_prefix": "/"}`,
+	} {
+		t.Run(key, func(t *testing.T) {
+			if _, err := runStack(t, map[string]string{key: value}); err == nil {
+				t.Errorf("expected mailmunch:%s %q to be rejected", key, value)
+			}
+		})
+	}
+}
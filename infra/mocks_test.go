@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	testProject = "mailmunch"
+	testStack   = "test"
+	testAccount = "123456789012"
+	testRegion  = "eu-west-2"
+)
+
+// mockResource is a resource the program registered, with the inputs it was given.
+type mockResource struct {
+	Type   string
+	Name   string
+	Inputs map[string]any
+}
+
+// mocks records every resource and answers the provider functions the program invokes.
+type mocks struct {
+	mu        sync.Mutex
+	resources []mockResource
+}
+
+func (m *mocks) NewResource(args pulumi.MockResourceArgs) (string, resource.PropertyMap, error) {
+	state := args.Inputs.Mappable()
+	if state == nil {
+		state = map[string]any{}
+	}
+	m.mu.Lock()
+	m.resources = append(m.resources, mockResource{Type: args.TypeToken, Name: args.Name, Inputs: args.Inputs.Mappable()})
+	m.mu.Unlock()
+
+	id := args.Name + "-id"
+	switch args.TypeToken {
+	case "aws:s3/bucket:Bucket":
+		if _, ok := state["bucket"]; !ok {
+			state["bucket"] = args.Name
+		}
+		state["arn"] = "arn:aws:s3:::" + state["bucket"].(string)
+		id = state["bucket"].(string)
+	case "aws:lambda/function:Function":
+		state["name"] = args.Name
+		state["arn"] = "arn:aws:lambda:" + testRegion + ":" + testAccount + ":function:" + args.Name
+	case "aws:iam/role:Role":
+		state["name"] = args.Name
+		state["arn"] = "arn:aws:iam::" + testAccount + ":role/" + args.Name
+	case "aws:sqs/queue:Queue":
+		state["name"] = args.Name
+		state["arn"] = "arn:aws:sqs:" + testRegion + ":" + testAccount + ":" + args.Name
+		state["url"] = "https://sqs." + testRegion + ".amazonaws.com/" + testAccount + "/" + args.Name
+	case "aws:sns/topic:Topic":
+		state["arn"] = "arn:aws:sns:" + testRegion + ":" + testAccount + ":" + args.Name
+	case "aws:kms/key:Key":
+		state["keyId"] = args.Name + "-id"
+		state["arn"] = "arn:aws:kms:" + testRegion + ":" + testAccount + ":key/" + args.Name + "-id"
+	case "aws:secretsmanager/secret:Secret":
+		state["arn"] = "arn:aws:secretsmanager:" + testRegion + ":" + testAccount + ":secret:" + args.Name
+	case "aws:appconfig/configurationProfile:ConfigurationProfile":
+		state["configurationProfileId"] = args.Name + "-id"
+	case "aws:appconfig/environment:Environment":
+		state["environmentId"] = args.Name + "-id"
+	case "aws:appconfig/hostedConfigurationVersion:HostedConfigurationVersion":
+		state["versionNumber"] = 1
+	case "aws:glue/catalogDatabase:CatalogDatabase", "aws:glue/catalogTable:CatalogTable":
+		state["arn"] = "arn:aws:glue:" + testRegion + ":" + testAccount + ":" + args.Name
+	}
+	return id, resource.NewPropertyMapFromMap(state), nil
+}
+
+func (m *mocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	switch args.Token {
+	case "aws:iam/getPolicyDocument:getPolicyDocument":
+		doc, err := renderPolicyDocument(args.Args.Mappable())
+		if err != nil {
+			return nil, err
+		}
+		return resource.NewPropertyMapFromMap(map[string]any{"json": doc}), nil
+	case "aws:index/getCallerIdentity:getCallerIdentity":
+		return resource.NewPropertyMapFromMap(map[string]any{
+			"accountId": testAccount,
+			"arn":       "arn:aws:iam::" + testAccount + ":user/test",
+			"userId":    "test",
+		}), nil
+	case "aws:index/getRegion:getRegion":
+		return resource.NewPropertyMapFromMap(map[string]any{"name": testRegion}), nil
+	}
+	return args.Args, nil
+}
+
+// renderPolicyDocument turns getPolicyDocument arguments into the JSON AWS would return.
+func renderPolicyDocument(args map[string]any) (string, error) {
+	var statements []map[string]any
+	for _, s := range asList(args["statements"]) {
+		stmt := s.(map[string]any)
+		out := map[string]any{"Effect": "Allow", "Action": stmt["actions"], "Resource": stmt["resources"]}
+		if effect, ok := stmt["effect"]; ok {
+			out["Effect"] = effect
+		}
+		if principals := asList(stmt["principals"]); len(principals) > 0 {
+			p := map[string]any{}
+			for _, pr := range principals {
+				pr := pr.(map[string]any)
+				p[pr["type"].(string)] = pr["identifiers"]
+			}
+			out["Principal"] = p
+		}
+		if conditions := asList(stmt["conditions"]); len(conditions) > 0 {
+			c := map[string]map[string]any{}
+			for _, cond := range conditions {
+				cond := cond.(map[string]any)
+				test := cond["test"].(string)
+				if c[test] == nil {
+					c[test] = map[string]any{}
+				}
+				c[test][cond["variable"].(string)] = cond["values"]
+			}
+			out["Condition"] = c
+		}
+		statements = append(statements, out)
+	}
+	b, err := json.Marshal(map[string]any{"Version": "2012-10-17", "Statement": statements})
+	return string(b), err
+}
+
+func asList(v any) []any {
+	l, _ := v.([]any)
+	return l
+}
+
+// runProgram runs the stack against the mocks with the given mailmunch:* config.
+func runProgram(t *testing.T, config map[string]string) *mocks {
+	t.Helper()
+	m, err := runStack(t, config)
+	if err != nil {
+		t.Fatalf("program failed: %v", err)
+	}
+	return m
+}
+
+func runStack(t *testing.T, config map[string]string) (*mocks, error) {
+	t.Helper()
+	full := map[string]string{}
+	for k, v := range config {
+		full["mailmunch:"+k] = v
+	}
+	b, err := json.Marshal(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(pulumi.EnvConfig, string(b))
+
+	m := &mocks{}
+	return m, pulumi.RunErr(run, pulumi.WithMocks(testProject, testStack, m))
+}
+
+// get returns the resource of type typ called <project>-<stack>-suffix.
+func (m *mocks) get(t *testing.T, typ, suffix string) mockResource {
+	t.Helper()
+	name := testProject + "-" + testStack + "-" + suffix
+	for _, r := range m.resources {
+		if r.Type == typ && r.Name == name {
+			return r
+		}
+	}
+	t.Fatalf("no %s named %s", typ, name)
+	return mockResource{}
+}
+
+func (m *mocks) all(typ string) []mockResource {
+	var out []mockResource
+	for _, r := range m.resources {
+		if r.Type == typ {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// env returns the environment variables of the Lambda called <project>-<stack>-suffix.
+func (m *mocks) env(t *testing.T, suffix string) map[string]any {
+	t.Helper()
+	fn := m.get(t, "aws:lambda/function:Function", suffix)
+	env, _ := fn.Inputs["environment"].(map[string]any)
+	vars, _ := env["variables"].(map[string]any)
+	return vars
+}
+
+// triggers maps the ARN of each Lambda fed by a stage queue to the key prefix S3 notifies
+// that queue about.
+func (m *mocks) triggers(t *testing.T) map[string]string {
+	t.Helper()
+	queued := map[string]string{}
+	notify := m.get(t, "aws:s3/bucketNotification:BucketNotification", "data-notify")
+	for _, q := range asList(notify.Inputs["queues"]) {
+		q := q.(map[string]any)
+		queued[q["queueArn"].(string)] = q["filterPrefix"].(string)
+	}
+	out := map[string]string{}
+	for _, esm := range m.all("aws:lambda/eventSourceMapping:EventSourceMapping") {
+		prefix, ok := queued[esm.Inputs["eventSourceArn"].(string)]
+		if !ok {
+			t.Errorf("%s: reads a queue S3 does not notify", esm.Name)
+		}
+		out[esm.Inputs["functionName"].(string)] = prefix
+	}
+	return out
+}
+
+// functionARN is the ARN the mocks give the Lambda called <project>-<stack>-suffix.
+func functionARN(suffix string) string {
+	return "arn:aws:lambda:" + testRegion + ":" + testAccount + ":function:" + testProject + "-" + testStack + "-" + suffix
+}
+
+// queueARN is the ARN the mocks give the SQS queue called <project>-<stack>-suffix.
+func queueARN(suffix string) string {
+	return "arn:aws:sqs:" + testRegion + ":" + testAccount + ":" + testProject + "-" + testStack + "-" + suffix
+}
+
+// policyDocument is an IAM policy; actions, resources, principals and condition values may be
+// a string or a list.
+type policyDocument struct {
+	Statement []policyStatement
+}
+
+type policyStatement struct {
+	Effect    string
+	Action    stringList
+	Resource  stringList
+	Principal map[string]stringList
+	Condition map[string]map[string]stringList
+}
+
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(b []byte) error {
+	if strings.HasPrefix(string(b), `"`) {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*l = stringList{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(l))
+}
+
+func parsePolicy(t *testing.T, r mockResource) policyDocument {
+	t.Helper()
+	raw, _ := r.Inputs["policy"].(string)
+	var doc policyDocument
+	if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+		t.Fatalf("%s: invalid policy %q: %v", r.Name, raw, err)
+	}
+	return doc
+}
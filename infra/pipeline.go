@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/s3"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// IngestPipelineArgs configures a data source delivered by email: SES stores messages under
+// IncomingPrefix, Ingest extracts the export into RawPrefix and Transform curates it from there.
+// A new source is one more pipeline with its own prefixes and Lambdas.
+type IngestPipelineArgs struct {
+	Bucket         *s3.Bucket
+	IncomingPrefix string
+	RawPrefix      string
+	Ingest         FunctionArgs
+	Transform      FunctionArgs
+}
+
+// IngestPipeline is the ingest and transform stages of one source.
+type IngestPipeline struct {
+	pulumi.ResourceState
+
+	Ingest    *TransformStage
+	Transform *TransformStage
+}
+
+// NewIngestPipeline creates the stages as <name>-ingest and <name>-transform.
+func NewIngestPipeline(ctx *pulumi.Context, name string, args *IngestPipelineArgs, opts ...pulumi.ResourceOption) (*IngestPipeline, error) {
+	pipeline := &IngestPipeline{}
+	if err := ctx.RegisterComponentResource("mailmunch:index:IngestPipeline", name, pipeline, opts...); err != nil {
+		return nil, err
+	}
+
+	var err error
+	pipeline.Ingest, err = NewTransformStage(ctx, name+"-ingest", &TransformStageArgs{
+		FunctionArgs:  args.Ingest,
+		Bucket:        args.Bucket,
+		TriggerPrefix: args.IncomingPrefix,
+	}, pulumi.Parent(pipeline))
+	if err != nil {
+		return nil, err
+	}
+	pipeline.Transform, err = NewTransformStage(ctx, name+"-transform", &TransformStageArgs{
+		FunctionArgs:  args.Transform,
+		Bucket:        args.Bucket,
+		TriggerPrefix: args.RawPrefix,
+	}, pulumi.Parent(pipeline))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.RegisterResourceOutputs(pipeline, pulumi.Map{
+		"ingestFunction":    pipeline.Ingest.Function.Name,
+		"transformFunction": pipeline.Transform.Function.Name,
+	}); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+// Notifications are the bucket notification entries for both stages.
+func (p *IngestPipeline) Notifications() s3.BucketNotificationQueueArray {
+	return s3.BucketNotificationQueueArray{p.Ingest.Notification(), p.Transform.Notification()}
+}
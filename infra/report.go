@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/lambda"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/scheduler"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/sqs"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// ReportTrigger is an EventBridge Scheduler schedule invoking the report Lambda with Input.
+type ReportTrigger struct {
+	Name        string // created as <component>-<Name>-schedule
+	Description string
+	Expression  string // cron() or rate(), evaluated in the component's timezone
+	Input       string
+}
+
+// ScheduledReportArgs configures a Lambda run on a schedule rather than by S3 events.
+type ScheduledReportArgs struct {
+	FunctionArgs
+	Timezone string // IANA name the schedule expressions are evaluated in
+	Triggers []ReportTrigger
+}
+
+// ScheduledReport is a report Lambda and the schedules that invoke it.
+type ScheduledReport struct {
+	pulumi.ResourceState
+
+	Role            *iam.Role
+	Function        *lambda.Function
+	DeadLetterQueue *sqs.Queue // events the schedules could not deliver, and runs that failed
+}
+
+const (
+	// scheduleRetries is how often EventBridge Scheduler retries handing an event to Lambda
+	// (when it is throttled, say) before sending it to the dead-letter queue. These retries
+	// happen before the function runs, so they cannot send a report twice.
+	scheduleRetries = 3
+	// reportRetries is zero because a report run that times out or crashes may already have
+	// delivered; its event goes straight to the dead-letter queue to be redriven by hand.
+	reportRetries = 0
+)
+
+func NewScheduledReport(ctx *pulumi.Context, name string, args *ScheduledReportArgs, opts ...pulumi.ResourceOption) (*ScheduledReport, error) {
+	report := &ScheduledReport{}
+	if err := ctx.RegisterComponentResource("mailmunch:index:ScheduledReport", name, report, opts...); err != nil {
+		return nil, err
+	}
+
+	f, err := newFunction(ctx, name, args.FunctionArgs, reportRetries, report)
+	if err != nil {
+		return nil, err
+	}
+	fn, dlq := f.Function, f.DeadLetterQueue
+	report.Role, report.Function, report.DeadLetterQueue = f.Role, fn, dlq
+
+	child := childOpts(report)
+	schedulerRole, err := iam.NewRole(ctx, name+"-scheduler-role", &iam.RoleArgs{
+		AssumeRolePolicy: pulumi.String(`{
+			"Version": "2012-10-17",
+			"Statement": [
+				{
+					"Effect": "Allow",
+					"Principal": {
+						"Service": "scheduler.amazonaws.com"
+					},
+					"Action": "sts:AssumeRole"
+				}
+			]
+		}`),
+	}, child...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lambda invoke policy for scheduler; it also sends undeliverable events to the DLQ with this role
+	invokePolicy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: iam.GetPolicyDocumentStatementArray{
+			iam.GetPolicyDocumentStatementArgs{
+				Effect:    pulumi.String("Allow"),
+				Actions:   pulumi.ToStringArray([]string{"lambda:InvokeFunction"}),
+				Resources: pulumi.StringArray{fn.Arn},
+			},
+			iam.GetPolicyDocumentStatementArgs{
+				Effect:    pulumi.String("Allow"),
+				Actions:   pulumi.ToStringArray([]string{"sqs:SendMessage"}),
+				Resources: pulumi.StringArray{dlq.Arn},
+			},
+		},
+	}, pulumi.Parent(report))
+	schedulerPolicy, err := iam.NewRolePolicy(ctx, name+"-scheduler-lambda", &iam.RolePolicyArgs{
+		Role:   schedulerRole.ID(),
+		Policy: invokePolicy.Json(),
+	}, child...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range args.Triggers {
+		_, err = scheduler.NewSchedule(ctx, fmt.Sprintf("%s-%s-schedule", name, t.Name), &scheduler.ScheduleArgs{
+			Description:                pulumi.String(t.Description),
+			ScheduleExpression:         pulumi.String(t.Expression),
+			ScheduleExpressionTimezone: pulumi.String(args.Timezone),
+			FlexibleTimeWindow: &scheduler.ScheduleFlexibleTimeWindowArgs{
+				Mode: pulumi.String("OFF"),
+			},
+			Target: &scheduler.ScheduleTargetArgs{
+				Arn:     fn.Arn,
+				RoleArn: schedulerRole.Arn,
+				Input:   pulumi.String(t.Input),
+				RetryPolicy: &scheduler.ScheduleTargetRetryPolicyArgs{
+					MaximumRetryAttempts:     pulumi.Int(scheduleRetries),
+					MaximumEventAgeInSeconds: pulumi.Int(asyncMaxEventAge),
+				},
+				DeadLetterConfig: &scheduler.ScheduleTargetDeadLetterConfigArgs{
+					Arn: dlq.Arn,
+				},
+			},
+		}, append(child, pulumi.DependsOn([]pulumi.Resource{schedulerPolicy}))...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ctx.RegisterResourceOutputs(report, pulumi.Map{
+		"functionName":       fn.Name,
+		"deadLetterQueueUrl": dlq.Url,
+	}); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// reportSchedule is when reports run. EventBridge Scheduler evaluates the cron expressions
+// in Timezone, so they follow daylight saving time instead of drifting by an hour.
+type reportSchedule struct {
+	Timezone  string       // IANA name, also the weekly_report default for users without one
+	WeekStart time.Weekday // first day of a reporting week
+}
+
+// loadReportSchedule reads mailmunch:timezone (default Europe/London) and
+// mailmunch:weekStartDay (default monday).
+func loadReportSchedule(ctx *pulumi.Context) (reportSchedule, error) {
+	s := reportSchedule{Timezone: "Europe/London", WeekStart: time.Monday}
+	if v, ok := ctx.GetConfig("mailmunch:timezone"); ok && v != "" {
+		if _, err := time.LoadLocation(v); err != nil {
+			return s, fmt.Errorf("invalid mailmunch:timezone: %w", err)
+		}
+		s.Timezone = v
+	}
+	if v, ok := ctx.GetConfig("mailmunch:weekStartDay"); ok && v != "" {
+		day, ok := parseWeekday(v)
+		if !ok {
+			return s, fmt.Errorf("invalid mailmunch:weekStartDay %q (want a day name such as monday)", v)
+		}
+		s.WeekStart = day
+	}
+	return s, nil
+}
+
+// weekStartDay is the WEEK_START_DAY value for weekly_report.
+func (s reportSchedule) weekStartDay() string {
+	return strings.ToLower(s.WeekStart.String())
+}
+
+// endOfWeekCron runs at hour:00 local time on the last day of each week, so the weekly
+// report covers the week that is just ending.
+func (s reportSchedule) endOfWeekCron(hour int) string {
+	lastDay := (s.WeekStart + 6) % 7
+	return fmt.Sprintf("cron(0 %d ? * %s *)", hour, strings.ToUpper(lastDay.String()[:3]))
+}
+
+func parseWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		day := strings.ToLower(d.String())
+		if name == day || name == day[:3] {
+			return d, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/cloudwatch"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/lambda"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/s3"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/sqs"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const lambdaAssumeRolePolicy = `{
+	"Version": "2012-10-17",
+	"Statement": [
+		{
+			"Effect": "Allow",
+			"Principal": {
+				"Service": "lambda.amazonaws.com"
+			},
+			"Action": "sts:AssumeRole"
+		}
+	]
+}`
+
+// FunctionArgs describes one of the Go Lambdas under lambda/, deployed from ../dist/<Package>.zip
+// with its own role.
+type FunctionArgs struct {
+	Package     string // directory under lambda/ and name of the zip built by make
+	Timeout     int    // seconds; the Lambda default when zero
+	Environment pulumi.StringMap
+	Policies    []RolePolicy       // inline policies on top of basic execution (CloudWatch Logs)
+	InvokeSelf  bool               // the function invokes itself, see invoke_self in access.json
+	AlarmTopic  pulumi.StringInput // SNS topic the failure alarms notify; the alarms have no actions when nil
+}
+
+const (
+	// asyncRetries is how many times Lambda retries a failed asynchronous invocation of a stage
+	// before sending the event to the dead-letter queue.
+	asyncRetries = 2
+	// asyncMaxEventAge sends events Lambda could not run within an hour (while throttled, for
+	// instance) to the dead-letter queue, so they alarm sooner than after the default six hours.
+	asyncMaxEventAge = 60 * 60
+	// deadLetterRetention is the longest SQS keeps a message: 14 days to redrive it.
+	deadLetterRetention = 14 * 24 * 60 * 60
+)
+
+// RolePolicy is an inline IAM policy, created as <component>-<Name>.
+type RolePolicy struct {
+	Name     string
+	Document pulumi.StringInput
+}
+
+// childOpts parents a resource to a component. The alias keeps resources that were created at
+// the top of the stack before the components existed from being replaced.
+func childOpts(parent pulumi.Resource) []pulumi.ResourceOption {
+	return []pulumi.ResourceOption{
+		pulumi.Parent(parent),
+		pulumi.Aliases([]pulumi.Alias{{NoParent: pulumi.Bool(true)}}),
+	}
+}
+
+// function is a deployed Lambda and the resources it was created with.
+type function struct {
+	Role            *iam.Role
+	Function        *lambda.Function
+	DeadLetterQueue *sqs.Queue
+}
+
+// newFunction creates the role, its policies and the Lambda function called name. Events the
+// function still fails on after the given number of asynchronous retries end up in its
+// dead-letter queue, and an alarm fires on errors and on anything waiting in the queue.
+func newFunction(ctx *pulumi.Context, name string, args FunctionArgs, retries int, parent pulumi.Resource) (*function, error) {
+	opts := childOpts(parent)
+	role, err := iam.NewRole(ctx, name+"-role", &iam.RoleArgs{
+		AssumeRolePolicy: pulumi.String(lambdaAssumeRolePolicy),
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	_, err = iam.NewRolePolicyAttachment(ctx, name+"-basic", &iam.RolePolicyAttachmentArgs{
+		Role:      role.Name,
+		PolicyArn: pulumi.String("arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"),
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range args.Policies {
+		_, err = iam.NewRolePolicy(ctx, name+"-"+p.Name, &iam.RolePolicyArgs{
+			Role:   role.ID(),
+			Policy: p.Document,
+		}, opts...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dlq, err := sqs.NewQueue(ctx, name+"-dlq", &sqs.QueueArgs{
+		MessageRetentionSeconds: pulumi.Int(deadLetterRetention),
+		SqsManagedSseEnabled:    pulumi.Bool(true),
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Lambda sends failed events to the on-failure destination with the function's own role
+	sendPolicy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: iam.GetPolicyDocumentStatementArray{
+			iam.GetPolicyDocumentStatementArgs{
+				Effect:    pulumi.String("Allow"),
+				Actions:   pulumi.ToStringArray([]string{"sqs:SendMessage"}),
+				Resources: pulumi.StringArray{dlq.Arn},
+			},
+		},
+	}, pulumi.Parent(parent))
+	dlqPolicy, err := iam.NewRolePolicy(ctx, name+"-dlq-send", &iam.RolePolicyArgs{
+		Role:   role.ID(),
+		Policy: sendPolicy.Json(),
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	fnArgs := &lambda.FunctionArgs{
+		Role:          role.Arn,
+		Runtime:       pulumi.String("provided.al2"),
+		Handler:       pulumi.String("bootstrap"),
+		Architectures: pulumi.ToStringArray([]string{"arm64"}),
+		Code:          pulumi.NewFileArchive(fmt.Sprintf("../dist/%s.zip", args.Package)),
+		Environment: &lambda.FunctionEnvironmentArgs{
+			Variables: args.Environment,
+		},
+	}
+	if args.Timeout > 0 {
+		fnArgs.Timeout = pulumi.Int(args.Timeout)
+	}
+	fn, err := lambda.NewFunction(ctx, name, fnArgs, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if args.InvokeSelf {
+		invokePolicy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+			Statements: iam.GetPolicyDocumentStatementArray{
+				iam.GetPolicyDocumentStatementArgs{
+					Effect:    pulumi.String("Allow"),
+					Actions:   pulumi.ToStringArray([]string{"lambda:InvokeFunction"}),
+					Resources: pulumi.StringArray{fn.Arn},
+				},
+			},
+		}, pulumi.Parent(parent))
+		_, err = iam.NewRolePolicy(ctx, name+"-invoke-self", &iam.RolePolicyArgs{
+			Role:   role.ID(),
+			Policy: invokePolicy.Json(),
+		}, opts...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Lambda checks the role can send to the destination when the config is saved
+	_, err = lambda.NewFunctionEventInvokeConfig(ctx, name+"-async", &lambda.FunctionEventInvokeConfigArgs{
+		FunctionName:             fn.Name,
+		MaximumRetryAttempts:     pulumi.Int(retries),
+		MaximumEventAgeInSeconds: pulumi.Int(asyncMaxEventAge),
+		DestinationConfig: &lambda.FunctionEventInvokeConfigDestinationConfigArgs{
+			OnFailure: &lambda.FunctionEventInvokeConfigDestinationConfigOnFailureArgs{
+				Destination: dlq.Arn,
+			},
+		},
+	}, append(opts, pulumi.DependsOn([]pulumi.Resource{dlqPolicy}))...)
+	if err != nil {
+		return nil, err
+	}
+
+	var actions pulumi.Array
+	if args.AlarmTopic != nil {
+		actions = pulumi.Array{args.AlarmTopic}
+	}
+	_, err = cloudwatch.NewMetricAlarm(ctx, name+"-errors-alarm", &cloudwatch.MetricAlarmArgs{
+		AlarmDescription:   pulumi.Sprintf("%s returned an error", fn.Name),
+		Namespace:          pulumi.String("AWS/Lambda"),
+		MetricName:         pulumi.String("Errors"),
+		Dimensions:         pulumi.StringMap{"FunctionName": fn.Name},
+		Statistic:          pulumi.String("Sum"),
+		Period:             pulumi.Int(300),
+		EvaluationPeriods:  pulumi.Int(1),
+		Threshold:          pulumi.Float64(1),
+		ComparisonOperator: pulumi.String("GreaterThanOrEqualToThreshold"),
+		TreatMissingData:   pulumi.String("notBreaching"),
+		AlarmActions:       actions,
+		OkActions:          actions,
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	_, err = cloudwatch.NewMetricAlarm(ctx, name+"-dlq-alarm", &cloudwatch.MetricAlarmArgs{
+		AlarmDescription:   pulumi.Sprintf("%s gave up on an event; redrive it from %s once fixed", fn.Name, dlq.Url),
+		Namespace:          pulumi.String("AWS/SQS"),
+		MetricName:         pulumi.String("ApproximateNumberOfMessagesVisible"),
+		Dimensions:         pulumi.StringMap{"QueueName": dlq.Name},
+		Statistic:          pulumi.String("Maximum"),
+		Period:             pulumi.Int(300),
+		EvaluationPeriods:  pulumi.Int(1),
+		Threshold:          pulumi.Float64(1),
+		ComparisonOperator: pulumi.String("GreaterThanOrEqualToThreshold"),
+		TreatMissingData:   pulumi.String("notBreaching"),
+		AlarmActions:       actions,
+		OkActions:          actions,
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &function{Role: role, Function: fn, DeadLetterQueue: dlq}, nil
+}
+
+// TransformStageArgs configures a Lambda that runs for every object created under
+// TriggerPrefix in Bucket.
+type TransformStageArgs struct {
+	FunctionArgs
+	Bucket        *s3.Bucket
+	TriggerPrefix string
+}
+
+const (
+	// stageBatchSize and stageBatchWindow let a burst of uploads, such as a backfill, reach the
+	// function in batches of up to ten notifications rather than one invocation per object.
+	stageBatchSize   = 10
+	stageBatchWindow = 5
+	// stageMaxConcurrency caps the concurrent invocations a stage's queue drives; the rest of
+	// a burst waits in the queue instead of being throttled.
+	stageMaxConcurrency = 5
+	// stageMaxReceives is how often a notification is tried before it moves to the
+	// dead-letter queue.
+	stageMaxReceives = 5
+)
+
+// TransformStage is one S3-triggered processing step. S3 notifies the stage's SQS queue, which
+// buffers bursts and retries each notification the function reports as failed. A bucket has a
+// single notification configuration, so the stage does not create it; pass Notification() to
+// the bucket's s3.BucketNotification instead.
+type TransformStage struct {
+	pulumi.ResourceState
+
+	Role            *iam.Role
+	Function        *lambda.Function
+	Queue           *sqs.Queue
+	DeadLetterQueue *sqs.Queue
+	TriggerPrefix   string
+}
+
+func NewTransformStage(ctx *pulumi.Context, name string, args *TransformStageArgs, opts ...pulumi.ResourceOption) (*TransformStage, error) {
+	if args.TriggerPrefix == "" {
+		return nil, fmt.Errorf("%s: TriggerPrefix is required", name)
+	}
+	stage := &TransformStage{TriggerPrefix: args.TriggerPrefix}
+	if err := ctx.RegisterComponentResource("mailmunch:index:TransformStage", name, stage, opts...); err != nil {
+		return nil, err
+	}
+
+	f, err := newFunction(ctx, name, args.FunctionArgs, asyncRetries, stage)
+	if err != nil {
+		return nil, err
+	}
+	fn := f.Function
+	stage.Role, stage.Function, stage.DeadLetterQueue = f.Role, fn, f.DeadLetterQueue
+
+	child := childOpts(stage)
+	// Lambda needs the visibility timeout to be at least the function timeout; AWS recommends
+	// six times it, so a batch can be retried within a single receive
+	timeout := args.Timeout
+	if timeout == 0 {
+		timeout = 3
+	}
+	queue, err := sqs.NewQueue(ctx, name+"-queue", &sqs.QueueArgs{
+		VisibilityTimeoutSeconds: pulumi.Int(max(30, 6*timeout+stageBatchWindow)),
+		SqsManagedSseEnabled:     pulumi.Bool(true),
+		RedrivePolicy: pulumi.Sprintf(`{"deadLetterTargetArn":%q,"maxReceiveCount":%d}`,
+			f.DeadLetterQueue.Arn, stageMaxReceives),
+	}, child...)
+	if err != nil {
+		return nil, err
+	}
+	stage.Queue = queue
+
+	// Only notifications from the bucket may be sent to the queue
+	queuePolicy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: iam.GetPolicyDocumentStatementArray{
+			iam.GetPolicyDocumentStatementArgs{
+				Effect:    pulumi.String("Allow"),
+				Actions:   pulumi.ToStringArray([]string{"sqs:SendMessage"}),
+				Resources: pulumi.StringArray{queue.Arn},
+				Principals: iam.GetPolicyDocumentStatementPrincipalArray{
+					iam.GetPolicyDocumentStatementPrincipalArgs{
+						Type:        pulumi.String("Service"),
+						Identifiers: pulumi.ToStringArray([]string{"s3.amazonaws.com"}),
+					},
+				},
+				Conditions: iam.GetPolicyDocumentStatementConditionArray{
+					iam.GetPolicyDocumentStatementConditionArgs{
+						Test:     pulumi.String("ArnEquals"),
+						Variable: pulumi.String("aws:SourceArn"),
+						Values:   pulumi.StringArray{args.Bucket.Arn},
+					},
+				},
+			},
+		},
+	}, pulumi.Parent(stage))
+	_, err = sqs.NewQueuePolicy(ctx, name+"-queue-policy", &sqs.QueuePolicyArgs{
+		QueueUrl: queue.Url,
+		Policy:   queuePolicy.Json(),
+	}, child...)
+	if err != nil {
+		return nil, err
+	}
+
+	consumePolicy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: iam.GetPolicyDocumentStatementArray{
+			iam.GetPolicyDocumentStatementArgs{
+				Effect:    pulumi.String("Allow"),
+				Actions:   pulumi.ToStringArray([]string{"sqs:ReceiveMessage", "sqs:DeleteMessage", "sqs:GetQueueAttributes", "sqs:ChangeMessageVisibility"}),
+				Resources: pulumi.StringArray{queue.Arn},
+			},
+		},
+	}, pulumi.Parent(stage))
+	consume, err := iam.NewRolePolicy(ctx, name+"-queue-consume", &iam.RolePolicyArgs{
+		Role:   f.Role.ID(),
+		Policy: consumePolicy.Json(),
+	}, child...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lambda checks the role can read the queue when the mapping is created
+	_, err = lambda.NewEventSourceMapping(ctx, name+"-events", &lambda.EventSourceMappingArgs{
+		EventSourceArn:                 queue.Arn,
+		FunctionName:                   fn.Arn,
+		BatchSize:                      pulumi.Int(stageBatchSize),
+		MaximumBatchingWindowInSeconds: pulumi.Int(stageBatchWindow),
+		FunctionResponseTypes:          pulumi.ToStringArray([]string{"ReportBatchItemFailures"}),
+		ScalingConfig: &lambda.EventSourceMappingScalingConfigArgs{
+			MaximumConcurrency: pulumi.Int(stageMaxConcurrency),
+		},
+	}, append(child, pulumi.DependsOn([]pulumi.Resource{consume}))...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.RegisterResourceOutputs(stage, pulumi.Map{
+		"functionName":       fn.Name,
+		"queueUrl":           queue.Url,
+		"deadLetterQueueUrl": f.DeadLetterQueue.Url,
+		"triggerPrefix":      pulumi.String(args.TriggerPrefix),
+	}); err != nil {
+		return nil, err
+	}
+	return stage, nil
+}
+
+// Notification is the bucket notification entry that queues work for the stage.
+func (s *TransformStage) Notification() *s3.BucketNotificationQueueArgs {
+	return &s3.BucketNotificationQueueArgs{
+		QueueArn:     s.Queue.Arn,
+		Events:       pulumi.ToStringArray([]string{"s3:ObjectCreated:*"}),
+		FilterPrefix: pulumi.String(s.TriggerPrefix),
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// defaultUserID owns mail sent to the plain recipient address and data ingested before
+// per-user partitioning.
+const defaultUserID = "default"
+
+var userIDPattern = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+// reportUser is a user registry entry as published to AppConfig for weekly_report.
+type reportUser struct {
+	ID          string          `json:"id"`
+	ReportEmail string          `json:"report_email,omitempty"`
+	Timezone    string          `json:"timezone,omitempty"`
+	Goals       json.RawMessage `json:"goals,omitempty"`    // passed through; weekly_report owns the schema
+	Channels    json.RawMessage `json:"channels,omitempty"` // likewise
+}
+
+// householdUser is one entry of the mailmunch:users config. IngestAddress is an extra
+// address SES accepts for the user besides the <recipient>+<id>@ plus-address.
+type householdUser struct {
+	reportUser
+	IngestAddress string `json:"ingest_address,omitempty"`
+}
+
+// loadUsers reads the optional mailmunch:users JSON array.
+func loadUsers(ctx *pulumi.Context) ([]householdUser, error) {
+	raw, ok := ctx.GetConfig("mailmunch:users")
+	if !ok || strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var users []householdUser
+	if err := json.Unmarshal([]byte(raw), &users); err != nil {
+		return nil, fmt.Errorf("invalid mailmunch:users: %w", err)
+	}
+	seen := map[string]bool{}
+	for _, u := range users {
+		if !userIDPattern.MatchString(u.ID) {
+			return nil, fmt.Errorf("invalid mailmunch:users id %q (want lower-case letters, digits, _ or -)", u.ID)
+		}
+		if seen[u.ID] {
+			return nil, fmt.Errorf("duplicate mailmunch:users id %q", u.ID)
+		}
+		seen[u.ID] = true
+		if u.ReportEmail == "" && len(u.Channels) == 0 {
+			return nil, fmt.Errorf("mailmunch:users entry %q has no report_email or channels", u.ID)
+		}
+	}
+	return users, nil
+}
+
+// registry returns the users as stored in AppConfig.
+func registry(users []householdUser) []reportUser {
+	out := make([]reportUser, 0, len(users))
+	for _, u := range users {
+		out = append(out, u.reportUser)
+	}
+	return out
+}
+
+// userAddresses maps each explicit ingest address to its user ID for email_ingest.
+func userAddresses(users []householdUser) (string, error) {
+	m := map[string]string{}
+	for _, u := range users {
+		if u.IngestAddress != "" {
+			m[strings.ToLower(u.IngestAddress)] = u.ID
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// receiptRecipients lists every address the SES receipt rule accepts: the recipient
+// itself, a plus-address per user, and any explicit ingest addresses.
+func receiptRecipients(recipient string, users []householdUser) []string {
+	local, domain, _ := strings.Cut(recipient, "@")
+	addrs := []string{recipient}
+	for _, u := range users {
+		if u.ID != defaultUserID {
+			addrs = append(addrs, fmt.Sprintf("%s+%s@%s", local, u.ID, domain))
+		}
+		if u.IngestAddress != "" {
+			addrs = append(addrs, u.IngestAddress)
+		}
+	}
+	return addrs
+}
+
+// receivesExports reports whether addr is the recipient, any plus-address of it or a user's
+// ingest address.
+func receivesExports(addr, recipient string, users []householdUser) bool {
+	for _, r := range receiptRecipients(recipient, users) {
+		if strings.EqualFold(addr, r) {
+			return true
+		}
+	}
+	local, domain, _ := strings.Cut(recipient, "@")
+	addrLocal, addrDomain, _ := strings.Cut(addr, "@")
+	return strings.EqualFold(addrDomain, domain) && strings.HasPrefix(strings.ToLower(addrLocal), strings.ToLower(local)+"+")
+}
+
+// bareAddress returns the address part of e.g. "MailMunch <reports@example.com>", or "".
+func bareAddress(addr string) string {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return ""
+	}
+	return parsed.Address
+}
+
+// userIDs lists the values for the reports table's user_id partition projection.
+func userIDs(users []householdUser) string {
+	ids := []string{defaultUserID}
+	for _, u := range users {
+		if u.ID != defaultUserID {
+			ids = append(ids, u.ID)
+		}
+	}
+	return strings.Join(ids, ",")
+}
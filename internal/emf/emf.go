@@ -0,0 +1,61 @@
+// Package emf writes CloudWatch metrics in Embedded Metric Format. Lambda sends stdout to
+// CloudWatch Logs, which extracts the metrics into the namespace in METRICS_NAMESPACE.
+package emf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Out receives the EMF records. Tests replace it, see emftest.
+var Out io.Writer = os.Stdout
+
+// Metric is one value in an EMF record; Unit is a CloudWatch unit such as Count.
+type Metric struct {
+	Name  string
+	Value float64
+	Unit  string
+}
+
+// Count is a metric counting n things.
+func Count(name string, n float64) Metric {
+	return Metric{Name: name, Value: n, Unit: "Count"}
+}
+
+// Milliseconds is a metric timing something that took d.
+func Milliseconds(name string, d time.Duration) Metric {
+	return Metric{Name: name, Value: float64(d.Milliseconds()), Unit: "Milliseconds"}
+}
+
+// Put writes one EMF record holding metrics, without dimensions. Nothing is written without
+// METRICS_NAMESPACE, which infra sets per stack, so stacks never share metrics.
+func Put(metrics ...Metric) {
+	namespace := os.Getenv("METRICS_NAMESPACE")
+	if namespace == "" {
+		return
+	}
+	record := map[string]any{}
+	defs := make([]map[string]string, 0, len(metrics))
+	for _, m := range metrics {
+		record[m.Name] = m.Value
+		defs = append(defs, map[string]string{"Name": m.Name, "Unit": m.Unit})
+	}
+	record["_aws"] = map[string]any{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]any{{
+			"Namespace":  namespace,
+			"Dimensions": [][]string{{}},
+			"Metrics":    defs,
+		}},
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("warn: encode metrics: %v", err)
+		return
+	}
+	fmt.Fprintln(Out, string(b))
+}
@@ -0,0 +1,67 @@
+package emf_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/duderman/mailmunch/internal/emf"
+	"github.com/duderman/mailmunch/internal/emf/emftest"
+)
+
+func TestPutWritesEMF(t *testing.T) {
+	out := emftest.Capture(t)
+
+	emf.Put(emf.Count("EmailsReceived", 1), emf.Milliseconds("ReportLatency", 0))
+
+	var record struct {
+		AWS struct {
+			Timestamp         int64
+			CloudWatchMetrics []struct {
+				Namespace  string
+				Dimensions [][]string
+				Metrics    []struct{ Name, Unit string }
+			}
+		} `json:"_aws"`
+		EmailsReceived *float64
+		ReportLatency  *float64
+	}
+	if err := json.Unmarshal([]byte(out.String()), &record); err != nil {
+		t.Fatalf("decode %q: %v", out.String(), err)
+	}
+	if record.AWS.Timestamp == 0 || len(record.AWS.CloudWatchMetrics) != 1 {
+		t.Fatalf("missing EMF metadata: %s", out)
+	}
+	directive := record.AWS.CloudWatchMetrics[0]
+	if directive.Namespace != "mailmunch/test" || len(directive.Dimensions) != 1 || len(directive.Dimensions[0]) != 0 {
+		t.Errorf("unexpected namespace or dimensions: %s", out)
+	}
+	if len(directive.Metrics) != 2 || directive.Metrics[0].Name != "EmailsReceived" || directive.Metrics[0].Unit != "Count" ||
+		directive.Metrics[1].Name != "ReportLatency" || directive.Metrics[1].Unit != "Milliseconds" {
+		t.Errorf("unexpected metric definitions %+v", directive.Metrics)
+	}
+	if record.EmailsReceived == nil || *record.EmailsReceived != 1 || record.ReportLatency == nil || *record.ReportLatency != 0 {
+		t.Errorf("unexpected values: %s", out)
+	}
+}
+
+func TestPutNeedsNamespace(t *testing.T) {
+	out := emftest.Capture(t)
+	t.Setenv("METRICS_NAMESPACE", "")
+
+	emf.Put(emf.Count("EmailsReceived", 1))
+	if out.String() != "" {
+		t.Errorf("expected no metrics without METRICS_NAMESPACE, got %s", out)
+	}
+}
+
+func TestRecorderTotals(t *testing.T) {
+	out := emftest.Capture(t)
+
+	emf.Put(emf.Count("EmailsReceived", 1), emf.Count("EmailsClassified", 0))
+	emf.Put(emf.Count("EmailsReceived", 1))
+
+	totals := out.Totals()
+	if len(totals) != 2 || totals["EmailsReceived"] != 2 || totals["EmailsClassified"] != 0 {
+		t.Errorf("unexpected totals %v", totals)
+	}
+}
@@ -0,0 +1,54 @@
+// Package emftest captures the metrics a Lambda writes through emf in its tests.
+package emftest
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/duderman/mailmunch/internal/emf"
+)
+
+// Recorder holds the EMF records written since Capture.
+type Recorder struct {
+	t   *testing.T
+	buf bytes.Buffer
+}
+
+// Capture sends emf records to a Recorder under the mailmunch/test namespace until the test ends.
+func Capture(t *testing.T) *Recorder {
+	t.Helper()
+	t.Setenv("METRICS_NAMESPACE", "mailmunch/test")
+	r := &Recorder{t: t}
+	old := emf.Out
+	emf.Out = &r.buf
+	t.Cleanup(func() { emf.Out = old })
+	return r
+}
+
+// String returns the records as written, one JSON object per line.
+func (r *Recorder) String() string {
+	return r.buf.String()
+}
+
+// Totals sums each metric across the records.
+func (r *Recorder) Totals() map[string]float64 {
+	r.t.Helper()
+	totals := map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSpace(r.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			r.t.Fatalf("metrics line is not JSON: %q", line)
+		}
+		for name, v := range record {
+			if f, ok := v.(float64); ok {
+				totals[name] += f
+			}
+		}
+	}
+	return totals
+}
@@ -0,0 +1,3 @@
+module github.com/duderman/mailmunch/internal/emf
+
+go 1.22
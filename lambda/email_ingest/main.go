@@ -3,6 +3,9 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -20,7 +23,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
-	"github.com/google/uuid"
+	"github.com/duderman/mailmunch/internal/emf"
 	"github.com/jhillyerd/enmime"
 )
 
@@ -28,7 +31,6 @@ import (
 type s3API interface {
 	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
-	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
 }
 
 var newS3Client = func(ctx context.Context) (s3API, error) {
@@ -50,18 +52,38 @@ func main() {
 	lambda.Start(handler)
 }
 
-func handler(ctx context.Context, evt events.S3Event) error {
+// handler processes S3 notifications delivered through the stage's SQS queue. Messages whose
+// emails fail are reported as batch item failures, so SQS retries only those and moves them to
+// the dead-letter queue once they have failed too often.
+func handler(ctx context.Context, evt events.SQSEvent) (events.SQSEventResponse, error) {
+	var resp events.SQSEventResponse
 	bucketName := os.Getenv("EMAIL_BUCKET")
 	if bucketName == "" {
-		return fmt.Errorf("EMAIL_BUCKET env var is required")
+		return resp, fmt.Errorf("EMAIL_BUCKET env var is required")
 	}
 	incomingPrefix := envOr("INCOMING_PREFIX", "raw/email/incoming/")
 
 	s3c, err := newS3Client(ctx)
 	if err != nil {
-		return fmt.Errorf("load aws config: %w", err)
+		return resp, fmt.Errorf("load aws config: %w", err)
 	}
 
+	for _, msg := range evt.Records {
+		if err := processMessage(ctx, s3c, incomingPrefix, msg); err != nil {
+			log.Printf("error processing message %s: %v", msg.MessageId, err)
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: msg.MessageId})
+		}
+	}
+	return resp, nil
+}
+
+// processMessage processes the emails in one S3 notification.
+func processMessage(ctx context.Context, s3c s3API, incomingPrefix string, msg events.SQSMessage) error {
+	var evt events.S3Event
+	if err := json.Unmarshal([]byte(msg.Body), &evt); err != nil {
+		return fmt.Errorf("parse s3 event: %w", err)
+	}
+	// S3's test event when the notification is configured has no records
 	for _, rec := range evt.Records {
 		b := rec.S3.Bucket.Name
 		k, err := urlDecode(rec.S3.Object.Key)
@@ -75,8 +97,7 @@ func handler(ctx context.Context, evt events.S3Event) error {
 		}
 
 		if err := processEmail(ctx, s3c, b, k); err != nil {
-			log.Printf("error processing email %s/%s: %v", b, k, err)
-			// Continue processing other emails rather than failing the entire batch
+			return fmt.Errorf("process email %s/%s: %w", b, k, err)
 		}
 	}
 	return nil
@@ -106,20 +127,25 @@ func processEmail(ctx context.Context, s3c s3API, bucketName, key string) error
 	// Check if email is from LoseIt - return early if not
 	if !isLoseItEmailContent(msg) {
 		log.Printf("info: email not from LoseIt domain or doesn't match LoseIt patterns, ignoring")
+		emf.Put(emf.Count("EmailsReceived", 1), emf.Count("EmailsClassified", 0))
 		return nil
 	}
 
 	log.Printf("info: processing LoseIt email")
 
+	// Keys derive from the email itself so a redelivered message overwrites what it wrote before
 	messageID := sanitizeMessageID(msg)
 	if messageID == "" {
-		messageID = uuid.New().String()
+		sum := sha256.Sum256(rawBytes)
+		messageID = hex.EncodeToString(sum[:16])
 	}
 	dt := dateFromMessage(msg)
+	userID := newUserResolver().userID(msg)
+	log.Printf("info: email belongs to user %s", userID)
 
-	// Always write raw EML to partitioned path raw/email/year=YYYY/month=MM/day=DD/<messageID>.eml
+	// Always write raw EML to partitioned path raw/email/user_id=ID/year=YYYY/month=MM/day=DD/<messageID>.eml
 	year, month, day := dateParts(dt)
-	rawKey := fmt.Sprintf("%syear=%s/month=%s/day=%s/%s.eml", rawEmailBase, year, month, day, messageID)
+	rawKey := fmt.Sprintf("%suser_id=%s/year=%s/month=%s/day=%s/%s.eml", rawEmailBase, userID, year, month, day, messageID)
 	if _, err := s3c.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:      &bucketName,
 		Key:         &rawKey,
@@ -131,10 +157,12 @@ func processEmail(ctx context.Context, s3c s3API, bucketName, key string) error
 	}
 
 	// Extract CSV attachments using enmime
+	extracted := 0
 	env, err := enmime.ReadEnvelope(bytes.NewReader(rawBytes))
 	if err != nil {
 		log.Printf("warn: enmime parse failed (%v); continuing with raw only", err)
 	} else {
+		used := map[string]bool{}
 		for _, a := range env.Attachments {
 			ctype, _, _ := mime.ParseMediaType(a.ContentType)
 			name := a.FileName
@@ -144,15 +172,15 @@ func processEmail(ctx context.Context, s3c s3API, bucketName, key string) error
 					log.Printf("warn: attachment %s has no content", name)
 					continue
 				}
-				// Desired path: raw/loseit_csv/year=YYYY/month=MM/day=DD/loseit-daily.csv (immutable)
-				// To avoid collisions if multiple emails per day, append index if key exists.
+				// Path: raw/loseit_csv/user_id=ID/year=YYYY/month=MM/day=DD/<messageID>-loseit-daily.csv.
+				// The message ID keeps several emails on one day apart; attachments sharing a name
+				// within one email get -2, -3, ... in the order they appear.
 				baseName := "loseit-daily.csv"
 				if sn := strings.TrimSpace(name); sn != "" {
 					baseName = sanitizeFilename(sn)
 				}
-				csvKey := fmt.Sprintf("%syear=%s/month=%s/day=%s/%s", rawCsvBase, year, month, day, baseName)
-				// If object exists, append suffix -2, -3, ...
-				csvKey = ensureUniqueKey(ctx, s3c, bucketName, csvKey)
+				baseName = uniqueFilename(baseName, used)
+				csvKey := fmt.Sprintf("%suser_id=%s/year=%s/month=%s/day=%s/%s-%s", rawCsvBase, userID, year, month, day, messageID, baseName)
 				if _, perr := s3c.PutObject(ctx, &s3.PutObjectInput{
 					Bucket:      &bucketName,
 					Key:         &csvKey,
@@ -160,12 +188,19 @@ func processEmail(ctx context.Context, s3c s3API, bucketName, key string) error
 					ContentType: aws.String("text/csv"),
 					ACL:         s3types.ObjectCannedACLPrivate,
 				}); perr != nil {
-					log.Printf("warn: put csv %s: %v", csvKey, perr)
+					// Fail the message so SQS delivers the email again rather than losing the CSV
+					return fmt.Errorf("put csv %s: %w", csvKey, perr)
 				}
+				extracted++
 			}
 		}
 	}
 
+	emf.Put(
+		emf.Count("EmailsReceived", 1),
+		emf.Count("EmailsClassified", 1),
+		emf.Count("CsvAttachmentsExtracted", float64(extracted)),
+	)
 	return nil
 }
 
@@ -257,6 +292,18 @@ func sanitizeFilename(name string) string {
 	return re.ReplaceAllString(name, "_")
 }
 
+// uniqueFilename returns name, or name with -2, -3, ... before its extension, whichever is
+// not in used yet, and adds it to used.
+func uniqueFilename(name string, used map[string]bool) string {
+	ext := filepath.Ext(name)
+	unique := name
+	for n := 2; used[unique]; n++ {
+		unique = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext)
+	}
+	used[unique] = true
+	return unique
+}
+
 func dateFromMessage(msg *mail.Message) string {
 	// Prefer Date header; fallback to now UTC
 	t := time.Now().UTC()
@@ -279,27 +326,3 @@ func dateParts(dt string) (string, string, string) {
 	}
 	return parts[0], parts[1], parts[2]
 }
-
-func ensureUniqueKey(ctx context.Context, s3c s3API, bucket, key string) string {
-	// If key exists, append -2, -3, ... before extension
-	base := key
-	ext := ""
-	if i := strings.LastIndex(key, "."); i > -1 {
-		base = key[:i]
-		ext = key[i:]
-	}
-	try := 1
-	k := key
-	for {
-		_, err := s3c.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &bucket, Key: &k})
-		if err != nil {
-			// assume not found
-			return k
-		}
-		try++
-		k = fmt.Sprintf("%s-%d%s", base, try, ext)
-		if try > 50 {
-			return fmt.Sprintf("%s-%s%s", base, uuid.New().String(), ext)
-		}
-	}
-}
@@ -3,17 +3,20 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/mail"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/duderman/mailmunch/internal/emf/emftest"
 )
 
 func TestUrlUnescape(t *testing.T) {
@@ -60,6 +63,18 @@ func TestSanitizeFilename(t *testing.T) {
 	}
 }
 
+func TestUniqueFilename(t *testing.T) {
+	used := map[string]bool{}
+	var got []string
+	for _, name := range []string{"loseit-daily.csv", "loseit-daily.csv", "loseit-daily-2.csv", "loseit-daily.csv"} {
+		got = append(got, uniqueFilename(name, used))
+	}
+	want := []string{"loseit-daily.csv", "loseit-daily-2.csv", "loseit-daily-2-2.csv", "loseit-daily-3.csv"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
 func TestDateFromMessage(t *testing.T) {
 	raw := "Date: Wed, 27 Aug 2025 12:34:56 -0700\r\n\r\nBody"
 	msg, err := mail.ReadMessage(bytes.NewReader([]byte(raw)))
@@ -88,15 +103,23 @@ type putCall struct {
 }
 type mockS3 struct {
 	// get returns this body for any GetObject
-	getBody []byte
-	puts    []putCall
+	getBody  []byte
+	missing  []string // GetObject fails for these keys
+	failPuts string   // PutObject fails for keys with this prefix
+	puts     []putCall
 }
 
 func (m *mockS3) GetObject(ctx context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if slices.Contains(m.missing, aws.ToString(in.Key)) {
+		return nil, fmt.Errorf("NoSuchKey: %s", aws.ToString(in.Key))
+	}
 	rc := io.NopCloser(bytes.NewReader(m.getBody))
 	return &s3.GetObjectOutput{Body: rc}, nil
 }
 func (m *mockS3) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if m.failPuts != "" && strings.HasPrefix(aws.ToString(in.Key), m.failPuts) {
+		return nil, fmt.Errorf("SlowDown: %s", aws.ToString(in.Key))
+	}
 	b, _ := io.ReadAll(in.Body)
 	ct := ""
 	if in.ContentType != nil {
@@ -105,10 +128,6 @@ func (m *mockS3) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func
 	m.puts = append(m.puts, putCall{Key: aws.ToString(in.Key), Body: b, ContentType: ct})
 	return &s3.PutObjectOutput{}, nil
 }
-func (m *mockS3) HeadObject(ctx context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
-	// Simulate not found so ensureUniqueKey uses the initial name
-	return nil, fmt.Errorf("not found")
-}
 
 func TestHandler_ExtractsCSVFromEML(t *testing.T) {
 	// Load example EML
@@ -130,27 +149,23 @@ func TestHandler_ExtractsCSVFromEML(t *testing.T) {
 	t.Setenv("RAW_EMAIL_BASE", "raw/email/")
 	t.Setenv("RAW_CSV_BASE", "raw/loseit_csv/")
 
-	// Build S3 event
-	evt := events.S3Event{Records: []events.S3EventRecord{{
-		S3: events.S3Entity{
-			Bucket: events.S3Bucket{Name: "test-bucket"},
-			Object: events.S3Object{Key: "raw/email/incoming/loseit.eml"},
-		},
-	}}}
-
 	// Run handler
-	if err := handler(context.Background(), evt); err != nil {
+	resp, err := handler(context.Background(), sqsEvent(t, "test-bucket", "raw/email/incoming/loseit.eml"))
+	if err != nil {
 		t.Fatalf("handler error: %v", err)
 	}
+	if len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("unexpected failures %v", resp.BatchItemFailures)
+	}
 
 	// Validate we wrote raw EML and CSV
 	var gotRaw, gotCSV *putCall
 	for i := range mock.puts {
 		pc := &mock.puts[i]
-		if strings.HasPrefix(pc.Key, "raw/email/year=") && strings.HasSuffix(pc.Key, ".eml") {
+		if strings.HasPrefix(pc.Key, "raw/email/user_id=default/year=") && strings.HasSuffix(pc.Key, ".eml") {
 			gotRaw = pc
 		}
-		if strings.HasPrefix(pc.Key, "raw/loseit_csv/year=") && strings.HasSuffix(pc.Key, ".csv") {
+		if strings.HasPrefix(pc.Key, "raw/loseit_csv/user_id=default/year=") && strings.HasSuffix(pc.Key, ".csv") {
 			gotCSV = pc
 		}
 	}
@@ -164,3 +179,130 @@ func TestHandler_ExtractsCSVFromEML(t *testing.T) {
 		t.Fatalf("csv body is empty")
 	}
 }
+
+// sqsEvent wraps one S3 notification per key the way the stage's queue delivers them; message
+// IDs are msg-0, msg-1 and so on.
+func sqsEvent(t *testing.T, bucket string, keys ...string) events.SQSEvent {
+	t.Helper()
+	var evt events.SQSEvent
+	for i, key := range keys {
+		body, err := json.Marshal(events.S3Event{Records: []events.S3EventRecord{{
+			S3: events.S3Entity{
+				Bucket: events.S3Bucket{Name: bucket},
+				Object: events.S3Object{Key: key},
+			},
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		evt.Records = append(evt.Records, events.SQSMessage{MessageId: fmt.Sprintf("msg-%d", i), Body: string(body)})
+	}
+	return evt
+}
+
+func TestHandler_ReportsFailedMessages(t *testing.T) {
+	eml, err := os.ReadFile(filepath.Join(".", "loseit_example.eml"))
+	if err != nil {
+		t.Fatalf("read eml: %v", err)
+	}
+	mock := &mockS3{getBody: eml, missing: []string{"raw/email/incoming/gone.eml"}}
+	old := newS3Client
+	newS3Client = func(ctx context.Context) (s3API, error) { return mock, nil }
+	defer func() { newS3Client = old }()
+	t.Setenv("EMAIL_BUCKET", "test-bucket")
+
+	evt := sqsEvent(t, "test-bucket", "raw/email/incoming/loseit.eml", "raw/email/incoming/gone.eml")
+	evt.Records = append(evt.Records, events.SQSMessage{MessageId: "s3-test-event", Body: `{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"test-bucket"}`})
+	resp, err := handler(context.Background(), evt)
+	if err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+	if len(resp.BatchItemFailures) != 1 || resp.BatchItemFailures[0].ItemIdentifier != "msg-1" {
+		t.Fatalf("expected only the missing email to fail, got %v", resp.BatchItemFailures)
+	}
+	if len(mock.puts) == 0 {
+		t.Error("the other email in the batch was not processed")
+	}
+}
+
+func TestHandler_RetriesFailedCSVPuts(t *testing.T) {
+	eml, err := os.ReadFile(filepath.Join(".", "loseit_example.eml"))
+	if err != nil {
+		t.Fatalf("read eml: %v", err)
+	}
+	mock := &mockS3{getBody: eml, failPuts: "raw/loseit_csv/"}
+	old := newS3Client
+	newS3Client = func(ctx context.Context) (s3API, error) { return mock, nil }
+	defer func() { newS3Client = old }()
+	t.Setenv("EMAIL_BUCKET", "test-bucket")
+
+	resp, err := handler(context.Background(), sqsEvent(t, "test-bucket", "raw/email/incoming/loseit.eml"))
+	if err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+	if len(resp.BatchItemFailures) != 1 || resp.BatchItemFailures[0].ItemIdentifier != "msg-0" {
+		t.Fatalf("expected the email to be retried when its CSV could not be stored, got %v", resp.BatchItemFailures)
+	}
+}
+
+func TestHandler_RedeliveryOverwritesSameKeys(t *testing.T) {
+	eml, err := os.ReadFile(filepath.Join(".", "loseit_example.eml"))
+	if err != nil {
+		t.Fatalf("read eml: %v", err)
+	}
+	mock := &mockS3{getBody: eml}
+	old := newS3Client
+	newS3Client = func(ctx context.Context) (s3API, error) { return mock, nil }
+	defer func() { newS3Client = old }()
+	t.Setenv("EMAIL_BUCKET", "test-bucket")
+
+	// SQS delivers at least once, so the same notification can arrive twice
+	for range 2 {
+		resp, err := handler(context.Background(), sqsEvent(t, "test-bucket", "raw/email/incoming/loseit.eml"))
+		if err != nil || len(resp.BatchItemFailures) != 0 {
+			t.Fatalf("handler: %v %v", resp.BatchItemFailures, err)
+		}
+	}
+	if len(mock.puts) != 4 {
+		t.Fatalf("expected an EML and a CSV per delivery, got %#v", mock.puts)
+	}
+	for i, pc := range mock.puts[:2] {
+		if again := mock.puts[i+2].Key; again != pc.Key {
+			t.Errorf("redelivery wrote %s instead of %s", again, pc.Key)
+		}
+	}
+	csvKey := mock.puts[1].Key
+	if !strings.HasPrefix(csvKey, "raw/loseit_csv/user_id=default/year=") || !strings.Contains(csvKey, "/day=") ||
+		!strings.HasSuffix(csvKey, ".csv") {
+		t.Errorf("unexpected CSV key %s", csvKey)
+	}
+}
+
+func TestHandler_EmitsMetrics(t *testing.T) {
+	eml, err := os.ReadFile(filepath.Join(".", "loseit_example.eml"))
+	if err != nil {
+		t.Fatalf("read eml: %v", err)
+	}
+	mock := &mockS3{getBody: eml}
+	old := newS3Client
+	newS3Client = func(ctx context.Context) (s3API, error) { return mock, nil }
+	defer func() { newS3Client = old }()
+	t.Setenv("EMAIL_BUCKET", "test-bucket")
+	out := emftest.Capture(t)
+
+	if _, err := handler(context.Background(), sqsEvent(t, "test-bucket", "raw/email/incoming/loseit.eml")); err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+	mock.getBody = []byte("From: friend@example.com\r\nSubject: hello\r\n\r\nBody")
+	if _, err := handler(context.Background(), sqsEvent(t, "test-bucket", "raw/email/incoming/other.eml")); err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+
+	totals := out.Totals()
+	want := map[string]float64{"EmailsReceived": 2, "EmailsClassified": 1, "CsvAttachmentsExtracted": 1}
+	for name, v := range want {
+		if totals[name] != v {
+			t.Errorf("%s = %v, expected %v", name, totals[name], v)
+		}
+	}
+}
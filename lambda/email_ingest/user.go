@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// defaultUserID owns mail sent to the base recipient address and any address we cannot map.
+const defaultUserID = "default"
+
+var (
+	userIDPattern = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+	receivedForRe = regexp.MustCompile(`(?i)\bfor\s+<?([^\s<>;]+@[^\s<>;]+)>?`)
+	recipientHdrs = []string{"X-Original-To", "Delivered-To", "To", "Cc"}
+)
+
+// userResolver maps the address an email was sent to onto a user_id partition value:
+//
+//   - exact matches from USER_ADDRESSES ({"alice@example.com": "alice"})
+//   - plus-tags on RECIPIENT_ADDRESS (reports+alice@example.com -> alice)
+//   - everything else -> default
+type userResolver struct {
+	base      string            // RECIPIENT_ADDRESS, lower case
+	addresses map[string]string // lower-case address -> user ID
+}
+
+func newUserResolver() *userResolver {
+	r := &userResolver{
+		base:      strings.ToLower(strings.TrimSpace(envOr("RECIPIENT_ADDRESS", ""))),
+		addresses: map[string]string{},
+	}
+	if raw := envOr("USER_ADDRESSES", ""); raw != "" {
+		var m map[string]string
+		if err := json.Unmarshal([]byte(raw), &m); err != nil {
+			log.Printf("warn: ignoring invalid USER_ADDRESSES: %v", err)
+		}
+		for addr, id := range m {
+			if !userIDPattern.MatchString(id) {
+				log.Printf("warn: ignoring invalid user ID %q for %s", id, addr)
+				continue
+			}
+			r.addresses[strings.ToLower(strings.TrimSpace(addr))] = id
+		}
+	}
+	return r
+}
+
+// userID returns the user for msg, checking the SES envelope recipient in Received
+// headers before the visible recipient headers.
+func (r *userResolver) userID(msg *mail.Message) string {
+	for _, addr := range messageRecipients(msg) {
+		if id, ok := r.lookup(addr); ok {
+			return id
+		}
+	}
+	return defaultUserID
+}
+
+func (r *userResolver) lookup(addr string) (string, bool) {
+	addr = strings.ToLower(addr)
+	if id, ok := r.addresses[addr]; ok {
+		return id, true
+	}
+	if r.base == "" {
+		return "", false
+	}
+	local, domain, ok := strings.Cut(addr, "@")
+	baseLocal, baseDomain, _ := strings.Cut(r.base, "@")
+	if !ok || domain != baseDomain {
+		return "", false
+	}
+	if local == baseLocal {
+		return defaultUserID, true
+	}
+	if tag, found := strings.CutPrefix(local, baseLocal+"+"); found && userIDPattern.MatchString(tag) {
+		return tag, true
+	}
+	return "", false
+}
+
+// messageRecipients lists candidate recipient addresses in order of trust.
+func messageRecipients(msg *mail.Message) []string {
+	if msg == nil {
+		return nil
+	}
+	var out []string
+	for _, received := range msg.Header["Received"] {
+		if m := receivedForRe.FindStringSubmatch(received); m != nil {
+			out = append(out, m[1])
+		}
+	}
+	for _, h := range recipientHdrs {
+		for _, v := range msg.Header[h] {
+			addrs, err := mail.ParseAddressList(v)
+			if err != nil {
+				continue
+			}
+			for _, a := range addrs {
+				out = append(out, a.Address)
+			}
+		}
+	}
+	return out
+}
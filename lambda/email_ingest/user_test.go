@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUserResolver_Lookup(t *testing.T) {
+	t.Setenv("RECIPIENT_ADDRESS", "Reports@Example.com")
+	t.Setenv("USER_ADDRESSES", `{"Alice@Home.example":"alice","bad@example.com":"Not Valid"}`)
+	r := newUserResolver()
+
+	cases := map[string]string{
+		"alice@home.example":        "alice",
+		"reports@example.com":       defaultUserID,
+		"reports+bob@example.com":   "bob",
+		"REPORTS+Bob@example.com":   "bob",
+		"reports+b%c@example.com":   "",
+		"reports+bob@elsewhere.com": "",
+		"bad@example.com":           "",
+	}
+	for addr, want := range cases {
+		got, ok := r.lookup(addr)
+		if want == "" {
+			if ok {
+				t.Errorf("lookup(%q) = %q, want no match", addr, got)
+			}
+			continue
+		}
+		if !ok || got != want {
+			t.Errorf("lookup(%q) = %q, %v, want %q", addr, got, ok, want)
+		}
+	}
+}
+
+func TestUserResolver_PrefersEnvelopeRecipient(t *testing.T) {
+	t.Setenv("RECIPIENT_ADDRESS", "reports@example.com")
+	t.Setenv("USER_ADDRESSES", "")
+	raw := "Received: from mx by inbound-smtp.amazonaws.com\r\n" +
+		"\tfor reports+carol@example.com; Mon, 1 Sep 2025 08:00:00 +0000\r\n" +
+		"To: Someone <reports+dave@example.com>\r\n" +
+		"Subject: LoseIt daily report\r\n\r\nbody"
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := newUserResolver().userID(msg); got != "carol" {
+		t.Errorf("userID = %q, want carol", got)
+	}
+
+	msg.Header["Received"] = nil
+	if got := newUserResolver().userID(msg); got != "dave" {
+		t.Errorf("userID = %q, want dave", got)
+	}
+
+	msg.Header["To"] = []string{"stranger@example.org"}
+	if got := newUserResolver().userID(msg); got != defaultUserID {
+		t.Errorf("userID = %q, want %s", got, defaultUserID)
+	}
+}
+
+func TestHandler_PartitionsByUser(t *testing.T) {
+	eml, err := os.ReadFile("loseit_example.eml")
+	if err != nil {
+		t.Fatalf("read eml: %v", err)
+	}
+	mock := &mockS3{getBody: eml}
+	old := newS3Client
+	newS3Client = func(ctx context.Context) (s3API, error) { return mock, nil }
+	defer func() { newS3Client = old }()
+
+	t.Setenv("EMAIL_BUCKET", "test-bucket")
+	t.Setenv("USER_ADDRESSES", `{"zduderman@gmail.com":"zd"}`)
+
+	resp, err := handler(context.Background(), sqsEvent(t, "test-bucket", "raw/email/incoming/loseit.eml"))
+	if err != nil || len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("handler error: %v %v", err, resp.BatchItemFailures)
+	}
+	if len(mock.puts) == 0 {
+		t.Fatal("expected puts")
+	}
+	for _, pc := range mock.puts {
+		if !strings.Contains(pc.Key, "/user_id=zd/year=") {
+			t.Errorf("key %s is not partitioned by user", pc.Key)
+		}
+	}
+}
@@ -35,3 +35,16 @@ func TestExtractYMD(t *testing.T) {
 		})
 	}
 }
+
+func TestExtractUserID(t *testing.T) {
+	tests := map[string]string{
+		"raw/loseit_csv/user_id=alice/year=2025/month=08/day=27/example_report.csv": "alice",
+		"raw/loseit_csv/year=2025/month=08/day=27/example_report.csv":               defaultUserID,
+		"raw/loseit_csv/user_id=/year=2025/month=08/day=27/example_report.csv":      defaultUserID,
+	}
+	for key, want := range tests {
+		if got := extractUserID(key); got != want {
+			t.Errorf("extractUserID(%s) = %q, want %q", key, got, want)
+		}
+	}
+}
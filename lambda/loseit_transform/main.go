@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -19,10 +20,14 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/duderman/mailmunch/internal/emf"
 	"github.com/parquet-go/parquet-go"
 	"github.com/parquet-go/parquet-go/compress/snappy"
 )
 
+// defaultUserID is the user_id partition for data from before per-user partitioning.
+const defaultUserID = "default"
+
 func envOr(k, def string) string {
 	if v := os.Getenv(k); v != "" {
 		return v
@@ -34,6 +39,7 @@ func envOr(k, def string) string {
 type s3API interface {
 	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
 }
 
 var newS3Client = func(ctx context.Context) (s3API, error) {
@@ -44,34 +50,49 @@ var newS3Client = func(ctx context.Context) (s3API, error) {
 	return s3.NewFromConfig(cfg), nil
 }
 
+// LoseItLog is one row of the curated Parquet files and the Glue loseit table.
 type LoseItLog struct {
-	RecordType      *string  `parquet:"name=record_type, type=UTF8, repetitiontype=OPTIONAL"`
-	Date            *string  `parquet:"name=date, type=UTF8, repetitiontype=OPTIONAL"`
-	Meal            *string  `parquet:"name=meal, type=UTF8, repetitiontype=OPTIONAL"`
-	Name            *string  `parquet:"name=name, type=UTF8, repetitiontype=OPTIONAL"`
-	Icon            *string  `parquet:"name=icon, type=UTF8, repetitiontype=OPTIONAL"`
-	Quantity        *float64 `parquet:"name=quantity, type=DOUBLE, repetitiontype=OPTIONAL"`
-	Units           *string  `parquet:"name=units, type=UTF8, repetitiontype=OPTIONAL"`
-	Calories        *float64 `parquet:"name=calories, type=DOUBLE, repetitiontype=OPTIONAL"`
-	Deleted         *bool    `parquet:"name=deleted, type=BOOLEAN, repetitiontype=OPTIONAL"`
-	ProteinG        *float64 `parquet:"name=protein_g, type=DOUBLE, repetitiontype=OPTIONAL"`
-	FatG            *float64 `parquet:"name=fat_g, type=DOUBLE, repetitiontype=OPTIONAL"`
-	CarbsG          *float64 `parquet:"name=carbs_g, type=DOUBLE, repetitiontype=OPTIONAL"`
-	SaturatedFatG   *float64 `parquet:"name=saturated_fat_g, type=DOUBLE, repetitiontype=OPTIONAL"`
-	FiberG          *float64 `parquet:"name=fiber_g, type=DOUBLE, repetitiontype=OPTIONAL"`
-	CholesterolMg   *float64 `parquet:"name=cholesterol_mg, type=DOUBLE, repetitiontype=OPTIONAL"`
-	SodiumMg        *float64 `parquet:"name=sodium_mg, type=DOUBLE, repetitiontype=OPTIONAL"`
-	SugarG          *float64 `parquet:"name=sugar_g, type=DOUBLE, repetitiontype=OPTIONAL"`
-	DurationMinutes *float64 `parquet:"name=duration_minutes, type=DOUBLE, repetitiontype=OPTIONAL"`
-	DistanceKm      *float64 `parquet:"name=distance_km, type=DOUBLE, repetitiontype=OPTIONAL"`
+	RecordType      *string  `parquet:"record_type,optional"`
+	Date            *string  `parquet:"date,optional"`
+	Meal            *string  `parquet:"meal,optional"`
+	Name            *string  `parquet:"name,optional"`
+	Icon            *string  `parquet:"icon,optional"`
+	Quantity        *float64 `parquet:"quantity,optional"`
+	Units           *string  `parquet:"units,optional"`
+	Calories        *float64 `parquet:"calories,optional"`
+	Deleted         *bool    `parquet:"deleted,optional"`
+	ProteinG        *float64 `parquet:"protein_g,optional"`
+	FatG            *float64 `parquet:"fat_g,optional"`
+	CarbsG          *float64 `parquet:"carbs_g,optional"`
+	SaturatedFatG   *float64 `parquet:"saturated_fat_g,optional"`
+	FiberG          *float64 `parquet:"fiber_g,optional"`
+	CholesterolMg   *float64 `parquet:"cholesterol_mg,optional"`
+	SodiumMg        *float64 `parquet:"sodium_mg,optional"`
+	SugarG          *float64 `parquet:"sugar_g,optional"`
+	DurationMinutes *float64 `parquet:"duration_minutes,optional"`
+	DistanceKm      *float64 `parquet:"distance_km,optional"`
 }
 
-func main() { lambda.Start(handler) }
+func main() {
+	// "migrate" rewrites existing curated files with the current schema instead of running as a Lambda
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(context.Background(), os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	lambda.Start(handler)
+}
 
-func handler(ctx context.Context, evt events.S3Event) error {
+// handler transforms the CSVs in S3 notifications delivered through the stage's SQS queue.
+// Messages whose CSVs fail are reported as batch item failures, so SQS retries only those and
+// moves them to the dead-letter queue once they have failed too often.
+func handler(ctx context.Context, evt events.SQSEvent) (events.SQSEventResponse, error) {
+	var resp events.SQSEventResponse
 	bucketName := os.Getenv("DATA_BUCKET")
 	if bucketName == "" {
-		return fmt.Errorf("DATA_BUCKET env var is required")
+		return resp, fmt.Errorf("DATA_BUCKET env var is required")
 	}
 
 	rawCsvBase := envOr("RAW_CSV_BASE", "raw/loseit_csv/")
@@ -79,81 +100,128 @@ func handler(ctx context.Context, evt events.S3Event) error {
 
 	s3c, err := newS3Client(ctx)
 	if err != nil {
-		return err
+		return resp, err
 	}
 
+	for _, msg := range evt.Records {
+		if err := processMessage(ctx, s3c, bucketName, rawCsvBase, curatedBase, msg); err != nil {
+			log.Printf("error processing message %s: %v", msg.MessageId, err)
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: msg.MessageId})
+		}
+	}
+	return resp, nil
+}
+
+// processMessage transforms the CSVs in one S3 notification.
+func processMessage(ctx context.Context, s3c s3API, bucketName, rawCsvBase, curatedBase string, msg events.SQSMessage) error {
+	var evt events.S3Event
+	if err := json.Unmarshal([]byte(msg.Body), &evt); err != nil {
+		return fmt.Errorf("parse s3 event: %w", err)
+	}
+	// S3's test event when the notification is configured has no records
 	for _, rec := range evt.Records {
-		b := rec.S3.Bucket.Name
-		key := rec.S3.Object.Key
+		if err := transformObject(ctx, s3c, bucketName, rawCsvBase, curatedBase, rec); err != nil {
+			return fmt.Errorf("transform %s: %w", rec.S3.Object.Key, err)
+		}
+	}
+	return nil
+}
 
-		// URL decode the key since S3 events may provide URL-encoded keys
-		decodedKey, err := urlDecode(key)
+// transformObject writes the CSV in rec to the curated layer as Parquet.
+func transformObject(ctx context.Context, s3c s3API, bucketName, rawCsvBase, curatedBase string, rec events.S3EventRecord) error {
+	b := rec.S3.Bucket.Name
+	key := rec.S3.Object.Key
 
-		if err != nil {
-			log.Printf("warn: failed to decode key %s, using original: %v", key, err)
-			decodedKey = key
-		}
+	// URL decode the key since S3 events may provide URL-encoded keys
+	decodedKey, err := urlDecode(key)
 
-		if !strings.HasPrefix(decodedKey, rawCsvBase) {
-			log.Printf("skip non-matching key: %s", decodedKey)
-			continue
-		}
-		// Parse partition path: raw/loseit_csv/year=YYYY/month=MM/day=DD/...
-		year, month, day := extractYMD(decodedKey)
-		if year == "" {
-			log.Printf("warn: cannot derive y/m/d from %s", decodedKey)
-		}
+	if err != nil {
+		log.Printf("warn: failed to decode key %s, using original: %v", key, err)
+		decodedKey = key
+	}
 
-		// Read CSV - use original (possibly encoded) key for S3 API call
-		obj, err := s3c.GetObject(ctx, &s3.GetObjectInput{Bucket: &b, Key: &decodedKey})
-		if err != nil {
-			return fmt.Errorf("s3 get %s/%s: %w", b, key, err)
-		}
-		body, err := io.ReadAll(obj.Body)
-		if closeErr := obj.Body.Close(); closeErr != nil {
-			return fmt.Errorf("failed to close object body: %w", closeErr)
-		}
-		if err != nil {
-			return err
-		}
+	if !strings.HasPrefix(decodedKey, rawCsvBase) {
+		log.Printf("skip non-matching key: %s", decodedKey)
+		return nil
+	}
+	// Parse partition path: raw/loseit_csv/user_id=ID/year=YYYY/month=MM/day=DD/...
+	userID := extractUserID(decodedKey)
+	year, month, day := extractYMD(decodedKey)
+	if year == "" {
+		log.Printf("warn: cannot derive y/m/d from %s", decodedKey)
+	}
 
-		rows, err := parseCSV(body)
-		if err != nil {
-			return err
-		}
+	// Read CSV - use original (possibly encoded) key for S3 API call
+	obj, err := s3c.GetObject(ctx, &s3.GetObjectInput{Bucket: &b, Key: &decodedKey})
+	if err != nil {
+		return fmt.Errorf("s3 get %s/%s: %w", b, key, err)
+	}
+	body, err := io.ReadAll(obj.Body)
+	if closeErr := obj.Body.Close(); closeErr != nil {
+		return fmt.Errorf("failed to close object body: %w", closeErr)
+	}
+	if err != nil {
+		return err
+	}
 
-		// Build Parquet in-memory
-		buf := new(bytes.Buffer)
-		w := parquet.NewWriter(buf,
-			parquet.SchemaOf(new(LoseItLog)),
-			parquet.Compression(&snappy.Codec{}),
-		)
-		// Map CSV rows to LoseItLog
-		for _, r := range rows {
-			rec := mapRow(r)
-			if err := w.Write(rec); err != nil {
-				return err
-			}
-		}
-		if err := w.Close(); err != nil {
-			return err
-		}
+	rows, err := parseCSV(body)
+	if err != nil {
+		return err
+	}
 
-		// Write Parquet to curated/loseit_parquet/year=YYYY/month=MM/day=DD/part-0000.snappy.parquet
-		outKey := fmt.Sprintf("%syear=%s/month=%s/day=%s/part-0000.snappy.parquet", curatedBase, year, month, day)
-		if _, err := s3c.PutObject(ctx, &s3.PutObjectInput{
-			Bucket:      &bucketName,
-			Key:         &outKey,
-			Body:        bytes.NewReader(buf.Bytes()),
-			ContentType: aws.String("application/octet-stream"),
-			ACL:         s3types.ObjectCannedACLPrivate,
-		}); err != nil {
-			return err
+	// Map CSV rows to LoseItLog; rows without a date or name cannot be reported on
+	logs := make([]*LoseItLog, 0, len(rows))
+	for _, r := range rows {
+		if l := mapRow(r); l.Date != nil && l.Name != nil {
+			logs = append(logs, l)
 		}
 	}
+	rejected := len(rows) - len(logs)
+	if rejected > 0 {
+		log.Printf("warn: rejected %d of %d rows without a date or name in %s", rejected, len(rows), decodedKey)
+	}
+	buf, err := writeParquet(logs)
+	if err != nil {
+		return err
+	}
+
+	// Write Parquet to curated/loseit_parquet/user_id=ID/year=YYYY/month=MM/day=DD/part-0000.snappy.parquet
+	outKey := fmt.Sprintf("%suser_id=%s/year=%s/month=%s/day=%s/part-0000.snappy.parquet", curatedBase, userID, year, month, day)
+	if _, err := s3c.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &bucketName,
+		Key:         &outKey,
+		Body:        bytes.NewReader(buf),
+		ContentType: aws.String("application/octet-stream"),
+		ACL:         s3types.ObjectCannedACLPrivate,
+	}); err != nil {
+		return err
+	}
+	emf.Put(
+		emf.Count("RowsTransformed", float64(len(logs))),
+		emf.Count("RowsRejected", float64(rejected)),
+		emf.Count("CuratedPartitionsWritten", 1),
+	)
 	return nil
 }
 
+// writeParquet builds a snappy-compressed Parquet file in memory.
+func writeParquet(logs []*LoseItLog) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := parquet.NewWriter(buf,
+		parquet.SchemaOf(new(LoseItLog)),
+		parquet.Compression(&snappy.Codec{}),
+	)
+	for _, rec := range logs {
+		if err := w.Write(rec); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func parseCSV(b []byte) ([]map[string]string, error) {
 	rdr := csv.NewReader(bytes.NewReader(b))
 	rdr.TrimLeadingSpace = true
@@ -316,6 +384,17 @@ func extractYMD(key string) (string, string, string) {
 	return y, m, d
 }
 
+// extractUserID returns the user_id partition of key. CSVs ingested before per-user
+// partitioning have none and belong to the default user.
+func extractUserID(key string) string {
+	for _, s := range strings.Split(key, "/") {
+		if id, ok := strings.CutPrefix(s, "user_id="); ok && id != "" {
+			return id
+		}
+	}
+	return defaultUserID
+}
+
 func urlDecode(s string) (string, error) {
 	// S3 event keys may be URL-encoded; handle + and %XX escapes.
 	r := strings.ReplaceAll(s, "+", "%20")
@@ -3,19 +3,26 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/duderman/mailmunch/internal/emf/emftest"
+	"github.com/parquet-go/parquet-go"
 )
 
 type mockS3 struct {
 	getBody    []byte
+	objects    map[string][]byte // served by key when set, otherwise getBody
 	lastGetKey string
 	puts       []struct {
 		Key         string
@@ -26,8 +33,25 @@ type mockS3 struct {
 
 func (m *mockS3) GetObject(ctx context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
 	m.lastGetKey = aws.ToString(in.Key)
+	if m.objects != nil {
+		return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(m.objects[m.lastGetKey]))}, nil
+	}
 	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(m.getBody))}, nil
 }
+func (m *mockS3) ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	var keys []string
+	for k := range m.objects {
+		if strings.HasPrefix(k, aws.ToString(in.Prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	for _, k := range keys {
+		out.Contents = append(out.Contents, s3types.Object{Key: aws.String(k)})
+	}
+	return out, nil
+}
 func (m *mockS3) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
 	b, _ := io.ReadAll(in.Body)
 	ct := ""
@@ -42,6 +66,53 @@ func (m *mockS3) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func
 	return &s3.PutObjectOutput{}, nil
 }
 
+// sqsEvent wraps one S3 notification per key the way the stage's queue delivers them; message
+// IDs are msg-0, msg-1 and so on.
+func sqsEvent(t *testing.T, bucket string, keys ...string) events.SQSEvent {
+	t.Helper()
+	var evt events.SQSEvent
+	for i, key := range keys {
+		body, err := json.Marshal(events.S3Event{Records: []events.S3EventRecord{{
+			S3: events.S3Entity{Bucket: events.S3Bucket{Name: bucket}, Object: events.S3Object{Key: key}},
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		evt.Records = append(evt.Records, events.SQSMessage{MessageId: fmt.Sprintf("msg-%d", i), Body: string(body)})
+	}
+	return evt
+}
+
+func TestHandler_ReportsFailedMessages(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join(".", "example_report.csv"))
+	if err != nil {
+		t.Fatalf("read csv: %v", err)
+	}
+	good := "raw/loseit_csv/user_id=alex/year=2025/month=08/day=27/loseit-daily.csv"
+	mock := &mockS3{objects: map[string][]byte{good: data}} // the other key reads as an empty file
+	oldFactory := newS3Client
+	newS3Client = func(ctx context.Context) (s3API, error) { return mock, nil }
+	defer func() { newS3Client = oldFactory }()
+	t.Setenv("DATA_BUCKET", "test-bucket")
+
+	evt := sqsEvent(t, "test-bucket", "raw/loseit_csv/user_id=alex/year=2025/month=08/day=28/loseit-daily.csv", good)
+	evt.Records = append(evt.Records, events.SQSMessage{MessageId: "not-json", Body: "{"})
+	resp, err := handler(context.Background(), evt)
+	if err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+	var failed []string
+	for _, f := range resp.BatchItemFailures {
+		failed = append(failed, f.ItemIdentifier)
+	}
+	if strings.Join(failed, ",") != "msg-0,not-json" {
+		t.Errorf("expected the empty CSV and the unreadable message to fail, got %v", failed)
+	}
+	if len(mock.puts) != 1 || !strings.Contains(mock.puts[0].Key, "user_id=alex/year=2025/month=08/day=27/") {
+		t.Errorf("expected only the good CSV to be written, got %d puts", len(mock.puts))
+	}
+}
+
 func TestHandler_TransformsCSVToParquet(t *testing.T) {
 	// Load example CSV from repo
 	csvPath := filepath.Join(".", "example_report.csv")
@@ -63,13 +134,13 @@ func TestHandler_TransformsCSVToParquet(t *testing.T) {
 
 	// Invoke handler with an S3 event pointing at a date-partitioned CSV path
 	key := "raw/loseit_csv/year%3D2025/month%3D08/day%3D27/example_report.csv"
-	evt := events.S3Event{Records: []events.S3EventRecord{{
-		S3: events.S3Entity{Bucket: events.S3Bucket{Name: "test-bucket"}, Object: events.S3Object{Key: key}},
-	}}}
-
-	if err := handler(context.Background(), evt); err != nil {
+	resp, err := handler(context.Background(), sqsEvent(t, "test-bucket", key))
+	if err != nil {
 		t.Fatalf("handler error: %v", err)
 	}
+	if len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("unexpected failures %v", resp.BatchItemFailures)
+	}
 
 	wantKey := "raw/loseit_csv/year=2025/month=08/day=27/example_report.csv"
 	if mock.lastGetKey != wantKey {
@@ -80,7 +151,7 @@ func TestHandler_TransformsCSVToParquet(t *testing.T) {
 	var outKey string
 	var outBody []byte
 	for _, p := range mock.puts {
-		if strings.HasPrefix(p.Key, "curated/loseit_parquet/year=2025/month=08/day=27/") && strings.HasSuffix(p.Key, ".parquet") {
+		if strings.HasPrefix(p.Key, "curated/loseit_parquet/user_id=default/year=2025/month=08/day=27/") && strings.HasSuffix(p.Key, ".parquet") {
 			outKey = p.Key
 			outBody = p.Body
 			break
@@ -92,4 +163,52 @@ func TestHandler_TransformsCSVToParquet(t *testing.T) {
 	if len(outBody) < 4 || string(outBody[:4]) != "PAR1" {
 		t.Fatalf("missing Parquet magic header")
 	}
+
+	// Columns have the plain names the Glue table declares
+	f, err := parquet.OpenFile(bytes.NewReader(outBody), int64(len(outBody)))
+	if err != nil {
+		t.Fatalf("open parquet: %v", err)
+	}
+	for _, col := range []string{"record_type", "date", "calories", "protein_g"} {
+		if _, ok := f.Schema().Lookup(col); !ok {
+			t.Errorf("missing column %q in %s", col, f.Schema())
+		}
+	}
+}
+
+func TestHandler_RejectsRowsWithoutDateOrName(t *testing.T) {
+	csv := "Date,Name,Type,Calories\n" +
+		"08/27/2025,Porridge Oats,Breakfast,185\n" +
+		",Banana,Snacks,90\n" +
+		"08/27/2025,,Lunch,400\n"
+	mock := &mockS3{getBody: []byte(csv)}
+	oldFactory := newS3Client
+	newS3Client = func(ctx context.Context) (s3API, error) { return mock, nil }
+	defer func() { newS3Client = oldFactory }()
+	t.Setenv("DATA_BUCKET", "test-bucket")
+	out := emftest.Capture(t)
+
+	key := "raw/loseit_csv/user_id=alex/year=2025/month=08/day=27/loseit-daily.csv"
+	resp, err := handler(context.Background(), sqsEvent(t, "test-bucket", key))
+	if err != nil || len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("unexpected failure: %v %v", err, resp.BatchItemFailures)
+	}
+	if len(mock.puts) != 1 {
+		t.Fatalf("expected one Parquet file, got %d puts", len(mock.puts))
+	}
+	rows, err := parquet.Read[LoseItLog](bytes.NewReader(mock.puts[0].Body), int64(len(mock.puts[0].Body)))
+	if err != nil {
+		t.Fatalf("read parquet: %v", err)
+	}
+	if len(rows) != 1 || rows[0].Name == nil || *rows[0].Name != "Porridge Oats" {
+		t.Errorf("expected only the complete row to be written, got %d rows", len(rows))
+	}
+
+	totals := out.Totals()
+	want := map[string]float64{"RowsTransformed": 1, "RowsRejected": 2, "CuratedPartitionsWritten": 1}
+	for name, v := range want {
+		if totals[name] != v {
+			t.Errorf("%s = %v, expected %v", name, totals[name], v)
+		}
+	}
 }
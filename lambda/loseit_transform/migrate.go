@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/parquet-go/parquet-go"
+)
+
+// legacyLoseItLog is the schema curated files were written with before LoseItLog had plain
+// parquet tags. parquet-go took the whole "name=date" option as the column name, so those
+// files have columns literally called "name=date", "name=calories" and so on.
+type legacyLoseItLog struct {
+	RecordType      *string  `parquet:"name=record_type, type=UTF8, repetitiontype=OPTIONAL"`
+	Date            *string  `parquet:"name=date, type=UTF8, repetitiontype=OPTIONAL"`
+	Meal            *string  `parquet:"name=meal, type=UTF8, repetitiontype=OPTIONAL"`
+	Name            *string  `parquet:"name=name, type=UTF8, repetitiontype=OPTIONAL"`
+	Icon            *string  `parquet:"name=icon, type=UTF8, repetitiontype=OPTIONAL"`
+	Quantity        *float64 `parquet:"name=quantity, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Units           *string  `parquet:"name=units, type=UTF8, repetitiontype=OPTIONAL"`
+	Calories        *float64 `parquet:"name=calories, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Deleted         *bool    `parquet:"name=deleted, type=BOOLEAN, repetitiontype=OPTIONAL"`
+	ProteinG        *float64 `parquet:"name=protein_g, type=DOUBLE, repetitiontype=OPTIONAL"`
+	FatG            *float64 `parquet:"name=fat_g, type=DOUBLE, repetitiontype=OPTIONAL"`
+	CarbsG          *float64 `parquet:"name=carbs_g, type=DOUBLE, repetitiontype=OPTIONAL"`
+	SaturatedFatG   *float64 `parquet:"name=saturated_fat_g, type=DOUBLE, repetitiontype=OPTIONAL"`
+	FiberG          *float64 `parquet:"name=fiber_g, type=DOUBLE, repetitiontype=OPTIONAL"`
+	CholesterolMg   *float64 `parquet:"name=cholesterol_mg, type=DOUBLE, repetitiontype=OPTIONAL"`
+	SodiumMg        *float64 `parquet:"name=sodium_mg, type=DOUBLE, repetitiontype=OPTIONAL"`
+	SugarG          *float64 `parquet:"name=sugar_g, type=DOUBLE, repetitiontype=OPTIONAL"`
+	DurationMinutes *float64 `parquet:"name=duration_minutes, type=DOUBLE, repetitiontype=OPTIONAL"`
+	DistanceKm      *float64 `parquet:"name=distance_km, type=DOUBLE, repetitiontype=OPTIONAL"`
+}
+
+// legacyColumn is present only in files written with legacyLoseItLog.
+const legacyColumn = "name=date"
+
+// runMigrate rewrites curated Parquet files that still have legacy column names in place,
+// so the Glue table's plain column names resolve in them. Files already migrated are left
+// alone, so it is safe to run again:
+//
+//	go run . migrate -bucket mailmunch-data -dry-run
+func runMigrate(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	bucket := flags.String("bucket", envOr("DATA_BUCKET", ""), "data bucket (default $DATA_BUCKET)")
+	prefix := flags.String("prefix", envOr("CURATED_BASE", "curated/loseit_parquet/"), "curated Parquet prefix")
+	dryRun := flags.Bool("dry-run", false, "list the files that would be rewritten without changing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *bucket == "" {
+		return fmt.Errorf("-bucket or DATA_BUCKET is required")
+	}
+
+	s3c, err := newS3Client(ctx)
+	if err != nil {
+		return err
+	}
+
+	var migrated, current int
+	var token *string
+	for {
+		page, err := s3c.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: bucket, Prefix: prefix, ContinuationToken: token})
+		if err != nil {
+			return fmt.Errorf("s3 list %s/%s: %w", *bucket, *prefix, err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if !strings.HasSuffix(key, ".parquet") {
+				continue
+			}
+			changed, err := migrateObject(ctx, s3c, *bucket, key, *dryRun)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				current++
+				continue
+			}
+			migrated++
+			fmt.Fprintf(stdout, "migrated %s\n", key)
+		}
+		if !aws.ToBool(page.IsTruncated) {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+
+	verb := "Migrated"
+	if *dryRun {
+		verb = "Would migrate"
+	}
+	fmt.Fprintf(stdout, "%s %d file(s); %d already had the current schema\n", verb, migrated, current)
+	return nil
+}
+
+// migrateObject rewrites one file if it has the legacy schema and reports whether it did.
+func migrateObject(ctx context.Context, s3c s3API, bucket, key string, dryRun bool) (bool, error) {
+	obj, err := s3c.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		return false, fmt.Errorf("s3 get %s/%s: %w", bucket, key, err)
+	}
+	body, err := io.ReadAll(obj.Body)
+	if closeErr := obj.Body.Close(); closeErr != nil {
+		return false, fmt.Errorf("failed to close object body: %w", closeErr)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	logs, legacy, err := readLegacyParquet(body)
+	if err != nil {
+		return false, fmt.Errorf("read %s: %w", key, err)
+	}
+	if !legacy || dryRun {
+		return legacy, nil
+	}
+
+	out, err := writeParquet(logs)
+	if err != nil {
+		return false, fmt.Errorf("write %s: %w", key, err)
+	}
+	if _, err := s3c.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(out),
+		ContentType: aws.String("application/octet-stream"),
+		ACL:         s3types.ObjectCannedACLPrivate,
+	}); err != nil {
+		return false, fmt.Errorf("s3 put %s/%s: %w", bucket, key, err)
+	}
+	return true, nil
+}
+
+// readLegacyParquet decodes a file written with legacyLoseItLog. It returns false without
+// rows when the file already has the current schema.
+func readLegacyParquet(body []byte) ([]*LoseItLog, bool, error) {
+	f, err := parquet.OpenFile(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, false, err
+	}
+	if _, ok := f.Schema().Lookup(legacyColumn); !ok {
+		return nil, false, nil
+	}
+
+	rows, err := parquet.Read[legacyLoseItLog](bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, false, err
+	}
+	logs := make([]*LoseItLog, len(rows))
+	for i := range rows {
+		row := LoseItLog(rows[i])
+		logs[i] = &row
+	}
+	return logs, true, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestRunMigrateRewritesLegacyFiles(t *testing.T) {
+	date, calories := "08/27/2025", 250.0
+	var legacy bytes.Buffer
+	if err := parquet.Write(&legacy, []legacyLoseItLog{{Date: &date, Calories: &calories}}); err != nil {
+		t.Fatalf("write legacy parquet: %v", err)
+	}
+	current, err := writeParquet([]*LoseItLog{{Date: &date}})
+	if err != nil {
+		t.Fatalf("write parquet: %v", err)
+	}
+
+	const legacyKey = "curated/loseit_parquet/user_id=default/year=2025/month=08/day=27/part-0000.snappy.parquet"
+	mock := &mockS3{objects: map[string][]byte{
+		legacyKey: legacy.Bytes(),
+		"curated/loseit_parquet/user_id=default/year=2025/month=08/day=28/part-0000.snappy.parquet": current,
+	}}
+	oldFactory := newS3Client
+	newS3Client = func(ctx context.Context) (s3API, error) { return mock, nil }
+	defer func() { newS3Client = oldFactory }()
+
+	// A dry run only reports
+	var out bytes.Buffer
+	if err := runMigrate(context.Background(), []string{"-bucket", "test-bucket", "-dry-run"}, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mock.puts) != 0 || !strings.Contains(out.String(), "Would migrate 1 file(s); 1 already") {
+		t.Fatalf("unexpected dry run: %d puts, output %q", len(mock.puts), out.String())
+	}
+
+	out.Reset()
+	if err := runMigrate(context.Background(), []string{"-bucket", "test-bucket"}, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mock.puts) != 1 || mock.puts[0].Key != legacyKey {
+		t.Fatalf("expected only the legacy file to be rewritten, got %+v", mock.puts)
+	}
+
+	rows, err := parquet.Read[LoseItLog](bytes.NewReader(mock.puts[0].Body), int64(len(mock.puts[0].Body)))
+	if err != nil {
+		t.Fatalf("read migrated parquet: %v", err)
+	}
+	if len(rows) != 1 || rows[0].Date == nil || *rows[0].Date != date || rows[0].Calories == nil || *rows[0].Calories != calories {
+		t.Errorf("values not carried over: %+v", rows)
+	}
+	if _, legacy, _ := readLegacyParquet(mock.puts[0].Body); legacy {
+		t.Error("migrated file still has legacy columns")
+	}
+}
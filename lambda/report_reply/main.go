@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ses"
+	openai "github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+// Config holds environment variables and configuration
+type Config struct {
+	OpenAISecretArn string
+	SenderEmail     string
+	Region          string
+	RepliesPrefix   string
+	ReportsBucket   string
+	ReportsPrefix   string
+	ContextChars    int // budget for each of the report and the two food diaries in the prompt
+}
+
+// s3API captures the subset of the S3 client API we use. This enables unit testing with a mock.
+type s3API interface {
+	GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+	PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error)
+	ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error)
+}
+
+// sesAPI captures the subset of the SES client API we use.
+type sesAPI interface {
+	SendRawEmailWithContext(ctx aws.Context, input *ses.SendRawEmailInput, opts ...request.Option) (*ses.SendRawEmailOutput, error)
+}
+
+// chatCompletionAPI captures the subset of the OpenAI client we use.
+type chatCompletionAPI interface {
+	New(ctx context.Context, body openai.ChatCompletionNewParams, opts ...option.RequestOption) (*openai.ChatCompletion, error)
+}
+
+// replyClients are the clients shared by every reply in an invocation.
+type replyClients struct {
+	s3   s3API
+	ses  sesAPI
+	chat chatCompletionAPI
+}
+
+var newClients = func(config *Config) (*replyClients, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(config.Region)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %w", err)
+	}
+	apiKey, err := getOpenAIAPIKey(secretsmanager.New(sess), config.OpenAISecretArn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve OpenAI API key: %w", err)
+	}
+	// A failed call fails the message for SQS to retry; SDK retries could outlast the Lambda
+	// and leave no time to send the answer
+	client := openai.NewClient(option.WithAPIKey(apiKey), option.WithMaxRetries(0))
+	return &replyClients{s3: s3.New(sess), ses: ses.New(sess), chat: &client.Chat.Completions}, nil
+}
+
+func main() {
+	lambda.Start(handler)
+}
+
+// handler answers replies to report emails. SES stores each reply under RepliesPrefix and the
+// S3 notification reaches this Lambda through the stage's SQS queue.
+func handler(ctx context.Context, evt events.SQSEvent) (events.SQSEventResponse, error) {
+	var resp events.SQSEventResponse
+	config := &Config{
+		OpenAISecretArn: getEnvOrDefault("OPENAI_SECRET_ARN", ""),
+		SenderEmail:     getEnvOrDefault("SENDER_EMAIL", ""),
+		Region:          getEnvOrDefault("AWS_REGION", "eu-west-2"),
+		RepliesPrefix:   getEnvOrDefault("REPLIES_PREFIX", "raw/email/replies/"),
+		ReportsBucket:   getEnvOrDefault("REPORTS_BUCKET", ""),
+		ReportsPrefix:   getEnvOrDefault("REPORTS_PREFIX", "reports/"),
+		ContextChars:    getEnvIntOrDefault("CONTEXT_CHARS", defaultContextChars),
+	}
+	if err := validateConfig(config); err != nil {
+		log.Printf("Invalid configuration: %v", err)
+		return resp, err
+	}
+
+	clients, err := newClients(config)
+	if err != nil {
+		log.Printf("Failed to initialise clients: %v", err)
+		return resp, err
+	}
+
+	// Messages whose replies fail before the answer is sent are reported as batch item
+	// failures so SQS retries them; processReply skips replies that have already been answered.
+	for _, msg := range evt.Records {
+		if err := processMessage(ctx, clients, config, msg); err != nil {
+			log.Printf("Failed to process message %s: %v", msg.MessageId, err)
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: msg.MessageId})
+		}
+	}
+	return resp, nil
+}
+
+// processMessage answers the replies in one S3 notification.
+func processMessage(ctx context.Context, clients *replyClients, config *Config, msg events.SQSMessage) error {
+	var evt events.S3Event
+	if err := json.Unmarshal([]byte(msg.Body), &evt); err != nil {
+		return fmt.Errorf("failed to parse S3 event: %w", err)
+	}
+	// S3's test event when the notification is configured has no records
+	for _, rec := range evt.Records {
+		bucket := rec.S3.Bucket.Name
+		key, err := url.QueryUnescape(rec.S3.Object.Key)
+		if err != nil {
+			key = rec.S3.Object.Key
+		}
+		if !strings.HasPrefix(key, config.RepliesPrefix) {
+			log.Printf("Skipping key outside %s: %s", config.RepliesPrefix, key)
+			continue
+		}
+		if err := processReply(ctx, clients, config, bucket, key); err != nil {
+			return fmt.Errorf("failed to answer reply s3://%s/%s: %w", bucket, key, err)
+		}
+	}
+	return nil
+}
+
+func getEnvOrDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvIntOrDefault(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s value %q, using %d: %v", key, value, defaultValue, err)
+		return defaultValue
+	}
+	return parsed
+}
+
+func validateConfig(config *Config) error {
+	if config.OpenAISecretArn == "" {
+		return fmt.Errorf("OPENAI_SECRET_ARN environment variable is required")
+	}
+	if config.SenderEmail == "" {
+		return fmt.Errorf("SENDER_EMAIL environment variable is required")
+	}
+	if config.ReportsBucket == "" {
+		return fmt.Errorf("REPORTS_BUCKET environment variable is required")
+	}
+	return nil
+}
+
+func getOpenAIAPIKey(secretsClient *secretsmanager.SecretsManager, secretArn string) (string, error) {
+	result, err := secretsClient.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretArn),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret value: %w", err)
+	}
+	if result.SecretString == nil {
+		return "", fmt.Errorf("secret value is empty")
+	}
+
+	// The secret is either the bare key or JSON with an openai_api_key field, as for weekly_report
+	var secretData map[string]string
+	if err := json.Unmarshal([]byte(*result.SecretString), &secretData); err == nil {
+		if apiKey, exists := secretData["openai_api_key"]; exists {
+			return apiKey, nil
+		}
+		return "", fmt.Errorf("openai_api_key field not found in secret JSON")
+	}
+	return *result.SecretString, nil
+}
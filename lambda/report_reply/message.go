@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// inboundReply is what we need from a reply to a report email.
+type inboundReply struct {
+	MessageID  string // without angle brackets
+	From       string // bare address, lower-cased
+	Subject    string
+	Date       time.Time
+	References []string // In-Reply-To first, then References from newest to oldest
+	Question   string   // the new text above the quoted report
+	headers    map[string]string
+}
+
+var messageIDRe = regexp.MustCompile(`<([^<>\s]+)>`)
+
+func parseInboundReply(env *enmime.Envelope) *inboundReply {
+	in := &inboundReply{
+		MessageID: strings.Trim(strings.TrimSpace(env.GetHeader("Message-ID")), "<>"),
+		From:      senderAddress(env.GetHeader("From")),
+		Subject:   env.GetHeader("Subject"),
+		Date:      time.Now(),
+		Question:  extractQuestion(env.Text),
+		headers:   map[string]string{},
+	}
+	if d, err := env.Date(); err == nil {
+		in.Date = d
+	}
+	for _, h := range []string{"Auto-Submitted", "Precedence", "X-Autoreply", "X-Autorespond", "X-SES-Spam-Verdict", "X-SES-Virus-Verdict"} {
+		in.headers[h] = strings.ToLower(strings.TrimSpace(env.GetHeader(h)))
+	}
+
+	seen := map[string]bool{}
+	add := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			in.References = append(in.References, id)
+		}
+	}
+	for _, m := range messageIDRe.FindAllStringSubmatch(env.GetHeader("In-Reply-To"), -1) {
+		add(m[1])
+	}
+	refs := messageIDRe.FindAllStringSubmatch(env.GetHeader("References"), -1)
+	for i := len(refs) - 1; i >= 0; i-- {
+		add(refs[i][1])
+	}
+	return in
+}
+
+// skipReason explains why a message should not be answered, or returns "" if it should.
+// Auto-replies and bounces are dropped so we never get into a loop with another robot.
+func (in *inboundReply) skipReason(senderEmail string) string {
+	switch {
+	case in.From == "":
+		return "no From address"
+	case in.From == senderAddress(senderEmail) || strings.HasPrefix(in.From, "mailer-daemon@"):
+		return "sent by a mail system"
+	case in.headers["Auto-Submitted"] != "" && in.headers["Auto-Submitted"] != "no":
+		return "auto-submitted"
+	case in.headers["X-Autoreply"] != "" || in.headers["X-Autorespond"] != "":
+		return "auto-reply"
+	case in.headers["Precedence"] == "bulk" || in.headers["Precedence"] == "junk" || in.headers["Precedence"] == "list" || in.headers["Precedence"] == "auto_reply":
+		return "bulk mail"
+	case in.headers["X-SES-Spam-Verdict"] == "fail" || in.headers["X-SES-Virus-Verdict"] == "fail":
+		return "failed the SES spam or virus scan"
+	case len(in.References) == 0:
+		return "not a reply"
+	}
+	return ""
+}
+
+// quoteHeaderRe matches the line mail clients put above the quoted message, e.g.
+// "On Sun, 21 Sep 2025 at 18:00, MailMunch <reports@example.com> wrote:".
+var quoteHeaderRe = regexp.MustCompile(`(?i)^(on .+ wrote:|-+ ?original message ?-+|from: .+|sent from my .+)$`)
+
+// extractQuestion returns the text written above the quoted report.
+func extractQuestion(text string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, ">") || quoteHeaderRe.MatchString(trimmed) || trimmed == "--" {
+			break
+		}
+		lines = append(lines, strings.TrimRight(line, " \t"))
+	}
+	return truncateString(strings.TrimSpace(strings.Join(lines, "\n")), maxQuestionChars)
+}
+
+// truncateString keeps the first maxLen characters of input, so a multi-byte character is
+// never cut in half.
+func truncateString(input string, maxLen int) string {
+	if utf8.RuneCountInString(input) <= maxLen {
+		return input
+	}
+	return string([]rune(input)[:maxLen])
+}
+
+// outboundReply is our answer, threaded under the message it answers.
+type outboundReply struct {
+	From       string
+	To         string
+	Subject    string
+	Date       time.Time
+	MessageID  string // without angle brackets
+	InReplyTo  string
+	References []string
+	Body       string
+}
+
+func newOutboundReply(from, to string, in *inboundReply, answer string, now time.Time) *outboundReply {
+	domain := "mailmunch.invalid"
+	if _, d, ok := strings.Cut(senderAddress(from), "@"); ok {
+		domain = d
+	}
+	subject := strings.TrimSpace(in.Subject)
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	// References carries the thread from oldest to newest, ending with the message answered
+	refs := make([]string, 0, len(in.References)+1)
+	for i := len(in.References) - 1; i >= 0; i-- {
+		refs = append(refs, in.References[i])
+	}
+	if in.MessageID != "" {
+		refs = append(refs, in.MessageID)
+	}
+
+	var body strings.Builder
+	body.WriteString(answer)
+	body.WriteString("\n\n")
+	fmt.Fprintf(&body, "On %s, %s wrote:\n", in.Date.Format("Mon, 2 Jan 2006 at 15:04"), in.From)
+	for _, line := range strings.Split(in.Question, "\n") {
+		body.WriteString("> " + line + "\n")
+	}
+
+	return &outboundReply{
+		From:       from,
+		To:         to,
+		Subject:    subject,
+		Date:       now,
+		MessageID:  fmt.Sprintf("reply.%d@%s", now.UnixNano(), domain),
+		InReplyTo:  in.MessageID,
+		References: refs,
+		Body:       body.String(),
+	}
+}
+
+// buildReplyEmail renders the answer as a plain text message for SES SendRawEmail.
+func buildReplyEmail(r *outboundReply) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", r.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", r.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", r.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", r.Date.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s>\r\n", r.MessageID)
+	if r.InReplyTo != "" {
+		fmt.Fprintf(&buf, "In-Reply-To: <%s>\r\n", r.InReplyTo)
+	}
+	if len(r.References) > 0 {
+		fmt.Fprintf(&buf, "References: <%s>\r\n", strings.Join(r.References, ">\r\n <"))
+	}
+	buf.WriteString("Auto-Submitted: auto-replied\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(r.Body)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// senderAddress returns the bare address of a From header, lower-cased.
+func senderAddress(from string) string {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(addr.Address)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+const testReply = "From: Alice <Alice@Example.com>\r\n" +
+	"To: reports@mailmunch.example\r\n" +
+	"Subject: Re: Weekly Nutrition Report - 2025-09-15 to 2025-09-21\r\n" +
+	"Date: Mon, 22 Sep 2025 09:30:00 +0100\r\n" +
+	"Message-ID: <CAF123@mail.example.com>\r\n" +
+	"In-Reply-To: <0102018abc-000000@eu-west-2.amazonses.com>\r\n" +
+	"References: <report-thread.alice.week@mailmunch.example>\r\n" +
+	" <0102018abc-000000@eu-west-2.amazonses.com>\r\n" +
+	"Content-Type: text/plain; charset=UTF-8\r\n" +
+	"\r\n" +
+	"What should I eat instead of crisps?\r\n" +
+	"I snack in the evening.\r\n" +
+	"\r\n" +
+	"On Sun, 21 Sep 2025 at 18:00, MailMunch <reports@mailmunch.example> wrote:\r\n" +
+	"> Weekly Nutrition Report\r\n" +
+	"> Crisps: 3 times\r\n"
+
+func parseTestReply(t *testing.T, raw string) *inboundReply {
+	t.Helper()
+	env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("failed to parse reply: %v", err)
+	}
+	return parseInboundReply(env)
+}
+
+func TestParseInboundReply(t *testing.T) {
+	in := parseTestReply(t, testReply)
+
+	if in.MessageID != "CAF123@mail.example.com" || in.From != "alice@example.com" {
+		t.Errorf("unexpected headers: %+v", in)
+	}
+	want := []string{"0102018abc-000000@eu-west-2.amazonses.com", "report-thread.alice.week@mailmunch.example"}
+	if strings.Join(in.References, " ") != strings.Join(want, " ") {
+		t.Errorf("references = %v, want %v", in.References, want)
+	}
+	if in.Question != "What should I eat instead of crisps?\nI snack in the evening." {
+		t.Errorf("unexpected question %q", in.Question)
+	}
+	if reason := in.skipReason("MailMunch <reports@mailmunch.example>"); reason != "" {
+		t.Errorf("expected reply to be answered, skipped: %s", reason)
+	}
+}
+
+func TestSkipReason(t *testing.T) {
+	for name, header := range map[string]string{
+		"auto-submitted": "Auto-Submitted: auto-replied\r\n",
+		"out of office":  "X-Autoreply: yes\r\n",
+		"bulk":           "Precedence: bulk\r\n",
+		"spam":           "X-SES-Spam-Verdict: FAIL\r\n",
+	} {
+		in := parseTestReply(t, header+testReply)
+		if in.skipReason("reports@mailmunch.example") == "" {
+			t.Errorf("%s: expected message to be skipped", name)
+		}
+	}
+
+	in := parseTestReply(t, testReply)
+	if in.skipReason("alice@example.com") == "" {
+		t.Error("expected our own messages to be skipped")
+	}
+
+	noRefs := strings.NewReplacer("In-Reply-To", "X-In-Reply-To", "References", "X-References").Replace(testReply)
+	if parseTestReply(t, noRefs).skipReason("reports@mailmunch.example") == "" {
+		t.Error("expected a message that is not a reply to be skipped")
+	}
+}
+
+func TestExtractQuestion(t *testing.T) {
+	for in, want := range map[string]string{
+		"Thanks!\n\n-----Original Message-----\nFrom: x": "Thanks!",
+		"Is 30g fibre enough?\n--\nAlice\n":              "Is 30g fibre enough?",
+		"Why?\n\nSent from my iPhone\n\n> quoted":        "Why?",
+		"> only quoted text\n":                           "",
+		"\n  Multi\n  line  \n\nquestion\n":              "Multi\n  line\n\nquestion",
+	} {
+		if got := extractQuestion(in); got != want {
+			t.Errorf("extractQuestion(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if got := extractQuestion(strings.Repeat("a", maxQuestionChars+10)); len(got) != maxQuestionChars {
+		t.Errorf("expected question clipped to %d chars, got %d", maxQuestionChars, len(got))
+	}
+	if got := extractQuestion(strings.Repeat("é", maxQuestionChars+10)); got != strings.Repeat("é", maxQuestionChars) {
+		t.Errorf("expected question clipped to %d whole characters, got %d bytes", maxQuestionChars, len(got))
+	}
+}
+
+func TestBuildReplyEmailThreads(t *testing.T) {
+	in := parseTestReply(t, testReply)
+	now := time.Date(2025, 9, 22, 9, 31, 0, 0, time.UTC)
+	out := newOutboundReply("MailMunch <reports@mailmunch.example>", "alice@example.com", in, "Try popcorn: 100 kcal a bowl.", now)
+
+	if out.Subject != "Re: Weekly Nutrition Report - 2025-09-15 to 2025-09-21" {
+		t.Errorf("subject should not get a second Re:, got %q", out.Subject)
+	}
+	if !strings.HasSuffix(out.MessageID, "@mailmunch.example") {
+		t.Errorf("Message-ID should use the sender domain, got %q", out.MessageID)
+	}
+
+	raw, err := buildReplyEmail(out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("reply is not a valid message: %v", err)
+	}
+	if got := msg.Header.Get("In-Reply-To"); got != "<CAF123@mail.example.com>" {
+		t.Errorf("In-Reply-To = %q", got)
+	}
+	wantRefs := "<report-thread.alice.week@mailmunch.example> <0102018abc-000000@eu-west-2.amazonses.com> <CAF123@mail.example.com>"
+	if got := strings.Join(strings.Fields(msg.Header.Get("References")), " "); got != wantRefs {
+		t.Errorf("References = %q, want %q", got, wantRefs)
+	}
+	if msg.Header.Get("Auto-Submitted") != "auto-replied" {
+		t.Error("answers should be marked auto-replied")
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("failed to parse reply body: %v", err)
+	}
+	if !strings.HasPrefix(env.Text, "Try popcorn: 100 kcal a bowl.") || !strings.Contains(env.Text, "> What should I eat instead of crisps?") {
+		t.Errorf("unexpected body:\n%s", env.Text)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/jhillyerd/enmime"
+	openai "github.com/openai/openai-go"
+	"github.com/openai/openai-go/shared"
+)
+
+const (
+	openAIChatModel = "gpt-5"
+
+	// defaultContextChars keeps the report and two periods of food diary to roughly 40k tokens.
+	defaultContextChars = 50000
+
+	// maxQuestionChars stops a pasted essay from dominating the prompt.
+	maxQuestionChars = 4000
+
+	// maxHistory is how many earlier questions and answers in the thread are replayed.
+	maxHistory = 5
+
+	// sendReserve is the slice of the Lambda deadline kept back for emailing the answer and
+	// saving the exchange once the model has replied.
+	sendReserve = 20 * time.Second
+)
+
+const followUpSystemPrompt = `You are the nutrition coach who wrote the report below, answering a follow-up question by email.
+Use the report and the person's LoseIt food diary to give a specific answer: refer to foods and days they actually logged and suggest concrete alternatives with approximate calories and protein.
+Keep it short enough to read on a phone, in plain text without Markdown headings or tables.
+If the question is not about food, nutrition or the report, say briefly that you can only help with those.`
+
+// reportIndexEntry is written by weekly_report under <REPORTS_PREFIX>message-index/ for every
+// Message-ID of a report email, and by this Lambda for its answers so the thread can continue.
+type reportIndexEntry struct {
+	UserID          string `json:"user_id"`
+	RunID           string `json:"run_id"`
+	Period          string `json:"period"`
+	PeriodStart     string `json:"period_start"`
+	PeriodEnd       string `json:"period_end"`
+	Recipient       string `json:"recipient"`
+	Subject         string `json:"subject"`
+	ArtifactsPrefix string `json:"artifacts_prefix"`
+}
+
+// exchange is one answered question, stored under <artifacts>/replies/ with the report.
+type exchange struct {
+	MessageID      string `json:"message_id"`
+	ReceivedAt     string `json:"received_at"`
+	From           string `json:"from"`
+	Question       string `json:"question"`
+	Answer         string `json:"answer"`
+	EmailMessageID string `json:"email_message_id"`
+	Model          string `json:"model"`
+	PromptTokens   int64  `json:"prompt_tokens"`
+	TotalTokens    int64  `json:"total_tokens"`
+}
+
+// reportContext is what the report run saved about the period.
+type reportContext struct {
+	Report       string
+	CurrentWeek  string
+	PreviousWeek string
+}
+
+// processReply answers one stored reply email in the thread of the report it refers to.
+func processReply(ctx context.Context, clients *replyClients, config *Config, bucket, key string) error {
+	raw, found, err := getObject(ctx, clients.s3, bucket, key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		log.Printf("Reply s3://%s/%s no longer exists", bucket, key)
+		return nil
+	}
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		// A malformed message will not parse on retry either
+		log.Printf("Ignoring unparseable reply %s: %v", key, err)
+		return nil
+	}
+
+	in := parseInboundReply(env)
+	if reason := in.skipReason(config.SenderEmail); reason != "" {
+		log.Printf("Ignoring reply %s: %s", key, reason)
+		return nil
+	}
+
+	entry, err := findReport(ctx, clients.s3, config, in.References)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		log.Printf("Ignoring reply %s: no report found for %v", key, in.References)
+		return nil
+	}
+	// Answers always go to the report's recipient, so only they may ask
+	if !strings.EqualFold(in.From, entry.Recipient) {
+		log.Printf("Ignoring reply %s: sender %s is not the recipient of report %s", key, in.From, entry.RunID)
+		return nil
+	}
+	if in.Question == "" {
+		log.Printf("Ignoring reply %s: no question above the quoted report", key)
+		return nil
+	}
+
+	repliesPrefix := entry.ArtifactsPrefix + "replies/"
+	exchangeKey := repliesPrefix + sanitizeID(in.MessageID) + ".json"
+	if _, answered, err := getObject(ctx, clients.s3, config.ReportsBucket, exchangeKey); err != nil {
+		return err
+	} else if answered {
+		log.Printf("Reply %s has already been answered", in.MessageID)
+		return nil
+	}
+
+	log.Printf("Answering %d char question from user %s about report %s", len(in.Question), entry.UserID, entry.RunID)
+
+	report, err := loadReportContext(ctx, clients.s3, config.ReportsBucket, entry.ArtifactsPrefix)
+	if err != nil {
+		return err
+	}
+	history, err := loadHistory(ctx, clients.s3, config.ReportsBucket, repliesPrefix)
+	if err != nil {
+		return err
+	}
+
+	params := buildConversation(entry, report, history, in.Question, config.ContextChars)
+	answerCtx, cancel := answerContext(ctx)
+	answer, usage, err := requestAnswer(answerCtx, clients.chat, params)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	out := newOutboundReply(config.SenderEmail, entry.Recipient, in, answer, time.Now())
+	rawReply, err := buildReplyEmail(out)
+	if err != nil {
+		return fmt.Errorf("failed to build reply email: %w", err)
+	}
+	sent, err := clients.ses.SendRawEmailWithContext(ctx, &ses.SendRawEmailInput{
+		Destinations: []*string{aws.String(out.To)},
+		Source:       aws.String(out.From),
+		RawMessage:   &ses.RawMessage{Data: rawReply},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+	sesID := aws.StringValue(sent.MessageId)
+	log.Printf("Answer sent to %s. MessageID: %s", out.To, sesID)
+
+	// The answer has gone out; failures from here on are logged rather than retried
+	record := exchange{
+		MessageID:      in.MessageID,
+		ReceivedAt:     in.Date.UTC().Format(time.RFC3339),
+		From:           in.From,
+		Question:       in.Question,
+		Answer:         answer,
+		EmailMessageID: sesID,
+		Model:          openAIChatModel,
+		PromptTokens:   usage.PromptTokens,
+		TotalTokens:    usage.TotalTokens,
+	}
+	if err := putJSON(ctx, clients.s3, config.ReportsBucket, exchangeKey, record); err != nil {
+		log.Printf("Failed to record answer: %v", err)
+	}
+	for _, id := range []string{sesID, out.MessageID} {
+		if err := putJSON(ctx, clients.s3, config.ReportsBucket, messageIndexKey(config.ReportsPrefix, id), entry); err != nil {
+			log.Printf("Failed to index answer %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// findReport returns the index entry of the first referenced message that has one, or nil.
+func findReport(ctx context.Context, s3c s3API, config *Config, messageIDs []string) (*reportIndexEntry, error) {
+	for _, id := range messageIDs {
+		body, found, err := getObject(ctx, s3c, config.ReportsBucket, messageIndexKey(config.ReportsPrefix, id))
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		entry := &reportIndexEntry{}
+		if err := json.Unmarshal(body, entry); err != nil {
+			return nil, fmt.Errorf("invalid message index entry for %s: %w", id, err)
+		}
+		return entry, nil
+	}
+	return nil, nil
+}
+
+// messageIndexKey mirrors weekly_report: <prefix>message-index/<local part of the Message-ID>.json.
+func messageIndexKey(prefix, messageID string) string {
+	id := strings.Trim(strings.TrimSpace(messageID), "<>")
+	if at := strings.LastIndex(id, "@"); at >= 0 {
+		id = id[:at]
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + "message-index/" + sanitizeID(id) + ".json"
+}
+
+// sanitizeID makes a Message-ID safe to use in an S3 key.
+func sanitizeID(id string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._-+=", r) {
+			return r
+		}
+		return '_'
+	}, strings.Trim(id, "<>"))
+}
+
+func loadReportContext(ctx context.Context, s3c s3API, bucket, artifactsPrefix string) (*reportContext, error) {
+	report := &reportContext{}
+	for _, f := range []struct {
+		name string
+		dst  *string
+	}{
+		{"report.txt", &report.Report},
+		{"current_week.csv", &report.CurrentWeek},
+		{"previous_week.csv", &report.PreviousWeek},
+	} {
+		body, found, err := getObject(ctx, s3c, bucket, artifactsPrefix+f.name)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			log.Printf("Warning: report artifact %s%s is missing", artifactsPrefix, f.name)
+		}
+		*f.dst = string(body)
+	}
+	return report, nil
+}
+
+// loadHistory returns the most recent earlier exchanges about the report, oldest first.
+func loadHistory(ctx context.Context, s3c s3API, bucket, prefix string) ([]exchange, error) {
+	var history []exchange
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix)}
+	for {
+		page, err := s3c.ListObjectsV2WithContext(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+		for _, obj := range page.Contents {
+			body, found, err := getObject(ctx, s3c, bucket, aws.StringValue(obj.Key))
+			if err != nil {
+				return nil, err
+			}
+			var e exchange
+			if !found || json.Unmarshal(body, &e) != nil {
+				continue
+			}
+			history = append(history, e)
+		}
+		if !aws.BoolValue(page.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = page.NextContinuationToken
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].ReceivedAt < history[j].ReceivedAt })
+	if len(history) > maxHistory {
+		history = history[len(history)-maxHistory:]
+	}
+	return history, nil
+}
+
+// buildConversation replays the report, earlier questions in the thread and the new question.
+func buildConversation(entry *reportIndexEntry, report *reportContext, history []exchange, question string, contextChars int) openai.ChatCompletionNewParams {
+	var b strings.Builder
+	fmt.Fprintf(&b, "REPORT: %s (%s to %s)\n\n%s\n\n", entry.Subject, entry.PeriodStart, entry.PeriodEnd, clip(report.Report, contextChars))
+	fmt.Fprintf(&b, "FOOD DIARY FOR THE REPORT PERIOD (CSV):\n%s\n\n", clip(report.CurrentWeek, contextChars))
+	fmt.Fprintf(&b, "FOOD DIARY FOR THE PERIOD BEFORE (CSV):\n%s", clip(report.PreviousWeek, contextChars))
+
+	messages := []openai.ChatCompletionMessageParamUnion{
+		openai.SystemMessage(followUpSystemPrompt),
+		openai.UserMessage(b.String()),
+		openai.AssistantMessage("I have the report and food diary. What would you like to know?"),
+	}
+	for _, e := range history {
+		messages = append(messages, openai.UserMessage(e.Question), openai.AssistantMessage(e.Answer))
+	}
+	messages = append(messages, openai.UserMessage(question))
+
+	return openai.ChatCompletionNewParams{
+		Model:               shared.ChatModel(openAIChatModel),
+		Messages:            messages,
+		MaxCompletionTokens: openai.Int(8000),
+	}
+}
+
+// clip keeps the start of s within limit bytes, noting how much was left out.
+func clip(s string, limit int) string {
+	if limit <= 0 || len(s) <= limit {
+		return s
+	}
+	cut := strings.LastIndex(s[:limit], "\n")
+	if cut < 0 {
+		cut = limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+	}
+	return fmt.Sprintf("%s\n[... %d more characters omitted]", s[:cut], len(s)-cut)
+}
+
+// answerContext derives the deadline for the model call from the Lambda context. A call that
+// runs out of time fails the message, which SQS retries, instead of the invocation timing out
+// while the answer is being sent.
+func answerContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline.Add(-sendReserve))
+}
+
+func requestAnswer(ctx context.Context, client chatCompletionAPI, params openai.ChatCompletionNewParams) (string, openai.CompletionUsage, error) {
+	resp, err := client.New(ctx, params)
+	if err != nil {
+		return "", openai.CompletionUsage{}, fmt.Errorf("OpenAI API error: %w", err)
+	}
+	if resp == nil || len(resp.Choices) == 0 {
+		return "", openai.CompletionUsage{}, fmt.Errorf("no response from OpenAI")
+	}
+	log.Printf("OpenAI completion usage: prompt=%d completion=%d total=%d (finish_reason=%s)",
+		resp.Usage.PromptTokens, resp.Usage.CompletionTokens, resp.Usage.TotalTokens, resp.Choices[0].FinishReason)
+
+	answer := strings.TrimSpace(resp.Choices[0].Message.Content)
+	if answer == "" {
+		return "", resp.Usage, fmt.Errorf("OpenAI returned an empty answer (finish_reason=%s)", resp.Choices[0].FinishReason)
+	}
+	return answer, resp.Usage, nil
+}
+
+// getObject returns the object body, or found=false when the key does not exist.
+func getObject(ctx context.Context, s3c s3API, bucket, key string) ([]byte, bool, error) {
+	obj, err := s3c.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to get s3://%s/%s: %w", bucket, key, err)
+	}
+	defer obj.Body.Close()
+	body, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read s3://%s/%s: %w", bucket, key, err)
+	}
+	return body, true, nil
+}
+
+func putJSON(ctx context.Context, s3c s3API, bucket, key string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := s3c.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}); err != nil {
+		return fmt.Errorf("failed to put s3://%s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
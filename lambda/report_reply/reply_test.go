@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ses"
+	openai "github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+// mockS3 is an in-memory bucket.
+type mockS3 struct {
+	objects map[string]string
+}
+
+func (m *mockS3) GetObjectWithContext(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	body, ok := m.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+func (m *mockS3) PutObjectWithContext(_ aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	body, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.objects[aws.StringValue(input.Key)] = string(body)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *mockS3) ListObjectsV2WithContext(_ aws.Context, input *s3.ListObjectsV2Input, _ ...request.Option) (*s3.ListObjectsV2Output, error) {
+	var keys []string
+	for k := range m.objects {
+		if strings.HasPrefix(k, aws.StringValue(input.Prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{}
+	for _, k := range keys {
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(k)})
+	}
+	return out, nil
+}
+
+type mockSES struct {
+	sent []*ses.SendRawEmailInput
+}
+
+func (m *mockSES) SendRawEmailWithContext(_ aws.Context, input *ses.SendRawEmailInput, _ ...request.Option) (*ses.SendRawEmailOutput, error) {
+	m.sent = append(m.sent, input)
+	return &ses.SendRawEmailOutput{MessageId: aws.String("0102018def-000000")}, nil
+}
+
+type mockChat struct {
+	answer string
+	calls  []openai.ChatCompletionNewParams
+}
+
+func (m *mockChat) New(_ context.Context, params openai.ChatCompletionNewParams, _ ...option.RequestOption) (*openai.ChatCompletion, error) {
+	m.calls = append(m.calls, params)
+	return &openai.ChatCompletion{
+		Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: m.answer}, FinishReason: "stop"}},
+		Usage:   openai.CompletionUsage{PromptTokens: 900, CompletionTokens: 100, TotalTokens: 1000},
+	}, nil
+}
+
+const testArtifacts = "reports/user_id=alice/year=2025/week=38/20250922T080005Z/"
+
+func testReplySetup() (*replyClients, *Config, *mockS3, *mockSES, *mockChat) {
+	entry, _ := json.Marshal(reportIndexEntry{
+		UserID: "alice", RunID: "20250922T080005Z", Period: "week", PeriodStart: "2025-09-15", PeriodEnd: "2025-09-21",
+		Recipient: "alice@example.com", Subject: "Weekly Nutrition Report", ArtifactsPrefix: testArtifacts,
+	})
+	store := &mockS3{objects: map[string]string{
+		"raw/email/replies/abc":                              testReply,
+		"reports/message-index/0102018abc-000000.json":       string(entry),
+		testArtifacts + "report.txt":                         "Crisps were your top snack.",
+		testArtifacts + "current_week.csv":                   "date,food_name,calories\n09/15/2025,Crisps,250\n",
+		testArtifacts + "previous_week.csv":                  "date,food_name,calories\n",
+		testArtifacts + "replies/earlier.json":               `{"question":"Was Monday ok?","answer":"Yes.","received_at":"2025-09-22T07:00:00Z"}`,
+		"reports/message-index/unrelated-report-thread.json": `{}`,
+	}}
+	sesMock := &mockSES{}
+	chat := &mockChat{answer: "Try popcorn."}
+	config := &Config{SenderEmail: "reports@mailmunch.example", RepliesPrefix: "raw/email/replies/", ReportsBucket: "bucket", ReportsPrefix: "reports/", ContextChars: defaultContextChars}
+	return &replyClients{s3: store, ses: sesMock, chat: chat}, config, store, sesMock, chat
+}
+
+func TestProcessReplyAnswersInThread(t *testing.T) {
+	clients, config, store, sesMock, chat := testReplySetup()
+
+	if err := processReply(context.Background(), clients, config, "bucket", "raw/email/replies/abc"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sesMock.sent) != 1 || aws.StringValue(sesMock.sent[0].Destinations[0]) != "alice@example.com" {
+		t.Fatalf("expected one answer to alice, got %+v", sesMock.sent)
+	}
+	if !strings.Contains(string(sesMock.sent[0].RawMessage.Data), "In-Reply-To: <CAF123@mail.example.com>") {
+		t.Error("answer is not threaded under the reply")
+	}
+
+	// The prompt carries the report, the food diary, the earlier exchange and the question
+	messages := chat.calls[0].Messages
+	if len(messages) != 6 {
+		t.Fatalf("expected system, context, ack, earlier Q&A and question messages, got %d", len(messages))
+	}
+	prompt, _ := json.Marshal(messages)
+	for _, want := range []string{"Crisps were your top snack.", "09/15/2025,Crisps,250", "Was Monday ok?", "What should I eat instead of crisps?"} {
+		if !strings.Contains(string(prompt), want) {
+			t.Errorf("prompt is missing %q", want)
+		}
+	}
+
+	var record exchange
+	if err := json.Unmarshal([]byte(store.objects[testArtifacts+"replies/CAF123_mail.example.com.json"]), &record); err != nil {
+		t.Fatalf("exchange not recorded: %v", err)
+	}
+	if record.Answer != "Try popcorn." || record.EmailMessageID != "0102018def-000000" || record.TotalTokens != 1000 {
+		t.Errorf("unexpected exchange %+v", record)
+	}
+	if _, ok := store.objects["reports/message-index/0102018def-000000.json"]; !ok {
+		t.Error("answer should be indexed so replies to it continue the conversation")
+	}
+
+	// A redelivered event does not answer twice
+	if err := processReply(context.Background(), clients, config, "bucket", "raw/email/replies/abc"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sesMock.sent) != 1 {
+		t.Errorf("expected the duplicate to be skipped, sent %d answers", len(sesMock.sent))
+	}
+}
+
+func TestProcessReplyIgnoresOtherSenders(t *testing.T) {
+	clients, config, store, sesMock, chat := testReplySetup()
+	store.objects["raw/email/replies/abc"] = strings.Replace(testReply, "Alice <Alice@Example.com>", "mallory@example.net", 1)
+
+	if err := processReply(context.Background(), clients, config, "bucket", "raw/email/replies/abc"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sesMock.sent) != 0 || len(chat.calls) != 0 {
+		t.Error("only the report's recipient may ask questions")
+	}
+}
+
+func TestProcessReplyIgnoresUnknownThreads(t *testing.T) {
+	clients, config, store, sesMock, _ := testReplySetup()
+	delete(store.objects, "reports/message-index/0102018abc-000000.json")
+
+	if err := processReply(context.Background(), clients, config, "bucket", "raw/email/replies/abc"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sesMock.sent) != 0 {
+		t.Error("replies to unknown messages should be ignored")
+	}
+}
+
+func TestClip(t *testing.T) {
+	if got := clip("short", 100); got != "short" {
+		t.Errorf("unexpected %q", got)
+	}
+	if got := clip("line one\nline two\nline three", 15); got != "line one\n[... 20 more characters omitted]" {
+		t.Errorf("unexpected %q", got)
+	}
+	if got := clip("ééé", 3); got != "é\n[... 4 more characters omitted]" {
+		t.Errorf("unexpected %q", got)
+	}
+}
+
+func TestAnswerContextReservesSendTime(t *testing.T) {
+	deadline := time.Now().Add(2 * time.Minute)
+	parent, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	ctx, answerCancel := answerContext(parent)
+	defer answerCancel()
+
+	got, ok := ctx.Deadline()
+	if !ok || !got.Equal(deadline.Add(-sendReserve)) {
+		t.Errorf("expected deadline %v, got %v", deadline.Add(-sendReserve), got)
+	}
+}
+
+func TestHandlerReportsFailedMessages(t *testing.T) {
+	clients, _, _, sesMock, _ := testReplySetup()
+	old := newClients
+	newClients = func(*Config) (*replyClients, error) { return clients, nil }
+	defer func() { newClients = old }()
+	t.Setenv("OPENAI_SECRET_ARN", "arn:aws:secretsmanager:eu-west-2:123456789012:secret:openai")
+	t.Setenv("SENDER_EMAIL", "reports@mailmunch.example")
+	t.Setenv("REPORTS_BUCKET", "bucket")
+
+	var evt events.SQSEvent
+	for i, key := range []string{"raw/email/replies/abc", "raw/email/replies/gone"} {
+		body, _ := json.Marshal(events.S3Event{Records: []events.S3EventRecord{{
+			S3: events.S3Entity{Bucket: events.S3Bucket{Name: "bucket"}, Object: events.S3Object{Key: key}},
+		}}})
+		evt.Records = append(evt.Records, events.SQSMessage{MessageId: fmt.Sprintf("msg-%d", i), Body: string(body)})
+	}
+	evt.Records = append(evt.Records, events.SQSMessage{MessageId: "not-json", Body: "{"})
+
+	resp, err := handler(context.Background(), evt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var failed []string
+	for _, f := range resp.BatchItemFailures {
+		failed = append(failed, f.ItemIdentifier)
+	}
+	// A reply deleted since the notification is skipped rather than retried
+	if strings.Join(failed, ",") != "not-json" {
+		t.Errorf("expected only the unreadable message to fail, got %v", failed)
+	}
+	if len(sesMock.sent) != 1 {
+		t.Errorf("expected the good reply in the batch to be answered, sent %d", len(sesMock.sent))
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// actionPlanSteps is the number of steps the AI must return in the weekly plan.
+const actionPlanSteps = 5
+
+// StructuredAnalysis is the JSON document the model returns when structured output succeeds.
+type StructuredAnalysis struct {
+	Summary       string        `json:"summary"`
+	Wins          []string      `json:"wins"`
+	Concerns      []string      `json:"concerns"`
+	FoodSwaps     []FoodSwap    `json:"food_swaps"`
+	ProteinTiming ProteinTiming `json:"protein_timing"`
+	ActionPlan    []string      `json:"action_plan"`
+}
+
+// FoodSwap suggests replacing a logged food with a better alternative.
+type FoodSwap struct {
+	InsteadOf string `json:"instead_of"`
+	Try       string `json:"try"`
+	Reason    string `json:"reason"`
+}
+
+// ProteinTiming captures the protein distribution assessment and advice.
+type ProteinTiming struct {
+	Assessment      string   `json:"assessment"`
+	Recommendations []string `json:"recommendations"`
+}
+
+// ReportAnalysis is the outcome of the AI step. Exactly one of Structured or Markdown is set.
+type ReportAnalysis struct {
+	Structured *StructuredAnalysis
+	Markdown   string
+}
+
+// analysisJSONSchema describes StructuredAnalysis for OpenAI structured outputs (strict mode).
+var analysisJSONSchema = map[string]any{
+	"type":                 "object",
+	"additionalProperties": false,
+	"required":             []string{"summary", "wins", "concerns", "food_swaps", "protein_timing", "action_plan"},
+	"properties": map[string]any{
+		"summary": map[string]any{
+			"type":        "string",
+			"description": "Week-over-week comparison of calories, macronutrients and overall diet quality.",
+		},
+		"wins": map[string]any{
+			"type":        "array",
+			"description": "Things that went well this week.",
+			"items":       map[string]any{"type": "string"},
+		},
+		"concerns": map[string]any{
+			"type":        "array",
+			"description": "Issues to address, such as excess sugar or sodium, low fibre or processed foods.",
+			"items":       map[string]any{"type": "string"},
+		},
+		"food_swaps": map[string]any{
+			"type":        "array",
+			"description": "Specific swaps for foods that were actually logged.",
+			"items": map[string]any{
+				"type":                 "object",
+				"additionalProperties": false,
+				"required":             []string{"instead_of", "try", "reason"},
+				"properties": map[string]any{
+					"instead_of": map[string]any{"type": "string"},
+					"try":        map[string]any{"type": "string"},
+					"reason":     map[string]any{"type": "string"},
+				},
+			},
+		},
+		"protein_timing": map[string]any{
+			"type":                 "object",
+			"additionalProperties": false,
+			"required":             []string{"assessment", "recommendations"},
+			"properties": map[string]any{
+				"assessment":      map[string]any{"type": "string"},
+				"recommendations": map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+			},
+		},
+		"action_plan": map[string]any{
+			"type":        "array",
+			"description": fmt.Sprintf("Exactly %d specific, actionable steps for next week.", actionPlanSteps),
+			"items":       map[string]any{"type": "string"},
+		},
+	},
+}
+
+// parseStructuredAnalysis decodes and validates the model's JSON response.
+func parseStructuredAnalysis(content string) (*StructuredAnalysis, error) {
+	trimmed := strings.TrimSpace(content)
+	if trimmed == "" {
+		return nil, fmt.Errorf("empty structured analysis")
+	}
+
+	var analysis StructuredAnalysis
+	dec := json.NewDecoder(strings.NewReader(trimmed))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&analysis); err != nil {
+		return nil, fmt.Errorf("failed to decode structured analysis: %w", err)
+	}
+
+	if err := validateStructuredAnalysis(&analysis); err != nil {
+		return nil, err
+	}
+	return &analysis, nil
+}
+
+func validateStructuredAnalysis(analysis *StructuredAnalysis) error {
+	if strings.TrimSpace(analysis.Summary) == "" {
+		return fmt.Errorf("structured analysis is missing a summary")
+	}
+	if len(analysis.ActionPlan) != actionPlanSteps {
+		return fmt.Errorf("structured analysis has %d action plan steps, want %d", len(analysis.ActionPlan), actionPlanSteps)
+	}
+	for i, step := range analysis.ActionPlan {
+		if strings.TrimSpace(step) == "" {
+			return fmt.Errorf("action plan step %d is empty", i+1)
+		}
+	}
+	for i, swap := range analysis.FoodSwaps {
+		if strings.TrimSpace(swap.InsteadOf) == "" || strings.TrimSpace(swap.Try) == "" {
+			return fmt.Errorf("food swap %d is incomplete", i+1)
+		}
+	}
+	if strings.TrimSpace(analysis.ProteinTiming.Assessment) == "" {
+		return fmt.Errorf("structured analysis is missing a protein timing assessment")
+	}
+	return nil
+}
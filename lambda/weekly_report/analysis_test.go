@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/duderman/mailmunch/internal/emf/emftest"
+	openai "github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+const validStructuredJSON = `{
+	"summary": "Calories were 8% lower than last week while protein held steady.",
+	"wins": ["Hit protein target on 5 of 7 days"],
+	"concerns": ["Sodium above 2,300mg on 4 days"],
+	"food_swaps": [{"instead_of": "Crisps", "try": "Salted edamame", "reason": "More protein and fibre for similar calories"}],
+	"protein_timing": {"assessment": "Most protein is eaten at dinner.", "recommendations": ["Add 30g protein at breakfast"]},
+	"action_plan": ["Step one", "Step two", "Step three", "Step four", "Step five"]
+}`
+
+func TestParseStructuredAnalysis(t *testing.T) {
+	analysis, err := parseStructuredAnalysis(validStructuredJSON)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(analysis.ActionPlan) != actionPlanSteps {
+		t.Errorf("expected %d steps, got %d", actionPlanSteps, len(analysis.ActionPlan))
+	}
+	if analysis.FoodSwaps[0].Try != "Salted edamame" {
+		t.Errorf("unexpected food swap: %+v", analysis.FoodSwaps[0])
+	}
+}
+
+func TestParseStructuredAnalysisRejectsInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "empty", content: "  "},
+		{name: "markdown", content: "## WEEKLY SUMMARY\nAll good"},
+		{name: "unknown field", content: strings.Replace(validStructuredJSON, `"wins"`, `"extra": 1, "wins"`, 1)},
+		{name: "missing summary", content: strings.Replace(validStructuredJSON, "Calories were 8% lower than last week while protein held steady.", "", 1)},
+		{name: "short plan", content: strings.Replace(validStructuredJSON, `, "Step five"`, "", 1)},
+		{name: "incomplete swap", content: strings.Replace(validStructuredJSON, `"try": "Salted edamame"`, `"try": ""`, 1)},
+		{name: "missing protein assessment", content: strings.Replace(validStructuredJSON, "Most protein is eaten at dinner.", "", 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseStructuredAnalysis(tt.content); err == nil {
+				t.Error("expected validation error")
+			}
+		})
+	}
+}
+
+func TestAnalysisJSONSchemaIsStrictCompatible(t *testing.T) {
+	// Strict structured outputs require every property to be listed as required.
+	raw, err := json.Marshal(analysisJSONSchema)
+	if err != nil {
+		t.Fatalf("marshal schema: %v", err)
+	}
+	var schema struct {
+		Required   []string                   `json:"required"`
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		t.Fatalf("unmarshal schema: %v", err)
+	}
+	if len(schema.Required) != len(schema.Properties) {
+		t.Errorf("required has %d entries, properties has %d", len(schema.Required), len(schema.Properties))
+	}
+	for _, name := range schema.Required {
+		if _, ok := schema.Properties[name]; !ok {
+			t.Errorf("required property %q is not defined", name)
+		}
+	}
+}
+
+// mockChatClient returns queued responses in order and records requests.
+type mockChatClient struct {
+	responses     []string
+	finishReasons []string
+	errs          []error
+	requests      []openai.ChatCompletionNewParams
+}
+
+func (m *mockChatClient) New(_ context.Context, body openai.ChatCompletionNewParams, _ ...option.RequestOption) (*openai.ChatCompletion, error) {
+	i := len(m.requests)
+	m.requests = append(m.requests, body)
+	if i < len(m.errs) && m.errs[i] != nil {
+		return nil, m.errs[i]
+	}
+	if i >= len(m.responses) {
+		return nil, fmt.Errorf("unexpected request %d", i+1)
+	}
+	finishReason := "stop"
+	if i < len(m.finishReasons) && m.finishReasons[i] != "" {
+		finishReason = m.finishReasons[i]
+	}
+	return &openai.ChatCompletion{
+		Choices: []openai.ChatCompletionChoice{{
+			FinishReason: finishReason,
+			Message:      openai.ChatCompletionMessage{Content: m.responses[i]},
+		}},
+		Usage: openai.CompletionUsage{PromptTokens: 100, CompletionTokens: 50, TotalTokens: 150},
+	}, nil
+}
+
+func withMockChatClient(t *testing.T, mock *mockChatClient) {
+	t.Helper()
+	old := newChatClient
+	newChatClient = func(string) chatCompletionAPI { return mock }
+	t.Cleanup(func() { newChatClient = old })
+}
+
+func TestGenerateAIReportStructured(t *testing.T) {
+	mock := &mockChatClient{responses: []string{validStructuredJSON}}
+	withMockChatClient(t, mock)
+
+	usage := &TokenUsage{}
+	report, err := generateAIReport(context.Background(), "sk-test", &Config{SystemPrompt: "system"}, "prompt", usage)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Structured == nil {
+		t.Fatal("expected structured analysis")
+	}
+	if len(mock.requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(mock.requests))
+	}
+	if mock.requests[0].ResponseFormat.OfJSONSchema == nil {
+		t.Error("expected JSON schema response format")
+	}
+	if usage.Requests != 1 || usage.TotalTokens != 150 {
+		t.Errorf("unexpected usage: %+v", usage)
+	}
+}
+
+func TestGenerateAIReportFallsBackToMarkdown(t *testing.T) {
+	mock := &mockChatClient{responses: []string{`{"summary": ""}`, "## WEEKLY SUMMARY\nDone"}}
+	withMockChatClient(t, mock)
+
+	out := emftest.Capture(t)
+
+	usage := &TokenUsage{}
+	report, err := generateAIReport(context.Background(), "sk-test", &Config{SystemPrompt: "system"}, "prompt", usage)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Structured != nil {
+		t.Fatal("expected Markdown fallback")
+	}
+	if report.Markdown != "## WEEKLY SUMMARY\nDone" {
+		t.Errorf("unexpected markdown: %q", report.Markdown)
+	}
+	if len(mock.requests) != 2 || mock.requests[1].ResponseFormat.OfJSONSchema != nil {
+		t.Error("expected a second free-text request")
+	}
+	if usage.Requests != 2 {
+		t.Errorf("expected usage from both requests, got %+v", usage)
+	}
+	if totals := out.Totals(); totals["ReportTokensUsed"] != 300 {
+		t.Errorf("ReportTokensUsed = %v, expected the tokens of both requests", totals["ReportTokensUsed"])
+	}
+}
+
+func TestGenerateAIReportFallsBackWhenTruncated(t *testing.T) {
+	mock := &mockChatClient{
+		responses:     []string{validStructuredJSON[:40], "## WEEKLY SUMMARY\nDone"},
+		finishReasons: []string{"length"},
+	}
+	withMockChatClient(t, mock)
+
+	report, err := generateAIReport(context.Background(), "sk-test", &Config{SystemPrompt: "system"}, "prompt", &TokenUsage{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Markdown != "## WEEKLY SUMMARY\nDone" {
+		t.Errorf("expected Markdown fallback, got %+v", report)
+	}
+	if len(mock.requests) != 2 || mock.requests[1].ResponseFormat.OfJSONSchema != nil {
+		t.Errorf("expected the truncated structured request not to be retried, got %d requests", len(mock.requests))
+	}
+}
+
+func TestBuildEmailsWithStructuredAnalysis(t *testing.T) {
+	structured, err := parseStructuredAnalysis(validStructuredJSON)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	week := &WeeklyData{StartDate: "2025-09-15", EndDate: "2025-09-21"}
+	analysis := &ReportAnalysis{Structured: structured}
+
+	htmlBody, err := buildHTMLEmail(analysis, week, week, reportExtras{})
+	if err != nil {
+		t.Fatalf("build HTML: %v", err)
+	}
+	for _, want := range []string{"Weekly Summary", "Wins", "Concerns", "<td>Crisps</td>", "Protein Timing", "<li>Step five</li>"} {
+		if !strings.Contains(htmlBody, want) {
+			t.Errorf("HTML email missing %q", want)
+		}
+	}
+	if strings.Contains(htmlBody, "AI Analysis &amp; Recommendations") {
+		t.Error("HTML email should not use the Markdown fallback section")
+	}
+
+	textBody, err := buildTextEmail(analysis, week, week, reportExtras{})
+	if err != nil {
+		t.Fatalf("build text: %v", err)
+	}
+	for _, want := range []string{"WEEKLY SUMMARY:", "Instead of Crisps, try Salted edamame", "5. Step five"} {
+		if !strings.Contains(textBody, want) {
+			t.Errorf("text email missing %q", want)
+		}
+	}
+}
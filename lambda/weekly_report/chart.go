@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// ChartImage is a PNG chart embedded in the HTML email as an inline CID attachment.
+type ChartImage struct {
+	ContentID string // referenced from HTML as cid:<ContentID>
+	Filename  string
+	Title     string
+	Alt       string
+	PNG       []byte
+}
+
+const (
+	chartWidth  = 640
+	chartHeight = 260
+	// Plot area margins leave room for the title and axis labels.
+	chartMarginLeft   = 56
+	chartMarginRight  = 16
+	chartMarginTop    = 32
+	chartMarginBottom = 36
+)
+
+var (
+	chartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	chartText       = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	chartGrid       = color.RGBA{0xe0, 0xe0, 0xe0, 0xff}
+	chartGreen      = color.RGBA{0x4c, 0xaf, 0x50, 0xff}
+	chartOrange     = color.RGBA{0xff, 0x98, 0x00, 0xff}
+	chartRed        = color.RGBA{0xc6, 0x28, 0x28, 0xff}
+	chartBlue       = color.RGBA{0x1e, 0x88, 0xe5, 0xff}
+	chartPurple     = color.RGBA{0x8e, 0x24, 0xaa, 0xff}
+)
+
+// buildTrendCharts renders the monthly/quarterly charts from the period's food entries:
+// daily calories against the target, the macro split and the weekly average trend.
+// It returns nil when there is nothing to plot.
+func buildTrendCharts(period *WeeklyData, calorieTarget float64) ([]ChartImage, error) {
+	entries, err := parseFoodEntries(period.RawData)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	days, err := dailyCalories(period, entries)
+	if err != nil {
+		return nil, err
+	}
+	var totals nutrientTotals
+	for _, e := range entries {
+		totals.add(e)
+	}
+
+	var charts []ChartImage
+	for _, c := range []struct {
+		id, title, alt string
+		render         func() ([]byte, error)
+	}{
+		{"daily-calories", "Daily calories", "Bar chart of calories per day against the daily target", func() ([]byte, error) {
+			return renderDailyCaloriesChart(days, calorieTarget)
+		}},
+		{"macro-split", "Macro split", "Share of calories from protein, carbs and fat", func() ([]byte, error) {
+			return renderMacroSplitChart(totals)
+		}},
+		{"weekly-trend", "Weekly average calories", "Line chart of average daily calories for each week", func() ([]byte, error) {
+			return renderWeeklyTrendChart(weeklyAverages(days), calorieTarget)
+		}},
+	} {
+		img, err := c.render()
+		if err != nil {
+			return nil, fmt.Errorf("failed to render %s chart: %w", c.id, err)
+		}
+		charts = append(charts, ChartImage{ContentID: c.id, Filename: c.id + ".png", Title: c.title, Alt: c.alt, PNG: img})
+	}
+	return charts, nil
+}
+
+// dayTotal is one calendar day of the period; Logged is false for days without entries.
+type dayTotal struct {
+	Date     time.Time
+	Calories float64
+	Logged   bool
+}
+
+// dailyCalories returns one dayTotal per calendar day of the period so gaps show on the chart.
+func dailyCalories(period *WeeklyData, entries []FoodEntry) ([]dayTotal, error) {
+	start, err := time.Parse("2006-01-02", period.StartDate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid period start %q: %w", period.StartDate, err)
+	}
+	end, err := time.Parse("2006-01-02", period.EndDate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid period end %q: %w", period.EndDate, err)
+	}
+
+	byDate := map[string]float64{}
+	for _, g := range aggregateEntries(entries, func(e FoodEntry) string { return e.Date }) {
+		// LoseIt exports dates as MM/DD/YYYY
+		d, err := time.Parse("01/02/2006", g.key)
+		if err != nil {
+			continue
+		}
+		byDate[d.Format("2006-01-02")] = g.totals.Calories
+	}
+
+	var days []dayTotal
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		cal, ok := byDate[d.Format("2006-01-02")]
+		days = append(days, dayTotal{Date: d, Calories: cal, Logged: ok})
+	}
+	return days, nil
+}
+
+// weekAverage is the average daily calories over the logged days of one ISO week.
+type weekAverage struct {
+	Label    string
+	Calories float64
+}
+
+func weeklyAverages(days []dayTotal) []weekAverage {
+	var weeks []weekAverage
+	var sum float64
+	var n int
+	var current string
+	flush := func() {
+		if n > 0 {
+			weeks = append(weeks, weekAverage{Label: current, Calories: sum / float64(n)})
+		}
+		sum, n = 0, 0
+	}
+	for _, d := range days {
+		year, week := d.Date.ISOWeek()
+		label := fmt.Sprintf("W%02d", week)
+		if year != d.Date.Year() {
+			label = fmt.Sprintf("%d-W%02d", year, week)
+		}
+		if label != current {
+			flush()
+			current = label
+		}
+		if d.Logged {
+			sum += d.Calories
+			n++
+		}
+	}
+	flush()
+	return weeks
+}
+
+func renderDailyCaloriesChart(days []dayTotal, target float64) ([]byte, error) {
+	c := newChartCanvas("Daily calories")
+	maxValue := target
+	for _, d := range days {
+		maxValue = math.Max(maxValue, d.Calories)
+	}
+	yMax := c.drawYAxis(maxValue)
+
+	slot := float64(c.plot.Dx()) / float64(len(days))
+	barWidth := int(math.Max(1, slot*0.7))
+	for i, d := range days {
+		x := c.plot.Min.X + int(float64(i)*slot+(slot-float64(barWidth))/2)
+		if d.Logged {
+			bar := chartGreen
+			if target > 0 && d.Calories > target {
+				bar = chartOrange
+			}
+			top := c.yFor(d.Calories, yMax)
+			c.fill(image.Rect(x, top, x+barWidth, c.plot.Max.Y), bar)
+		}
+		// Label roughly every week so labels never overlap
+		if i%7 == 0 {
+			label := d.Date.Format("02 Jan")
+			c.text(min(x, chartWidth-len(label)*7-2), c.plot.Max.Y+16, label, chartText)
+		}
+	}
+
+	if target > 0 {
+		y := c.yFor(target, yMax)
+		c.dashedHLine(c.plot.Min.X, c.plot.Max.X, y, chartRed)
+		c.text(c.plot.Max.X-110, y-4, fmt.Sprintf("Target %.0f", target), chartRed)
+	}
+	return c.encode()
+}
+
+func renderMacroSplitChart(totals nutrientTotals) ([]byte, error) {
+	c := newChartCanvas("Macro split (share of calories)")
+	macros := []struct {
+		name     string
+		calories float64
+		colour   color.RGBA
+	}{
+		{"Protein", totals.Protein * 4, chartBlue},
+		{"Carbs", totals.Carbs * 4, chartOrange},
+		{"Fat", totals.Fat * 9, chartPurple},
+	}
+	var sum float64
+	for _, m := range macros {
+		sum += m.calories
+	}
+	if sum == 0 {
+		c.text(c.plot.Min.X, c.plot.Min.Y+40, "No macro data logged", chartText)
+		return c.encode()
+	}
+
+	bar := image.Rect(c.plot.Min.X, c.plot.Min.Y+30, c.plot.Max.X, c.plot.Min.Y+90)
+	x := bar.Min.X
+	for i, m := range macros {
+		width := int(math.Round(m.calories / sum * float64(bar.Dx())))
+		if i == len(macros)-1 {
+			width = bar.Max.X - x
+		}
+		c.fill(image.Rect(x, bar.Min.Y, x+width, bar.Max.Y), m.colour)
+
+		legendX := c.plot.Min.X + i*180
+		legendY := bar.Max.Y + 40
+		c.fill(image.Rect(legendX, legendY-10, legendX+12, legendY+2), m.colour)
+		c.text(legendX+18, legendY, fmt.Sprintf("%s %.0f%%", m.name, m.calories/sum*100), chartText)
+		x += width
+	}
+	return c.encode()
+}
+
+func renderWeeklyTrendChart(weeks []weekAverage, target float64) ([]byte, error) {
+	c := newChartCanvas("Average daily calories by week")
+	if len(weeks) == 0 {
+		c.text(c.plot.Min.X, c.plot.Min.Y+40, "No food data logged", chartText)
+		return c.encode()
+	}
+
+	maxValue := target
+	for _, w := range weeks {
+		maxValue = math.Max(maxValue, w.Calories)
+	}
+	yMax := c.drawYAxis(maxValue)
+
+	slot := float64(c.plot.Dx()) / float64(len(weeks))
+	var prev image.Point
+	for i, w := range weeks {
+		pt := image.Pt(c.plot.Min.X+int(float64(i)*slot+slot/2), c.yFor(w.Calories, yMax))
+		if i > 0 {
+			c.line(prev, pt, chartGreen)
+		}
+		c.fill(image.Rect(pt.X-3, pt.Y-3, pt.X+4, pt.Y+4), chartGreen)
+		c.text(pt.X-14, c.plot.Max.Y+16, w.Label, chartText)
+		prev = pt
+	}
+
+	if target > 0 {
+		c.dashedHLine(c.plot.Min.X, c.plot.Max.X, c.yFor(target, yMax), chartRed)
+	}
+	return c.encode()
+}
+
+// chartCanvas is a minimal raster plotting surface; charts are simple enough that a
+// plotting library would add more weight to the Lambda than it saves.
+type chartCanvas struct {
+	img  *image.RGBA
+	plot image.Rectangle
+}
+
+func newChartCanvas(title string) *chartCanvas {
+	c := &chartCanvas{
+		img:  image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight)),
+		plot: image.Rect(chartMarginLeft, chartMarginTop, chartWidth-chartMarginRight, chartHeight-chartMarginBottom),
+	}
+	draw.Draw(c.img, c.img.Bounds(), image.NewUniform(chartBackground), image.Point{}, draw.Src)
+	c.text(chartMarginLeft, 18, title, chartText)
+	return c
+}
+
+// drawYAxis draws horizontal gridlines with labels and returns the axis maximum.
+func (c *chartCanvas) drawYAxis(maxValue float64) float64 {
+	step := niceStep(maxValue / 4)
+	yMax := math.Max(step, math.Ceil(maxValue*1.05/step)*step)
+	for v := 0.0; v <= yMax+step/2; v += step {
+		y := c.yFor(v, yMax)
+		c.fill(image.Rect(c.plot.Min.X, y, c.plot.Max.X, y+1), chartGrid)
+		label := fmt.Sprintf("%.0f", v)
+		c.text(c.plot.Min.X-8-len(label)*7, y+4, label, chartText)
+	}
+	return yMax
+}
+
+// niceStep rounds raw up to 1, 2 or 5 times a power of ten.
+func niceStep(raw float64) float64 {
+	if raw <= 0 {
+		return 1
+	}
+	magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if raw <= m*magnitude {
+			return m * magnitude
+		}
+	}
+	return 10 * magnitude
+}
+
+func (c *chartCanvas) yFor(v, yMax float64) int {
+	return c.plot.Max.Y - int(math.Round(v/yMax*float64(c.plot.Dy())))
+}
+
+func (c *chartCanvas) fill(r image.Rectangle, col color.Color) {
+	draw.Draw(c.img, r, image.NewUniform(col), image.Point{}, draw.Src)
+}
+
+func (c *chartCanvas) text(x, y int, s string, col color.Color) {
+	d := font.Drawer{Dst: c.img, Src: image.NewUniform(col), Face: basicfont.Face7x13, Dot: fixed.P(x, y)}
+	d.DrawString(s)
+}
+
+func (c *chartCanvas) dashedHLine(x0, x1, y int, col color.Color) {
+	for x := x0; x < x1; x += 8 {
+		c.fill(image.Rect(x, y, min(x+5, x1), y+2), col)
+	}
+}
+
+// line draws a 2px line between two points using Bresenham's algorithm.
+func (c *chartCanvas) line(a, b image.Point, col color.Color) {
+	dx, dy := abs(b.X-a.X), -abs(b.Y-a.Y)
+	sx, sy := 1, 1
+	if a.X > b.X {
+		sx = -1
+	}
+	if a.Y > b.Y {
+		sy = -1
+	}
+	err := dx + dy
+	for {
+		c.fill(image.Rect(a.X, a.Y, a.X+2, a.Y+2), col)
+		if a == b {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			a.X += sx
+		}
+		if e2 <= dx {
+			err += dx
+			a.Y += sy
+		}
+	}
+}
+
+func (c *chartCanvas) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, c.img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func monthOfData() *WeeklyData {
+	var raw strings.Builder
+	raw.WriteString("date,meal,food_name,quantity,unit,calories,protein,carbs,fat,fiber,sugar,sodium\n")
+	for d := 1; d <= 30; d++ {
+		if d%5 == 0 {
+			continue // unlogged day
+		}
+		date := time.Date(2025, 9, d, 0, 0, 0, 0, time.UTC).Format("01/02/2006")
+		raw.WriteString(date + ",Breakfast,Oats,50,g,900,30,120,20,10,5,100\n")
+		raw.WriteString(date + ",Dinner,Salmon,150,g,1200,60,40,50,2,1,400\n")
+	}
+	return &WeeklyData{StartDate: "2025-09-01", EndDate: "2025-09-30", Period: periodMonth, RawData: raw.String()}
+}
+
+func TestBuildTrendCharts(t *testing.T) {
+	charts, err := buildTrendCharts(monthOfData(), 2000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(charts) != 3 {
+		t.Fatalf("expected 3 charts, got %d", len(charts))
+	}
+	for _, c := range charts {
+		img, err := png.Decode(bytes.NewReader(c.PNG))
+		if err != nil {
+			t.Fatalf("%s is not a valid PNG: %v", c.ContentID, err)
+		}
+		if b := img.Bounds(); b.Dx() != chartWidth || b.Dy() != chartHeight {
+			t.Errorf("%s has size %v", c.ContentID, b)
+		}
+	}
+
+	none, err := buildTrendCharts(&WeeklyData{StartDate: "2025-09-01", EndDate: "2025-09-30", RawData: "date,calories\n"}, 2000)
+	if err != nil || none != nil {
+		t.Errorf("expected no charts for empty data, got %d, %v", len(none), err)
+	}
+}
+
+func TestDailyCaloriesAndWeeklyAverages(t *testing.T) {
+	week := monthOfData()
+	entries, err := parseFoodEntries(week.RawData)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	days, err := dailyCalories(week, entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(days) != 30 {
+		t.Fatalf("expected one entry per day, got %d", len(days))
+	}
+	if !days[0].Logged || days[0].Calories != 2100 || days[4].Logged {
+		t.Errorf("unexpected days: %+v %+v", days[0], days[4])
+	}
+
+	weeks := weeklyAverages(days)
+	// 1 Sep 2025 is a Monday in ISO week 36; 30 Sep is in week 40
+	if len(weeks) != 5 || weeks[0].Label != "W36" || weeks[4].Label != "W40" {
+		t.Fatalf("unexpected weeks: %+v", weeks)
+	}
+	if weeks[0].Calories != 2100 {
+		t.Errorf("average should ignore unlogged days, got %v", weeks[0].Calories)
+	}
+}
+
+func TestNiceStep(t *testing.T) {
+	for raw, want := range map[float64]float64{0: 1, 380: 500, 600: 1000, 1500: 2000, 90: 100} {
+		if got := niceStep(raw); got != want {
+			t.Errorf("niceStep(%v) = %v, want %v", raw, got, want)
+		}
+	}
+}
+
+func TestBuildRawEmailEmbedsCharts(t *testing.T) {
+	charts, err := buildTrendCharts(monthOfData(), 2000)
+	if err != nil {
+		t.Fatalf("charts: %v", err)
+	}
+	week := monthOfData()
+	report, err := renderReport(nil, week, week, reportExtras{Charts: charts})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if !strings.Contains(report.HTML, `src="cid:daily-calories"`) {
+		t.Error("HTML should reference the chart by content ID")
+	}
+	if !strings.Contains(report.Text, "included in the HTML version") {
+		t.Error("text email should mention the charts")
+	}
+
+	raw, err := buildRawEmail(emailEnvelope{From: "sender@example.com", To: "me@example.com"}, report)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("invalid message: %v", err)
+	}
+	dec := new(mime.WordDecoder)
+	if subject, _ := dec.DecodeHeader(msg.Header.Get("Subject")); subject != report.Subject {
+		t.Errorf("subject = %q, want %q", subject, report.Subject)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("unexpected content type %q: %v", mediaType, err)
+	}
+	body, err := multipart.NewReader(msg.Body, params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatalf("read body part: %v", err)
+	}
+	mediaType, params, err = mime.ParseMediaType(body.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" {
+		t.Fatalf("unexpected body content type %q: %v", mediaType, err)
+	}
+
+	var types, contentIDs []string
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read part: %v", err)
+		}
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		types = append(types, mediaType)
+		if id := part.Header.Get("Content-ID"); id != "" {
+			contentIDs = append(contentIDs, id)
+		}
+	}
+	if strings.Join(types, ",") != "multipart/alternative,image/png,image/png,image/png" {
+		t.Errorf("unexpected parts: %v", types)
+	}
+	if len(contentIDs) != 3 || contentIDs[0] != "<daily-calories>" {
+		t.Errorf("unexpected content IDs: %v", contentIDs)
+	}
+}
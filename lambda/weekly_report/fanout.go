@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	lambdaservice "github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// invokeAPI captures the Lambda client call used to run each user's report on its own.
+type invokeAPI interface {
+	InvokeWithContext(ctx aws.Context, input *lambdaservice.InvokeInput, opts ...request.Option) (*lambdaservice.InvokeOutput, error)
+}
+
+// shouldFanOut reports whether a run covering several users hands each of them to a separate
+// invocation. Dry runs return every report to the invoker, so they stay in one.
+func shouldFanOut(request *ReportRequest, users []User, functionName string) bool {
+	return functionName != "" && request.UserID == "" && !request.DryRun && len(users) > 1
+}
+
+// fanOut invokes functionName asynchronously once per user with the event narrowed to that
+// user, so each report gets the whole Lambda timeout and a user whose report fails does not
+// hold up, or resend, anyone else's.
+func fanOut(ctx context.Context, invoker invokeAPI, functionName string, event events.CloudWatchEvent, request *ReportRequest, users []User) (*HandlerResponse, error) {
+	response := &HandlerResponse{}
+	var errs []error
+	for _, user := range users {
+		if err := invokeForUser(ctx, invoker, functionName, event, *request, user.ID); err != nil {
+			log.Printf("Failed to start the report for user %s: %v", user.ID, err)
+			errs = append(errs, fmt.Errorf("user %s: %w", user.ID, err))
+			continue
+		}
+		response.Invoked = append(response.Invoked, user.ID)
+	}
+
+	// As with reports, only fail when nothing started; retrying would start the others again
+	if len(errs) == len(users) {
+		return nil, errors.Join(errs...)
+	}
+	return response, nil
+}
+
+func invokeForUser(ctx context.Context, invoker invokeAPI, functionName string, event events.CloudWatchEvent, request ReportRequest, userID string) error {
+	request.UserID = userID
+	detail, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	event.Detail = detail
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = invoker.InvokeWithContext(ctx, &lambdaservice.InvokeInput{
+		FunctionName:   aws.String(functionName),
+		InvocationType: aws.String(lambdaservice.InvocationTypeEvent),
+		Payload:        payload,
+	})
+	return err
+}
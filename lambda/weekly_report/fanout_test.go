@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	lambdaservice "github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// mockInvoker records asynchronous invocations and fails those for failUser.
+type mockInvoker struct {
+	events   []events.CloudWatchEvent
+	failUser string
+}
+
+func (m *mockInvoker) InvokeWithContext(_ aws.Context, input *lambdaservice.InvokeInput, _ ...request.Option) (*lambdaservice.InvokeOutput, error) {
+	if aws.StringValue(input.FunctionName) != "mailmunch-test-weekly-report" || aws.StringValue(input.InvocationType) != "Event" {
+		return nil, errors.New("unexpected invocation")
+	}
+	var event events.CloudWatchEvent
+	if err := json.Unmarshal(input.Payload, &event); err != nil {
+		return nil, err
+	}
+	req, err := parseReportRequest(event.Detail)
+	if err != nil {
+		return nil, err
+	}
+	if req.UserID == m.failUser {
+		return nil, errors.New("throttled")
+	}
+	m.events = append(m.events, event)
+	return &lambdaservice.InvokeOutput{StatusCode: aws.Int64(202)}, nil
+}
+
+func TestFanOutInvokesOncePerUser(t *testing.T) {
+	users := []User{{ID: "alex"}, {ID: "sam"}}
+	event := events.CloudWatchEvent{Source: "aws.scheduler", DetailType: "Monthly Report Trigger"}
+	request := &ReportRequest{Period: periodMonth, Offset: -1}
+	invoker := &mockInvoker{}
+
+	resp, err := fanOut(context.Background(), invoker, "mailmunch-test-weekly-report", event, request, users)
+	if err != nil {
+		t.Fatalf("fanOut: %v", err)
+	}
+	if len(resp.Invoked) != 2 || len(invoker.events) != 2 {
+		t.Fatalf("expected an invocation per user, got %v", resp.Invoked)
+	}
+	for i, e := range invoker.events {
+		req, err := parseReportRequest(e.Detail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.UserID != users[i].ID || req.Period != periodMonth || req.Offset != -1 || e.DetailType != event.DetailType {
+			t.Errorf("invocation %d got %+v from %+v", i, req, e)
+		}
+	}
+	if request.UserID != "" {
+		t.Error("fanOut changed the caller's request")
+	}
+}
+
+func TestFanOutFailsOnlyWhenNothingStarted(t *testing.T) {
+	users := []User{{ID: "alex"}, {ID: "sam"}}
+	resp, err := fanOut(context.Background(), &mockInvoker{failUser: "sam"}, "mailmunch-test-weekly-report", events.CloudWatchEvent{}, &ReportRequest{}, users)
+	if err != nil || len(resp.Invoked) != 1 || resp.Invoked[0] != "alex" {
+		t.Errorf("expected alex's report to start, got %+v (%v)", resp, err)
+	}
+
+	if _, err := fanOut(context.Background(), &mockInvoker{failUser: "alex"}, "mailmunch-test-weekly-report", events.CloudWatchEvent{}, &ReportRequest{}, users[:1]); err == nil {
+		t.Error("expected an error when no report started")
+	}
+}
+
+func TestShouldFanOut(t *testing.T) {
+	two := []User{{ID: "alex"}, {ID: "sam"}}
+	for name, tc := range map[string]struct {
+		request  ReportRequest
+		users    []User
+		function string
+		want     bool
+	}{
+		"household":    {users: two, function: "fn", want: true},
+		"one user":     {users: two[:1], function: "fn"},
+		"user request": {request: ReportRequest{UserID: "alex"}, users: two, function: "fn"},
+		"dry run":      {request: ReportRequest{DryRun: true}, users: two, function: "fn"},
+		"not a lambda": {users: two},
+	} {
+		if got := shouldFanOut(&tc.request, tc.users, tc.function); got != tc.want {
+			t.Errorf("%s: shouldFanOut = %t, expected %t", name, got, tc.want)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-module weekly_report
+module github.com/duderman/mailmunch/lambda/weekly_report
 
 go 1.24
 
@@ -6,12 +6,16 @@ require (
 	github.com/aws/aws-lambda-go v1.47.0
 	github.com/aws/aws-sdk-go v1.55.5
 	github.com/openai/openai-go v1.12.0
+	golang.org/x/image v0.30.0
 )
 
 require (
+	github.com/duderman/mailmunch/internal/emf v0.0.0
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/tidwall/gjson v1.14.4 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.1 // indirect
 	github.com/tidwall/sjson v1.2.5 // indirect
 )
+
+replace github.com/duderman/mailmunch/internal/emf => ../../internal/emf
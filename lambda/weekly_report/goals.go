@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// NutritionGoals are a user's targets. They are injected into the prompt and each logged
+// day of the report is checked against the daily ones.
+type NutritionGoals struct {
+	DailyCalories  int     `json:"daily_calories,omitempty"`   // upper limit, kcal
+	ProteinGPerKg  float64 `json:"protein_g_per_kg,omitempty"` // minimum, needs weight_kg
+	WeightKg       float64 `json:"weight_kg,omitempty"`        // current body weight for the protein target
+	FiberMinG      float64 `json:"fiber_min_g,omitempty"`
+	SodiumMaxMg    float64 `json:"sodium_max_mg,omitempty"`
+	TargetWeightKg float64 `json:"target_weight_kg,omitempty"`
+	TargetDate     string  `json:"target_date,omitempty"` // YYYY-MM-DD
+	Notes          string  `json:"notes,omitempty"`       // free text passed to the model, e.g. "high protein, cutting"
+}
+
+// withDefaults fills goals the user has not set from the deployment-wide goals.
+func (g NutritionGoals) withDefaults(defaults NutritionGoals) NutritionGoals {
+	if g.DailyCalories == 0 {
+		g.DailyCalories = defaults.DailyCalories
+	}
+	if g.ProteinGPerKg == 0 {
+		g.ProteinGPerKg = defaults.ProteinGPerKg
+	}
+	if g.WeightKg == 0 {
+		g.WeightKg = defaults.WeightKg
+	}
+	if g.FiberMinG == 0 {
+		g.FiberMinG = defaults.FiberMinG
+	}
+	if g.SodiumMaxMg == 0 {
+		g.SodiumMaxMg = defaults.SodiumMaxMg
+	}
+	if g.TargetWeightKg == 0 {
+		g.TargetWeightKg = defaults.TargetWeightKg
+	}
+	if g.TargetDate == "" {
+		g.TargetDate = defaults.TargetDate
+	}
+	if g.Notes == "" {
+		g.Notes = defaults.Notes
+	}
+	return g
+}
+
+func (g NutritionGoals) validate() error {
+	for name, v := range map[string]float64{
+		"daily_calories":   float64(g.DailyCalories),
+		"protein_g_per_kg": g.ProteinGPerKg,
+		"weight_kg":        g.WeightKg,
+		"fiber_min_g":      g.FiberMinG,
+		"sodium_max_mg":    g.SodiumMaxMg,
+		"target_weight_kg": g.TargetWeightKg,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s cannot be negative", name)
+		}
+	}
+	if g.ProteinGPerKg > 0 && g.WeightKg == 0 {
+		return fmt.Errorf("protein_g_per_kg requires weight_kg")
+	}
+	if g.TargetDate != "" {
+		if _, err := time.Parse("2006-01-02", g.TargetDate); err != nil {
+			return fmt.Errorf("invalid target_date %q (want YYYY-MM-DD)", g.TargetDate)
+		}
+	}
+	return nil
+}
+
+// dailyTargets returns the goals that can be checked against a day of food data.
+func (g NutritionGoals) dailyTargets() []dailyTarget {
+	var targets []dailyTarget
+	if g.DailyCalories > 0 {
+		targets = append(targets, dailyTarget{"Calories", "kcal", float64(g.DailyCalories), true, func(t nutrientTotals) float64 { return t.Calories }})
+	}
+	if g.ProteinGPerKg > 0 && g.WeightKg > 0 {
+		targets = append(targets, dailyTarget{"Protein", "g", g.ProteinGPerKg * g.WeightKg, false, func(t nutrientTotals) float64 { return t.Protein }})
+	}
+	if g.FiberMinG > 0 {
+		targets = append(targets, dailyTarget{"Fiber", "g", g.FiberMinG, false, func(t nutrientTotals) float64 { return t.Fiber }})
+	}
+	if g.SodiumMaxMg > 0 {
+		targets = append(targets, dailyTarget{"Sodium", "mg", g.SodiumMaxMg, true, func(t nutrientTotals) float64 { return t.Sodium }})
+	}
+	return targets
+}
+
+// dailyTarget is a minimum or maximum for one nutrient per day.
+type dailyTarget struct {
+	Name   string
+	Unit   string
+	Target float64
+	Max    bool // the day must stay at or below Target rather than reach it
+	value  func(nutrientTotals) float64
+}
+
+// Label describes the target, e.g. "≤ 2000 kcal".
+func (t dailyTarget) Label() string {
+	op := "≥"
+	if t.Max {
+		op = "≤"
+	}
+	return fmt.Sprintf("%s %.0f %s", op, t.Target, t.Unit)
+}
+
+func (t dailyTarget) met(v float64) bool {
+	if t.Max {
+		return v <= t.Target
+	}
+	return v >= t.Target
+}
+
+// GoalCheck is one nutrient on one day.
+type GoalCheck struct {
+	Value float64
+	Met   bool
+}
+
+// DayAdherence holds a day's checks in the same order as GoalAdherence.Targets.
+type DayAdherence struct {
+	Date    string // YYYY-MM-DD
+	Logged  bool
+	Missing bool // no export arrived for the day, as opposed to nothing logged
+	Checks  []GoalCheck
+}
+
+// GoalSummary counts the logged days that met one target.
+type GoalSummary struct {
+	Name       string
+	Label      string
+	DaysMet    int
+	DaysLogged int
+}
+
+// GoalAdherence is the per-day evaluation of a period against the user's goals.
+type GoalAdherence struct {
+	Goals   NutritionGoals
+	Targets []dailyTarget
+	Days    []DayAdherence
+	Summary []GoalSummary
+}
+
+// evaluateAdherence checks every day of the period against the daily goals. It returns
+// nil when the user has no goals at all.
+func evaluateAdherence(period *WeeklyData, goals NutritionGoals) (*GoalAdherence, error) {
+	if goals == (NutritionGoals{}) {
+		return nil, nil
+	}
+	targets := goals.dailyTargets()
+
+	entries, err := parseFoodEntries(period.RawData)
+	if err != nil {
+		return nil, err
+	}
+	start, err := time.Parse("2006-01-02", period.StartDate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid period start %q: %w", period.StartDate, err)
+	}
+	end, err := time.Parse("2006-01-02", period.EndDate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid period end %q: %w", period.EndDate, err)
+	}
+
+	byDate := map[string]nutrientTotals{}
+	for _, g := range aggregateEntries(entries, func(e FoodEntry) string { return e.Date }) {
+		// LoseIt exports dates as MM/DD/YYYY
+		d, err := time.Parse("01/02/2006", g.key)
+		if err != nil {
+			continue
+		}
+		byDate[d.Format("2006-01-02")] = g.totals
+	}
+
+	adherence := &GoalAdherence{Goals: goals, Targets: targets}
+	for _, t := range targets {
+		adherence.Summary = append(adherence.Summary, GoalSummary{Name: t.Name, Label: t.Label()})
+	}
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		day := DayAdherence{Date: d.Format("2006-01-02")}
+		totals, ok := byDate[day.Date]
+		day.Missing = !ok && period.isMissingDay(day.Date)
+		if ok {
+			day.Logged = true
+			for i, t := range targets {
+				v := t.value(totals)
+				check := GoalCheck{Value: v, Met: t.met(v)}
+				day.Checks = append(day.Checks, check)
+				adherence.Summary[i].DaysLogged++
+				if check.Met {
+					adherence.Summary[i].DaysMet++
+				}
+			}
+		}
+		adherence.Days = append(adherence.Days, day)
+	}
+	return adherence, nil
+}
+
+// goalsPrompt appends the user's goals, and how the period measured up against them, to
+// the base prompt so the analysis can refer to them instead of guessing.
+func goalsPrompt(basePrompt string, adherence *GoalAdherence) string {
+	if adherence == nil {
+		return basePrompt
+	}
+	goals := adherence.Goals
+
+	var b strings.Builder
+	b.WriteString(basePrompt)
+	b.WriteString("\n\nTHIS PERSON'S GOALS:\n")
+	for _, s := range adherence.Summary {
+		fmt.Fprintf(&b, "- Daily %s %s: met on %d of %d logged days\n", strings.ToLower(s.Name), s.Label, s.DaysMet, s.DaysLogged)
+	}
+	if goals.ProteinGPerKg > 0 {
+		fmt.Fprintf(&b, "- Protein target is %.1f g per kg of body weight (%.0f kg)\n", goals.ProteinGPerKg, goals.WeightKg)
+	}
+	if goals.TargetWeightKg > 0 {
+		fmt.Fprintf(&b, "- Target weight: %.1f kg", goals.TargetWeightKg)
+		if goals.TargetDate != "" {
+			fmt.Fprintf(&b, " by %s", goals.TargetDate)
+		}
+		b.WriteString("\n")
+	}
+	if notes := strings.TrimSpace(goals.Notes); notes != "" {
+		b.WriteString("- " + notes + "\n")
+	}
+	b.WriteString("Judge the food diary against these goals rather than general guidelines.")
+	return b.String()
+}
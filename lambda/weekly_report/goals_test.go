@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func goalsWeek() *WeeklyData {
+	return &WeeklyData{
+		StartDate: "2025-09-15",
+		EndDate:   "2025-09-17",
+		RawData: "date,meal,food_name,quantity,unit,calories,protein,carbs,fat,fiber,sugar,sodium\n" +
+			"09/15/2025,Breakfast,Oats,50,g,900,60,120,20,20,5,900\n" +
+			"09/15/2025,Dinner,Salmon,150,g,900,70,40,50,12,1,800\n" +
+			"09/16/2025,Dinner,Pizza,1,slice,2600,80,300,100,5,10,3100\n",
+	}
+}
+
+func TestEvaluateAdherence(t *testing.T) {
+	goals := NutritionGoals{DailyCalories: 2000, ProteinGPerKg: 1.6, WeightKg: 80, FiberMinG: 30, SodiumMaxMg: 2300}
+	adherence, err := evaluateAdherence(goalsWeek(), goals)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(adherence.Targets) != 4 || adherence.Targets[1].Target != 128 {
+		t.Fatalf("unexpected targets: %+v", adherence.Targets)
+	}
+	if len(adherence.Days) != 3 || adherence.Days[2].Logged {
+		t.Fatalf("expected three days with the last unlogged, got %+v", adherence.Days)
+	}
+
+	// 15 Sep: 1800 kcal, 130 g protein, 32 g fiber, 1700 mg sodium -> all met
+	for i, c := range adherence.Days[0].Checks {
+		if !c.Met {
+			t.Errorf("day 1 %s should be met: %+v", adherence.Targets[i].Name, c)
+		}
+	}
+	// 16 Sep: 2600 kcal, 80 g protein, 5 g fiber, 3100 mg sodium -> all missed
+	for i, c := range adherence.Days[1].Checks {
+		if c.Met {
+			t.Errorf("day 2 %s should be missed: %+v", adherence.Targets[i].Name, c)
+		}
+	}
+	if s := adherence.Summary[0]; s.DaysMet != 1 || s.DaysLogged != 2 || s.Label != "≤ 2000 kcal" {
+		t.Errorf("unexpected summary: %+v", s)
+	}
+
+	none, err := evaluateAdherence(goalsWeek(), NutritionGoals{})
+	if err != nil || none != nil {
+		t.Errorf("expected no adherence without goals, got %+v, %v", none, err)
+	}
+}
+
+func TestNutritionGoalsDefaultsAndValidation(t *testing.T) {
+	goals := NutritionGoals{DailyCalories: 1800}.withDefaults(NutritionGoals{DailyCalories: 2200, FiberMinG: 30})
+	if goals.DailyCalories != 1800 || goals.FiberMinG != 30 {
+		t.Errorf("unexpected goals: %+v", goals)
+	}
+
+	for _, g := range []NutritionGoals{
+		{DailyCalories: -1},
+		{ProteinGPerKg: 1.6},
+		{TargetWeightKg: 75, TargetDate: "01/03/2026"},
+	} {
+		if err := g.validate(); err == nil {
+			t.Errorf("expected error for %+v", g)
+		}
+	}
+	if err := (NutritionGoals{ProteinGPerKg: 1.6, WeightKg: 80, TargetDate: "2026-03-01"}).validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestGoalsPrompt(t *testing.T) {
+	if goalsPrompt("base", nil) != "base" {
+		t.Error("prompt without goals should be unchanged")
+	}
+
+	goals := NutritionGoals{DailyCalories: 2000, ProteinGPerKg: 1.6, WeightKg: 80, TargetWeightKg: 75, TargetDate: "2026-03-01", Notes: "Cutting"}
+	adherence, err := evaluateAdherence(goalsWeek(), goals)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	prompt := goalsPrompt("base", adherence)
+	for _, want := range []string{"base\n\nTHIS PERSON'S GOALS:", "Daily calories ≤ 2000 kcal: met on 1 of 2 logged days", "1.6 g per kg", "75.0 kg by 2026-03-01", "- Cutting"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("prompt missing %q:\n%s", want, prompt)
+		}
+	}
+}
+
+func TestEmailShowsGoalAdherence(t *testing.T) {
+	adherence, err := evaluateAdherence(goalsWeek(), NutritionGoals{DailyCalories: 2000, SodiumMaxMg: 2300, TargetWeightKg: 75})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	week := goalsWeek()
+	report, err := renderReport(nil, week, week, reportExtras{Adherence: adherence})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+
+	for _, want := range []string{`<td class="met">1800</td>`, `<td class="missed">2600</td>`, "not logged", "<th>1 / 2</th>", "Target weight: 75.0 kg"} {
+		if !strings.Contains(report.HTML, want) {
+			t.Errorf("HTML missing %q", want)
+		}
+	}
+	for _, want := range []string{"GOALS:", "2025-09-15 ✓ 1800 kcal  ✓ 1700 mg", "2025-09-16 ✗ 2600 kcal  ✗ 3100 mg", "2025-09-17 not logged"} {
+		if !strings.Contains(report.Text, want) {
+			t.Errorf("text missing %q:\n%s", want, report.Text)
+		}
+	}
+
+	plain, err := renderReport(nil, week, week, reportExtras{})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if strings.Contains(plain.HTML, "goals-section") || strings.Contains(plain.Text, "GOALS:") {
+		t.Error("goals section should be omitted without goals")
+	}
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	texttemplate "text/template"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -16,8 +20,10 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/appconfigdata"
 	"github.com/aws/aws-sdk-go/service/athena"
+	lambdaservice "github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/duderman/mailmunch/internal/emf"
 	openai "github.com/openai/openai-go"
 	"github.com/openai/openai-go/option"
 	"github.com/openai/openai-go/shared"
@@ -31,16 +37,19 @@ type WeeklyReportEvent struct {
 	Time       time.Time `json:"time"`
 }
 
-// WeeklyData represents raw food data for a week period
+// WeeklyData represents raw food data for a report period (a week unless requested otherwise)
 type WeeklyData struct {
-	StartDate string `json:"start_date"`
-	EndDate   string `json:"end_date"`
-	RawData   string `json:"raw_data"` // Raw CSV-like data from Athena query
+	StartDate   string   `json:"start_date"`
+	EndDate     string   `json:"end_date"`
+	Period      string   `json:"period,omitempty"`       // day, week, month or custom; empty means week
+	RawData     string   `json:"raw_data"`               // Raw CSV-like data from Athena query
+	MissingDays []string `json:"missing_days,omitempty"` // YYYY-MM-DD days no LoseIt export arrived for
 }
 
 // Config holds environment variables and configuration
 type Config struct {
 	OpenAISecretArn        string
+	NotifierSecretArn      string
 	ReportEmail            string
 	SenderEmail            string
 	Region                 string
@@ -50,102 +59,320 @@ type Config struct {
 	AthenaTable            string
 	AthenaWorkgroup        string
 	AthenaResultsBucket    string
+	ReportsBucket          string
+	ReportsPrefix          string
+	DataBucket             string // bucket of the raw LoseIt CSVs, checked for missing exports
+	RawCsvBase             string
+	NudgeAfterDays         int // days without an export before nudge mode sends a reminder
+	PromptTokenBudget      int
+	DailyCalorieTarget     int
 	AppConfigApplication   string
 	AppConfigEnvironment   string
 	AppConfigConfiguration string
+	Timezone               string       // IANA name of the deployment's timezone, the default for users without one
+	WeekStart              time.Weekday // first day of a reporting week
+	UserID                 string       // user_id partition the report covers; set per user, not from the environment
 }
 
 func main() {
+	// "preview" renders report templates locally instead of running as a Lambda
+	if len(os.Args) > 1 && os.Args[1] == "preview" {
+		if err := runPreview(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	lambda.Start(handler)
 }
 
-func handler(ctx context.Context, event events.CloudWatchEvent) error {
+func handler(ctx context.Context, event events.CloudWatchEvent) (*HandlerResponse, error) {
+	request, err := parseReportRequest(event.Detail)
+	if err != nil {
+		log.Printf("Invalid report request: %v", err)
+		return nil, err
+	}
+
 	config := &Config{
 		OpenAISecretArn:        getEnvOrDefault("OPENAI_SECRET_ARN", ""),
+		NotifierSecretArn:      getEnvOrDefault("NOTIFIER_SECRET_ARN", ""),
 		ReportEmail:            getEnvOrDefault("REPORT_EMAIL", ""),
 		SenderEmail:            getEnvOrDefault("SENDER_EMAIL", ""),
 		Region:                 getEnvOrDefault("AWS_REGION", "eu-west-2"),
-		AthenaDatabase:         getEnvOrDefault("ATHENA_DATABASE", "mailmunch_dev_db"),
-		AthenaTable:            getEnvOrDefault("ATHENA_TABLE", "loseit_entries"),
-		AthenaWorkgroup:        getEnvOrDefault("ATHENA_WORKGROUP", "primary"),
+		AthenaDatabase:         getEnvOrDefault("ATHENA_DATABASE", ""),
+		AthenaTable:            getEnvOrDefault("ATHENA_TABLE", ""),
+		AthenaWorkgroup:        getEnvOrDefault("ATHENA_WORKGROUP", ""),
 		AthenaResultsBucket:    getEnvOrDefault("ATHENA_RESULTS_BUCKET", ""),
+		ReportsBucket:          getEnvOrDefault("REPORTS_BUCKET", ""),
+		ReportsPrefix:          getEnvOrDefault("REPORTS_PREFIX", ""),
+		DataBucket:             getEnvOrDefault("DATA_BUCKET", ""),
+		RawCsvBase:             getEnvOrDefault("RAW_CSV_BASE", ""),
+		NudgeAfterDays:         getEnvIntOrDefault("NUDGE_AFTER_DAYS", defaultNudgeAfterDays),
+		PromptTokenBudget:      getEnvIntOrDefault("PROMPT_TOKEN_BUDGET", defaultPromptTokenBudget),
+		DailyCalorieTarget:     getEnvIntOrDefault("DAILY_CALORIE_TARGET", 0),
 		AppConfigApplication:   getEnvOrDefault("APPCONFIG_APPLICATION", ""),
 		AppConfigEnvironment:   getEnvOrDefault("APPCONFIG_ENVIRONMENT", ""),
 		AppConfigConfiguration: getEnvOrDefault("APPCONFIG_CONFIGURATION", ""),
+		Timezone:               getEnvOrDefault("REPORT_TIMEZONE", ""),
 	}
 
+	config.WeekStart, err = parseWeekday(getEnvOrDefault("WEEK_START_DAY", ""))
+	if err != nil {
+		log.Printf("Configuration error: %v", err)
+		return nil, err
+	}
 	if err := validateConfig(config); err != nil {
 		log.Printf("Configuration error: %v", err)
-		return err
+		return nil, err
 	}
 
-	log.Printf("Starting weekly report generation for email: %s", config.ReportEmail)
-
-	// Calculate date ranges for current and previous weeks
-	now := time.Now().In(londonTimeZone())
-	currentWeekStart, currentWeekEnd := getWeekRange(now)
-	previousWeekStart, previousWeekEnd := getWeekRange(currentWeekStart.AddDate(0, 0, -7))
-
-	log.Printf("Current week: %s to %s", currentWeekStart.Format("2006-01-02"), currentWeekEnd.Format("2006-01-02"))
-	log.Printf("Previous week: %s to %s", previousWeekStart.Format("2006-01-02"), previousWeekEnd.Format("2006-01-02"))
-
 	// Initialize AWS session
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(config.Region),
 	})
 	if err != nil {
 		log.Printf("Failed to create AWS session: %v", err)
-		return err
+		return nil, err
 	}
 
-	sesClient := ses.New(sess)
+	clients := &reportClients{
+		ses:       ses.New(sess),
+		athena:    athena.New(sess),
+		s3:        newS3Client(sess),
+		appConfig: appconfigdata.New(sess),
+	}
 	secretsClient := secretsmanager.New(sess)
-	athenaClient := athena.New(sess)
-	appConfigClient := appconfigdata.New(sess)
 
-	// Get prompt configuration from AppConfig
-	config.BasePrompt, config.SystemPrompt, err = getPromptsFromAppConfig(appConfigClient, config)
+	// Get prompts and the user registry from AppConfig
+	doc, err := getAppConfigDocument(clients.appConfig, config)
+	if err != nil {
+		log.Printf("Failed to retrieve configuration from AppConfig: %v", err)
+		return nil, err
+	}
+	config.BasePrompt, config.SystemPrompt = doc.BasePrompt, doc.SystemPrompt
+
+	// Custom templates that fail to load or validate fall back to the built-in ones
+	clients.templates, err = loadTemplates(ctx, clients.s3, config.ReportsBucket, doc.Templates)
+	if clients.templates == nil {
+		log.Printf("Failed to compile built-in templates: %v", err)
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("Warning: using built-in templates %s: %v", clients.templates.Version, err)
+	}
+
+	users, err := resolveUsers(doc.Users, doc.Goals, config.ReportEmail, config.Timezone, request.UserID)
 	if err != nil {
-		log.Printf("Failed to retrieve prompt from AppConfig: %v", err)
-		return err
+		log.Printf("Invalid user registry: %v", err)
+		return nil, err
+	}
+
+	// The daily nudge only looks at exports and sends plain reminders
+	if request.Mode == modeNudge {
+		return runNudges(ctx, clients, config, request, users)
+	}
+
+	// Several users' reports would share one Lambda timeout, so each gets an invocation of its own
+	if functionName := os.Getenv("AWS_LAMBDA_FUNCTION_NAME"); shouldFanOut(request, users, functionName) {
+		return fanOut(ctx, lambdaservice.New(sess), functionName, event, request, users)
 	}
 
 	// Retrieve OpenAI API key from Secrets Manager
-	openaiAPIKey, err := getOpenAIAPIKey(secretsClient, config.OpenAISecretArn)
+	clients.openAIAPIKey, err = getOpenAIAPIKey(secretsClient, config.OpenAISecretArn)
 	if err != nil {
 		log.Printf("Failed to retrieve OpenAI API key: %v", err)
-		return err
+		return nil, err
+	}
+
+	// Slack, Telegram and webhook channels keep their credentials in a separate secret
+	if usesSecrets(users) {
+		if config.NotifierSecretArn == "" {
+			err := fmt.Errorf("NOTIFIER_SECRET_ARN is required for channels with a secret")
+			log.Printf("Invalid configuration: %v", err)
+			return nil, err
+		}
+		clients.notifierSecrets, err = getNotifierSecrets(secretsClient, config.NotifierSecretArn)
+		if err != nil {
+			log.Printf("Failed to retrieve notifier secrets: %v", err)
+			return nil, err
+		}
 	}
 
-	// Query data for both weeks using Athena
-	currentWeekData, err := queryWeeklyDataWithAthena(ctx, athenaClient, config, currentWeekStart, currentWeekEnd)
+	// One report per user; a failure for one user should not stop the others
+	response := &HandlerResponse{}
+	var errs []error
+	for _, user := range users {
+		report, err := generateUserReport(ctx, clients, configFor(config, user), request, user)
+		if err != nil {
+			log.Printf("Report for user %s failed: %v", user.ID, err)
+			errs = append(errs, fmt.Errorf("user %s: %w", user.ID, err))
+			report = &ReportResponse{UserID: user.ID, Recipient: user.ReportEmail, DryRun: request.DryRun, Error: err.Error()}
+		}
+		response.Reports = append(response.Reports, report)
+	}
+
+	// Only fail the invocation when nothing was sent; retrying would re-send the reports that succeeded
+	if len(errs) == len(users) {
+		return nil, errors.Join(errs...)
+	}
+	return response, nil
+}
+
+// reportClients are the clients and credentials shared by every user's report in a run.
+type reportClients struct {
+	ses          *ses.SES
+	athena       *athena.Athena
+	s3           s3API
+	appConfig    *appconfigdata.AppConfigData
+	openAIAPIKey string
+	templates    *reportTemplates
+	// notifierSecrets maps channel secret names to values, see Channel.Secret
+	notifierSecrets map[string]string
+}
+
+// generateUserReport builds, delivers and records one user's report.
+func generateUserReport(ctx context.Context, clients *reportClients, config *Config, request *ReportRequest, user User) (*ReportResponse, error) {
+	started := time.Now()
+
+	// A recipient override is for checking a report by email, so it skips the user's other channels
+	if request.Recipient != "" {
+		config.ReportEmail = request.Recipient
+		user.Channels = []Channel{{Type: channelEmail}}
+	}
+	notifiers, err := newNotifiers(user, config, clients)
 	if err != nil {
-		log.Printf("Failed to query current week data: %v", err)
-		return err
+		log.Printf("Invalid delivery channels: %v", err)
+		return nil, err
 	}
 
-	previousWeekData, err := queryWeeklyDataWithAthena(ctx, athenaClient, config, previousWeekStart, previousWeekEnd)
+	// Calculate date ranges for the requested period and the one before it, in the user's timezone
+	period, err := resolveReportPeriod(request, time.Now().In(user.location()), config.WeekStart)
 	if err != nil {
-		log.Printf("Failed to query previous week data: %v", err)
-		return err
+		log.Printf("Invalid report period: %v", err)
+		return nil, err
 	}
 
-	// Generate OpenAI analysis
-	report, err := generateAIReport(openaiAPIKey, config, currentWeekData, previousWeekData)
+	log.Printf("Starting %s report generation for user %s, email: %s (dry run: %t)", period.Kind, user.ID, config.ReportEmail, request.DryRun)
+	log.Printf("Current %s: %s to %s", period.Kind, period.Start.Format("2006-01-02"), period.End.Format("2006-01-02"))
+	log.Printf("Previous %s: %s to %s", period.Kind, period.PreviousStart.Format("2006-01-02"), period.PreviousEnd.Format("2006-01-02"))
+
+	// Query data for both periods using Athena
+	currentWeekData, err := queryWeeklyDataWithAthena(ctx, clients.athena, config, period.Start, period.End)
 	if err != nil {
-		log.Printf("Failed to generate AI report: %v", err)
-		return err
+		log.Printf("Failed to query current %s data: %v", period.Kind, err)
+		return nil, err
 	}
+	currentWeekData.Period = period.Kind
 
-	// Send email report
-	err = sendEmailReport(sesClient, config, report, currentWeekData, previousWeekData)
+	previousWeekData, err := queryWeeklyDataWithAthena(ctx, clients.athena, config, period.PreviousStart, period.PreviousEnd)
 	if err != nil {
-		log.Printf("Failed to send email report: %v", err)
-		return err
+		log.Printf("Failed to query previous %s data: %v", period.Kind, err)
+		return nil, err
 	}
+	previousWeekData.Period = period.Kind
 
-	log.Printf("Weekly report sent successfully to %s", config.ReportEmail)
-	return nil
+	// Days without an export are missing data rather than days without food
+	if config.DataBucket != "" {
+		now := time.Now().In(user.location())
+		if err := markMissingDays(ctx, clients.s3, config, currentWeekData, period.Start, period.End, now); err != nil {
+			log.Printf("Warning: failed to check current %s for missing exports: %v", period.Kind, err)
+		}
+		if err := markMissingDays(ctx, clients.s3, config, previousWeekData, period.PreviousStart, period.PreviousEnd, now); err != nil {
+			log.Printf("Warning: failed to check previous %s for missing exports: %v", period.Kind, err)
+		}
+	}
+
+	// Check each day against the user's goals; DAILY_CALORIE_TARGET applies when the user has no calorie goal
+	goals := user.Goals
+	goals.DailyCalories = config.DailyCalorieTarget
+	adherence, err := evaluateAdherence(currentWeekData, goals)
+	if err != nil {
+		log.Printf("Warning: failed to evaluate goal adherence: %v", err)
+		adherence = nil
+	}
+
+	// Prepare data for OpenAI within the token budget
+	basePrompt := missingDaysPrompt(goalsPrompt(periodPrompt(config.BasePrompt, period), adherence), currentWeekData, previousWeekData)
+	prompt, strategy, promptTokens := buildBudgetedPrompt(basePrompt, config.SystemPrompt, config.PromptTokenBudget, currentWeekData, previousWeekData)
+
+	bundle := newReportBundle(time.Now().UTC(), user.ID, config.ReportEmail, currentWeekData, previousWeekData)
+	bundle.Prompt = prompt
+	bundle.Metadata.PromptStrategy = string(strategy)
+	bundle.Metadata.PromptTokensEstimate = promptTokens
+
+	// Generate OpenAI analysis, keeping part of the Lambda deadline back for the fallback email
+	aiCtx, cancel := aiContext(ctx)
+	report, err := generateAIReport(aiCtx, clients.openAIAPIKey, config, prompt, &bundle.Metadata.Usage)
+	cancel()
+	if err != nil {
+		// Still send the computed metrics so the week is not silently skipped
+		log.Printf("Failed to generate AI report, sending metrics-only fallback: %v", err)
+		bundle.Metadata.AIError = err.Error()
+		report = nil
+	}
+	bundle.setAnalysis(report)
+
+	// Monthly and quarterly reports include trend charts; a chart failure should not block the report
+	var charts []ChartImage
+	if isTrendPeriod(period.Kind) {
+		if charts, err = buildTrendCharts(currentWeekData, float64(config.DailyCalorieTarget)); err != nil {
+			log.Printf("Warning: failed to render trend charts: %v", err)
+			charts = nil
+		}
+	}
+
+	rendered, err := renderReport(report, currentWeekData, previousWeekData, reportExtras{Charts: charts, Adherence: adherence, Templates: clients.templates})
+	if err != nil {
+		log.Printf("Failed to render report: %v", err)
+		return nil, err
+	}
+	bundle.Rendered = rendered
+	bundle.Metadata.TemplateVersion = rendered.TemplateVersion
+
+	response := &ReportResponse{
+		RunID:          bundle.Metadata.RunID,
+		UserID:         user.ID,
+		Period:         period.Kind,
+		PeriodStart:    currentWeekData.StartDate,
+		PeriodEnd:      currentWeekData.EndDate,
+		Recipient:      config.ReportEmail,
+		DryRun:         request.DryRun,
+		AIStatus:       bundle.Metadata.AIStatus,
+		PromptStrategy: bundle.Metadata.PromptStrategy,
+		Subject:        rendered.Subject,
+	}
+
+	// Dry runs return the report to the invoker without delivering or recording it
+	if request.DryRun {
+		log.Printf("Dry run: skipping delivery to %d channel(s) and report persistence", len(notifiers))
+		response.Prompt = prompt
+		response.HTML = rendered.HTML
+		response.Text = rendered.Text
+		return response, nil
+	}
+
+	// Deliver to every channel; the report only fails when none of them worked
+	notification := &reportNotification{
+		Envelope: newEmailEnvelope(config, bundle.Metadata, time.Now()),
+		Report:   rendered,
+		Metadata: &bundle.Metadata,
+	}
+	deliveryErr := deliverReport(ctx, notifiers, notification)
+	response.EmailMessageID = bundle.Metadata.EmailMessageID
+	response.Deliveries = bundle.Metadata.Deliveries
+	if deliveryErr != nil {
+		log.Printf("Failed to deliver report: %v", deliveryErr)
+		return nil, deliveryErr
+	}
+
+	log.Printf("%s delivered for user %s", rendered.Subject, user.ID)
+	emf.Put(emf.Milliseconds("ReportLatency", time.Since(started)))
+
+	// Persist the bundle for history and audit; the report has already gone out so failures are not retried
+	if err := persistReportBundle(ctx, clients.s3, config, bundle); err != nil {
+		log.Printf("Failed to persist report bundle: %v", err)
+	}
+	return response, nil
 }
 
 func getEnvOrDefault(key, defaultValue string) string {
@@ -155,6 +382,19 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvIntOrDefault(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s value %q, using %d: %v", key, value, defaultValue, err)
+		return defaultValue
+	}
+	return parsed
+}
+
 func validateConfig(config *Config) error {
 	if config.OpenAISecretArn == "" {
 		return fmt.Errorf("OPENAI_SECRET_ARN environment variable is required")
@@ -165,6 +405,23 @@ func validateConfig(config *Config) error {
 	if config.SenderEmail == "" {
 		return fmt.Errorf("SENDER_EMAIL environment variable is required")
 	}
+	// Athena names and the data layout come from the stack, so there are no defaults to fall
+	// back on
+	if config.ReportsPrefix == "" {
+		return fmt.Errorf("REPORTS_PREFIX environment variable is required")
+	}
+	if config.RawCsvBase == "" {
+		return fmt.Errorf("RAW_CSV_BASE environment variable is required")
+	}
+	if config.AthenaDatabase == "" {
+		return fmt.Errorf("ATHENA_DATABASE environment variable is required")
+	}
+	if config.AthenaTable == "" {
+		return fmt.Errorf("ATHENA_TABLE environment variable is required")
+	}
+	if config.AthenaWorkgroup == "" {
+		return fmt.Errorf("ATHENA_WORKGROUP environment variable is required")
+	}
 	if config.AppConfigApplication == "" {
 		return fmt.Errorf("APPCONFIG_APPLICATION environment variable is required")
 	}
@@ -174,6 +431,12 @@ func validateConfig(config *Config) error {
 	if config.AppConfigConfiguration == "" {
 		return fmt.Errorf("APPCONFIG_CONFIGURATION environment variable is required")
 	}
+	if config.Timezone == "" {
+		return fmt.Errorf("REPORT_TIMEZONE environment variable is required")
+	}
+	if _, err := time.LoadLocation(config.Timezone); err != nil {
+		return fmt.Errorf("invalid REPORT_TIMEZONE %q: %w", config.Timezone, err)
+	}
 	return nil
 }
 
@@ -205,68 +468,26 @@ func getOpenAIAPIKey(secretsClient *secretsmanager.SecretsManager, secretArn str
 	return *result.SecretString, nil
 }
 
-func getPromptsFromAppConfig(appConfigClient *appconfigdata.AppConfigData, config *Config) (string, string, error) {
-	// Start a configuration session
-	sessionInput := &appconfigdata.StartConfigurationSessionInput{
-		ApplicationIdentifier:          aws.String(config.AppConfigApplication),
-		EnvironmentIdentifier:          aws.String(config.AppConfigEnvironment),
-		ConfigurationProfileIdentifier: aws.String(config.AppConfigConfiguration),
-	}
-
-	sessionResult, err := appConfigClient.StartConfigurationSession(sessionInput)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to start configuration session: %w", err)
-	}
-
-	// Get the latest configuration
-	configInput := &appconfigdata.GetLatestConfigurationInput{
-		ConfigurationToken: sessionResult.InitialConfigurationToken,
-	}
-
-	result, err := appConfigClient.GetLatestConfiguration(configInput)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to get latest configuration from AppConfig: %w", err)
-	}
-
-	// Parse the JSON configuration
-	var configData map[string]string
-	if err := json.Unmarshal(result.Configuration, &configData); err != nil {
-		return "", "", fmt.Errorf("failed to parse AppConfig content as JSON: %w", err)
-	}
-
-	// Look for the weekly_report_base_prompt field
-	basePrompt, baseOk := configData["weekly_report_base_prompt"]
-	systemPrompt, sysOk := configData["weekly_report_system_prompt"]
-
-	if !baseOk {
-		return "", "", fmt.Errorf("weekly_report_base_prompt field not found in AppConfig")
+// parseWeekday parses a day name such as "monday" or "Sun" for WEEK_START_DAY.
+func parseWeekday(name string) (time.Weekday, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return 0, fmt.Errorf("WEEK_START_DAY environment variable is required")
 	}
-
-	if !sysOk {
-		return "", "", fmt.Errorf("weekly_report_system_prompt field not found in AppConfig")
-	}
-
-	return basePrompt, systemPrompt, nil
-}
-
-func londonTimeZone() *time.Location {
-	loc, err := time.LoadLocation("Europe/London")
-	if err != nil {
-		log.Printf("Warning: Failed to load London timezone, using UTC: %v", err)
-		return time.UTC
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		day := strings.ToLower(d.String())
+		if name == day || name == day[:3] {
+			return d, nil
+		}
 	}
-	return loc
+	return 0, fmt.Errorf("invalid WEEK_START_DAY %q (want a day name such as monday)", name)
 }
 
-func getWeekRange(date time.Time) (start, end time.Time) {
-	// Get Monday of the week (start of week)
-	weekday := date.Weekday()
-	daysFromMonday := int(weekday - time.Monday)
-	if weekday == time.Sunday {
-		daysFromMonday = 6 // Sunday is -1 day from Monday, so we go back 6 days
-	}
+// getWeekRange returns the week containing date, starting on weekStart, in date's location.
+func getWeekRange(date time.Time, weekStart time.Weekday) (start, end time.Time) {
+	daysIntoWeek := (int(date.Weekday()) - int(weekStart) + 7) % 7
 
-	start = date.AddDate(0, 0, -daysFromMonday)
+	start = date.AddDate(0, 0, -daysIntoWeek)
 	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location())
 
 	end = start.AddDate(0, 0, 6)
@@ -275,26 +496,33 @@ func getWeekRange(date time.Time) (start, end time.Time) {
 	return start, end
 }
 
-// queryWeeklyDataWithAthena executes an Athena query to get raw food data for the specified week
+// queryWeeklyDataWithAthena executes an Athena query to get raw food data for the specified week.
+// "date" is quoted so it cannot be read as the start of a date literal. Partitions are by the
+// day the export arrived, so the year filter only prunes partitions projection would otherwise
+// enumerate and leaves room for entries exported the next year.
 func queryWeeklyDataWithAthena(ctx context.Context, athenaClient *athena.Athena, config *Config, startDate, endDate time.Time) (*WeeklyData, error) {
 	query := fmt.Sprintf(`
 		SELECT
-			"name=date" AS date,
-			"name=name" AS food_name,
-			"name=quantity" AS quantity,
-			"name=units" AS unit,
-			"name=calories" AS calories,
-			"name=protein_g" AS protein,
-			"name=carbs_g" AS carbs,
-			"name=fat_g" AS fat,
-			"name=fiber_g" AS fiber,
-			"name=sugar_g" AS sugar,
-			"name=sodium_mg" AS sodium
+			"date",
+			meal,
+			name AS food_name,
+			quantity,
+			units AS unit,
+			calories,
+			protein_g AS protein,
+			carbs_g AS carbs,
+			fat_g AS fat,
+			fiber_g AS fiber,
+			sugar_g AS sugar,
+			sodium_mg AS sodium
 		FROM %s.%s
-		WHERE "name=record_type" <> 'Exercise'
-			AND date_parse("name=date", '%%m/%%d/%%Y') BETWEEN date '%s' AND date '%s'
+		WHERE user_id = '%s'
+			AND year BETWEEN %d AND %d
+			AND record_type <> 'Exercise'
+			AND date_parse("date", '%%m/%%d/%%Y') BETWEEN date '%s' AND date '%s'
 		ORDER BY date, food_name
-	`, config.AthenaDatabase, config.AthenaTable, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+	`, config.AthenaDatabase, config.AthenaTable, config.UserID, startDate.Year(), endDate.Year()+1,
+		startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
 
 	queryExecutionID, err := executeAthenaQuery(ctx, athenaClient, config, query)
 	if err != nil {
@@ -305,22 +533,29 @@ func queryWeeklyDataWithAthena(ctx context.Context, athenaClient *athena.Athena,
 		return nil, err
 	}
 
-	// Get query results
-	results, err := athenaClient.GetQueryResultsWithContext(ctx, &athena.GetQueryResultsInput{
+	// Get query results; monthly and quarterly periods exceed a single 1000-row page
+	var rows []*athena.Row
+	err = athenaClient.GetQueryResultsPagesWithContext(ctx, &athena.GetQueryResultsInput{
 		QueryExecutionId: aws.String(queryExecutionID),
+	}, func(page *athena.GetQueryResultsOutput, _ bool) bool {
+		rows = append(rows, page.ResultSet.Rows...)
+		return true
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get query results: %v", err)
 	}
 
-	// Convert results to CSV-like format for OpenAI
+	// Convert results to CSV for OpenAI; food names often contain commas so values are quoted as needed
 	var rawData strings.Builder
+	csvWriter := csv.NewWriter(&rawData)
 
 	// Add header row
-	rawData.WriteString("date,food_name,quantity,unit,calories,protein,carbs,fat,fiber,sugar,sodium\n")
+	if err := csvWriter.Write([]string{"date", "meal", "food_name", "quantity", "unit", "calories", "protein", "carbs", "fat", "fiber", "sugar", "sodium"}); err != nil {
+		return nil, fmt.Errorf("failed to write CSV header: %w", err)
+	}
 
 	// Skip header row in results and add data rows
-	for i, row := range results.ResultSet.Rows {
+	for i, row := range rows {
 		if i == 0 {
 			continue // Skip header row
 		}
@@ -333,7 +568,13 @@ func queryWeeklyDataWithAthena(ctx context.Context, athenaClient *athena.Athena,
 				values = append(values, "")
 			}
 		}
-		rawData.WriteString(strings.Join(values, ",") + "\n")
+		if err := csvWriter.Write(values); err != nil {
+			return nil, fmt.Errorf("failed to write CSV row: %w", err)
+		}
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to write CSV data: %w", err)
 	}
 
 	return &WeeklyData{
@@ -344,13 +585,18 @@ func queryWeeklyDataWithAthena(ctx context.Context, athenaClient *athena.Athena,
 }
 
 func executeAthenaQuery(ctx context.Context, athenaClient *athena.Athena, config *Config, query string) (string, error) {
-	result, err := athenaClient.StartQueryExecutionWithContext(ctx, &athena.StartQueryExecutionInput{
+	input := &athena.StartQueryExecutionInput{
 		QueryString: aws.String(query),
 		WorkGroup:   aws.String(config.AthenaWorkgroup),
-		ResultConfiguration: &athena.ResultConfiguration{
+	}
+	// The mailmunch workgroup enforces its own encrypted output location; this only matters
+	// for workgroups without one
+	if config.AthenaResultsBucket != "" {
+		input.ResultConfiguration = &athena.ResultConfiguration{
 			OutputLocation: aws.String(fmt.Sprintf("s3://%s/athena-results/", config.AthenaResultsBucket)),
-		},
-	})
+		}
+	}
+	result, err := athenaClient.StartQueryExecutionWithContext(ctx, input)
 	if err != nil {
 		return "", fmt.Errorf("failed to start Athena query execution: %w", err)
 	}
@@ -413,40 +659,98 @@ func waitForAthenaQueryCompletion(ctx context.Context, athenaClient *athena.Athe
 
 const openAIChatModel = "gpt-5"
 
-func generateAIReport(openaiAPIKey string, config *Config, currentWeek, previousWeek *WeeklyData) (string, error) {
+// chatCompletionAPI captures the subset of the OpenAI client we use. This enables unit testing with a mock.
+type chatCompletionAPI interface {
+	New(ctx context.Context, body openai.ChatCompletionNewParams, opts ...option.RequestOption) (*openai.ChatCompletion, error)
+}
+
+var newChatClient = func(apiKey string) chatCompletionAPI {
 	client := openai.NewClient(
-		option.WithAPIKey(openaiAPIKey),
+		option.WithAPIKey(apiKey),
+		// Retries are handled by openAIRetryPolicy so they can honour the Lambda deadline.
+		option.WithMaxRetries(0),
 	)
+	return &client.Chat.Completions
+}
 
-	// Prepare data for OpenAI
-	prompt := buildAnalysisPrompt(config.BasePrompt, currentWeek, previousWeek)
+// generateAIReport asks the model for a structured analysis and falls back to free-form
+// Markdown when the structured response cannot be obtained or fails validation.
+// Token usage across all attempts is accumulated into usage and the ReportTokensUsed
+// metric, including for failed runs.
+func generateAIReport(ctx context.Context, openaiAPIKey string, config *Config, prompt string, usage *TokenUsage) (*ReportAnalysis, error) {
+	client := newChatClient(openaiAPIKey)
+	defer func() { emf.Put(emf.Count("ReportTokensUsed", float64(usage.TotalTokens))) }()
 
 	log.Printf("Sending request to OpenAI with %d chars prompt", len(prompt))
 
-	resp, err := client.Chat.Completions.New(
-		context.Background(),
-		openai.ChatCompletionNewParams{
-			Model: shared.ChatModel(openAIChatModel),
-			Messages: []openai.ChatCompletionMessageParamUnion{
-				{
-					OfSystem: &openai.ChatCompletionSystemMessageParam{
-						Content: openai.ChatCompletionSystemMessageParamContentUnion{
-							OfString: openai.String(config.SystemPrompt),
-						},
+	structured, err := requestStructuredAnalysis(ctx, client, config.SystemPrompt, prompt, usage)
+	if err == nil {
+		log.Printf("Received structured analysis with %d action plan steps", len(structured.ActionPlan))
+		return &ReportAnalysis{Structured: structured}, nil
+	}
+	log.Printf("Structured analysis failed, falling back to Markdown: %v", err)
+
+	analysis, err := requestChatCompletion(ctx, client, buildChatParams(config.SystemPrompt, prompt), usage)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Received %d chars analysis from OpenAI", len(analysis))
+
+	return &ReportAnalysis{Markdown: analysis}, nil
+}
+
+func requestStructuredAnalysis(ctx context.Context, client chatCompletionAPI, systemPrompt, prompt string, usage *TokenUsage) (*StructuredAnalysis, error) {
+	params := buildChatParams(systemPrompt, prompt)
+	params.ResponseFormat = openai.ChatCompletionNewParamsResponseFormatUnion{
+		OfJSONSchema: &shared.ResponseFormatJSONSchemaParam{
+			JSONSchema: shared.ResponseFormatJSONSchemaJSONSchemaParam{
+				Name:        "weekly_nutrition_report",
+				Description: openai.String("Weekly nutrition analysis split into report sections"),
+				Schema:      analysisJSONSchema,
+				Strict:      openai.Bool(true),
+			},
+		},
+	}
+
+	content, err := requestChatCompletion(ctx, client, params, usage)
+	if err != nil {
+		return nil, err
+	}
+	return parseStructuredAnalysis(content)
+}
+
+func buildChatParams(systemPrompt, prompt string) openai.ChatCompletionNewParams {
+	return openai.ChatCompletionNewParams{
+		Model: shared.ChatModel(openAIChatModel),
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			{
+				OfSystem: &openai.ChatCompletionSystemMessageParam{
+					Content: openai.ChatCompletionSystemMessageParamContentUnion{
+						OfString: openai.String(systemPrompt),
 					},
 				},
-				{
-					OfUser: &openai.ChatCompletionUserMessageParam{
-						Content: openai.ChatCompletionUserMessageParamContentUnion{
-							OfString: openai.String(prompt),
-						},
+			},
+			{
+				OfUser: &openai.ChatCompletionUserMessageParam{
+					Content: openai.ChatCompletionUserMessageParamContentUnion{
+						OfString: openai.String(prompt),
 					},
 				},
 			},
-			MaxCompletionTokens: openai.Int(20000),
 		},
-	)
+		MaxCompletionTokens: openai.Int(20000),
+	}
+}
 
+// requestChatCompletion sends params under openAIRetryPolicy and returns the assistant content.
+func requestChatCompletion(ctx context.Context, client chatCompletionAPI, params openai.ChatCompletionNewParams, usage *TokenUsage) (string, error) {
+	return withRetry(ctx, openAIRetryPolicy, func(ctx context.Context) (string, error) {
+		return requestChatCompletionOnce(ctx, client, params, usage)
+	})
+}
+
+func requestChatCompletionOnce(ctx context.Context, client chatCompletionAPI, params openai.ChatCompletionNewParams, usage *TokenUsage) (string, error) {
+	resp, err := client.New(ctx, params)
 	if err != nil {
 		return "", fmt.Errorf("OpenAI API error: %w", err)
 	}
@@ -456,6 +760,7 @@ func generateAIReport(openaiAPIKey string, config *Config, currentWeek, previous
 	}
 
 	choice := resp.Choices[0]
+	usage.add(resp.Usage)
 
 	log.Printf(
 		"OpenAI completion usage: prompt=%d completion=%d total=%d (finish_reason=%s)",
@@ -469,13 +774,15 @@ func generateAIReport(openaiAPIKey string, config *Config, currentWeek, previous
 		log.Printf("OpenAI refusal detected; first 160 chars: %s", truncateString(refusal, 160))
 	}
 
-	analysis := extractAssistantContent(choice.Message)
-	if len(strings.TrimSpace(analysis)) == 0 {
-		log.Printf("Warning: OpenAI returned empty assistant content for weekly report prompt")
+	if choice.FinishReason == "length" {
+		return "", errTruncatedCompletion
 	}
-	log.Printf("Received %d chars analysis from OpenAI", len(analysis))
 
-	return analysis, nil
+	content := extractAssistantContent(choice.Message)
+	if strings.TrimSpace(content) == "" {
+		return "", errEmptyCompletion
+	}
+	return content, nil
 }
 
 // truncateString guards log messages from flooding CloudWatch when refusals are verbose.
@@ -520,59 +827,159 @@ func buildAnalysisPrompt(basePrompt string, currentWeek, previousWeek *WeeklyDat
 	return builder.String()
 }
 
-func sendEmailReport(sesClient *ses.SES, config *Config, analysis string, currentWeek, previousWeek *WeeklyData) error {
-	subject := fmt.Sprintf("Weekly Nutrition Report - %s to %s", currentWeek.StartDate, currentWeek.EndDate)
+// periodPrompt tells the model when the data covers something other than a week, since the
+// base prompt from AppConfig is written for weekly reports.
+func periodPrompt(basePrompt string, period reportPeriod) string {
+	if period.Kind == periodWeek {
+		return basePrompt
+	}
+	_, label := periodNames(period.Kind)
+	return fmt.Sprintf(
+		"%s\n\nNOTE: This report covers a %s (%s to %s) rather than a week. Read \"week\" in these instructions, "+
+			"and in the data headings below, as this reporting %s, compared with the %s before it.",
+		basePrompt, strings.ToLower(label),
+		period.Start.Format("2006-01-02"), period.End.Format("2006-01-02"),
+		strings.ToLower(label), strings.ToLower(label),
+	)
+}
+
+// RenderedReport is the final report content shared by email delivery and persistence.
+type RenderedReport struct {
+	Subject     string
+	HTML        string
+	Text        string
+	Charts      []ChartImage // inline images referenced from HTML
+	Attachments []Attachment // the period's data as CSV and the report as PDF
+	// TemplateVersion identifies the templates used, see reportTemplates
+	TemplateVersion string
+}
+
+// reportExtras are optional report sections beyond the metrics and the analysis.
+type reportExtras struct {
+	Charts    []ChartImage     // trend charts, monthly and quarterly reports only
+	Adherence *GoalAdherence   // nil when the user has no goals
+	Templates *reportTemplates // nil uses the built-in templates
+}
+
+// templates returns the templates the report is rendered with.
+func (e reportExtras) templates() (*reportTemplates, error) {
+	if e.Templates != nil {
+		return e.Templates, nil
+	}
+	return builtinTemplates()
+}
 
-	htmlBody, err := buildHTMLEmail(analysis, currentWeek, previousWeek)
+func renderReport(analysis *ReportAnalysis, currentWeek, previousWeek *WeeklyData, extras reportExtras) (*RenderedReport, error) {
+	htmlBody, err := buildHTMLEmail(analysis, currentWeek, previousWeek, extras)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build HTML email: %w", err)
+	}
+	textBody, err := buildTextEmail(analysis, currentWeek, previousWeek, extras)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build text email: %w", err)
+	}
+	tmpl, err := extras.templates()
 	if err != nil {
-		return fmt.Errorf("failed to build HTML email: %w", err)
+		return nil, err
+	}
+	subject, err := tmpl.renderSubject(newEmailData(analysis, currentWeek, previousWeek, extras))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build subject: %w", err)
+	}
+	report := &RenderedReport{
+		Subject:         subject,
+		HTML:            htmlBody,
+		Text:            textBody,
+		Charts:          extras.Charts,
+		TemplateVersion: tmpl.Version,
 	}
-	textBody := buildTextEmail(analysis, currentWeek, previousWeek)
 
-	input := &ses.SendEmailInput{
-		Destination: &ses.Destination{
-			ToAddresses: []*string{aws.String(config.ReportEmail)},
-		},
-		Message: &ses.Message{
-			Body: &ses.Body{
-				Html: &ses.Content{
-					Charset: aws.String("UTF-8"),
-					Data:    aws.String(htmlBody),
-				},
-				Text: &ses.Content{
-					Charset: aws.String("UTF-8"),
-					Data:    aws.String(textBody),
-				},
-			},
-			Subject: &ses.Content{
-				Charset: aws.String("UTF-8"),
-				Data:    aws.String(subject),
-			},
-		},
-		Source: aws.String(config.SenderEmail),
+	name := fmt.Sprintf("nutrition-%s-to-%s", currentWeek.StartDate, currentWeek.EndDate)
+	if currentWeek.RawData != "" {
+		report.Attachments = append(report.Attachments, Attachment{Filename: name + ".csv", ContentType: "text/csv", Data: []byte(currentWeek.RawData)})
 	}
+	// The PDF is a convenience copy; the email is still worth sending without it
+	pdf, err := buildReportPDF(report.Subject, textBody, extras.Charts)
+	if err != nil {
+		log.Printf("Warning: failed to render PDF report: %v", err)
+	} else {
+		report.Attachments = append(report.Attachments, Attachment{Filename: name + ".pdf", ContentType: "application/pdf", Data: pdf})
+	}
+	return report, nil
+}
 
-	result, err := sesClient.SendEmail(input)
+// sendEmailReport emails the rendered report as raw MIME, so charts can be embedded inline and
+// the data and PDF attached, and returns the SES message ID.
+func sendEmailReport(sesClient *ses.SES, env emailEnvelope, report *RenderedReport) (string, error) {
+	raw, err := buildRawEmail(env, report)
 	if err != nil {
-		return fmt.Errorf("failed to send email: %w", err)
+		return "", fmt.Errorf("failed to build raw email: %w", err)
 	}
 
-	log.Printf("Email sent successfully. MessageID: %s", *result.MessageId)
-	return nil
+	result, err := sesClient.SendRawEmail(&ses.SendRawEmailInput{
+		Destinations: []*string{aws.String(env.To)},
+		Source:       aws.String(env.From),
+		RawMessage:   &ses.RawMessage{Data: raw},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to send raw email: %w", err)
+	}
+
+	log.Printf("Email with %d charts and %d attachments sent successfully. MessageID: %s",
+		len(report.Charts), len(report.Attachments), aws.StringValue(result.MessageId))
+	return aws.StringValue(result.MessageId), nil
 }
 
 type EmailData struct {
-	CurrentWeek  *WeeklyData
-	PreviousWeek *WeeklyData
-	Analysis     string
+	Title           string // e.g. "Weekly Nutrition Report"
+	Cadence         string // e.g. "Weekly", used in section headings
+	PeriodLabel     string // e.g. "Week", used in "Current Week"
+	CurrentWeek     *WeeklyData
+	PreviousWeek    *WeeklyData
+	CurrentMetrics  WeeklyMetrics
+	PreviousMetrics WeeklyMetrics
+	Charts          []ChartImage
+	Adherence       *GoalAdherence
+	AIUnavailable   bool // AI step failed; only computed metrics are shown
+	Structured      *StructuredAnalysis
+	AnalysisHTML    template.HTML // Markdown fallback rendered to HTML
+	Analysis        string        // Markdown fallback as returned by the model
+}
+
+// newEmailData prepares template data. A nil analysis produces the metrics-only fallback.
+func newEmailData(analysis *ReportAnalysis, currentWeek, previousWeek *WeeklyData, extras reportExtras) EmailData {
+	data := EmailData{
+		Title:        reportTitle(currentWeek.Period),
+		CurrentWeek:  currentWeek,
+		PreviousWeek: previousWeek,
+		Charts:       extras.Charts,
+		Adherence:    extras.Adherence,
+	}
+	data.Cadence, data.PeriodLabel = periodNames(currentWeek.Period)
+	var err error
+	if data.CurrentMetrics, err = computeWeeklyMetrics(currentWeek); err != nil {
+		log.Printf("Warning: failed to compute current week metrics: %v", err)
+	}
+	if data.PreviousMetrics, err = computeWeeklyMetrics(previousWeek); err != nil {
+		log.Printf("Warning: failed to compute previous week metrics: %v", err)
+	}
+	if analysis == nil {
+		data.AIUnavailable = true
+		return data
+	}
+	data.Structured = analysis.Structured
+	if analysis.Structured == nil {
+		data.Analysis = analysis.Markdown
+		data.AnalysisHTML = renderMarkdownHTML(analysis.Markdown)
+	}
+	return data
 }
 
-func buildHTMLEmail(analysis string, currentWeek, previousWeek *WeeklyData) (string, error) {
-	const htmlTemplate = `<!DOCTYPE html>
+const htmlEmailTemplate = `<!DOCTYPE html>
 <html>
 <head>
     <meta charset="UTF-8">
-    <title>Weekly Nutrition Report</title>
+    <title>{{.Title}}</title>
     <style>
         body { font-family: Arial, sans-serif; line-height: 1.6; color: #333; }
         .container { max-width: 800px; margin: 0 auto; padding: 20px; }
@@ -581,36 +988,122 @@ func buildHTMLEmail(analysis string, currentWeek, previousWeek *WeeklyData) (str
         .week-card { background-color: #f9f9f9; padding: 15px; border-radius: 8px; flex: 1; margin: 0 10px; }
         .metrics { margin: 10px 0; }
         .metric { margin: 5px 0; }
+        .charts img { display: block; max-width: 100%; margin: 10px auto; }
         .analysis { background-color: #e8f5e8; padding: 20px; border-radius: 8px; margin: 20px 0; }
+        .section { margin: 20px 0; }
+        .wins li { color: #2e7d32; }
+        .concerns li { color: #c62828; }
+        table.swaps { border-collapse: collapse; width: 100%; }
+        table.swaps th, table.swaps td { border-bottom: 1px solid #ddd; padding: 8px; text-align: left; vertical-align: top; }
+        table.goals { border-collapse: collapse; width: 100%; }
+        table.goals th, table.goals td { border-bottom: 1px solid #ddd; padding: 6px 8px; text-align: center; }
+        .met { background-color: #e8f5e9; color: #2e7d32; }
+        .missed { background-color: #ffebee; color: #c62828; }
+        .unlogged { color: #999; }
         .footer { text-align: center; margin-top: 30px; font-size: 12px; color: #666; }
     </style>
 </head>
 <body>
     <div class="container">
         <div class="header">
-            <h1>Weekly Nutrition Report</h1>
+            <h1>{{.Title}}</h1>
             <p>{{.CurrentWeek.StartDate}} to {{.CurrentWeek.EndDate}}</p>
         </div>
 
         <div class="summary">
             <div class="week-card">
-                <h3>Current Week ({{.CurrentWeek.StartDate}} to {{.CurrentWeek.EndDate}})</h3>
-                <div class="metrics">
-                    <div class="metric">Raw food data has been analyzed by AI below</div>
-                </div>
+                <h3>Current {{.PeriodLabel}} ({{.CurrentWeek.StartDate}} to {{.CurrentWeek.EndDate}})</h3>
+                {{template "metrics" .CurrentMetrics}}
+                {{- with .CurrentWeek.MissingDays}}
+                <div class="metric unlogged">No export received: {{join . ", "}}</div>
+                {{- end}}
             </div>
 
             <div class="week-card">
-                <h3>Previous Week ({{.PreviousWeek.StartDate}} to {{.PreviousWeek.EndDate}})</h3>
-                <div class="metrics">
-                    <div class="metric">Used for comparison in AI analysis</div>
-                </div>
+                <h3>Previous {{.PeriodLabel}} ({{.PreviousWeek.StartDate}} to {{.PreviousWeek.EndDate}})</h3>
+                {{template "metrics" .PreviousMetrics}}
+                {{- with .PreviousWeek.MissingDays}}
+                <div class="metric unlogged">No export received: {{join . ", "}}</div>
+                {{- end}}
             </div>
         </div>
+{{- with .Adherence}}
+
+        <div class="section goals-section">
+            <h3>Goals</h3>
+            {{- if .Targets}}
+            <table class="goals">
+                <tr><th>Day</th>{{range .Targets}}<th>{{.Name}}<br><small>{{.Label}}</small></th>{{end}}</tr>
+                {{- range .Days}}
+                <tr><td>{{.Date}}</td>
+                {{- if .Logged}}{{range .Checks}}<td class="{{if .Met}}met{{else}}missed{{end}}">{{printf "%.0f" .Value}}</td>{{end}}
+                {{- else}}<td class="unlogged" colspan="{{len $.Adherence.Targets}}">{{if .Missing}}no export{{else}}not logged{{end}}</td>{{end}}</tr>
+                {{- end}}
+                <tr><th>Days met</th>{{range .Summary}}<th>{{.DaysMet}} / {{.DaysLogged}}</th>{{end}}</tr>
+            </table>
+            {{- end}}
+            {{- with .Goals}}{{if .TargetWeightKg}}
+            <p>Target weight: {{printf "%.1f" .TargetWeightKg}} kg{{if .TargetDate}} by {{.TargetDate}}{{end}}</p>
+            {{- end}}{{end}}
+        </div>
+{{- end}}
+{{- if .Charts}}
+
+        <div class="charts">
+            <h3>{{.PeriodLabel}} Trends</h3>
+            {{- range .Charts}}
+            <img src="cid:{{.ContentID}}" alt="{{.Alt}}" title="{{.Title}}" width="640">
+            {{- end}}
+        </div>
+{{- end}}
 
         <div class="analysis">
+{{- if .AIUnavailable}}
+            <h3>AI Analysis Unavailable</h3>
+            <p>The AI analysis could not be generated this {{lower .PeriodLabel}}. The figures above were computed directly from your food diary.</p>
+{{- else}}{{with .Structured}}
+            <div class="section">
+                <h3>{{$.Cadence}} Summary</h3>
+                <p>{{.Summary}}</p>
+            </div>
+            {{- if .Wins}}
+            <div class="section wins">
+                <h3>Wins</h3>
+                <ul>{{range .Wins}}<li>{{.}}</li>{{end}}</ul>
+            </div>
+            {{- end}}
+            {{- if .Concerns}}
+            <div class="section concerns">
+                <h3>Concerns</h3>
+                <ul>{{range .Concerns}}<li>{{.}}</li>{{end}}</ul>
+            </div>
+            {{- end}}
+            {{- if .FoodSwaps}}
+            <div class="section">
+                <h3>Food Swaps</h3>
+                <table class="swaps">
+                    <tr><th>Instead of</th><th>Try</th><th>Why</th></tr>
+                    {{- range .FoodSwaps}}
+                    <tr><td>{{.InsteadOf}}</td><td>{{.Try}}</td><td>{{.Reason}}</td></tr>
+                    {{- end}}
+                </table>
+            </div>
+            {{- end}}
+            <div class="section">
+                <h3>Protein Timing</h3>
+                <p>{{.ProteinTiming.Assessment}}</p>
+                {{- if .ProteinTiming.Recommendations}}
+                <ul>{{range .ProteinTiming.Recommendations}}<li>{{.}}</li>{{end}}</ul>
+                {{- end}}
+            </div>
+            <div class="section">
+                <h3>Your 5-Step Plan for Next {{$.PeriodLabel}}</h3>
+                <ol>{{range .ActionPlan}}<li>{{.}}</li>{{end}}</ol>
+            </div>
+{{- else}}
             <h3>AI Analysis & Recommendations</h3>
-            <div style="white-space: pre-wrap;">{{.Analysis}}</div>
+            <div>{{.AnalysisHTML}}</div>
+{{- end}}{{end}}
         </div>
 
         <div class="footer">
@@ -618,43 +1111,130 @@ func buildHTMLEmail(analysis string, currentWeek, previousWeek *WeeklyData) (str
         </div>
     </div>
 </body>
-</html>`
-
-	tmpl, err := template.New("email").Parse(htmlTemplate)
-	if err != nil {
-		log.Printf("Error parsing email template: %v", err)
-		return "", fmt.Errorf("failed to parse email template: %w", err)
-	}
+</html>
+{{- define "metrics"}}
+                <div class="metrics">
+                {{- if .DaysLogged}}
+                    <div class="metric">Days logged: {{.DaysLogged}} ({{.Entries}} entries)</div>
+                    <div class="metric">Avg calories: {{printf "%.0f" .AvgCalories}} kcal/day</div>
+                    <div class="metric">Avg protein: {{printf "%.0f" .AvgProtein}} g/day</div>
+                    <div class="metric">Avg carbs: {{printf "%.0f" .AvgCarbs}} g/day</div>
+                    <div class="metric">Avg fat: {{printf "%.0f" .AvgFat}} g/day</div>
+                    <div class="metric">Avg fiber: {{printf "%.0f" .AvgFiber}} g/day</div>
+                    <div class="metric">Avg sugar: {{printf "%.0f" .AvgSugar}} g/day</div>
+                    <div class="metric">Avg sodium: {{printf "%.0f" .AvgSodium}} mg/day</div>
+                {{- else}}
+                    <div class="metric">No food data logged</div>
+                {{- end}}
+                </div>
+{{- end}}`
+
+const textEmailTemplate = `{{upper .Title}}
+{{rule "=" 51}}
+
+Report Period: {{.CurrentWeek.StartDate}} to {{.CurrentWeek.EndDate}}
+
+THIS {{upper .PeriodLabel}}:
+{{rule "-" 41}}
+{{template "metrics" .CurrentMetrics}}
+{{- with .CurrentWeek.MissingDays}}No export:    {{join . ", "}}
+{{end}}
+PREVIOUS {{upper .PeriodLabel}} ({{.PreviousWeek.StartDate}} to {{.PreviousWeek.EndDate}}):
+{{rule "-" 41}}
+{{template "metrics" .PreviousMetrics}}
+{{- with .PreviousWeek.MissingDays}}No export:    {{join . ", "}}
+{{end}}
+{{with .Adherence -}}
+GOALS:
+{{rule "-" 41}}
+{{range .Summary}}{{printf "%-9s" .Name}} {{.Label}}: met on {{.DaysMet}} of {{.DaysLogged}} logged days
+{{end}}{{if .Targets}}{{range .Days}}{{.Date}} {{if .Logged}}{{range $i, $c := .Checks}}{{if $i}}  {{end}}{{if $c.Met}}✓{{else}}✗{{end}} {{printf "%.0f" $c.Value}} {{(index $.Adherence.Targets $i).Unit}}{{end}}{{else}}{{if .Missing}}no export{{else}}not logged{{end}}{{end}}
+{{end}}{{end}}{{with .Goals}}{{if .TargetWeightKg}}Target weight: {{printf "%.1f" .TargetWeightKg}} kg{{if .TargetDate}} by {{.TargetDate}}{{end}}
+{{end}}{{end}}
+{{end -}}
+{{if .Charts -}}
+Trend charts ({{range $i, $c := .Charts}}{{if $i}}, {{end}}{{lower $c.Title}}{{end}}) are included in the HTML version of this email.
+
+{{end -}}
+{{if .AIUnavailable -}}
+AI ANALYSIS UNAVAILABLE:
+{{rule "-" 41}}
+The AI analysis could not be generated this {{lower .PeriodLabel}}. The figures above
+were computed directly from your food diary.
+{{else}}{{with .Structured -}}
+{{upper $.Cadence}} SUMMARY:
+{{rule "-" 41}}
+{{.Summary}}
+{{if .Wins}}
+WINS:
+{{rule "-" 41}}
+{{range .Wins}}+ {{.}}
+{{end}}{{end}}{{if .Concerns}}
+CONCERNS:
+{{rule "-" 41}}
+{{range .Concerns}}! {{.}}
+{{end}}{{end}}{{if .FoodSwaps}}
+FOOD SWAPS:
+{{rule "-" 41}}
+{{range .FoodSwaps}}- Instead of {{.InsteadOf}}, try {{.Try}}{{if .Reason}} ({{.Reason}}){{end}}
+{{end}}{{end}}
+PROTEIN TIMING:
+{{rule "-" 41}}
+{{.ProteinTiming.Assessment}}
+{{range .ProteinTiming.Recommendations}}- {{.}}
+{{end}}
+YOUR 5-STEP PLAN FOR NEXT {{upper $.PeriodLabel}}:
+{{rule "-" 41}}
+{{range $i, $step := .ActionPlan}}{{inc $i}}. {{$step}}
+{{end}}
+{{- else -}}
+AI ANALYSIS & RECOMMENDATIONS:
+{{rule "-" 41}}
+{{.Analysis}}
+{{end}}{{end}}
+Generated by MailMunch Weekly Report System
+{{- define "metrics"}}
+{{- if .DaysLogged -}}
+Days logged:  {{.DaysLogged}} ({{.Entries}} entries)
+Avg calories: {{printf "%.0f" .AvgCalories}} kcal/day
+Avg protein:  {{printf "%.0f" .AvgProtein}} g/day
+Avg carbs:    {{printf "%.0f" .AvgCarbs}} g/day
+Avg fat:      {{printf "%.0f" .AvgFat}} g/day
+Avg fiber:    {{printf "%.0f" .AvgFiber}} g/day
+Avg sugar:    {{printf "%.0f" .AvgSugar}} g/day
+Avg sodium:   {{printf "%.0f" .AvgSodium}} mg/day
+{{else -}}
+No food data logged
+{{end}}
+{{- end}}
+`
+
+var textTemplateFuncs = texttemplate.FuncMap{
+	"rule":  strings.Repeat,
+	"inc":   func(i int) int { return i + 1 },
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"join":  strings.Join,
+}
 
-	data := EmailData{
-		CurrentWeek:  currentWeek,
-		PreviousWeek: previousWeek,
-		Analysis:     analysis,
-	}
+var htmlTemplateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"join":  strings.Join,
+}
 
-	var buffer strings.Builder
-	if err := tmpl.Execute(&buffer, data); err != nil {
-		log.Printf("Error executing email template: %v", err)
-		return "", fmt.Errorf("failed to execute email template: %w", err)
+// buildHTMLEmail renders the HTML body; charts are referenced as cid: images.
+func buildHTMLEmail(analysis *ReportAnalysis, currentWeek, previousWeek *WeeklyData, extras reportExtras) (string, error) {
+	tmpl, err := extras.templates()
+	if err != nil {
+		return "", err
 	}
-
-	return buffer.String(), nil
+	return tmpl.renderHTML(newEmailData(analysis, currentWeek, previousWeek, extras))
 }
 
-func buildTextEmail(analysis string, currentWeek, previousWeek *WeeklyData) string {
-	var builder strings.Builder
-
-	builder.WriteString("WEEKLY NUTRITION REPORT\n")
-	builder.WriteString("=" + strings.Repeat("=", 50) + "\n\n")
-
-	builder.WriteString("Report Period: " + currentWeek.StartDate + " to " + currentWeek.EndDate + "\n\n")
-
-	builder.WriteString("AI ANALYSIS & RECOMMENDATIONS:\n")
-	builder.WriteString("-" + strings.Repeat("-", 40) + "\n")
-	builder.WriteString(analysis)
-	builder.WriteString("\n\n")
-
-	builder.WriteString("Generated by MailMunch Weekly Report System\n")
-
-	return builder.String()
+func buildTextEmail(analysis *ReportAnalysis, currentWeek, previousWeek *WeeklyData, extras reportExtras) (string, error) {
+	tmpl, err := extras.templates()
+	if err != nil {
+		return "", err
+	}
+	return tmpl.renderText(newEmailData(analysis, currentWeek, previousWeek, extras))
 }
@@ -12,7 +12,7 @@ import (
 func TestGetWeekRange(t *testing.T) {
 	// Test Sunday (should get Monday to Sunday range)
 	sunday := time.Date(2025, 1, 12, 15, 0, 0, 0, time.UTC) // Sunday, Jan 12, 2025
-	start, end := getWeekRange(sunday)
+	start, end := getWeekRange(sunday, time.Monday)
 
 	expectedStart := time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC)           // Monday, Jan 6
 	expectedEnd := time.Date(2025, 1, 12, 23, 59, 59, 999999999, time.UTC) // Sunday, Jan 12
@@ -28,7 +28,7 @@ func TestGetWeekRange(t *testing.T) {
 func TestGetWeekRangeMonday(t *testing.T) {
 	// Test Monday (should get same week Monday to Sunday)
 	monday := time.Date(2025, 1, 6, 10, 0, 0, 0, time.UTC) // Monday, Jan 6, 2025
-	start, end := getWeekRange(monday)
+	start, end := getWeekRange(monday, time.Monday)
 
 	expectedStart := time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC)           // Same Monday
 	expectedEnd := time.Date(2025, 1, 12, 23, 59, 59, 999999999, time.UTC) // Sunday, Jan 12
@@ -44,7 +44,7 @@ func TestGetWeekRangeMonday(t *testing.T) {
 func TestGetWeekRangeWednesday(t *testing.T) {
 	// Test Wednesday (should get previous Monday to Sunday)
 	wednesday := time.Date(2025, 1, 8, 14, 30, 0, 0, time.UTC) // Wednesday, Jan 8, 2025
-	start, end := getWeekRange(wednesday)
+	start, end := getWeekRange(wednesday, time.Monday)
 
 	expectedStart := time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC)           // Monday, Jan 6
 	expectedEnd := time.Date(2025, 1, 12, 23, 59, 59, 999999999, time.UTC) // Sunday, Jan 12
@@ -69,12 +69,52 @@ func TestValidateConfig(t *testing.T) {
 				OpenAISecretArn:        "arn:aws:secretsmanager:us-east-1:123456789012:secret:test-secret",
 				ReportEmail:            "test@example.com",
 				SenderEmail:            "sender@example.com",
+				AthenaDatabase:         "mailmunch_test",
+				AthenaTable:            "loseit_loseit_parquet",
+				AthenaWorkgroup:        "mailmunch-test",
 				AppConfigApplication:   "test-app",
 				AppConfigEnvironment:   "prod",
 				AppConfigConfiguration: "test-config",
+				ReportsPrefix:          "reports/",
+				RawCsvBase:             "raw/loseit_csv/",
+				Timezone:               defaultUserTimezone,
 			},
 			wantErr: false,
 		},
+		{
+			name: "missing timezone",
+			config: &Config{
+				OpenAISecretArn:        "arn:aws:secretsmanager:us-east-1:123456789012:secret:test-secret",
+				ReportEmail:            "test@example.com",
+				SenderEmail:            "sender@example.com",
+				AthenaDatabase:         "mailmunch_test",
+				AthenaTable:            "loseit_loseit_parquet",
+				AthenaWorkgroup:        "mailmunch-test",
+				AppConfigApplication:   "test-app",
+				AppConfigEnvironment:   "prod",
+				AppConfigConfiguration: "test-config",
+				ReportsPrefix:          "reports/",
+				RawCsvBase:             "raw/loseit_csv/",
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing raw CSV base",
+			config: &Config{
+				OpenAISecretArn:        "arn:aws:secretsmanager:us-east-1:123456789012:secret:test-secret",
+				ReportEmail:            "test@example.com",
+				SenderEmail:            "sender@example.com",
+				AthenaDatabase:         "mailmunch_test",
+				AthenaTable:            "loseit_loseit_parquet",
+				AthenaWorkgroup:        "mailmunch-test",
+				AppConfigApplication:   "test-app",
+				AppConfigEnvironment:   "prod",
+				AppConfigConfiguration: "test-config",
+				ReportsPrefix:          "reports/",
+				Timezone:               defaultUserTimezone,
+			},
+			wantErr: true,
+		},
 		{
 			name: "missing OpenAI secret ARN",
 			config: &Config{
@@ -99,6 +139,20 @@ func TestValidateConfig(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "missing Athena database",
+			config: &Config{
+				OpenAISecretArn:        "arn:aws:secretsmanager:us-east-1:123456789012:secret:test-secret",
+				ReportEmail:            "test@example.com",
+				SenderEmail:            "sender@example.com",
+				AthenaTable:            "loseit_loseit_parquet",
+				AthenaWorkgroup:        "mailmunch-test",
+				AppConfigApplication:   "test-app",
+				AppConfigEnvironment:   "prod",
+				AppConfigConfiguration: "test-config",
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -149,15 +203,36 @@ func TestGetEnvOrDefault(t *testing.T) {
 	}
 }
 
-func TestLondonTimeZone(t *testing.T) {
-	tz := londonTimeZone()
-	if tz == nil {
-		t.Error("londonTimeZone() returned nil")
+func TestGetWeekRangeSundayStart(t *testing.T) {
+	// Weeks starting on Sunday, across the start of British Summer Time
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skipf("timezone data unavailable: %v", err)
 	}
+	saturday := time.Date(2025, 4, 5, 18, 0, 0, 0, london)
+	start, end := getWeekRange(saturday, time.Sunday)
 
-	// Should return either London timezone or UTC as fallback
-	if tz.String() != "Europe/London" && tz.String() != "UTC" {
-		t.Errorf("londonTimeZone() returned unexpected timezone: %s", tz.String())
+	if got := start.Format(time.RFC3339); got != "2025-03-30T00:00:00Z" {
+		t.Errorf("unexpected start %s", got)
+	}
+	if got := end.Format(time.RFC3339); got != "2025-04-05T23:59:59+01:00" {
+		t.Errorf("unexpected end %s", got)
+	}
+	if start, _ := getWeekRange(start, time.Sunday); start.Day() != 30 {
+		t.Errorf("the first day should start its own week, got %s", start)
+	}
+}
+
+func TestParseWeekday(t *testing.T) {
+	for in, want := range map[string]time.Weekday{"monday": time.Monday, "Sunday": time.Sunday, "sat": time.Saturday, " TUE ": time.Tuesday} {
+		if got, err := parseWeekday(in); err != nil || got != want {
+			t.Errorf("parseWeekday(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "mo", "1", "someday"} {
+		if _, err := parseWeekday(in); err == nil {
+			t.Errorf("parseWeekday(%q) should fail", in)
+		}
 	}
 }
 
@@ -193,7 +268,7 @@ func TestLambdaHandlerComponentsIntegration(t *testing.T) {
 	t.Setenv("SENDER_EMAIL", "sender@example.com")
 	t.Setenv("AWS_REGION", "us-east-1")
 	t.Setenv("ATHENA_DATABASE", "test_db")
-	t.Setenv("ATHENA_WORKGROUP", "primary")
+	t.Setenv("ATHENA_WORKGROUP", "mailmunch")
 	t.Setenv("ATHENA_RESULTS_BUCKET", "test-bucket")
 	t.Setenv("APPCONFIG_APPLICATION", "test-app")
 	t.Setenv("APPCONFIG_ENVIRONMENT", "test-env")
@@ -246,9 +321,15 @@ func TestLambdaHandlerComponentsIntegration(t *testing.T) {
 			OpenAISecretArn:        "arn:aws:secretsmanager:us-east-1:123456789012:secret:openai-key",
 			ReportEmail:            "test@example.com",
 			SenderEmail:            "sender@example.com",
+			AthenaDatabase:         "mailmunch_test",
+			AthenaTable:            "loseit_loseit_parquet",
+			AthenaWorkgroup:        "mailmunch-test",
 			AppConfigApplication:   "test-app",
 			AppConfigEnvironment:   "test-env",
 			AppConfigConfiguration: "test-config",
+			ReportsPrefix:          "reports/",
+			RawCsvBase:             "raw/loseit_csv/",
+			Timezone:               defaultUserTimezone,
 		}
 
 		err := validateConfig(config)
@@ -268,7 +349,7 @@ func TestLambdaHandlerComponentsIntegration(t *testing.T) {
 	t.Run("date_range_calculations", func(t *testing.T) {
 		// Test with a known date
 		testDate := time.Date(2025, 9, 21, 15, 0, 0, 0, time.UTC) // Sunday
-		start, end := getWeekRange(testDate)
+		start, end := getWeekRange(testDate, time.Monday)
 
 		expectedStart := time.Date(2025, 9, 15, 0, 0, 0, 0, time.UTC)          // Monday
 		expectedEnd := time.Date(2025, 9, 21, 23, 59, 59, 999999999, time.UTC) // Sunday
@@ -281,7 +362,7 @@ func TestLambdaHandlerComponentsIntegration(t *testing.T) {
 		}
 
 		// Test that previous week calculation works
-		prevStart, prevEnd := getWeekRange(start.AddDate(0, 0, -7))
+		prevStart, prevEnd := getWeekRange(start.AddDate(0, 0, -7), time.Monday)
 		expectedPrevStart := time.Date(2025, 9, 8, 0, 0, 0, 0, time.UTC)
 		expectedPrevEnd := time.Date(2025, 9, 14, 23, 59, 59, 999999999, time.UTC)
 
@@ -362,8 +443,8 @@ func TestLambdaHandlerComponentsIntegration(t *testing.T) {
 			RawData:   "sample data",
 		}
 
-		// Test HTML email building
-		htmlBody, err := buildHTMLEmail(analysis, currentWeek, previousWeek)
+		// Test HTML email building (Markdown fallback path)
+		htmlBody, err := buildHTMLEmail(&ReportAnalysis{Markdown: analysis}, currentWeek, previousWeek, reportExtras{})
 		if err != nil {
 			t.Fatalf("Failed to build HTML email: %v", err)
 		}
@@ -372,8 +453,14 @@ func TestLambdaHandlerComponentsIntegration(t *testing.T) {
 		if !strings.Contains(htmlBody, "<!DOCTYPE html>") {
 			t.Error("HTML email should have proper DOCTYPE")
 		}
-		if !strings.Contains(htmlBody, analysis) {
-			t.Error("HTML email should contain analysis")
+		if !strings.Contains(htmlBody, "<h2>WEEKLY SUMMARY</h2>") {
+			t.Error("HTML email should render Markdown headings")
+		}
+		if !strings.Contains(htmlBody, "<li>Increase fiber intake</li>") {
+			t.Error("HTML email should render Markdown lists")
+		}
+		if strings.Contains(htmlBody, "## ") {
+			t.Error("HTML email should not contain raw Markdown markers")
 		}
 		if !strings.Contains(htmlBody, "2025-09-15") {
 			t.Error("HTML email should contain current week dates")
@@ -386,7 +473,10 @@ func TestLambdaHandlerComponentsIntegration(t *testing.T) {
 		}
 
 		// Test text email building
-		textBody := buildTextEmail(analysis, currentWeek, previousWeek)
+		textBody, err := buildTextEmail(&ReportAnalysis{Markdown: analysis}, currentWeek, previousWeek, reportExtras{})
+		if err != nil {
+			t.Fatalf("Failed to build text email: %v", err)
+		}
 		if !strings.Contains(textBody, analysis) {
 			t.Error("Text email should contain analysis")
 		}
@@ -450,19 +540,14 @@ func TestLambdaHandlerComponentsIntegration(t *testing.T) {
 
 	// Test timezone handling
 	t.Run("timezone_handling", func(t *testing.T) {
-		tz := londonTimeZone()
+		tz := User{Timezone: defaultUserTimezone}.location()
 		if tz == nil {
-			t.Error("londonTimeZone() should not return nil")
-		}
-
-		// Should be either London or UTC (fallback)
-		if tz.String() != "Europe/London" && tz.String() != "UTC" {
-			t.Errorf("Unexpected timezone: %s", tz.String())
+			t.Error("location() should not return nil")
 		}
 
 		// Test that time calculations work in the timezone
 		now := time.Now().In(tz)
-		start, end := getWeekRange(now)
+		start, end := getWeekRange(now, time.Monday)
 
 		if start.Location() != tz {
 			t.Error("Week start should be in London timezone")
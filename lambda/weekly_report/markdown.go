@@ -0,0 +1,116 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	mdHeading     = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	mdUnordered   = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdOrdered     = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	mdRule        = regexp.MustCompile(`^\s*([-*_])(\s*[-*_]){2,}\s*$`)
+	mdBold        = regexp.MustCompile(`\*\*(.+?)\*\*|__(.+?)__`)
+	mdItalic      = regexp.MustCompile(`\*([^*\s][^*]*?)\*|\b_([^_\s][^_]*?)_\b`)
+	mdInlineCode  = regexp.MustCompile("`([^`]+)`")
+	mdPlaceholder = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+// renderMarkdownHTML converts the subset of Markdown the model produces (headings, lists,
+// emphasis, inline code and rules) into HTML. It is the fallback when structured output fails.
+func renderMarkdownHTML(markdown string) template.HTML {
+	var out strings.Builder
+	var paragraph []string
+	listTag := ""
+
+	flushParagraph := func() {
+		if len(paragraph) == 0 {
+			return
+		}
+		out.WriteString("<p>")
+		out.WriteString(strings.Join(paragraph, "<br>\n"))
+		out.WriteString("</p>\n")
+		paragraph = nil
+	}
+	closeList := func() {
+		if listTag == "" {
+			return
+		}
+		out.WriteString("</" + listTag + ">\n")
+		listTag = ""
+	}
+	openList := func(tag string) {
+		if listTag == tag {
+			return
+		}
+		closeList()
+		out.WriteString("<" + tag + ">\n")
+		listTag = tag
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(markdown, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			flushParagraph()
+			closeList()
+		case mdRule.MatchString(trimmed):
+			flushParagraph()
+			closeList()
+			out.WriteString("<hr>\n")
+		case mdHeading.MatchString(trimmed):
+			flushParagraph()
+			closeList()
+			m := mdHeading.FindStringSubmatch(trimmed)
+			level := strconv.Itoa(len(m[1]))
+			out.WriteString("<h" + level + ">" + renderInlineMarkdown(m[2]) + "</h" + level + ">\n")
+		case mdUnordered.MatchString(line):
+			flushParagraph()
+			openList("ul")
+			out.WriteString("<li>" + renderInlineMarkdown(mdUnordered.FindStringSubmatch(line)[1]) + "</li>\n")
+		case mdOrdered.MatchString(line):
+			flushParagraph()
+			openList("ol")
+			out.WriteString("<li>" + renderInlineMarkdown(mdOrdered.FindStringSubmatch(line)[1]) + "</li>\n")
+		default:
+			closeList()
+			paragraph = append(paragraph, renderInlineMarkdown(trimmed))
+		}
+	}
+	flushParagraph()
+	closeList()
+
+	// All text has been escaped by renderInlineMarkdown before tags were added.
+	return template.HTML(out.String())
+}
+
+// renderInlineMarkdown escapes text and applies inline code, bold and italic markup.
+func renderInlineMarkdown(text string) string {
+	// Protect code spans so emphasis markers inside them are left alone.
+	var codeSpans []string
+	text = mdInlineCode.ReplaceAllStringFunc(text, func(m string) string {
+		codeSpans = append(codeSpans, "<code>"+html.EscapeString(mdInlineCode.FindStringSubmatch(m)[1])+"</code>")
+		return "\x00" + strconv.Itoa(len(codeSpans)-1) + "\x00"
+	})
+
+	escaped := html.EscapeString(text)
+	escaped = mdBold.ReplaceAllStringFunc(escaped, func(m string) string {
+		sub := mdBold.FindStringSubmatch(m)
+		return "<strong>" + sub[1] + sub[2] + "</strong>"
+	})
+	escaped = mdItalic.ReplaceAllStringFunc(escaped, func(m string) string {
+		sub := mdItalic.FindStringSubmatch(m)
+		return "<em>" + sub[1] + sub[2] + "</em>"
+	})
+
+	return mdPlaceholder.ReplaceAllStringFunc(escaped, func(m string) string {
+		idx, err := strconv.Atoi(mdPlaceholder.FindStringSubmatch(m)[1])
+		if err != nil || idx >= len(codeSpans) {
+			return ""
+		}
+		return codeSpans[idx]
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdownHTML(t *testing.T) {
+	md := "## Weekly Summary\nYou ate **more** protein and *less* sugar.\n\n- Swap `crisps` for nuts\n- Drink water\n\n1. First\n2. Second\n\n---\n<script>alert(1)</script>"
+
+	got := string(renderMarkdownHTML(md))
+
+	for _, want := range []string{
+		"<h2>Weekly Summary</h2>",
+		"<strong>more</strong>",
+		"<em>less</em>",
+		"<ul>\n<li>Swap <code>crisps</code> for nuts</li>\n<li>Drink water</li>\n</ul>",
+		"<ol>\n<li>First</li>\n<li>Second</li>\n</ol>",
+		"<hr>",
+		"&lt;script&gt;",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("rendered HTML missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "<script>") {
+		t.Error("raw HTML must be escaped")
+	}
+}
+
+func TestRenderInlineMarkdownLeavesSnakeCase(t *testing.T) {
+	got := renderInlineMarkdown("protein_g and fiber_g")
+	if got != "protein_g and fiber_g" {
+		t.Errorf("got %q", got)
+	}
+}
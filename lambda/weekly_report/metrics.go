@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// FoodEntry is a single food diary row as returned by the weekly Athena query.
+type FoodEntry struct {
+	Date     string
+	Meal     string
+	FoodName string
+	Quantity float64
+	Unit     string
+	Calories float64
+	Protein  float64
+	Carbs    float64
+	Fat      float64
+	Fiber    float64
+	Sugar    float64
+	Sodium   float64
+}
+
+// WeeklyMetrics are nutrition totals computed locally from the raw data, independent of the AI step.
+type WeeklyMetrics struct {
+	Entries       int     `json:"entries"`
+	DaysLogged    int     `json:"days_logged"`
+	TotalCalories float64 `json:"total_calories"`
+	AvgCalories   float64 `json:"avg_calories"`
+	AvgProtein    float64 `json:"avg_protein_g"`
+	AvgCarbs      float64 `json:"avg_carbs_g"`
+	AvgFat        float64 `json:"avg_fat_g"`
+	AvgFiber      float64 `json:"avg_fiber_g"`
+	AvgSugar      float64 `json:"avg_sugar_g"`
+	AvgSodium     float64 `json:"avg_sodium_mg"`
+}
+
+// parseFoodEntries reads the CSV produced by queryWeeklyDataWithAthena.
+func parseFoodEntries(raw string) ([]FoodEntry, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	rdr := csv.NewReader(strings.NewReader(raw))
+	rdr.FieldsPerRecord = -1
+	hdr, err := rdr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	idx := make(map[string]int, len(hdr))
+	for i, h := range hdr {
+		idx[strings.TrimSpace(h)] = i
+	}
+
+	var entries []FoodEntry
+	for {
+		rec, err := rdr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV row: %w", err)
+		}
+		str := func(col string) string {
+			if i, ok := idx[col]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		num := func(col string) float64 {
+			f, err := strconv.ParseFloat(str(col), 64)
+			if err != nil {
+				return 0
+			}
+			return f
+		}
+		entries = append(entries, FoodEntry{
+			Date:     str("date"),
+			Meal:     str("meal"),
+			FoodName: str("food_name"),
+			Quantity: num("quantity"),
+			Unit:     str("unit"),
+			Calories: num("calories"),
+			Protein:  num("protein"),
+			Carbs:    num("carbs"),
+			Fat:      num("fat"),
+			Fiber:    num("fiber"),
+			Sugar:    num("sugar"),
+			Sodium:   num("sodium"),
+		})
+	}
+	return entries, nil
+}
+
+// computeWeeklyMetrics totals the week's entries and averages them over the days that have data.
+func computeWeeklyMetrics(week *WeeklyData) (WeeklyMetrics, error) {
+	var metrics WeeklyMetrics
+	if week == nil {
+		return metrics, nil
+	}
+
+	entries, err := parseFoodEntries(week.RawData)
+	if err != nil {
+		return metrics, err
+	}
+
+	var protein, carbs, fat, fiber, sugar, sodium float64
+	days := map[string]struct{}{}
+	for _, e := range entries {
+		days[e.Date] = struct{}{}
+		metrics.TotalCalories += e.Calories
+		protein += e.Protein
+		carbs += e.Carbs
+		fat += e.Fat
+		fiber += e.Fiber
+		sugar += e.Sugar
+		sodium += e.Sodium
+	}
+	metrics.Entries = len(entries)
+	metrics.DaysLogged = len(days)
+	if metrics.DaysLogged == 0 {
+		return metrics, nil
+	}
+
+	n := float64(metrics.DaysLogged)
+	metrics.AvgCalories = metrics.TotalCalories / n
+	metrics.AvgProtein = protein / n
+	metrics.AvgCarbs = carbs / n
+	metrics.AvgFat = fat / n
+	metrics.AvgFiber = fiber / n
+	metrics.AvgSugar = sugar / n
+	metrics.AvgSodium = sodium / n
+	return metrics, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestComputeWeeklyMetrics(t *testing.T) {
+	week := &WeeklyData{
+		StartDate: "2025-09-15",
+		EndDate:   "2025-09-21",
+		RawData: "date,food_name,quantity,unit,calories,protein,carbs,fat,fiber,sugar,sodium\n" +
+			"09/15/2025,Chicken Breast,100,g,165,31,0,3.6,0,0,74\n" +
+			"09/15/2025,\"Raspberries, Raw\",30,g,24,0.5,5.4,0.3,3.2,2,0.5\n" +
+			"09/16/2025,Brown Rice,50,g,180,4,36,1.8,1.8,0.4,5\n",
+	}
+
+	metrics, err := computeWeeklyMetrics(week)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metrics.Entries != 3 || metrics.DaysLogged != 2 {
+		t.Fatalf("got %d entries over %d days", metrics.Entries, metrics.DaysLogged)
+	}
+	if metrics.TotalCalories != 369 {
+		t.Errorf("total calories = %v, want 369", metrics.TotalCalories)
+	}
+	if math.Abs(metrics.AvgProtein-17.75) > 1e-9 {
+		t.Errorf("avg protein = %v, want 17.75", metrics.AvgProtein)
+	}
+}
+
+func TestComputeWeeklyMetricsEmpty(t *testing.T) {
+	metrics, err := computeWeeklyMetrics(&WeeklyData{RawData: "date,food_name\n"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metrics.DaysLogged != 0 || metrics.AvgCalories != 0 {
+		t.Errorf("expected zero metrics, got %+v", metrics)
+	}
+}
+
+func TestBuildEmailsMetricsOnlyFallback(t *testing.T) {
+	current := &WeeklyData{
+		StartDate: "2025-09-15",
+		EndDate:   "2025-09-21",
+		RawData:   "date,food_name,quantity,unit,calories,protein,carbs,fat,fiber,sugar,sodium\n09/15/2025,Oats,50,g,185,6,29.5,3.9,4.4,0.5,15\n",
+	}
+	previous := &WeeklyData{StartDate: "2025-09-08", EndDate: "2025-09-14"}
+
+	htmlBody, err := buildHTMLEmail(nil, current, previous, reportExtras{})
+	if err != nil {
+		t.Fatalf("build HTML: %v", err)
+	}
+	for _, want := range []string{"AI Analysis Unavailable", "Avg calories: 185 kcal/day", "No food data logged"} {
+		if !strings.Contains(htmlBody, want) {
+			t.Errorf("HTML email missing %q", want)
+		}
+	}
+
+	textBody, err := buildTextEmail(nil, current, previous, reportExtras{})
+	if err != nil {
+		t.Fatalf("build text: %v", err)
+	}
+	for _, want := range []string{"AI ANALYSIS UNAVAILABLE", "Avg calories: 185 kcal/day"} {
+		if !strings.Contains(textBody, want) {
+			t.Errorf("text email missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Attachment is a file attached to the report email.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// emailEnvelope holds the addressing and threading headers of a report email.
+type emailEnvelope struct {
+	From      string
+	To        string
+	Date      time.Time
+	MessageID string // without angle brackets
+	// ThreadID is a fixed Message-ID every report for the same user and cadence refers to
+	// in In-Reply-To and References, so mail clients group them into one conversation.
+	ThreadID    string
+	Unsubscribe string // List-Unsubscribe URI, e.g. mailto:reports@example.com?subject=unsubscribe
+}
+
+// newEmailEnvelope derives stable, unique header values for one report run.
+func newEmailEnvelope(config *Config, metadata ReportMetadata, date time.Time) emailEnvelope {
+	domain := "mailmunch.invalid"
+	if addr, err := mail.ParseAddress(config.SenderEmail); err == nil {
+		if _, d, ok := strings.Cut(addr.Address, "@"); ok {
+			domain = d
+		}
+	}
+	userID := metadata.UserID
+	if userID == "" {
+		userID = defaultUserID
+	}
+	return emailEnvelope{
+		From:        config.SenderEmail,
+		To:          config.ReportEmail,
+		Date:        date,
+		MessageID:   fmt.Sprintf("%s.%s.%s@%s", metadata.RunID, userID, metadata.Period, domain),
+		ThreadID:    fmt.Sprintf("report-thread.%s.%s@%s", userID, metadata.Period, domain),
+		Unsubscribe: fmt.Sprintf("mailto:%s?subject=unsubscribe", config.SenderEmail),
+	}
+}
+
+// buildRawEmail assembles a MIME message for SES SendRawEmail:
+//
+//	multipart/mixed
+//	  multipart/related (only when there are charts)
+//	    multipart/alternative (text/plain, text/html)
+//	    image/png parts referenced from the HTML as cid:<ContentID>
+//	  attachments (report data as CSV, the report as PDF)
+func buildRawEmail(env emailEnvelope, report *RenderedReport) ([]byte, error) {
+	var buf bytes.Buffer
+	mixed := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", env.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", env.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", report.Subject))
+	if !env.Date.IsZero() {
+		fmt.Fprintf(&buf, "Date: %s\r\n", env.Date.Format(time.RFC1123Z))
+	}
+	if env.MessageID != "" {
+		fmt.Fprintf(&buf, "Message-ID: <%s>\r\n", env.MessageID)
+	}
+	if env.ThreadID != "" {
+		fmt.Fprintf(&buf, "In-Reply-To: <%s>\r\n", env.ThreadID)
+		fmt.Fprintf(&buf, "References: <%s>\r\n", env.ThreadID)
+	}
+	if env.Unsubscribe != "" {
+		fmt.Fprintf(&buf, "List-Unsubscribe: <%s>\r\n", env.Unsubscribe)
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mixed.Boundary())
+
+	bodyType, body, err := buildEmailBody(report)
+	if err != nil {
+		return nil, err
+	}
+	w, err := mixed.CreatePart(textproto.MIMEHeader{"Content-Type": {bodyType}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+
+	for _, a := range report.Attachments {
+		w, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {fmt.Sprintf("%s; name=%q", a.ContentType, a.Filename)},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", a.Filename)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(wrapBase64(a.Data)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// buildEmailBody returns the readable part of the message and its content type: the text
+// and HTML alternatives, wrapped with the inline chart images when there are any.
+func buildEmailBody(report *RenderedReport) (string, []byte, error) {
+	var alternativeBody bytes.Buffer
+	alternative := multipart.NewWriter(&alternativeBody)
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=UTF-8", report.Text},
+		{"text/html; charset=UTF-8", report.HTML},
+	} {
+		w, err := alternative.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return "", nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := alternative.Close(); err != nil {
+		return "", nil, err
+	}
+	alternativeType := fmt.Sprintf("multipart/alternative; boundary=%q", alternative.Boundary())
+	if len(report.Charts) == 0 {
+		return alternativeType, alternativeBody.Bytes(), nil
+	}
+
+	var relatedBody bytes.Buffer
+	related := multipart.NewWriter(&relatedBody)
+	w, err := related.CreatePart(textproto.MIMEHeader{"Content-Type": {alternativeType}})
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := w.Write(alternativeBody.Bytes()); err != nil {
+		return "", nil, err
+	}
+
+	for _, chart := range report.Charts {
+		w, err := related.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {fmt.Sprintf("image/png; name=%q", chart.Filename)},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-ID":                {"<" + chart.ContentID + ">"},
+			"Content-Disposition":       {fmt.Sprintf("inline; filename=%q", chart.Filename)},
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		if _, err := w.Write(wrapBase64(chart.PNG)); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if err := related.Close(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("multipart/related; type=\"multipart/alternative\"; boundary=%q", related.Boundary()), relatedBody.Bytes(), nil
+}
+
+// wrapBase64 encodes data as base64 in 76 character lines as required by RFC 2045.
+func wrapBase64(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var b strings.Builder
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76])
+		b.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded)
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewEmailEnvelope(t *testing.T) {
+	config := &Config{SenderEmail: "MailMunch <reports@mailmunch.example>", ReportEmail: "me@example.com"}
+	metadata := ReportMetadata{RunID: "20250922T080005Z", UserID: "alice", Period: periodWeek}
+	env := newEmailEnvelope(config, metadata, time.Date(2025, 9, 22, 8, 0, 5, 0, time.UTC))
+
+	if env.MessageID != "20250922T080005Z.alice.week@mailmunch.example" {
+		t.Errorf("unexpected Message-ID %q", env.MessageID)
+	}
+	if env.ThreadID != "report-thread.alice.week@mailmunch.example" {
+		t.Errorf("unexpected thread ID %q", env.ThreadID)
+	}
+	if env.To != "me@example.com" || !strings.HasPrefix(env.Unsubscribe, "mailto:") {
+		t.Errorf("unexpected envelope: %+v", env)
+	}
+
+	// Monthly reports thread separately from weekly ones
+	metadata.Period = periodMonth
+	if newEmailEnvelope(config, metadata, time.Now()).ThreadID == env.ThreadID {
+		t.Error("expected a different thread per cadence")
+	}
+}
+
+func TestBuildRawEmailAttachmentsAndHeaders(t *testing.T) {
+	week := &WeeklyData{
+		StartDate: "2025-09-15",
+		EndDate:   "2025-09-21",
+		RawData:   "date,food_name,calories\n09/15/2025,Oats,300\n",
+	}
+	report, err := renderReport(nil, week, week, reportExtras{})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if len(report.Attachments) != 2 {
+		t.Fatalf("expected CSV and PDF attachments, got %d", len(report.Attachments))
+	}
+
+	env := emailEnvelope{
+		From:        "reports@mailmunch.example",
+		To:          "me@example.com",
+		Date:        time.Date(2025, 9, 22, 8, 0, 5, 0, time.UTC),
+		MessageID:   "run.default.week@mailmunch.example",
+		ThreadID:    "report-thread.default.week@mailmunch.example",
+		Unsubscribe: "mailto:reports@mailmunch.example?subject=unsubscribe",
+	}
+	raw, err := buildRawEmail(env, report)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("invalid message: %v", err)
+	}
+	for header, want := range map[string]string{
+		"Message-ID":       "<run.default.week@mailmunch.example>",
+		"In-Reply-To":      "<report-thread.default.week@mailmunch.example>",
+		"References":       "<report-thread.default.week@mailmunch.example>",
+		"List-Unsubscribe": "<mailto:reports@mailmunch.example?subject=unsubscribe>",
+		"Date":             "Mon, 22 Sep 2025 08:00:05 +0000",
+	} {
+		if got := msg.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("content type: %v", err)
+	}
+	var types, filenames []string
+	var csvBody []byte
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read part: %v", err)
+		}
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		types = append(types, mediaType)
+		if name := part.FileName(); name != "" {
+			filenames = append(filenames, name)
+		}
+		if mediaType == "text/csv" {
+			csvBody, _ = io.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+		}
+	}
+	// Without charts the body is plain multipart/alternative
+	if strings.Join(types, ",") != "multipart/alternative,text/csv,application/pdf" {
+		t.Errorf("unexpected parts: %v", types)
+	}
+	if strings.Join(filenames, ",") != "nutrition-2025-09-15-to-2025-09-21.csv,nutrition-2025-09-15-to-2025-09-21.pdf" {
+		t.Errorf("unexpected filenames: %v", filenames)
+	}
+	if string(csvBody) != week.RawData {
+		t.Errorf("CSV attachment = %q, want raw data", csvBody)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ses"
+)
+
+// Delivery channel types accepted in a user's channels.
+const (
+	channelEmail    = "email"
+	channelWebhook  = "webhook"
+	channelSlack    = "slack"
+	channelTelegram = "telegram"
+	channelS3Page   = "s3_page"
+)
+
+// Channel is one place a user's report is delivered to. Sensitive values (Slack webhook URLs,
+// Telegram bot tokens, webhook signing keys) are not stored in AppConfig; Secret names a key
+// in the JSON secret at NOTIFIER_SECRET_ARN instead.
+type Channel struct {
+	Type    string `json:"type"`
+	URL     string `json:"url,omitempty"`      // webhook: endpoint to POST to
+	ChatID  string `json:"chat_id,omitempty"`  // telegram: chat to message
+	Prefix  string `json:"prefix,omitempty"`   // s3_page: key prefix in REPORTS_BUCKET, default pages/<user_id>/
+	BaseURL string `json:"base_url,omitempty"` // s3_page: public URL of the prefix, linked from other channels
+	Secret  string `json:"secret,omitempty"`
+}
+
+func (c Channel) validate() error {
+	switch c.Type {
+	case channelEmail:
+	case channelWebhook:
+		if u, err := url.Parse(c.URL); err != nil || u.Scheme != "https" {
+			return fmt.Errorf("webhook channel needs an https url")
+		}
+	case channelSlack:
+		if c.Secret == "" {
+			return fmt.Errorf("slack channel needs a secret holding the incoming webhook URL")
+		}
+	case channelTelegram:
+		if c.Secret == "" || c.ChatID == "" {
+			return fmt.Errorf("telegram channel needs chat_id and a secret holding the bot token")
+		}
+	case channelS3Page:
+		// The function is only allowed to write pages under pages/
+		if p := c.Prefix; p != "" && (!strings.HasPrefix(p, "pages/") || strings.Contains(p, "..")) {
+			return fmt.Errorf("s3_page channel prefix %q must be under pages/", p)
+		}
+	default:
+		return fmt.Errorf("unknown channel type %q (want email, webhook, slack, telegram or s3_page)", c.Type)
+	}
+	return nil
+}
+
+// reportNotification is everything a Notifier may use to deliver one report.
+type reportNotification struct {
+	Envelope emailEnvelope
+	Report   *RenderedReport
+	Metadata *ReportMetadata
+	PageURL  string // set once an s3_page channel has published the report
+}
+
+// Notifier delivers a report to one channel and returns an identifier for the delivery,
+// such as the SES message ID or the S3 key written.
+type Notifier interface {
+	Channel() string
+	Notify(ctx context.Context, n *reportNotification) (string, error)
+}
+
+// DeliveryResult records the outcome of one channel in the report metadata.
+type DeliveryResult struct {
+	Channel    string `json:"channel"`
+	DeliveryID string `json:"delivery_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// httpDoer is the subset of http.Client used by the HTTP notifiers. This enables unit testing.
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+var notifierHTTPClient httpDoer = &http.Client{Timeout: 15 * time.Second}
+
+// telegramAPIBase is replaced in tests.
+var telegramAPIBase = "https://api.telegram.org"
+
+// newNotifiers builds the notifiers for a user's channels, defaulting to email. Static
+// pages are published first so the other channels can link to them.
+func newNotifiers(user User, config *Config, clients *reportClients) ([]Notifier, error) {
+	channels := user.Channels
+	if len(channels) == 0 {
+		channels = []Channel{{Type: channelEmail}}
+	}
+
+	var pages, others []Notifier
+	for _, c := range channels {
+		secret := ""
+		if c.Secret != "" {
+			var ok bool
+			if secret, ok = clients.notifierSecrets[c.Secret]; !ok {
+				return nil, fmt.Errorf("%s channel secret %q not found in NOTIFIER_SECRET_ARN", c.Type, c.Secret)
+			}
+		}
+		switch c.Type {
+		case channelEmail:
+			others = append(others, &sesNotifier{client: clients.ses})
+		case channelWebhook:
+			others = append(others, &webhookNotifier{url: c.URL, signingKey: secret})
+		case channelSlack:
+			others = append(others, &slackNotifier{webhookURL: secret})
+		case channelTelegram:
+			others = append(others, &telegramNotifier{token: secret, chatID: c.ChatID})
+		case channelS3Page:
+			prefix := c.Prefix
+			if prefix == "" {
+				prefix = fmt.Sprintf("pages/%s/", user.ID)
+			}
+			pages = append(pages, &s3PageNotifier{client: clients.s3, bucket: config.ReportsBucket, prefix: prefix, baseURL: c.BaseURL})
+		}
+	}
+	return append(pages, others...), nil
+}
+
+// deliverReport sends the report to every notifier, recording each outcome in the metadata.
+// It only fails when no channel succeeded.
+func deliverReport(ctx context.Context, notifiers []Notifier, n *reportNotification) error {
+	var errs []error
+	for _, notifier := range notifiers {
+		result := DeliveryResult{Channel: notifier.Channel()}
+		id, err := notifier.Notify(ctx, n)
+		if err != nil {
+			log.Printf("Failed to deliver report via %s: %v", notifier.Channel(), err)
+			result.Error = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", notifier.Channel(), err))
+		} else {
+			log.Printf("Report delivered via %s: %s", notifier.Channel(), id)
+			result.DeliveryID = id
+		}
+		n.Metadata.Deliveries = append(n.Metadata.Deliveries, result)
+	}
+	if len(errs) == len(notifiers) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// getNotifierSecrets reads the JSON object of channel secrets.
+func getNotifierSecrets(secretsClient *secretsmanager.SecretsManager, secretArn string) (map[string]string, error) {
+	result, err := secretsClient.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(secretArn)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notifier secrets: %w", err)
+	}
+	var secrets map[string]string
+	if err := json.Unmarshal([]byte(aws.StringValue(result.SecretString)), &secrets); err != nil {
+		return nil, fmt.Errorf("notifier secret must be a JSON object of strings: %w", err)
+	}
+	return secrets, nil
+}
+
+// usesSecrets reports whether any user has a channel that needs NOTIFIER_SECRET_ARN.
+func usesSecrets(users []User) bool {
+	for _, u := range users {
+		for _, c := range u.Channels {
+			if c.Secret != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sesNotifier emails the full report.
+type sesNotifier struct {
+	client *ses.SES
+}
+
+func (s *sesNotifier) Channel() string { return channelEmail }
+
+func (s *sesNotifier) Notify(_ context.Context, n *reportNotification) (string, error) {
+	id, err := sendEmailReport(s.client, n.Envelope, n.Report)
+	if err != nil {
+		return "", err
+	}
+	n.Metadata.EmailMessageID = id
+	n.Metadata.MessageID = n.Envelope.MessageID
+	return id, nil
+}
+
+// webhookNotifier POSTs the report metadata as JSON. With a signing key the body is signed
+// like Stripe webhooks: X-Mailmunch-Signature is sha256=HMAC(key, "<timestamp>.<body>").
+type webhookNotifier struct {
+	url        string
+	signingKey string
+}
+
+// webhookPayload is the report metadata plus the rendered text.
+type webhookPayload struct {
+	*ReportMetadata
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	PageURL string `json:"page_url,omitempty"`
+}
+
+func (w *webhookNotifier) Channel() string { return channelWebhook }
+
+func (w *webhookNotifier) Notify(ctx context.Context, n *reportNotification) (string, error) {
+	body, err := json.Marshal(webhookPayload{ReportMetadata: n.Metadata, Subject: n.Report.Subject, Text: n.Report.Text, PageURL: n.PageURL})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+	headers := map[string]string{}
+	if w.signingKey != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		headers["X-Mailmunch-Timestamp"] = timestamp
+		headers["X-Mailmunch-Signature"] = "sha256=" + webhookSignature(w.signingKey, timestamp, body)
+	}
+	if _, err := postJSON(ctx, w.url, body, headers); err != nil {
+		return "", err
+	}
+	return n.Metadata.RunID, nil
+}
+
+func webhookSignature(key, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// slackNotifier posts the summary to a Slack incoming webhook.
+type slackNotifier struct {
+	webhookURL string
+}
+
+func (s *slackNotifier) Channel() string { return channelSlack }
+
+func (s *slackNotifier) Notify(ctx context.Context, n *reportNotification) (string, error) {
+	body, err := json.Marshal(map[string]string{"text": summaryMessage(n, true)})
+	if err != nil {
+		return "", err
+	}
+	if _, err := postJSON(ctx, s.webhookURL, body, nil); err != nil {
+		return "", err
+	}
+	return n.Metadata.RunID, nil
+}
+
+// telegramMessageLimit is the maximum length of a Telegram message.
+const telegramMessageLimit = 4096
+
+// telegramNotifier sends the summary through a Telegram bot.
+type telegramNotifier struct {
+	token  string
+	chatID string
+}
+
+func (t *telegramNotifier) Channel() string { return channelTelegram }
+
+func (t *telegramNotifier) Notify(ctx context.Context, n *reportNotification) (string, error) {
+	body, err := json.Marshal(map[string]any{
+		"chat_id":                  t.chatID,
+		"text":                     truncateString(summaryMessage(n, false), telegramMessageLimit-3),
+		"disable_web_page_preview": true,
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err := postJSON(ctx, telegramAPIBase+"/bot"+t.token+"/sendMessage", body, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Result struct {
+			MessageID int64 `json:"message_id"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return "", fmt.Errorf("invalid Telegram response: %w", err)
+	}
+	return strconv.FormatInt(result.Result.MessageID, 10), nil
+}
+
+// s3PageNotifier publishes the HTML report as a static page, with charts alongside it, at
+// <prefix><period-start>/index.html and updates <prefix>index.html to the latest report.
+type s3PageNotifier struct {
+	client  s3API
+	bucket  string
+	prefix  string
+	baseURL string
+}
+
+func (p *s3PageNotifier) Channel() string { return channelS3Page }
+
+func (p *s3PageNotifier) Notify(ctx context.Context, n *reportNotification) (string, error) {
+	if p.bucket == "" {
+		return "", fmt.Errorf("REPORTS_BUCKET is required for s3_page delivery")
+	}
+	prefix := p.prefix
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	dir := fmt.Sprintf("%s-%s/", n.Metadata.Period, n.Metadata.PeriodStart)
+
+	// Inline cid: images become files next to the page
+	html, latest := n.Report.HTML, n.Report.HTML
+	objects := []bundleObject{}
+	for _, chart := range n.Report.Charts {
+		html = strings.ReplaceAll(html, "cid:"+chart.ContentID, chart.Filename)
+		latest = strings.ReplaceAll(latest, "cid:"+chart.ContentID, dir+chart.Filename)
+		objects = append(objects, bundleObject{prefix + dir + chart.Filename, string(chart.PNG), "image/png"})
+	}
+	objects = append(objects,
+		bundleObject{prefix + dir + "index.html", html, "text/html; charset=utf-8"},
+		bundleObject{prefix + "index.html", latest, "text/html; charset=utf-8"},
+	)
+
+	for _, obj := range objects {
+		if _, err := p.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:       aws.String(p.bucket),
+			Key:          aws.String(obj.key),
+			Body:         bytes.NewReader([]byte(obj.body)),
+			ContentType:  aws.String(obj.contentType),
+			CacheControl: aws.String("no-cache"),
+		}); err != nil {
+			return "", fmt.Errorf("failed to put s3://%s/%s: %w", p.bucket, obj.key, err)
+		}
+	}
+
+	if p.baseURL != "" {
+		n.PageURL = strings.TrimSuffix(p.baseURL, "/") + "/" + dir
+	}
+	return prefix + dir + "index.html", nil
+}
+
+// summaryMessage is the short chat version of a report: headline metrics, the AI summary
+// and a link to the full report when one was published.
+func summaryMessage(n *reportNotification, markdown bool) string {
+	m := n.Metadata
+	var b strings.Builder
+	if markdown {
+		fmt.Fprintf(&b, "*%s*\n", n.Report.Subject)
+	} else {
+		fmt.Fprintf(&b, "%s\n", n.Report.Subject)
+	}
+	if m.CurrentMetrics.DaysLogged > 0 {
+		fmt.Fprintf(&b, "%d days logged · avg %.0f kcal · %.0f g protein · %.0f g fiber per day\n",
+			m.CurrentMetrics.DaysLogged, m.CurrentMetrics.AvgCalories, m.CurrentMetrics.AvgProtein, m.CurrentMetrics.AvgFiber)
+	} else {
+		b.WriteString("No food data logged\n")
+	}
+	switch {
+	case m.Analysis != nil:
+		b.WriteString("\n" + m.Analysis.Summary + "\n")
+	case m.AIStatus == aiStatusFailed:
+		b.WriteString("\nThe AI analysis could not be generated this time.\n")
+	}
+	if n.PageURL != "" {
+		fmt.Fprintf(&b, "\nFull report: %s\n", n.PageURL)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// postJSON POSTs body and returns the response body, failing on non-2xx statuses. URLs may
+// embed secrets (Slack webhooks, Telegram tokens), so they are kept out of errors.
+func postJSON(ctx context.Context, endpoint string, body []byte, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.New("invalid request URL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mailmunch-weekly-report")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := notifierHTTPClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("request to %s failed: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from %s: %w", req.URL.Host, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s returned %s: %s", req.URL.Host, resp.Status, truncateString(strings.TrimSpace(string(respBody)), 200))
+	}
+	return respBody, nil
+}
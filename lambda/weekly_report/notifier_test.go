@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testNotification() *reportNotification {
+	bundle := testBundle()
+	bundle.Metadata.CurrentMetrics = WeeklyMetrics{DaysLogged: 5, AvgCalories: 1850, AvgProtein: 120, AvgFiber: 28}
+	bundle.Metadata.AIStatus = aiStatusStructured
+	bundle.Metadata.Analysis = &StructuredAnalysis{Summary: "A steady week."}
+	return &reportNotification{Report: bundle.Rendered, Metadata: &bundle.Metadata}
+}
+
+// recordingServer captures the last request body and headers and replies with status and reply.
+func recordingServer(t *testing.T, status int, reply string) (*httptest.Server, *http.Request, *[]byte) {
+	t.Helper()
+	var last http.Request
+	var body []byte
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		last = *r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+		io.WriteString(w, reply)
+	}))
+	t.Cleanup(srv.Close)
+
+	orig := notifierHTTPClient
+	notifierHTTPClient = srv.Client()
+	t.Cleanup(func() { notifierHTTPClient = orig })
+	return srv, &last, &body
+}
+
+func TestWebhookNotifierSignsPayload(t *testing.T) {
+	srv, req, body := recordingServer(t, http.StatusOK, "")
+	n := testNotification()
+
+	id, err := (&webhookNotifier{url: srv.URL + "/hook", signingKey: "s3cret"}).Notify(context.Background(), n)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != n.Metadata.RunID {
+		t.Errorf("expected run id as delivery id, got %q", id)
+	}
+
+	timestamp := req.Header.Get("X-Mailmunch-Timestamp")
+	want := "sha256=" + webhookSignature("s3cret", timestamp, *body)
+	if timestamp == "" || req.Header.Get("X-Mailmunch-Signature") != want {
+		t.Errorf("bad signature headers: %v", req.Header)
+	}
+
+	var payload map[string]any
+	if err := json.Unmarshal(*body, &payload); err != nil {
+		t.Fatalf("payload is not JSON: %v", err)
+	}
+	if payload["user_id"] != "alice" || payload["subject"] != "subject" || payload["period_start"] != "2025-09-15" {
+		t.Errorf("unexpected payload: %v", payload)
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	srv, _, body := recordingServer(t, http.StatusOK, "ok")
+	n := testNotification()
+	n.PageURL = "https://reports.example.com/week-2025-09-15/"
+
+	if _, err := (&slackNotifier{webhookURL: srv.URL + "/services/T/B/X"}).Notify(context.Background(), n); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var msg struct{ Text string }
+	if err := json.Unmarshal(*body, &msg); err != nil {
+		t.Fatalf("payload is not JSON: %v", err)
+	}
+	for _, want := range []string{"*subject*", "5 days logged", "avg 1850 kcal", "A steady week.", "Full report: " + n.PageURL} {
+		if !strings.Contains(msg.Text, want) {
+			t.Errorf("expected %q in message:\n%s", want, msg.Text)
+		}
+	}
+}
+
+func TestTelegramNotifier(t *testing.T) {
+	srv, req, body := recordingServer(t, http.StatusOK, `{"ok":true,"result":{"message_id":42}}`)
+	orig := telegramAPIBase
+	telegramAPIBase = srv.URL
+	t.Cleanup(func() { telegramAPIBase = orig })
+
+	id, err := (&telegramNotifier{token: "123:abc", chatID: "-100"}).Notify(context.Background(), testNotification())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "42" {
+		t.Errorf("expected message id 42, got %q", id)
+	}
+	if req.URL.Path != "/bot123:abc/sendMessage" {
+		t.Errorf("unexpected path %q", req.URL.Path)
+	}
+	var msg struct {
+		ChatID string `json:"chat_id"`
+		Text   string `json:"text"`
+	}
+	if err := json.Unmarshal(*body, &msg); err != nil || msg.ChatID != "-100" || !strings.HasPrefix(msg.Text, "subject\n") {
+		t.Errorf("unexpected message %+v, %v", msg, err)
+	}
+}
+
+func TestPostJSONKeepsSecretsOutOfErrors(t *testing.T) {
+	srv, _, _ := recordingServer(t, http.StatusForbidden, "invalid_token")
+
+	_, err := (&slackNotifier{webhookURL: srv.URL + "/services/SECRET"}).Notify(context.Background(), testNotification())
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "invalid_token") {
+		t.Fatalf("expected status error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "SECRET") {
+		t.Errorf("error leaks the webhook URL: %v", err)
+	}
+
+	srv.Close()
+	_, err = (&telegramNotifier{token: "SECRET", chatID: "1"}).Notify(context.Background(), testNotification())
+	if err == nil || strings.Contains(err.Error(), "SECRET") {
+		t.Errorf("expected a connection error without the token, got %v", err)
+	}
+}
+
+func TestS3PageNotifier(t *testing.T) {
+	mock := &mockS3{}
+	n := testNotification()
+	n.Report.HTML = `<img src="cid:calories"><p>report</p>`
+	n.Report.Charts = []ChartImage{{ContentID: "calories", Filename: "calories.png", PNG: []byte("png")}}
+
+	p := &s3PageNotifier{client: mock, bucket: "bucket", prefix: "pages/alice", baseURL: "https://reports.example.com/alice/"}
+	id, err := p.Notify(context.Background(), n)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "pages/alice/week-2025-09-15/index.html" {
+		t.Errorf("unexpected delivery id %q", id)
+	}
+	if got := mock.objects["pages/alice/week-2025-09-15/index.html"]; got != `<img src="calories.png"><p>report</p>` {
+		t.Errorf("unexpected page: %s", got)
+	}
+	if got := mock.objects["pages/alice/index.html"]; got != `<img src="week-2025-09-15/calories.png"><p>report</p>` {
+		t.Errorf("unexpected latest page: %s", got)
+	}
+	if mock.objects["pages/alice/week-2025-09-15/calories.png"] != "png" {
+		t.Errorf("chart not published: %v", mock.keys)
+	}
+	if n.PageURL != "https://reports.example.com/alice/week-2025-09-15/" {
+		t.Errorf("unexpected page URL %q", n.PageURL)
+	}
+}
+
+type stubNotifier struct {
+	name string
+	err  error
+}
+
+func (s stubNotifier) Channel() string { return s.name }
+
+func (s stubNotifier) Notify(context.Context, *reportNotification) (string, error) {
+	return s.name + "-id", s.err
+}
+
+func TestDeliverReport(t *testing.T) {
+	n := testNotification()
+	err := deliverReport(context.Background(), []Notifier{
+		stubNotifier{name: channelSlack, err: errors.New("boom")},
+		stubNotifier{name: channelTelegram},
+	}, n)
+	if err != nil {
+		t.Fatalf("one working channel should be enough, got %v", err)
+	}
+	want := []DeliveryResult{{Channel: channelSlack, Error: "boom"}, {Channel: channelTelegram, DeliveryID: "telegram-id"}}
+	if len(n.Metadata.Deliveries) != 2 || n.Metadata.Deliveries[0] != want[0] || n.Metadata.Deliveries[1] != want[1] {
+		t.Errorf("unexpected deliveries %+v", n.Metadata.Deliveries)
+	}
+
+	err = deliverReport(context.Background(), []Notifier{stubNotifier{name: channelWebhook, err: errors.New("down")}}, testNotification())
+	if err == nil || !strings.Contains(err.Error(), "webhook: down") {
+		t.Errorf("expected failure when every channel fails, got %v", err)
+	}
+}
+
+func TestNewNotifiers(t *testing.T) {
+	config := &Config{ReportsBucket: "bucket"}
+	clients := &reportClients{notifierSecrets: map[string]string{"alice-slack": "https://hooks.slack.com/services/x"}}
+
+	notifiers, err := newNotifiers(User{ID: "alice"}, config, clients)
+	if err != nil || len(notifiers) != 1 || notifiers[0].Channel() != channelEmail {
+		t.Fatalf("expected email by default, got %v, %v", notifiers, err)
+	}
+
+	user := User{ID: "alice", Channels: []Channel{{Type: channelSlack, Secret: "alice-slack"}, {Type: channelS3Page}}}
+	notifiers, err = newNotifiers(user, config, clients)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if notifiers[0].Channel() != channelS3Page || notifiers[1].Channel() != channelSlack {
+		t.Errorf("expected the page to be published first, got %v", notifiers)
+	}
+	if page := notifiers[0].(*s3PageNotifier); page.prefix != "pages/alice/" || page.bucket != "bucket" {
+		t.Errorf("unexpected page defaults %+v", page)
+	}
+
+	user.Channels[0].Secret = "missing"
+	if _, err := newNotifiers(user, config, clients); err == nil {
+		t.Error("expected error for an unknown secret")
+	}
+}
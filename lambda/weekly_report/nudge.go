@@ -0,0 +1,225 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// modeNudge is the ReportRequest mode the daily schedule sends: instead of reporting, check each
+// user's LoseIt exports and remind them when they have stopped arriving.
+const modeNudge = "nudge"
+
+const (
+	// defaultNudgeAfterDays is the NUDGE_AFTER_DAYS default: days without an export before a reminder.
+	defaultNudgeAfterDays = 2
+	// maxNudgeLookbackDays bounds how far back exports are looked for. Users without one for
+	// longer are not reminded again, so an abandoned account does not get mail forever.
+	maxNudgeLookbackDays = 60
+)
+
+// NudgeResponse describes one user's export check.
+type NudgeResponse struct {
+	UserID      string `json:"user_id"`
+	Recipient   string `json:"recipient"`
+	MissingDays int    `json:"missing_days"` // consecutive days up to yesterday without an export
+	Sent        bool   `json:"sent"`
+	DryRun      bool   `json:"dry_run"`
+	Error       string `json:"error,omitempty"` // set when this user's check failed
+}
+
+// exportDays returns the days, as YYYY-MM-DD, from start to end that have a raw LoseIt CSV
+// partition for the user. CSVs ingested before per-user partitioning belong to the default user.
+func exportDays(ctx context.Context, s3c s3API, config *Config, userID string, start, end time.Time) (map[string]bool, error) {
+	userID = cmp.Or(userID, defaultUserID)
+	bases := []string{fmt.Sprintf("%suser_id=%s/", config.RawCsvBase, userID)}
+	if userID == defaultUserID {
+		bases = append(bases, config.RawCsvBase)
+	}
+
+	days := map[string]bool{}
+	first := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, start.Location())
+	for month := first; !month.After(end); month = month.AddDate(0, 1, 0) {
+		for _, base := range bases {
+			// One listing per month rather than per day keeps a quarter to a few requests
+			prefix := fmt.Sprintf("%syear=%04d/month=%02d/", base, month.Year(), int(month.Month()))
+			err := s3c.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+				Bucket: aws.String(config.DataBucket),
+				Prefix: aws.String(prefix),
+			}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+				for _, obj := range page.Contents {
+					partition, _, _ := strings.Cut(strings.TrimPrefix(aws.StringValue(obj.Key), prefix), "/")
+					if day, ok := strings.CutPrefix(partition, "day="); ok {
+						days[fmt.Sprintf("%04d-%02d-%s", month.Year(), int(month.Month()), day)] = true
+					}
+				}
+				return true
+			})
+			if err != nil {
+				return nil, fmt.Errorf("s3 list %s: %w", prefix, err)
+			}
+		}
+	}
+	return days, nil
+}
+
+// markMissingDays sets week.MissingDays to the days from start to end, before today, that have
+// neither an export nor any entries. Today's export may still be on its way, and an export can
+// carry entries for earlier days, so neither is reported missing.
+func markMissingDays(ctx context.Context, s3c s3API, config *Config, week *WeeklyData, start, end, now time.Time) error {
+	week.MissingDays = nil
+	today := startOfDay(now)
+	if !end.Before(today) {
+		end = today.AddDate(0, 0, -1)
+	}
+	if end.Before(start) {
+		return nil
+	}
+	exports, err := exportDays(ctx, s3c, config, config.UserID, start, end)
+	if err != nil {
+		return err
+	}
+	entries, err := parseFoodEntries(week.RawData)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		// LoseIt exports dates as MM/DD/YYYY
+		if d, err := time.Parse("01/02/2006", e.Date); err == nil {
+			exports[d.Format("2006-01-02")] = true
+		}
+	}
+	for d := startOfDay(start); !d.After(end); d = d.AddDate(0, 0, 1) {
+		if day := d.Format("2006-01-02"); !exports[day] {
+			week.MissingDays = append(week.MissingDays, day)
+		}
+	}
+	return nil
+}
+
+// consecutiveMissingDays counts the days without an export going back from yesterday, up to
+// maxNudgeLookbackDays.
+func consecutiveMissingDays(ctx context.Context, s3c s3API, config *Config, now time.Time) (int, error) {
+	yesterday := startOfDay(now).AddDate(0, 0, -1)
+	exports, err := exportDays(ctx, s3c, config, config.UserID, yesterday.AddDate(0, 0, 1-maxNudgeLookbackDays), yesterday)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for d := yesterday; n < maxNudgeLookbackDays && !exports[d.Format("2006-01-02")]; d = d.AddDate(0, 0, -1) {
+		n++
+	}
+	return n, nil
+}
+
+// shouldNudge reminds on the day the gap reaches afterDays and every afterDays after that, so a
+// user who has not fixed their export hears about it again without being mailed daily.
+func shouldNudge(missing, afterDays int) bool {
+	return afterDays > 0 && missing >= afterDays && missing < maxNudgeLookbackDays && missing%afterDays == 0
+}
+
+// runNudges checks every user's exports; a failure for one user does not stop the others.
+func runNudges(ctx context.Context, clients *reportClients, config *Config, request *ReportRequest, users []User) (*HandlerResponse, error) {
+	if config.DataBucket == "" {
+		err := fmt.Errorf("DATA_BUCKET is required to check for missing exports")
+		log.Printf("Invalid configuration: %v", err)
+		return nil, err
+	}
+
+	response := &HandlerResponse{}
+	var errs []error
+	for _, user := range users {
+		nudge, err := nudgeUser(ctx, clients, configFor(config, user), request, user)
+		if err != nil {
+			log.Printf("Export check for user %s failed: %v", user.ID, err)
+			errs = append(errs, fmt.Errorf("user %s: %w", user.ID, err))
+			nudge = &NudgeResponse{UserID: user.ID, Recipient: user.ReportEmail, DryRun: request.DryRun, Error: err.Error()}
+		}
+		response.Nudges = append(response.Nudges, nudge)
+	}
+	if len(errs) == len(users) {
+		return nil, errors.Join(errs...)
+	}
+	return response, nil
+}
+
+// nudgeUser checks one user's exports and emails a reminder when they are due one.
+func nudgeUser(ctx context.Context, clients *reportClients, config *Config, request *ReportRequest, user User) (*NudgeResponse, error) {
+	recipient := cmp.Or(request.Recipient, config.ReportEmail)
+	response := &NudgeResponse{UserID: user.ID, Recipient: recipient, DryRun: request.DryRun}
+
+	now := time.Now().In(user.location())
+	missing, err := consecutiveMissingDays(ctx, clients.s3, config, now)
+	if err != nil {
+		return nil, err
+	}
+	response.MissingDays = missing
+	if !shouldNudge(missing, config.NudgeAfterDays) {
+		log.Printf("User %s: %d day(s) without a LoseIt export; no reminder due", user.ID, missing)
+		return response, nil
+	}
+	if request.DryRun {
+		log.Printf("Dry run: skipping reminder to user %s after %d day(s) without an export", user.ID, missing)
+		return response, nil
+	}
+
+	last := startOfDay(now).AddDate(0, 0, -missing-1)
+	env := emailEnvelope{
+		From: config.SenderEmail,
+		To:   recipient,
+		Date: now,
+	}
+	if _, err := sendEmailReport(clients.ses, env, nudgeEmail(missing, last)); err != nil {
+		return nil, err
+	}
+	response.Sent = true
+	log.Printf("Reminded user %s after %d day(s) without a LoseIt export", user.ID, missing)
+	return response, nil
+}
+
+// nudgeEmail is the short reminder sent when exports stop; last is the most recent day that had one.
+func nudgeEmail(missing int, last time.Time) *RenderedReport {
+	text := fmt.Sprintf("No LoseIt daily export has arrived since %s (%d days).\n\n"+
+		"Check that LoseIt is still set to email your daily report to your MailMunch address. "+
+		"Until it is, the missing days will show as missing in your next report.\n", last.Format("Monday 2 January"), missing)
+	return &RenderedReport{
+		Subject: fmt.Sprintf("No LoseIt export for %d days", missing),
+		Text:    text,
+		HTML:    "<p>" + strings.ReplaceAll(html.EscapeString(strings.TrimSpace(text)), "\n\n", "</p><p>") + "</p>",
+	}
+}
+
+// missingDaysPrompt tells the model which days have no export at all, so it does not read them
+// as days the person ate nothing.
+func missingDaysPrompt(basePrompt string, currentWeek, previousWeek *WeeklyData) string {
+	if len(currentWeek.MissingDays) == 0 && len(previousWeek.MissingDays) == 0 {
+		return basePrompt
+	}
+	var b strings.Builder
+	b.WriteString(basePrompt)
+	b.WriteString("\n\nMISSING DATA: No food diary export arrived for these days, so nothing is known about them. " +
+		"Treat them as missing, not as days with zero calories, and leave them out of daily averages and trends.\n")
+	for _, p := range []struct {
+		label string
+		week  *WeeklyData
+	}{{"Current period", currentWeek}, {"Previous period", previousWeek}} {
+		if len(p.week.MissingDays) > 0 {
+			fmt.Fprintf(&b, "- %s: %s\n", p.label, strings.Join(p.week.MissingDays, ", "))
+		}
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// isMissingDay reports whether day, as YYYY-MM-DD, had no export.
+func (w *WeeklyData) isMissingDay(day string) bool {
+	return w != nil && slices.Contains(w.MissingDays, day)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func nudgeConfig(userID string) *Config {
+	return &Config{DataBucket: "mailmunch-data", RawCsvBase: "raw/loseit_csv/", UserID: userID, NudgeAfterDays: 2}
+}
+
+// exportObjects is a bucket with one LoseIt CSV per day for the user.
+func exportObjects(userID string, days ...string) *mockS3 {
+	m := &mockS3{objects: map[string]string{}}
+	for _, day := range days {
+		y, rest, _ := strings.Cut(day, "-")
+		mo, d, _ := strings.Cut(rest, "-")
+		m.objects["raw/loseit_csv/user_id="+userID+"/year="+y+"/month="+mo+"/day="+d+"/loseit-daily.csv"] = "csv"
+	}
+	return m
+}
+
+func TestExportDays(t *testing.T) {
+	s3c := exportObjects("alice", "2025-08-31", "2025-09-02")
+	s3c.objects["raw/loseit_csv/user_id=bob/year=2025/month=09/day=01/loseit-daily.csv"] = "csv"
+	s3c.objects["raw/loseit_csv/year=2025/month=09/day=03/loseit-daily.csv"] = "csv"
+	start := time.Date(2025, 8, 30, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2025, 9, 5, 0, 0, 0, 0, time.UTC)
+
+	days, err := exportDays(context.Background(), s3c, nudgeConfig("alice"), "alice", start, end)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(days, map[string]bool{"2025-08-31": true, "2025-09-02": true}) {
+		t.Errorf("unexpected export days across months %v", days)
+	}
+
+	// CSVs from before per-user partitioning are the default user's
+	days, err = exportDays(context.Background(), s3c, nudgeConfig(""), "", start, end)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(days, map[string]bool{"2025-09-03": true}) {
+		t.Errorf("unexpected default user export days %v", days)
+	}
+}
+
+func TestMarkMissingDays(t *testing.T) {
+	s3c := exportObjects("alice", "2025-09-15", "2025-09-16")
+	week := &WeeklyData{
+		StartDate: "2025-09-15",
+		EndDate:   "2025-09-21",
+		RawData:   "date,meal,food_name,calories\n09/18/2025,Lunch,Soup,300\n",
+	}
+	start := time.Date(2025, 9, 15, 0, 0, 0, 0, time.UTC)
+	end := endOfDay(time.Date(2025, 9, 21, 0, 0, 0, 0, time.UTC))
+	now := time.Date(2025, 9, 21, 18, 0, 0, 0, time.UTC)
+
+	if err := markMissingDays(context.Background(), s3c, nudgeConfig("alice"), week, start, end, now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// 18 Sep has entries from a later export, and today's export may not have arrived yet
+	if want := []string{"2025-09-17", "2025-09-19", "2025-09-20"}; !slices.Equal(week.MissingDays, want) {
+		t.Errorf("missing days = %v, expected %v", week.MissingDays, want)
+	}
+
+	future := time.Date(2025, 9, 15, 9, 0, 0, 0, time.UTC)
+	if err := markMissingDays(context.Background(), s3c, nudgeConfig("alice"), week, start, end, future); err != nil || week.MissingDays != nil {
+		t.Errorf("a period that has only just started has no missing days, got %v, %v", week.MissingDays, err)
+	}
+}
+
+func TestConsecutiveMissingDays(t *testing.T) {
+	now := time.Date(2025, 9, 21, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		exports []string
+		want    int
+	}{
+		{"arrived yesterday", []string{"2025-09-20"}, 0},
+		{"stopped three days ago", []string{"2025-09-10", "2025-09-17"}, 3},
+		{"never arrived", nil, maxNudgeLookbackDays},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := consecutiveMissingDays(context.Background(), exportObjects("alice", tc.exports...), nudgeConfig("alice"), now)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("got %d missing days, expected %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestShouldNudge(t *testing.T) {
+	var nudged []int
+	for missing := 0; missing <= maxNudgeLookbackDays; missing++ {
+		if shouldNudge(missing, 3) {
+			nudged = append(nudged, missing)
+		}
+	}
+	if len(nudged) == 0 || nudged[0] != 3 || nudged[1] != 6 || slices.Contains(nudged, maxNudgeLookbackDays) {
+		t.Errorf("expected reminders every 3 days until the lookback runs out, got %v", nudged)
+	}
+	if shouldNudge(2, 0) {
+		t.Error("NUDGE_AFTER_DAYS=0 should turn reminders off")
+	}
+}
+
+func TestNudgeEmail(t *testing.T) {
+	report := nudgeEmail(3, time.Date(2025, 9, 17, 0, 0, 0, 0, time.UTC))
+	if report.Subject != "No LoseIt export for 3 days" {
+		t.Errorf("unexpected subject %q", report.Subject)
+	}
+	if !strings.Contains(report.Text, "since Wednesday 17 September (3 days)") || !strings.HasPrefix(report.HTML, "<p>No LoseIt") {
+		t.Errorf("unexpected reminder:\n%s\n%s", report.Text, report.HTML)
+	}
+	if _, err := buildRawEmail(emailEnvelope{From: "reports@example.com", To: "me@example.com"}, report); err != nil {
+		t.Errorf("reminder does not build as an email: %v", err)
+	}
+}
+
+func TestMissingDaysShownInReport(t *testing.T) {
+	week := goalsWeek()
+	week.MissingDays = []string{"2025-09-17"}
+	previous := goalsWeek()
+
+	prompt := missingDaysPrompt("BASE", week, previous)
+	if !strings.Contains(prompt, "not as days with zero calories") || !strings.Contains(prompt, "- Current period: 2025-09-17") || strings.Contains(prompt, "Previous period") {
+		t.Errorf("unexpected prompt:\n%s", prompt)
+	}
+	if missingDaysPrompt("BASE", previous, previous) != "BASE" {
+		t.Error("prompt should be unchanged without missing days")
+	}
+
+	adherence, err := evaluateAdherence(week, NutritionGoals{DailyCalories: 2000})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !adherence.Days[2].Missing || adherence.Days[1].Missing {
+		t.Errorf("expected only the day without an export to be missing: %+v", adherence.Days)
+	}
+	report, err := renderReport(nil, week, previous, reportExtras{Adherence: adherence})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	for _, want := range []string{"No export received: 2025-09-17", ">no export</td>"} {
+		if !strings.Contains(report.HTML, want) {
+			t.Errorf("HTML missing %q", want)
+		}
+	}
+	for _, want := range []string{"No export:    2025-09-17", "2025-09-17 no export"} {
+		if !strings.Contains(report.Text, want) {
+			t.Errorf("text missing %q:\n%s", want, report.Text)
+		}
+	}
+}
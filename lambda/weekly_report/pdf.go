@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/png"
+	"strings"
+	"unicode/utf8"
+)
+
+// A4 in points with 50pt margins. The body is set in 9pt Courier so the column layout of
+// the text email survives: 91 characters per line, 11pt leading.
+const (
+	pdfPageWidth   = 595
+	pdfPageHeight  = 842
+	pdfMargin      = 50
+	pdfFontSize    = 9
+	pdfLeading     = 11
+	pdfTitleSize   = 16
+	pdfLineChars   = 91
+	pdfChartWidth  = pdfPageWidth - 2*pdfMargin
+	pdfChartMargin = 16
+)
+
+// buildReportPDF renders the text version of the report, followed by any charts, as a PDF.
+// It uses the standard Courier and Helvetica fonts so nothing needs embedding.
+func buildReportPDF(title string, text string, charts []ChartImage) ([]byte, error) {
+	doc := &pdfWriter{}
+	catalog := doc.reserve()
+	pages := doc.reserve()
+	body := doc.add("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	heading := doc.add("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	resources := fmt.Sprintf("/Font << /F1 %d 0 R /F2 %d 0 R >>", body, heading)
+
+	var pageIDs []int
+	addPage := func(content string, xobjects string) {
+		stream := doc.addStream("", []byte(content))
+		res := resources
+		if xobjects != "" {
+			res += " /XObject << " + xobjects + " >>"
+		}
+		pageIDs = append(pageIDs, doc.add(fmt.Sprintf(
+			"<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %d %d] /Resources << %s >> /Contents %d 0 R >>",
+			pages, pdfPageWidth, pdfPageHeight, res, stream)))
+	}
+
+	// Text pages; the title takes the first two lines of the first page.
+	lines := wrapPDFLines(text)
+	linesPerPage := (pdfPageHeight - 2*pdfMargin) / pdfLeading
+	first := true
+	for first || len(lines) > 0 {
+		var content strings.Builder
+		y := pdfPageHeight - pdfMargin
+		n := linesPerPage
+		if first {
+			fmt.Fprintf(&content, "BT /F2 %d Tf %d %d Td (%s) Tj ET\n", pdfTitleSize, pdfMargin, y-pdfTitleSize, pdfString(title))
+			y -= pdfTitleSize + 2*pdfLeading
+			n -= (pdfTitleSize + 2*pdfLeading) / pdfLeading
+			first = false
+		}
+		if n > len(lines) {
+			n = len(lines)
+		}
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL %d %d Td\n", pdfFontSize, pdfLeading, pdfMargin, y-pdfFontSize)
+		for _, line := range lines[:n] {
+			fmt.Fprintf(&content, "(%s) Tj T*\n", pdfString(line))
+		}
+		content.WriteString("ET\n")
+		lines = lines[n:]
+		addPage(content.String(), "")
+	}
+
+	// Chart pages, scaled to the text width and stacked top to bottom.
+	var content strings.Builder
+	var xobjects []string
+	y := pdfPageHeight - pdfMargin
+	for i, chart := range charts {
+		img, err := png.Decode(bytes.NewReader(chart.PNG))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s chart: %w", chart.ContentID, err)
+		}
+		b := img.Bounds()
+		height := pdfChartWidth * b.Dy() / b.Dx()
+		if y-height < pdfMargin && len(xobjects) > 0 {
+			addPage(content.String(), strings.Join(xobjects, " "))
+			content.Reset()
+			xobjects = nil
+			y = pdfPageHeight - pdfMargin
+		}
+		id, err := doc.addImage(img)
+		if err != nil {
+			return nil, err
+		}
+		name := fmt.Sprintf("Im%d", i+1)
+		xobjects = append(xobjects, fmt.Sprintf("/%s %d 0 R", name, id))
+		y -= height
+		fmt.Fprintf(&content, "q %d 0 0 %d %d %d cm /%s Do Q\n", pdfChartWidth, height, pdfMargin, y, name)
+		y -= pdfChartMargin
+	}
+	if len(xobjects) > 0 {
+		addPage(content.String(), strings.Join(xobjects, " "))
+	}
+
+	kids := make([]string, len(pageIDs))
+	for i, id := range pageIDs {
+		kids[i] = fmt.Sprintf("%d 0 R", id)
+	}
+	doc.set(pages, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pageIDs)))
+	doc.set(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages))
+	doc.info = doc.add(fmt.Sprintf("<< /Title (%s) /Producer (MailMunch) >>", pdfString(title)))
+	return doc.bytes(catalog), nil
+}
+
+// wrapPDFLines splits text into lines that fit the page, breaking long lines at spaces.
+func wrapPDFLines(text string) []string {
+	var out []string
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		line = strings.TrimRight(line, " \r")
+		for utf8.RuneCountInString(line) > pdfLineChars {
+			runes := []rune(line)
+			cut := pdfLineChars
+			for i := pdfLineChars; i > pdfLineChars/2; i-- {
+				if runes[i] == ' ' {
+					cut = i
+					break
+				}
+			}
+			out = append(out, string(runes[:cut]))
+			line = "  " + strings.TrimLeft(string(runes[cut:]), " ")
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+// pdfSubstitutes cover characters the report uses that WinAnsiEncoding lacks.
+var pdfSubstitutes = map[rune]string{'≤': "<=", '≥': ">=", '✓': "OK", '✗': "X", '→': "->"}
+
+// winAnsi maps the non-Latin-1 characters WinAnsiEncoding does have.
+var winAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94,
+	'•': 0x95, '–': 0x96, '—': 0x97, '™': 0x99,
+}
+
+// pdfString encodes s as the body of a PDF literal string in WinAnsiEncoding.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if sub, ok := pdfSubstitutes[r]; ok {
+			b.WriteString(sub)
+			continue
+		}
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString("    ")
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			if c, ok := winAnsi[r]; ok {
+				fmt.Fprintf(&b, "\\%03o", c)
+			} else {
+				b.WriteByte('?')
+			}
+		}
+	}
+	return b.String()
+}
+
+// pdfWriter collects numbered objects and writes them with a cross-reference table.
+type pdfWriter struct {
+	objects [][]byte // index i holds object i+1
+	info    int
+}
+
+func (w *pdfWriter) reserve() int {
+	w.objects = append(w.objects, nil)
+	return len(w.objects)
+}
+
+func (w *pdfWriter) set(id int, body string) {
+	w.objects[id-1] = []byte(body)
+}
+
+func (w *pdfWriter) add(body string) int {
+	id := w.reserve()
+	w.set(id, body)
+	return id
+}
+
+func (w *pdfWriter) addStream(dict string, data []byte) int {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<< %s/Length %d >>\nstream\n", dict, len(data))
+	b.Write(data)
+	b.WriteString("\nendstream")
+	id := w.reserve()
+	w.objects[id-1] = b.Bytes()
+	return id
+}
+
+// addImage stores img as a Flate-compressed RGB image XObject.
+func (w *pdfWriter) addImage(img image.Image) (int, error) {
+	bounds := img.Bounds()
+	var raw bytes.Buffer
+	zw := zlib.NewWriter(&raw)
+	row := make([]byte, 0, bounds.Dx()*3)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row = row[:0]
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			row = append(row, byte(r>>8), byte(g>>8), byte(b>>8))
+		}
+		if _, err := zw.Write(row); err != nil {
+			return 0, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode ",
+		bounds.Dx(), bounds.Dy())
+	return w.addStream(dict, raw.Bytes()), nil
+}
+
+func (w *pdfWriter) bytes(root int) []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(w.objects))
+	for i, obj := range w.objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n", i+1)
+		b.Write(obj)
+		b.WriteString("\nendobj\n")
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(w.objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root %d 0 R", len(w.objects)+1, root)
+	if w.info != 0 {
+		fmt.Fprintf(&b, " /Info %d 0 R", w.info)
+	}
+	fmt.Fprintf(&b, " >>\nstartxref\n%d\n%%%%EOF\n", xref)
+	return b.Bytes()
+}
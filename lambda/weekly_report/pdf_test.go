@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBuildReportPDF(t *testing.T) {
+	charts, err := buildTrendCharts(monthOfData(), 2000)
+	if err != nil {
+		t.Fatalf("charts: %v", err)
+	}
+	text := strings.Repeat("Avg calories: 2000 kcal/day (fish & chips) ≤ target ✓\n", 150)
+	pdf, err := buildReportPDF("Monthly Nutrition Report", text, charts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatal("missing PDF header or trailer")
+	}
+	// 150 lines need three text pages; three 201pt charts fit on one more
+	if m := regexp.MustCompile(`/Count (\d+)`).FindSubmatch(pdf); m == nil || string(m[1]) != "4" {
+		t.Errorf("unexpected page count: %s", m)
+	}
+	if n := bytes.Count(pdf, []byte("/Subtype /Image")); n != 3 {
+		t.Errorf("expected 3 images, got %d", n)
+	}
+	if !bytes.Contains(pdf, []byte(`(Avg calories: 2000 kcal/day \(fish & chips\) <= target OK) Tj`)) {
+		t.Error("text should be escaped and mapped to WinAnsi")
+	}
+
+	// Every xref entry must point at the start of its object
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)
+	offset, _ := strconv.Atoi(string(startxref[1]))
+	if !bytes.HasPrefix(pdf[offset:], []byte("xref\n")) {
+		t.Fatalf("startxref does not point at the xref table")
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(pdf[offset:], -1)
+	for i, e := range entries {
+		off, _ := strconv.Atoi(string(e[1]))
+		if want := fmt.Sprintf("%d 0 obj", i+1); !bytes.HasPrefix(pdf[off:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q", i+1, pdf[off:off+10])
+		}
+	}
+}
+
+func TestWrapPDFLinesAndString(t *testing.T) {
+	long := strings.Repeat("word ", 30)
+	lines := wrapPDFLines("short\n" + long)
+	if len(lines) != 3 || lines[0] != "short" {
+		t.Fatalf("unexpected lines: %q", lines)
+	}
+	for _, l := range lines {
+		if len([]rune(l)) > pdfLineChars {
+			t.Errorf("line too long: %q", l)
+		}
+	}
+	if !strings.HasPrefix(lines[2], "  word") {
+		t.Errorf("continuation lines should be indented: %q", lines[2])
+	}
+
+	if got := pdfString(`a\b (c) café – ☃`); got != `a\\b \(c\) caf\351 \226 ?` {
+		t.Errorf("pdfString = %q", got)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"time"
+)
+
+// Report period types accepted in the event detail.
+const (
+	periodDay     = "day"
+	periodWeek    = "week"
+	periodMonth   = "month"
+	periodQuarter = "quarter"
+	periodCustom  = "custom"
+)
+
+// maxCustomPeriodDays bounds start_date/end_date ranges so a typo cannot pull years of data into one prompt.
+const maxCustomPeriodDays = 92
+
+// ReportRequest is the optional event detail for on-demand reports. An empty detail
+// reports on the current week, which is what the weekly schedule sends.
+type ReportRequest struct {
+	StartDate string `json:"start_date,omitempty"` // YYYY-MM-DD; with period, any date inside the period
+	EndDate   string `json:"end_date,omitempty"`   // YYYY-MM-DD, inclusive; requires start_date
+	ISOWeek   string `json:"iso_week,omitempty"`   // e.g. 2025-W38
+	Period    string `json:"period,omitempty"`     // day, week, month or quarter
+	Offset    int    `json:"offset,omitempty"`     // shifts period by whole periods, e.g. -1 for last month
+	UserID    string `json:"user_id,omitempty"`    // report on one user from the registry only
+	Recipient string `json:"recipient,omitempty"`  // overrides each user's report email
+	DryRun    bool   `json:"dry_run,omitempty"`    // return the rendered report instead of emailing it
+	Mode      string `json:"mode,omitempty"`       // "nudge" checks for missing exports instead of reporting
+}
+
+// HandlerResponse is returned to the invoker with one entry per user reported on.
+type HandlerResponse struct {
+	Reports []*ReportResponse `json:"reports"`
+	Nudges  []*NudgeResponse  `json:"nudges,omitempty"`  // nudge mode only
+	Invoked []string          `json:"invoked,omitempty"` // users whose reports run in invocations of their own
+}
+
+// ReportResponse describes one user's report. Rendered content and the prompt are only
+// included for dry runs.
+type ReportResponse struct {
+	RunID          string           `json:"run_id"`
+	UserID         string           `json:"user_id"`
+	Period         string           `json:"period"`
+	PeriodStart    string           `json:"period_start"`
+	PeriodEnd      string           `json:"period_end"`
+	Recipient      string           `json:"recipient"`
+	DryRun         bool             `json:"dry_run"`
+	AIStatus       string           `json:"ai_status"`
+	PromptStrategy string           `json:"prompt_strategy"`
+	EmailMessageID string           `json:"email_message_id,omitempty"`
+	Deliveries     []DeliveryResult `json:"deliveries,omitempty"`
+	Subject        string           `json:"subject"`
+	Prompt         string           `json:"prompt,omitempty"`
+	HTML           string           `json:"html,omitempty"`
+	Text           string           `json:"text,omitempty"`
+	Error          string           `json:"error,omitempty"` // set when this user's report failed
+}
+
+// reportPeriod is the resolved reporting window and the equally sized window before it.
+type reportPeriod struct {
+	Kind          string
+	Start         time.Time
+	End           time.Time
+	PreviousStart time.Time
+	PreviousEnd   time.Time
+}
+
+// parseReportRequest decodes the event detail. Unknown fields are rejected so a misspelt
+// option fails loudly instead of silently reporting on the current week.
+func parseReportRequest(detail json.RawMessage) (*ReportRequest, error) {
+	req := &ReportRequest{}
+	detail = bytes.TrimSpace(detail)
+	if len(detail) == 0 || string(detail) == "null" {
+		return req, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(detail))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(req); err != nil {
+		return nil, fmt.Errorf("invalid event detail: %w", err)
+	}
+
+	if req.Mode != "" && req.Mode != modeNudge {
+		return nil, fmt.Errorf("invalid mode %q: expected %q or none", req.Mode, modeNudge)
+	}
+	if req.Recipient != "" {
+		addr, err := mail.ParseAddress(req.Recipient)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %w", req.Recipient, err)
+		}
+		req.Recipient = addr.Address
+	}
+	return req, nil
+}
+
+// resolveReportPeriod turns a request into concrete dates in now's location. Weeks start on
+// weekStart, except ISO weeks which always run Monday to Sunday.
+func resolveReportPeriod(req *ReportRequest, now time.Time, weekStart time.Weekday) (reportPeriod, error) {
+	loc := now.Location()
+
+	if req.ISOWeek != "" {
+		if req.StartDate != "" || req.EndDate != "" {
+			return reportPeriod{}, fmt.Errorf("iso_week cannot be combined with start_date or end_date")
+		}
+		if req.Period != "" && req.Period != periodWeek {
+			return reportPeriod{}, fmt.Errorf("iso_week cannot be combined with period %q", req.Period)
+		}
+		if req.Offset != 0 {
+			return reportPeriod{}, fmt.Errorf("iso_week cannot be combined with offset")
+		}
+		monday, err := parseISOWeek(req.ISOWeek, loc)
+		if err != nil {
+			return reportPeriod{}, err
+		}
+		return periodContaining(periodWeek, monday, time.Monday), nil
+	}
+
+	if req.EndDate != "" {
+		if req.StartDate == "" {
+			return reportPeriod{}, fmt.Errorf("end_date requires start_date")
+		}
+		if req.Period != "" || req.Offset != 0 {
+			return reportPeriod{}, fmt.Errorf("period and offset cannot be combined with end_date")
+		}
+		start, err := parseReportDate("start_date", req.StartDate, loc)
+		if err != nil {
+			return reportPeriod{}, err
+		}
+		end, err := parseReportDate("end_date", req.EndDate, loc)
+		if err != nil {
+			return reportPeriod{}, err
+		}
+		if end.Before(start) {
+			return reportPeriod{}, fmt.Errorf("end_date %s is before start_date %s", req.EndDate, req.StartDate)
+		}
+		days := int(end.Sub(start).Hours()/24+0.5) + 1
+		if days > maxCustomPeriodDays {
+			return reportPeriod{}, fmt.Errorf("period of %d days exceeds the %d day limit", days, maxCustomPeriodDays)
+		}
+		return reportPeriod{
+			Kind:          periodCustom,
+			Start:         start,
+			End:           endOfDay(end),
+			PreviousStart: start.AddDate(0, 0, -days),
+			PreviousEnd:   endOfDay(start.AddDate(0, 0, -1)),
+		}, nil
+	}
+
+	kind := req.Period
+	if kind == "" {
+		kind = periodWeek
+	}
+	if kind != periodDay && kind != periodWeek && kind != periodMonth && kind != periodQuarter {
+		return reportPeriod{}, fmt.Errorf("unsupported period %q (want day, week, month or quarter)", req.Period)
+	}
+
+	ref := now
+	if req.StartDate != "" {
+		var err error
+		if ref, err = parseReportDate("start_date", req.StartDate, loc); err != nil {
+			return reportPeriod{}, err
+		}
+	}
+	if req.Offset != 0 {
+		ref = shiftPeriod(kind, periodContaining(kind, ref, weekStart).Start, req.Offset)
+	}
+	return periodContaining(kind, ref, weekStart), nil
+}
+
+// shiftPeriod moves start, the first day of a period, by n whole periods.
+func shiftPeriod(kind string, start time.Time, n int) time.Time {
+	switch kind {
+	case periodDay:
+		return start.AddDate(0, 0, n)
+	case periodMonth:
+		return start.AddDate(0, n, 0)
+	case periodQuarter:
+		return start.AddDate(0, 3*n, 0)
+	default:
+		return start.AddDate(0, 0, 7*n)
+	}
+}
+
+// periodContaining returns the day, week, month or quarter containing date and the one before it.
+func periodContaining(kind string, date time.Time, weekStart time.Weekday) reportPeriod {
+	switch kind {
+	case periodDay:
+		start := startOfDay(date)
+		previous := start.AddDate(0, 0, -1)
+		return reportPeriod{Kind: kind, Start: start, End: endOfDay(start), PreviousStart: previous, PreviousEnd: endOfDay(previous)}
+	case periodMonth:
+		start := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, date.Location())
+		return reportPeriod{
+			Kind:          kind,
+			Start:         start,
+			End:           endOfDay(start.AddDate(0, 1, -1)),
+			PreviousStart: start.AddDate(0, -1, 0),
+			PreviousEnd:   endOfDay(start.AddDate(0, 0, -1)),
+		}
+	case periodQuarter:
+		firstMonth := time.Month((int(date.Month())-1)/3*3 + 1)
+		start := time.Date(date.Year(), firstMonth, 1, 0, 0, 0, 0, date.Location())
+		return reportPeriod{
+			Kind:          kind,
+			Start:         start,
+			End:           endOfDay(start.AddDate(0, 3, -1)),
+			PreviousStart: start.AddDate(0, -3, 0),
+			PreviousEnd:   endOfDay(start.AddDate(0, 0, -1)),
+		}
+	default:
+		start, end := getWeekRange(date, weekStart)
+		previousStart, previousEnd := getWeekRange(start.AddDate(0, 0, -7), weekStart)
+		return reportPeriod{Kind: periodWeek, Start: start, End: end, PreviousStart: previousStart, PreviousEnd: previousEnd}
+	}
+}
+
+// parseISOWeek returns the Monday of an ISO 8601 week such as 2025-W38.
+func parseISOWeek(value string, loc *time.Location) (time.Time, error) {
+	var year, week int
+	if n, err := fmt.Sscanf(value, "%4d-W%2d", &year, &week); err != nil || n != 2 {
+		return time.Time{}, fmt.Errorf("invalid iso_week %q (want YYYY-Www)", value)
+	}
+	// 4 January is always in week 1.
+	week1, _ := getWeekRange(time.Date(year, time.January, 4, 0, 0, 0, 0, loc), time.Monday)
+	monday := week1.AddDate(0, 0, (week-1)*7)
+	if y, w := monday.ISOWeek(); y != year || w != week {
+		return time.Time{}, fmt.Errorf("invalid iso_week %q: %d has no week %d", value, year, week)
+	}
+	return monday, nil
+}
+
+func parseReportDate(field, value string, loc *time.Location) (time.Time, error) {
+	date, err := time.ParseInLocation("2006-01-02", value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q (want YYYY-MM-DD): %w", field, value, err)
+	}
+	return date, nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func endOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 23, 59, 59, 999999999, t.Location())
+}
+
+// periodNames returns the cadence adjective used in titles ("Weekly") and the noun used
+// in section labels ("Week") for a period kind.
+func periodNames(kind string) (cadence, label string) {
+	switch kind {
+	case periodDay:
+		return "Daily", "Day"
+	case periodMonth:
+		return "Monthly", "Month"
+	case periodQuarter:
+		return "Quarterly", "Quarter"
+	case periodCustom:
+		return "Period", "Period"
+	default:
+		return "Weekly", "Week"
+	}
+}
+
+// isTrendPeriod reports whether a period is long enough for the trend charts.
+func isTrendPeriod(kind string) bool {
+	return kind == periodMonth || kind == periodQuarter
+}
+
+// reportTitle is used for the email subject and heading.
+func reportTitle(kind string) string {
+	if kind == periodCustom {
+		return "Nutrition Report"
+	}
+	cadence, _ := periodNames(kind)
+	return cadence + " Nutrition Report"
+}
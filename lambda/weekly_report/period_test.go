@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseReportRequest(t *testing.T) {
+	req, err := parseReportRequest(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *req != (ReportRequest{}) {
+		t.Errorf("expected empty request, got %+v", req)
+	}
+
+	req, err = parseReportRequest(json.RawMessage(`{"iso_week":"2025-W38","recipient":"Me <me@example.com>","dry_run":true}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if req.ISOWeek != "2025-W38" || req.Recipient != "me@example.com" || !req.DryRun {
+		t.Errorf("unexpected request: %+v", req)
+	}
+
+	req, err = parseReportRequest(json.RawMessage(`{"mode":"nudge"}`))
+	if err != nil || req.Mode != modeNudge {
+		t.Errorf("unexpected nudge request: %+v, %v", req, err)
+	}
+
+	for _, detail := range []string{`{"startDate":"2025-09-15"}`, `{"recipient":"not an address"}`, `{"mode":"remind"}`, `[]`} {
+		if _, err := parseReportRequest(json.RawMessage(detail)); err == nil {
+			t.Errorf("expected error for %s", detail)
+		}
+	}
+}
+
+func TestResolveReportPeriod(t *testing.T) {
+	london := User{Timezone: defaultUserTimezone}.location()
+	now := time.Date(2025, 9, 21, 18, 0, 0, 0, london) // Sunday, when the schedule runs
+
+	tests := []struct {
+		name               string
+		req                ReportRequest
+		kind               string
+		start, end         string
+		prevStart, prevEnd string
+	}{
+		{"default week", ReportRequest{}, periodWeek, "2025-09-15", "2025-09-21", "2025-09-08", "2025-09-14"},
+		{"iso week", ReportRequest{ISOWeek: "2025-W01"}, periodWeek, "2024-12-30", "2025-01-05", "2024-12-23", "2024-12-29"},
+		{"week containing date", ReportRequest{Period: periodWeek, StartDate: "2025-09-03"}, periodWeek, "2025-09-01", "2025-09-07", "2025-08-25", "2025-08-31"},
+		{"today", ReportRequest{Period: periodDay}, periodDay, "2025-09-21", "2025-09-21", "2025-09-20", "2025-09-20"},
+		{"month", ReportRequest{Period: periodMonth, StartDate: "2025-03-15"}, periodMonth, "2025-03-01", "2025-03-31", "2025-02-01", "2025-02-28"},
+		{"quarter", ReportRequest{Period: periodQuarter}, periodQuarter, "2025-07-01", "2025-09-30", "2025-04-01", "2025-06-30"},
+		{"last month", ReportRequest{Period: periodMonth, Offset: -1}, periodMonth, "2025-08-01", "2025-08-31", "2025-07-01", "2025-07-31"},
+		{"last quarter from January", ReportRequest{Period: periodQuarter, StartDate: "2026-01-01", Offset: -1}, periodQuarter, "2025-10-01", "2025-12-31", "2025-07-01", "2025-09-30"},
+		{"last week", ReportRequest{Offset: -1}, periodWeek, "2025-09-08", "2025-09-14", "2025-09-01", "2025-09-07"},
+		{"custom range", ReportRequest{StartDate: "2025-09-10", EndDate: "2025-09-12"}, periodCustom, "2025-09-10", "2025-09-12", "2025-09-07", "2025-09-09"},
+		// Spans the end of British Summer Time
+		{"custom range over DST", ReportRequest{StartDate: "2025-10-20", EndDate: "2025-10-29"}, periodCustom, "2025-10-20", "2025-10-29", "2025-10-10", "2025-10-19"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := resolveReportPeriod(&tt.req, now, time.Monday)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := []string{p.Kind, p.Start.Format("2006-01-02"), p.End.Format("2006-01-02"), p.PreviousStart.Format("2006-01-02"), p.PreviousEnd.Format("2006-01-02")}
+			want := []string{tt.kind, tt.start, tt.end, tt.prevStart, tt.prevEnd}
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if p.End.Hour() != 23 || p.PreviousEnd.Hour() != 23 {
+				t.Errorf("period ends should be end of day: %s, %s", p.End, p.PreviousEnd)
+			}
+		})
+	}
+}
+
+func TestResolveReportPeriodWeekStart(t *testing.T) {
+	now := time.Date(2025, 9, 20, 18, 0, 0, 0, time.UTC) // Saturday, the last day of a Sunday week
+
+	p, err := resolveReportPeriod(&ReportRequest{}, now, time.Sunday)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := p.Start.Format("2006-01-02") + " " + p.End.Format("2006-01-02") + " " + p.PreviousStart.Format("2006-01-02"); got != "2025-09-14 2025-09-20 2025-09-07" {
+		t.Errorf("unexpected week %s", got)
+	}
+
+	// ISO weeks ignore the configured week start
+	p, err = resolveReportPeriod(&ReportRequest{ISOWeek: "2025-W38"}, now, time.Sunday)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Start.Weekday() != time.Monday || p.Start.Format("2006-01-02") != "2025-09-15" {
+		t.Errorf("ISO week should start on Monday 2025-09-15, got %s", p.Start)
+	}
+}
+
+func TestResolveReportPeriodRejectsInvalid(t *testing.T) {
+	now := time.Date(2025, 9, 21, 18, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		req  ReportRequest
+	}{
+		{"unknown period", ReportRequest{Period: "year"}},
+		{"bad date", ReportRequest{StartDate: "15/09/2025"}},
+		{"end without start", ReportRequest{EndDate: "2025-09-21"}},
+		{"end before start", ReportRequest{StartDate: "2025-09-21", EndDate: "2025-09-15"}},
+		{"range too long", ReportRequest{StartDate: "2025-01-01", EndDate: "2025-12-31"}},
+		{"period with end date", ReportRequest{Period: periodMonth, StartDate: "2025-09-01", EndDate: "2025-09-30"}},
+		{"iso week with dates", ReportRequest{ISOWeek: "2025-W38", StartDate: "2025-09-15"}},
+		{"iso week with month", ReportRequest{ISOWeek: "2025-W38", Period: periodMonth}},
+		{"iso week with offset", ReportRequest{ISOWeek: "2025-W38", Offset: -1}},
+		{"offset with end date", ReportRequest{StartDate: "2025-09-01", EndDate: "2025-09-30", Offset: 1}},
+		{"malformed iso week", ReportRequest{ISOWeek: "2025-38"}},
+		{"week 53 in a 52 week year", ReportRequest{ISOWeek: "2025-W53"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := resolveReportPeriod(&tt.req, now, time.Monday); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestBuildEmailsForMonthlyPeriod(t *testing.T) {
+	current := &WeeklyData{StartDate: "2025-09-01", EndDate: "2025-09-30", Period: periodMonth}
+	previous := &WeeklyData{StartDate: "2025-08-01", EndDate: "2025-08-31", Period: periodMonth}
+
+	rendered, err := renderReport(nil, current, previous, reportExtras{})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if rendered.Subject != "Monthly Nutrition Report - 2025-09-01 to 2025-09-30" {
+		t.Errorf("unexpected subject: %q", rendered.Subject)
+	}
+	for _, want := range []string{"<h1>Monthly Nutrition Report</h1>", "Current Month", "Previous Month", "this month"} {
+		if !strings.Contains(rendered.HTML, want) {
+			t.Errorf("HTML missing %q", want)
+		}
+	}
+	for _, want := range []string{"MONTHLY NUTRITION REPORT", "THIS MONTH:", "PREVIOUS MONTH (2025-08-01 to 2025-08-31)"} {
+		if !strings.Contains(rendered.Text, want) {
+			t.Errorf("text missing %q", want)
+		}
+	}
+}
+
+func TestPeriodPrompt(t *testing.T) {
+	if got := periodPrompt("base", periodContaining(periodWeek, time.Now(), time.Monday)); got != "base" {
+		t.Errorf("weekly prompt should be unchanged, got %q", got)
+	}
+	p := periodContaining(periodDay, time.Date(2025, 9, 21, 12, 0, 0, 0, time.UTC), time.Monday)
+	if got := periodPrompt("base", p); !strings.Contains(got, "covers a day (2025-09-21 to 2025-09-21)") {
+		t.Errorf("unexpected daily prompt: %q", got)
+	}
+}
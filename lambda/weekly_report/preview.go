@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Sample reports used to validate templates and to preview them.
+const (
+	previewStructured  = "structured"   // weekly report with the structured AI analysis and goals
+	previewMarkdown    = "markdown"     // weekly report with the Markdown fallback analysis
+	previewMetricsOnly = "metrics-only" // the AI step failed
+	previewMonthly     = "monthly"      // monthly report with trend charts
+)
+
+var previewVariants = []string{previewStructured, previewMarkdown, previewMetricsOnly, previewMonthly}
+
+// sampleEmailData builds template data for one of previewVariants from made-up food entries.
+func sampleEmailData(variant string) EmailData {
+	current := samplePeriod(periodWeek, time.Date(2025, 9, 15, 0, 0, 0, 0, time.UTC), 7)
+	previous := samplePeriod(periodWeek, time.Date(2025, 9, 8, 0, 0, 0, 0, time.UTC), 7)
+	var extras reportExtras
+	analysis := &ReportAnalysis{Structured: &StructuredAnalysis{
+		Summary:       "A steady week with protein on target on most days.",
+		Wins:          []string{"Breakfast logged every day", "Fibre above 30g on four days"},
+		Concerns:      []string{"Calories ran high at the weekend"},
+		FoodSwaps:     []FoodSwap{{InsteadOf: "Crisps", Try: "Popcorn", Reason: "Half the calories for the same volume"}},
+		ProteinTiming: ProteinTiming{Assessment: "Most protein arrives at dinner.", Recommendations: []string{"Add Greek yoghurt to breakfast"}},
+		ActionPlan:    []string{"Plan weekend meals in advance"},
+	}}
+
+	switch variant {
+	case previewMarkdown:
+		analysis = &ReportAnalysis{Markdown: "## Summary\n\nA steady week.\n\n- **Win:** breakfast logged every day\n- **Concern:** weekend calories\n"}
+	case previewMetricsOnly:
+		analysis = nil
+	case previewMonthly:
+		current = samplePeriod(periodMonth, time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC), 30)
+		previous = samplePeriod(periodMonth, time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC), 31)
+		extras.Charts, _ = buildTrendCharts(current, 2000)
+	}
+	if variant != previewMetricsOnly {
+		goals := NutritionGoals{DailyCalories: 2000, ProteinGPerKg: 1.6, WeightKg: 80, FiberMinG: 30, SodiumMaxMg: 2300}
+		extras.Adherence, _ = evaluateAdherence(current, goals)
+	}
+	return newEmailData(analysis, current, previous, extras)
+}
+
+func samplePeriod(kind string, start time.Time, days int) *WeeklyData {
+	var raw strings.Builder
+	raw.WriteString("date,meal,food_name,quantity,unit,calories,protein,carbs,fat,fiber,sugar,sodium\n")
+	for d := 0; d < days; d++ {
+		if d%6 == 5 {
+			continue // unlogged day
+		}
+		date := start.AddDate(0, 0, d).Format("01/02/2006")
+		fmt.Fprintf(&raw, "%s,Breakfast,Oats,50,g,%d,30,60,8,9,5,150\n", date, 400+d*10)
+		fmt.Fprintf(&raw, "%s,Dinner,Salmon,150,g,%d,60,40,30,6,3,900\n", date, 1200+d%3*300)
+	}
+	return &WeeklyData{
+		StartDate: start.Format("2006-01-02"),
+		EndDate:   start.AddDate(0, 0, days-1).Format("2006-01-02"),
+		Period:    kind,
+		RawData:   raw.String(),
+	}
+}
+
+// readTemplateDir loads the template files of a directory laid out like templates.s3_prefix.
+func readTemplateDir(dir string) (*templateConfig, error) {
+	cfg := &templateConfig{Version: "preview:" + filepath.Base(dir)}
+	for name, dst := range map[string]*string{
+		templateHTMLObject:    &cfg.HTML,
+		templateTextObject:    &cfg.Text,
+		templateSubjectObject: &cfg.Subject,
+	} {
+		body, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		*dst = string(body)
+	}
+	return cfg, nil
+}
+
+// runPreview renders templates against sample data so they can be checked before they are
+// published to AppConfig or S3:
+//
+//	go run . preview -templates ./my-templates -variant monthly -out /tmp/preview
+func runPreview(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("preview", flag.ContinueOnError)
+	dir := flags.String("templates", "", "directory with "+templateHTMLObject+", "+templateTextObject+" and "+templateSubjectObject+"; built-in templates when empty")
+	variant := flags.String("variant", previewStructured, "sample report: "+strings.Join(previewVariants, ", "))
+	out := flags.String("out", filepath.Join(os.TempDir(), "mailmunch-preview"), "directory the rendered report is written to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !slices.Contains(previewVariants, *variant) {
+		return fmt.Errorf("unknown variant %q, expected one of %s", *variant, strings.Join(previewVariants, ", "))
+	}
+
+	tmpl, err := builtinTemplates()
+	if err != nil {
+		return err
+	}
+	if *dir != "" {
+		cfg, err := readTemplateDir(*dir)
+		if err != nil {
+			return fmt.Errorf("failed to read templates: %w", err)
+		}
+		if tmpl, err = compileTemplateConfig(context.Background(), nil, "", cfg); err != nil {
+			return fmt.Errorf("invalid templates: %w", err)
+		}
+	}
+
+	data := sampleEmailData(*variant)
+	subject, err := tmpl.renderSubject(data)
+	if err != nil {
+		return err
+	}
+	html, err := tmpl.renderHTML(data)
+	if err != nil {
+		return err
+	}
+	text, err := tmpl.renderText(data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		return err
+	}
+	// Inline cid: images become files next to the page so it opens in a browser
+	for _, chart := range data.Charts {
+		html = strings.ReplaceAll(html, "cid:"+chart.ContentID, chart.Filename)
+		if err := os.WriteFile(filepath.Join(*out, chart.Filename), chart.PNG, 0o644); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(*out, "email.html"), []byte(html), 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(*out, "email.txt"), []byte(text), 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Templates %s, %s report\nSubject: %s\nWritten to %s\n", tmpl.Version, *variant, subject, *out)
+	return nil
+}
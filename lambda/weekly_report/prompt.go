@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// promptStrategy names how the food data was represented in the analysis prompt.
+type promptStrategy string
+
+const (
+	// promptStrategyRaw pastes every row for both weeks.
+	promptStrategyRaw promptStrategy = "raw"
+	// promptStrategyHybrid keeps raw rows for the current week and aggregates the previous week.
+	promptStrategyHybrid promptStrategy = "hybrid"
+	// promptStrategyAggregated replaces rows with per-day and per-meal totals plus top foods.
+	promptStrategyAggregated promptStrategy = "aggregated"
+	// promptStrategyCompact keeps only daily totals and a short top-foods list.
+	promptStrategyCompact promptStrategy = "compact"
+	// promptStrategyTruncated is used when the data cannot be aggregated: raw rows are cut to fit.
+	promptStrategyTruncated promptStrategy = "truncated"
+)
+
+const (
+	defaultPromptTokenBudget = 30000
+	topFoodsLimit            = 25
+	compactTopFoodsLimit     = 10
+)
+
+// estimateTokens approximates the token count of s. Food diary CSV is dense with numbers and
+// punctuation, which tokenise worse than prose, so we assume ~3 characters per token.
+func estimateTokens(s string) int {
+	return (utf8.RuneCountInString(s) + 2) / 3
+}
+
+// buildBudgetedPrompt picks the most detailed representation of the data whose estimated size,
+// together with the system prompt, fits within budget tokens.
+func buildBudgetedPrompt(basePrompt, systemPrompt string, budget int, currentWeek, previousWeek *WeeklyData) (string, promptStrategy, int) {
+	if budget <= 0 {
+		budget = defaultPromptTokenBudget
+	}
+	overhead := estimateTokens(systemPrompt)
+
+	prompt := buildAnalysisPrompt(basePrompt, currentWeek, previousWeek)
+	tokens := overhead + estimateTokens(prompt)
+	if tokens <= budget {
+		logPromptStrategy(promptStrategyRaw, tokens, budget)
+		return prompt, promptStrategyRaw, tokens
+	}
+	log.Printf("Raw prompt is ~%d tokens, over the %d token budget; aggregating food data", tokens, budget)
+
+	current, errCurrent := parseFoodEntries(currentWeek.RawData)
+	previous, errPrevious := parseFoodEntries(previousWeek.RawData)
+	if errCurrent != nil || errPrevious != nil {
+		log.Printf("Warning: cannot aggregate food data (%v, %v); truncating raw rows", errCurrent, errPrevious)
+		prompt = buildTruncatedPrompt(basePrompt, budget-overhead, currentWeek, previousWeek)
+		tokens = overhead + estimateTokens(prompt)
+		logPromptStrategy(promptStrategyTruncated, tokens, budget)
+		return prompt, promptStrategyTruncated, tokens
+	}
+
+	candidates := []struct {
+		strategy promptStrategy
+		build    func() string
+	}{
+		{promptStrategyHybrid, func() string {
+			var b strings.Builder
+			writePromptHeader(&b, basePrompt)
+			writeRawSection(&b, "CURRENT WEEK RAW DATA", currentWeek, currentWeek.RawData)
+			writeAggregatedSection(&b, "PREVIOUS WEEK AGGREGATED DATA", previousWeek, previous, true, topFoodsLimit)
+			return b.String()
+		}},
+		{promptStrategyAggregated, func() string {
+			var b strings.Builder
+			writePromptHeader(&b, basePrompt)
+			writeAggregatedSection(&b, "CURRENT WEEK AGGREGATED DATA", currentWeek, current, true, topFoodsLimit)
+			writeAggregatedSection(&b, "PREVIOUS WEEK AGGREGATED DATA", previousWeek, previous, true, topFoodsLimit)
+			return b.String()
+		}},
+		{promptStrategyCompact, func() string {
+			var b strings.Builder
+			writePromptHeader(&b, basePrompt)
+			writeAggregatedSection(&b, "CURRENT WEEK AGGREGATED DATA", currentWeek, current, false, compactTopFoodsLimit)
+			writeAggregatedSection(&b, "PREVIOUS WEEK AGGREGATED DATA", previousWeek, previous, false, compactTopFoodsLimit)
+			return b.String()
+		}},
+	}
+
+	for i, c := range candidates {
+		prompt = c.build()
+		tokens = overhead + estimateTokens(prompt)
+		if tokens <= budget || i == len(candidates)-1 {
+			if tokens > budget {
+				log.Printf("Warning: even the %s prompt exceeds the token budget", c.strategy)
+			}
+			logPromptStrategy(c.strategy, tokens, budget)
+			return prompt, c.strategy, tokens
+		}
+	}
+	return prompt, promptStrategyCompact, tokens
+}
+
+func logPromptStrategy(strategy promptStrategy, tokens, budget int) {
+	log.Printf("Built analysis prompt using %s strategy (~%d tokens estimated, budget %d)", strategy, tokens, budget)
+}
+
+func writePromptHeader(b *strings.Builder, basePrompt string) {
+	b.WriteString(basePrompt)
+	b.WriteString("\n\n")
+	b.WriteString("Some food data below has been aggregated to fit the context window. ")
+	b.WriteString("Daily and per-meal rows are totals; top foods are ranked by total calories for the week.\n\n")
+}
+
+func writeRawSection(b *strings.Builder, title string, week *WeeklyData, rows string) {
+	b.WriteString("## " + title + " (" + week.StartDate + " to " + week.EndDate + "):\n")
+	b.WriteString("```csv\n")
+	b.WriteString(rows)
+	b.WriteString("```\n\n")
+}
+
+func writeAggregatedSection(b *strings.Builder, title string, week *WeeklyData, entries []FoodEntry, perMeal bool, topFoods int) {
+	b.WriteString("## " + title + " (" + week.StartDate + " to " + week.EndDate + "):\n")
+
+	b.WriteString("### Daily totals\n```csv\n")
+	b.WriteString("date,entries,calories,protein,carbs,fat,fiber,sugar,sodium\n")
+	for _, t := range aggregateEntries(entries, func(e FoodEntry) string { return e.Date }) {
+		fmt.Fprintf(b, "%s,%d,%s\n", t.key, t.count, t.totals.csv())
+	}
+	b.WriteString("```\n\n")
+
+	if perMeal {
+		b.WriteString("### Per-meal totals\n```csv\n")
+		b.WriteString("date,meal,entries,calories,protein,carbs,fat,fiber,sugar,sodium\n")
+		for _, t := range aggregateEntries(entries, func(e FoodEntry) string { return e.Date + "," + csvField(e.Meal) }) {
+			fmt.Fprintf(b, "%s,%d,%s\n", t.key, t.count, t.totals.csv())
+		}
+		b.WriteString("```\n\n")
+	}
+
+	foods := aggregateEntries(entries, func(e FoodEntry) string { return csvField(e.FoodName) })
+	sort.SliceStable(foods, func(i, j int) bool { return foods[i].totals.Calories > foods[j].totals.Calories })
+	if len(foods) > topFoods {
+		foods = foods[:topFoods]
+	}
+	fmt.Fprintf(b, "### Top %d foods by calories\n```csv\n", len(foods))
+	b.WriteString("food_name,times_logged,calories,protein,carbs,fat,fiber,sugar,sodium\n")
+	for _, t := range foods {
+		fmt.Fprintf(b, "%s,%d,%s\n", t.key, t.count, t.totals.csv())
+	}
+	b.WriteString("```\n\n")
+}
+
+// buildTruncatedPrompt keeps as many raw rows as fit, current week first.
+func buildTruncatedPrompt(basePrompt string, budget int, currentWeek, previousWeek *WeeklyData) string {
+	var b strings.Builder
+	b.WriteString(basePrompt)
+	b.WriteString("\n\n")
+	b.WriteString("The food data below was truncated to fit the context window.\n\n")
+
+	remaining := budget - estimateTokens(b.String())
+	for _, section := range []struct {
+		title string
+		week  *WeeklyData
+	}{
+		{"CURRENT WEEK RAW DATA", currentWeek},
+		{"PREVIOUS WEEK RAW DATA", previousWeek},
+	} {
+		lines := strings.SplitAfter(section.week.RawData, "\n")
+		var rows strings.Builder
+		for _, line := range lines {
+			if estimateTokens(rows.String()+line) > remaining/2 && rows.Len() > 0 {
+				break
+			}
+			rows.WriteString(line)
+		}
+		writeRawSection(&b, section.title, section.week, rows.String())
+	}
+	return b.String()
+}
+
+// nutrientTotals sums the nutrient columns of a group of entries.
+type nutrientTotals struct {
+	Calories, Protein, Carbs, Fat, Fiber, Sugar, Sodium float64
+}
+
+func (t *nutrientTotals) add(e FoodEntry) {
+	t.Calories += e.Calories
+	t.Protein += e.Protein
+	t.Carbs += e.Carbs
+	t.Fat += e.Fat
+	t.Fiber += e.Fiber
+	t.Sugar += e.Sugar
+	t.Sodium += e.Sodium
+}
+
+func (t nutrientTotals) csv() string {
+	return fmt.Sprintf("%.0f,%.1f,%.1f,%.1f,%.1f,%.1f,%.0f", t.Calories, t.Protein, t.Carbs, t.Fat, t.Fiber, t.Sugar, t.Sodium)
+}
+
+type entryGroup struct {
+	key    string
+	count  int
+	totals nutrientTotals
+}
+
+// aggregateEntries groups entries by key, preserving the order keys first appear in.
+func aggregateEntries(entries []FoodEntry, key func(FoodEntry) string) []entryGroup {
+	var groups []entryGroup
+	index := map[string]int{}
+	for _, e := range entries {
+		k := key(e)
+		i, ok := index[k]
+		if !ok {
+			i = len(groups)
+			index[k] = i
+			groups = append(groups, entryGroup{key: k})
+		}
+		groups[i].count++
+		groups[i].totals.add(e)
+	}
+	return groups
+}
+
+// csvField quotes s when it contains characters that would break a CSV row.
+func csvField(s string) string {
+	if strings.ContainsAny(s, ",\"\n") {
+		return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+	}
+	return s
+}
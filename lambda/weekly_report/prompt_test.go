@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const promptTestHeader = "date,meal,food_name,quantity,unit,calories,protein,carbs,fat,fiber,sugar,sodium\n"
+
+// heavyWeek generates a week with many rows so the raw prompt exceeds small budgets.
+func heavyWeek(start, end string, rowsPerDay int) *WeeklyData {
+	var b strings.Builder
+	b.WriteString(promptTestHeader)
+	for day := 1; day <= 7; day++ {
+		for i := 0; i < rowsPerDay; i++ {
+			meal := []string{"Breakfast", "Lunch", "Dinner", "Snacks"}[i%4]
+			fmt.Fprintf(&b, "09/%02d/2025,%s,\"Food %d, Raw\",100,g,%d,10,20,5,2,3,100\n", day, meal, i, 100+i)
+		}
+	}
+	return &WeeklyData{StartDate: start, EndDate: end, RawData: b.String()}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	if got := estimateTokens(""); got != 0 {
+		t.Errorf("estimateTokens(\"\") = %d", got)
+	}
+	if got := estimateTokens(strings.Repeat("a", 300)); got != 100 {
+		t.Errorf("estimateTokens(300 chars) = %d, want 100", got)
+	}
+}
+
+func TestBuildBudgetedPromptRawWhenUnderBudget(t *testing.T) {
+	current := heavyWeek("2025-09-15", "2025-09-21", 2)
+	previous := heavyWeek("2025-09-08", "2025-09-14", 2)
+
+	prompt, strategy, tokens := buildBudgetedPrompt("base", "system", 100000, current, previous)
+	if strategy != promptStrategyRaw {
+		t.Fatalf("strategy = %s, want raw", strategy)
+	}
+	if prompt != buildAnalysisPrompt("base", current, previous) {
+		t.Error("raw strategy should match buildAnalysisPrompt")
+	}
+	if tokens <= 0 {
+		t.Error("expected a positive token estimate")
+	}
+}
+
+func TestBuildBudgetedPromptDegradesWithBudget(t *testing.T) {
+	current := heavyWeek("2025-09-15", "2025-09-21", 40)
+	previous := heavyWeek("2025-09-08", "2025-09-14", 40)
+	rawTokens := estimateTokens("system") + estimateTokens(buildAnalysisPrompt("base", current, previous))
+
+	tests := []struct {
+		budget int
+		want   promptStrategy
+	}{
+		{budget: rawTokens, want: promptStrategyRaw},
+		{budget: rawTokens * 3 / 4, want: promptStrategyHybrid},
+		{budget: rawTokens / 3, want: promptStrategyAggregated},
+		{budget: rawTokens / 8, want: promptStrategyCompact},
+		{budget: 10, want: promptStrategyCompact},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("budget_%d", tt.budget), func(t *testing.T) {
+			prompt, strategy, tokens := buildBudgetedPrompt("base", "system", tt.budget, current, previous)
+			if strategy != tt.want {
+				t.Fatalf("strategy = %s (~%d tokens), want %s", strategy, tokens, tt.want)
+			}
+			if tt.want != promptStrategyCompact && tokens > tt.budget {
+				t.Errorf("prompt ~%d tokens exceeds budget %d", tokens, tt.budget)
+			}
+			if !strings.HasPrefix(prompt, "base") {
+				t.Error("prompt should start with the base prompt")
+			}
+		})
+	}
+}
+
+func TestWriteAggregatedSection(t *testing.T) {
+	week := &WeeklyData{
+		StartDate: "2025-09-15",
+		EndDate:   "2025-09-21",
+		RawData: promptTestHeader +
+			"09/15/2025,Breakfast,Oats,50,g,185,6,29.5,3.9,4.4,0.5,15\n" +
+			"09/15/2025,Dinner,\"Salmon, Baked\",120,g,250,25,0,12,0,0,60\n" +
+			"09/16/2025,Breakfast,Oats,50,g,185,6,29.5,3.9,4.4,0.5,15\n",
+	}
+	entries, err := parseFoodEntries(week.RawData)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	var b strings.Builder
+	writeAggregatedSection(&b, "CURRENT WEEK AGGREGATED DATA", week, entries, true, 1)
+	got := b.String()
+
+	for _, want := range []string{
+		"09/15/2025,2,435,31.0,29.5,15.9,4.4,0.5,75",
+		"09/15/2025,Dinner,1,250,25.0,0.0,12.0,0.0,0.0,60",
+		"### Top 1 foods by calories",
+		"Oats,2,370,12.0",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("aggregated section missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "Salmon") && !strings.Contains(got, "\"Salmon, Baked\"") {
+		t.Error("food names containing commas must be quoted")
+	}
+}
+
+func TestBuildBudgetedPromptTruncatesWhenDataCannotBeParsed(t *testing.T) {
+	bad := &WeeklyData{StartDate: "2025-09-15", EndDate: "2025-09-21", RawData: promptTestHeader + strings.Repeat("09/15/2025,\"unterminated\n", 200)}
+
+	prompt, strategy, _ := buildBudgetedPrompt("base", "system", 200, bad, bad)
+	if strategy != promptStrategyTruncated {
+		t.Fatalf("strategy = %s, want truncated", strategy)
+	}
+	if !strings.Contains(prompt, "truncated") {
+		t.Error("truncated prompt should say so")
+	}
+}
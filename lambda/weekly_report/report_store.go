@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	openai "github.com/openai/openai-go"
+)
+
+// s3API captures the subset of the S3 client API we use. This enables unit testing with a mock.
+type s3API interface {
+	GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+	PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error)
+	ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error
+}
+
+var newS3Client = func(sess *session.Session) s3API {
+	return s3.New(sess)
+}
+
+// TokenUsage accumulates OpenAI token usage across every request made for a report.
+type TokenUsage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+	Requests         int   `json:"requests"`
+}
+
+func (u *TokenUsage) add(usage openai.CompletionUsage) {
+	if u == nil {
+		return
+	}
+	u.PromptTokens += usage.PromptTokens
+	u.CompletionTokens += usage.CompletionTokens
+	u.TotalTokens += usage.TotalTokens
+	u.Requests++
+}
+
+// AI status values recorded in report metadata.
+const (
+	aiStatusStructured = "structured"
+	aiStatusMarkdown   = "markdown"
+	aiStatusFailed     = "failed"
+)
+
+// ReportMetadata is written as a single JSON line so the reports table can query it in Athena.
+type ReportMetadata struct {
+	RunID                string              `json:"run_id"`
+	UserID               string              `json:"user_id"`
+	GeneratedAt          string              `json:"generated_at"`
+	Period               string              `json:"period"`
+	PeriodStart          string              `json:"period_start"`
+	PeriodEnd            string              `json:"period_end"`
+	PreviousPeriodStart  string              `json:"previous_period_start"`
+	PreviousPeriodEnd    string              `json:"previous_period_end"`
+	Recipient            string              `json:"recipient"`
+	Model                string              `json:"model"`
+	PromptStrategy       string              `json:"prompt_strategy"`
+	PromptTokensEstimate int                 `json:"prompt_tokens_estimate"`
+	Usage                TokenUsage          `json:"usage"`
+	AIStatus             string              `json:"ai_status"`
+	AIError              string              `json:"ai_error,omitempty"`
+	TemplateVersion      string              `json:"template_version"`
+	EmailMessageID       string              `json:"email_message_id"`
+	MessageID            string              `json:"message_id,omitempty"` // Message-ID header we set, without angle brackets
+	Deliveries           []DeliveryResult    `json:"deliveries"`
+	CurrentMetrics       WeeklyMetrics       `json:"current_metrics"`
+	PreviousMetrics      WeeklyMetrics       `json:"previous_metrics"`
+	Analysis             *StructuredAnalysis `json:"analysis,omitempty"`
+	AnalysisMarkdown     string              `json:"analysis_markdown,omitempty"`
+	ArtifactsPrefix      string              `json:"artifacts_prefix"`
+}
+
+// ReportBundle is everything needed to reproduce or audit a report run.
+type ReportBundle struct {
+	Metadata     ReportMetadata
+	Prompt       string
+	Rendered     *RenderedReport
+	CurrentWeek  *WeeklyData
+	PreviousWeek *WeeklyData
+}
+
+type bundleObject struct {
+	key         string
+	body        string
+	contentType string
+}
+
+func newReportBundle(generatedAt time.Time, userID, recipient string, currentWeek, previousWeek *WeeklyData) *ReportBundle {
+	period := currentWeek.Period
+	if period == "" {
+		period = periodWeek
+	}
+	bundle := &ReportBundle{
+		Metadata: ReportMetadata{
+			RunID:               generatedAt.UTC().Format("20060102T150405Z"),
+			UserID:              userID,
+			GeneratedAt:         generatedAt.UTC().Format(time.RFC3339),
+			Period:              period,
+			PeriodStart:         currentWeek.StartDate,
+			PeriodEnd:           currentWeek.EndDate,
+			PreviousPeriodStart: previousWeek.StartDate,
+			PreviousPeriodEnd:   previousWeek.EndDate,
+			Recipient:           recipient,
+			Model:               openAIChatModel,
+			AIStatus:            aiStatusFailed,
+		},
+		CurrentWeek:  currentWeek,
+		PreviousWeek: previousWeek,
+	}
+	// Metric errors are already logged when the email is rendered; zero metrics are recorded here.
+	bundle.Metadata.CurrentMetrics, _ = computeWeeklyMetrics(currentWeek)
+	bundle.Metadata.PreviousMetrics, _ = computeWeeklyMetrics(previousWeek)
+	return bundle
+}
+
+func (b *ReportBundle) setAnalysis(analysis *ReportAnalysis) {
+	switch {
+	case analysis == nil:
+		b.Metadata.AIStatus = aiStatusFailed
+	case analysis.Structured != nil:
+		b.Metadata.AIStatus = aiStatusStructured
+		b.Metadata.Analysis = analysis.Structured
+	default:
+		b.Metadata.AIStatus = aiStatusMarkdown
+		b.Metadata.AnalysisMarkdown = analysis.Markdown
+	}
+}
+
+// reportPartitionPrefix returns <prefix>user_id=ID/year=YYYY/week=WW/ using the ISO week of the period start.
+func reportPartitionPrefix(prefix, userID, periodStart string) (string, error) {
+	start, err := time.Parse("2006-01-02", periodStart)
+	if err != nil {
+		return "", fmt.Errorf("invalid period start %q: %w", periodStart, err)
+	}
+	year, week := start.ISOWeek()
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if userID == "" {
+		userID = defaultUserID
+	}
+	return fmt.Sprintf("%suser_id=%s/year=%04d/week=%02d/", prefix, userID, year, week), nil
+}
+
+// messageIndexEntry points a report email at its bundle, so report_reply can find the report
+// a reply refers to from its In-Reply-To or References headers.
+type messageIndexEntry struct {
+	UserID          string `json:"user_id"`
+	RunID           string `json:"run_id"`
+	Period          string `json:"period"`
+	PeriodStart     string `json:"period_start"`
+	PeriodEnd       string `json:"period_end"`
+	Recipient       string `json:"recipient"`
+	Subject         string `json:"subject"`
+	ArtifactsPrefix string `json:"artifacts_prefix"`
+}
+
+// messageIndexKey returns <prefix>message-index/<id>.json for a Message-ID. Only the part
+// before the @ is used: SES replaces the header with <ses-message-id>@<region>.amazonses.com,
+// and replies quote whichever one the mail client saw.
+func messageIndexKey(prefix, messageID string) string {
+	id := strings.Trim(strings.TrimSpace(messageID), "<>")
+	if at := strings.LastIndex(id, "@"); at >= 0 {
+		id = id[:at]
+	}
+	id = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._-+=", r) {
+			return r
+		}
+		return '_'
+	}, id)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + "message-index/" + id + ".json"
+}
+
+// persistReportBundle writes the bundle to S3:
+//
+//	<prefix>user_id=ID/year=YYYY/week=WW/metadata/<run-id>.json   (queried by the reports Athena table)
+//	<prefix>user_id=ID/year=YYYY/week=WW/<run-id>/report.html, report.txt, report.pdf, prompt.txt, current_week.csv, previous_week.csv, <chart>.png
+//	<prefix>message-index/<message-id>.json                         (one per Message-ID of the report email)
+func persistReportBundle(ctx context.Context, s3c s3API, config *Config, bundle *ReportBundle) error {
+	if config.ReportsBucket == "" {
+		log.Printf("REPORTS_BUCKET not set; skipping report persistence")
+		return nil
+	}
+
+	partition, err := reportPartitionPrefix(config.ReportsPrefix, bundle.Metadata.UserID, bundle.Metadata.PeriodStart)
+	if err != nil {
+		return err
+	}
+	artifactsPrefix := partition + bundle.Metadata.RunID + "/"
+	bundle.Metadata.ArtifactsPrefix = artifactsPrefix
+
+	metadata, err := json.Marshal(bundle.Metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode report metadata: %w", err)
+	}
+
+	objects := []bundleObject{
+		{artifactsPrefix + "prompt.txt", bundle.Prompt, "text/plain; charset=utf-8"},
+		{artifactsPrefix + "current_week.csv", weekRawData(bundle.CurrentWeek), "text/csv; charset=utf-8"},
+		{artifactsPrefix + "previous_week.csv", weekRawData(bundle.PreviousWeek), "text/csv; charset=utf-8"},
+	}
+	if bundle.Rendered != nil {
+		objects = append(objects,
+			bundleObject{artifactsPrefix + "report.html", bundle.Rendered.HTML, "text/html; charset=utf-8"},
+			bundleObject{artifactsPrefix + "report.txt", bundle.Rendered.Text, "text/plain; charset=utf-8"},
+		)
+		for _, chart := range bundle.Rendered.Charts {
+			objects = append(objects, bundleObject{artifactsPrefix + chart.Filename, string(chart.PNG), "image/png"})
+		}
+		for _, a := range bundle.Rendered.Attachments {
+			if a.ContentType == "application/pdf" {
+				objects = append(objects, bundleObject{artifactsPrefix + "report.pdf", string(a.Data), a.ContentType})
+			}
+		}
+	}
+	// Metadata goes after the artifacts so a row in Athena implies they exist.
+	objects = append(objects, bundleObject{partition + "metadata/" + bundle.Metadata.RunID + ".json", string(metadata) + "\n", "application/json"})
+
+	if bundle.Metadata.EmailMessageID != "" {
+		entry := messageIndexEntry{
+			UserID:          bundle.Metadata.UserID,
+			RunID:           bundle.Metadata.RunID,
+			Period:          bundle.Metadata.Period,
+			PeriodStart:     bundle.Metadata.PeriodStart,
+			PeriodEnd:       bundle.Metadata.PeriodEnd,
+			Recipient:       bundle.Metadata.Recipient,
+			ArtifactsPrefix: artifactsPrefix,
+		}
+		if bundle.Rendered != nil {
+			entry.Subject = bundle.Rendered.Subject
+		}
+		index, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode message index: %w", err)
+		}
+		for _, id := range []string{bundle.Metadata.EmailMessageID, bundle.Metadata.MessageID} {
+			if id != "" {
+				objects = append(objects, bundleObject{messageIndexKey(config.ReportsPrefix, id), string(index), "application/json"})
+			}
+		}
+	}
+
+	for _, obj := range objects {
+		if _, err := s3c.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(config.ReportsBucket),
+			Key:         aws.String(obj.key),
+			Body:        bytes.NewReader([]byte(obj.body)),
+			ContentType: aws.String(obj.contentType),
+		}); err != nil {
+			return fmt.Errorf("failed to put s3://%s/%s: %w", config.ReportsBucket, obj.key, err)
+		}
+	}
+
+	log.Printf("Report bundle persisted to s3://%s/%s", config.ReportsBucket, artifactsPrefix)
+	return nil
+}
+
+func weekRawData(week *WeeklyData) string {
+	if week == nil {
+		return ""
+	}
+	return week.RawData
+}
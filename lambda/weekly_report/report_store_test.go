@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	openai "github.com/openai/openai-go"
+)
+
+// mockS3 records every object written and optionally fails on a key.
+type mockS3 struct {
+	objects map[string]string
+	keys    []string
+	failKey string
+	// denyMissing answers AccessDenied for missing objects, as S3 does for a role that may
+	// not list the whole bucket
+	denyMissing bool
+}
+
+func (m *mockS3) GetObjectWithContext(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	body, ok := m.objects[aws.StringValue(input.Key)]
+	if !ok && m.denyMissing {
+		return nil, awserr.New("AccessDenied", "Access Denied", nil)
+	}
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+func (m *mockS3) PutObjectWithContext(_ aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	key := aws.StringValue(input.Key)
+	if key == m.failKey {
+		return nil, errors.New("access denied")
+	}
+	body, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	if m.objects == nil {
+		m.objects = map[string]string{}
+	}
+	m.objects[key] = string(body)
+	m.keys = append(m.keys, key)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *mockS3) ListObjectsV2PagesWithContext(_ aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(key)})
+	}
+	fn(out, true)
+	return nil
+}
+
+func testBundle() *ReportBundle {
+	current := &WeeklyData{
+		StartDate: "2025-09-15",
+		EndDate:   "2025-09-21",
+		RawData:   "date,food_name,calories\n09/15/2025,Oats,300\n",
+	}
+	previous := &WeeklyData{StartDate: "2025-09-08", EndDate: "2025-09-14", RawData: "date,food_name,calories\n"}
+	bundle := newReportBundle(time.Date(2025, 9, 22, 8, 0, 5, 0, time.UTC), "alice", "me@example.com", current, previous)
+	bundle.Prompt = "prompt"
+	bundle.Rendered = &RenderedReport{Subject: "subject", HTML: "<p>html</p>", Text: "text"}
+	return bundle
+}
+
+func TestReportPartitionPrefix(t *testing.T) {
+	tests := []struct {
+		prefix, user, start, want string
+	}{
+		{"reports/", "alice", "2025-09-15", "reports/user_id=alice/year=2025/week=38/"},
+		{"reports", "alice", "2025-09-15", "reports/user_id=alice/year=2025/week=38/"},
+		{"reports/", "", "2025-09-15", "reports/user_id=default/year=2025/week=38/"},
+		// ISO week 1 of 2026 starts in December 2025
+		{"reports/", "alice", "2025-12-29", "reports/user_id=alice/year=2026/week=01/"},
+	}
+	for _, tt := range tests {
+		got, err := reportPartitionPrefix(tt.prefix, tt.user, tt.start)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("reportPartitionPrefix(%q, %q, %q) = %q, want %q", tt.prefix, tt.user, tt.start, got, tt.want)
+		}
+	}
+
+	if _, err := reportPartitionPrefix("reports/", "alice", "09/15/2025"); err == nil {
+		t.Error("expected error for invalid date")
+	}
+}
+
+func TestPersistReportBundle(t *testing.T) {
+	mock := &mockS3{}
+	bundle := testBundle()
+	bundle.setAnalysis(&ReportAnalysis{Markdown: "## WEEKLY SUMMARY"})
+	bundle.Metadata.Usage.add(openai.CompletionUsage{PromptTokens: 120, CompletionTokens: 30, TotalTokens: 150})
+
+	config := &Config{ReportsBucket: "bucket", ReportsPrefix: "reports/"}
+	if err := persistReportBundle(context.Background(), mock, config, bundle); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	artifacts := "reports/user_id=alice/year=2025/week=38/20250922T080005Z/"
+	for _, key := range []string{"prompt.txt", "current_week.csv", "previous_week.csv", "report.html", "report.txt"} {
+		if _, ok := mock.objects[artifacts+key]; !ok {
+			t.Errorf("missing artifact %s", key)
+		}
+	}
+	if mock.objects[artifacts+"current_week.csv"] != bundle.CurrentWeek.RawData {
+		t.Error("current week CSV does not match raw data")
+	}
+
+	metadataKey := "reports/user_id=alice/year=2025/week=38/metadata/20250922T080005Z.json"
+	if last := mock.keys[len(mock.keys)-1]; last != metadataKey {
+		t.Errorf("metadata should be written last, got %s", last)
+	}
+	body := mock.objects[metadataKey]
+	if !strings.HasSuffix(body, "\n") || strings.Count(body, "\n") != 1 {
+		t.Error("metadata should be a single JSON line")
+	}
+
+	var metadata map[string]any
+	if err := json.Unmarshal([]byte(body), &metadata); err != nil {
+		t.Fatalf("invalid metadata JSON: %v", err)
+	}
+	if metadata["ai_status"] != aiStatusMarkdown || metadata["artifacts_prefix"] != artifacts || metadata["user_id"] != "alice" {
+		t.Errorf("unexpected metadata: %v", metadata)
+	}
+	usage, _ := metadata["usage"].(map[string]any)
+	if usage["total_tokens"] != float64(150) {
+		t.Errorf("unexpected usage: %v", usage)
+	}
+	current, _ := metadata["current_metrics"].(map[string]any)
+	if current["total_calories"] != float64(300) {
+		t.Errorf("unexpected current metrics: %v", current)
+	}
+}
+
+func TestPersistReportBundleIndexesMessageIDs(t *testing.T) {
+	mock := &mockS3{}
+	bundle := testBundle()
+	bundle.Metadata.EmailMessageID = "0102018abc-def-000000"
+	bundle.Metadata.MessageID = "20250922T080005Z.alice.week@mailmunch.example"
+
+	config := &Config{ReportsBucket: "bucket", ReportsPrefix: "reports"}
+	if err := persistReportBundle(context.Background(), mock, config, bundle); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, key := range []string{"reports/message-index/0102018abc-def-000000.json", "reports/message-index/20250922T080005Z.alice.week.json"} {
+		var entry messageIndexEntry
+		if err := json.Unmarshal([]byte(mock.objects[key]), &entry); err != nil {
+			t.Fatalf("%s: invalid index entry: %v", key, err)
+		}
+		if entry.UserID != "alice" || entry.Subject != "subject" || entry.Recipient != "me@example.com" ||
+			entry.ArtifactsPrefix != "reports/user_id=alice/year=2025/week=38/20250922T080005Z/" {
+			t.Errorf("%s: unexpected entry %+v", key, entry)
+		}
+	}
+}
+
+func TestMessageIndexKey(t *testing.T) {
+	for in, want := range map[string]string{
+		"<0102018abc-000000@eu-west-2.amazonses.com>": "idx/message-index/0102018abc-000000.json",
+		"0102018abc-000000":                           "idx/message-index/0102018abc-000000.json",
+		"run.alice.week@example.com":                  "idx/message-index/run.alice.week.json",
+		"../../etc/passwd@x":                          "idx/message-index/.._.._etc_passwd.json",
+	} {
+		if got := messageIndexKey("idx/", in); got != want {
+			t.Errorf("messageIndexKey(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestPersistReportBundleSkipsWithoutBucket(t *testing.T) {
+	mock := &mockS3{}
+	if err := persistReportBundle(context.Background(), mock, &Config{}, testBundle()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mock.keys) != 0 {
+		t.Errorf("expected no writes, got %v", mock.keys)
+	}
+}
+
+func TestPersistReportBundleStopsBeforeMetadataOnError(t *testing.T) {
+	bundle := testBundle()
+	mock := &mockS3{failKey: "reports/user_id=alice/year=2025/week=38/" + bundle.Metadata.RunID + "/report.html"}
+
+	config := &Config{ReportsBucket: "bucket", ReportsPrefix: "reports/"}
+	if err := persistReportBundle(context.Background(), mock, config, bundle); err == nil {
+		t.Fatal("expected error")
+	}
+	for _, key := range mock.keys {
+		if strings.Contains(key, "/metadata/") {
+			t.Errorf("metadata written despite failed artifact: %s", key)
+		}
+	}
+}
+
+func TestReportBundleSetAnalysis(t *testing.T) {
+	bundle := testBundle()
+	if bundle.Metadata.AIStatus != aiStatusFailed {
+		t.Errorf("expected failed status by default, got %s", bundle.Metadata.AIStatus)
+	}
+
+	bundle.setAnalysis(&ReportAnalysis{Structured: &StructuredAnalysis{Summary: "ok"}})
+	if bundle.Metadata.AIStatus != aiStatusStructured || bundle.Metadata.Analysis == nil {
+		t.Errorf("unexpected metadata: %+v", bundle.Metadata)
+	}
+}
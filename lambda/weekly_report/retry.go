@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	openai "github.com/openai/openai-go"
+)
+
+var (
+	errEmptyCompletion     = errors.New("OpenAI returned empty assistant content")
+	errTruncatedCompletion = errors.New("OpenAI completion was truncated (finish_reason=length)")
+)
+
+// retryPolicy bounds how often and how long we retry OpenAI calls.
+type retryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var openAIRetryPolicy = retryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   2 * time.Second,
+	MaxDelay:    30 * time.Second,
+}
+
+// fallbackReserve is the slice of the Lambda deadline kept back for sending the
+// metrics-only fallback email when the AI step runs out of time.
+const fallbackReserve = 30 * time.Second
+
+// aiContext derives the deadline for the AI step from the Lambda context.
+func aiContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline.Add(-fallbackReserve))
+}
+
+// withRetry calls fn until it succeeds, returns a non-retryable error, the policy is
+// exhausted, or ctx is done.
+func withRetry[T any](ctx context.Context, policy retryPolicy, fn func(context.Context) (T, error)) (T, error) {
+	var zero T
+	var lastErr error
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		result, err := fn(ctx)
+		if err == nil {
+			return result, nil
+		}
+		lastErr = err
+
+		if !isRetryableError(err) || attempt == policy.MaxAttempts {
+			break
+		}
+
+		delay := policy.delay(attempt, err)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			log.Printf("OpenAI attempt %d failed and the next retry would exceed the deadline: %v", attempt, err)
+			break
+		}
+		log.Printf("OpenAI attempt %d/%d failed, retrying in %s: %v", attempt, policy.MaxAttempts, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return zero, errors.Join(lastErr, ctx.Err())
+		case <-timer.C:
+		}
+	}
+	return zero, lastErr
+}
+
+// isRetryableError reports whether err is transient: rate limits, server errors,
+// network failures and empty completions. A truncated completion is not: the same prompt
+// runs into the same token limit, so the caller falls back to its next strategy instead.
+func isRetryableError(err error) bool {
+	if errors.Is(err, errEmptyCompletion) {
+		return true
+	}
+	if errors.Is(err, errTruncatedCompletion) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.StatusCode == http.StatusRequestTimeout,
+			apiErr.StatusCode == http.StatusConflict,
+			apiErr.StatusCode == http.StatusTooManyRequests,
+			apiErr.StatusCode >= http.StatusInternalServerError:
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// delay returns how long to wait before the next attempt. Rate-limit headers from
+// the API take precedence over exponential backoff with jitter.
+func (p retryPolicy) delay(attempt int, err error) time.Duration {
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) && apiErr.Response != nil {
+		if d, ok := retryAfterFromHeaders(apiErr.Response.Header); ok {
+			if d > p.MaxDelay {
+				return p.MaxDelay
+			}
+			return d
+		}
+	}
+
+	backoff := p.BaseDelay << (attempt - 1)
+	if backoff <= 0 || backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	// Full jitter in the upper half keeps concurrent retries apart without collapsing to zero.
+	half := backoff / 2
+	if half <= 0 {
+		return backoff
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// retryAfterFromHeaders reads retry-after-ms, Retry-After and the x-ratelimit-reset-* headers.
+func retryAfterFromHeaders(h http.Header) (time.Duration, bool) {
+	if v := h.Get("retry-after-ms"); v != "" {
+		if ms, err := strconv.ParseFloat(v, 64); err == nil && ms >= 0 {
+			return time.Duration(ms * float64(time.Millisecond)), true
+		}
+	}
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil && secs >= 0 {
+			return time.Duration(secs * float64(time.Second)), true
+		}
+		if at, err := http.ParseTime(v); err == nil {
+			if d := time.Until(at); d > 0 {
+				return d, true
+			}
+			return 0, true
+		}
+	}
+
+	var longest time.Duration
+	found := false
+	for _, name := range []string{"x-ratelimit-reset-requests", "x-ratelimit-reset-tokens"} {
+		v := strings.TrimSpace(h.Get(name))
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err == nil {
+			found = true
+			if d > longest {
+				longest = d
+			}
+		}
+	}
+	return longest, found
+}
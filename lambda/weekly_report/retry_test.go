@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	openai "github.com/openai/openai-go"
+)
+
+func apiError(status int, header http.Header) *openai.Error {
+	return &openai.Error{
+		StatusCode: status,
+		Request:    &http.Request{Method: http.MethodPost, URL: &url.URL{Path: "/chat/completions"}},
+		Response:   &http.Response{StatusCode: status, Header: header},
+	}
+}
+
+// fastRetries shrinks the retry policy so tests do not sleep.
+func fastRetries(t *testing.T) {
+	t.Helper()
+	old := openAIRetryPolicy
+	openAIRetryPolicy = retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	t.Cleanup(func() { openAIRetryPolicy = old })
+}
+
+func TestRetryAfterFromHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		found  bool
+	}{
+		{name: "retry-after-ms", header: http.Header{"Retry-After-Ms": {"1500"}}, want: 1500 * time.Millisecond, found: true},
+		{name: "retry-after seconds", header: http.Header{"Retry-After": {"3"}}, want: 3 * time.Second, found: true},
+		{name: "ratelimit reset uses longest", header: http.Header{"X-Ratelimit-Reset-Requests": {"20ms"}, "X-Ratelimit-Reset-Tokens": {"6s"}}, want: 6 * time.Second, found: true},
+		{name: "no headers", header: http.Header{}, found: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := retryAfterFromHeaders(tt.header)
+			if found != tt.found || got != tt.want {
+				t.Errorf("retryAfterFromHeaders() = (%v, %v), want (%v, %v)", got, found, tt.want, tt.found)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := retryPolicy{MaxAttempts: 4, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	if got := policy.delay(1, apiError(429, http.Header{"Retry-After": {"2"}})); got != 2*time.Second {
+		t.Errorf("expected Retry-After to be honoured, got %v", got)
+	}
+	if got := policy.delay(1, apiError(429, http.Header{"Retry-After": {"120"}})); got != policy.MaxDelay {
+		t.Errorf("expected delay capped at %v, got %v", policy.MaxDelay, got)
+	}
+	for attempt := 1; attempt <= 6; attempt++ {
+		got := policy.delay(attempt, errEmptyCompletion)
+		if got <= 0 || got > policy.MaxDelay {
+			t.Errorf("attempt %d: backoff %v outside (0, %v]", attempt, got, policy.MaxDelay)
+		}
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "rate limited", err: apiError(429, nil), want: true},
+		{name: "server error", err: apiError(503, nil), want: true},
+		{name: "bad request", err: apiError(400, nil), want: false},
+		{name: "empty completion", err: errEmptyCompletion, want: true},
+		{name: "truncated completion", err: errTruncatedCompletion, want: false},
+		{name: "deadline", err: context.DeadlineExceeded, want: false},
+		{name: "other", err: errors.New("boom"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableError(tt.err); got != tt.want {
+				t.Errorf("isRetryableError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestChatCompletionRetriesTransientErrors(t *testing.T) {
+	fastRetries(t)
+	mock := &mockChatClient{
+		errs:      []error{apiError(429, http.Header{"Retry-After-Ms": {"1"}}), apiError(500, nil)},
+		responses: []string{"", "", "analysis"},
+	}
+
+	got, err := requestChatCompletion(context.Background(), mock, buildChatParams("system", "prompt"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "analysis" || len(mock.requests) != 3 {
+		t.Errorf("got %q after %d requests", got, len(mock.requests))
+	}
+}
+
+func TestRequestChatCompletionDoesNotRetryClientErrors(t *testing.T) {
+	fastRetries(t)
+	mock := &mockChatClient{errs: []error{apiError(400, nil)}}
+
+	if _, err := requestChatCompletion(context.Background(), mock, buildChatParams("system", "prompt"), nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(mock.requests) != 1 {
+		t.Errorf("expected 1 request, got %d", len(mock.requests))
+	}
+}
+
+func TestRequestChatCompletionDetectsIncompleteCompletions(t *testing.T) {
+	fastRetries(t)
+	mock := &mockChatClient{
+		responses:     []string{"  ", "cut off", "cut off"},
+		finishReasons: []string{"stop", "length", "length"},
+	}
+
+	// An empty completion is retried, but a truncated one would only be truncated again
+	_, err := requestChatCompletion(context.Background(), mock, buildChatParams("system", "prompt"), nil)
+	if !errors.Is(err, errTruncatedCompletion) {
+		t.Fatalf("expected truncated completion error, got %v", err)
+	}
+	if len(mock.requests) != 2 {
+		t.Errorf("expected 2 requests, got %d", len(mock.requests))
+	}
+}
+
+func TestWithRetryStopsAtDeadline(t *testing.T) {
+	policy := retryPolicy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	start := time.Now()
+	_, err := withRetry(ctx, policy, func(context.Context) (string, error) {
+		calls++
+		return "", errEmptyCompletion
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if calls != 1 {
+		t.Errorf("expected retry to be skipped when it would exceed the deadline, got %d calls", calls)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("withRetry should not sleep past the deadline")
+	}
+}
+
+func TestAIContextReservesFallbackTime(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Minute)
+	parent, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	ctx, aiCancel := aiContext(parent)
+	defer aiCancel()
+
+	got, ok := ctx.Deadline()
+	if !ok || !got.Equal(deadline.Add(-fallbackReserve)) {
+		t.Errorf("expected deadline %v, got %v", deadline.Add(-fallbackReserve), got)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// builtinTemplateVersion identifies the templates compiled into the binary in report metadata.
+// Bump it whenever htmlEmailTemplate, textEmailTemplate or subjectTemplate change.
+const builtinTemplateVersion = "builtin-1"
+
+const subjectTemplate = `{{.Title}} - {{.CurrentWeek.StartDate}} to {{.CurrentWeek.EndDate}}`
+
+// Template object names under templates.s3_prefix.
+const (
+	templateHTMLObject    = "email.html.tmpl"
+	templateTextObject    = "email.txt.tmpl"
+	templateSubjectObject = "subject.txt.tmpl"
+)
+
+// maxSubjectLength keeps a custom subject line within what mail clients display.
+const maxSubjectLength = 200
+
+// templateConfig is the templates section of the AppConfig document. Templates can be given
+// inline or as objects under s3_prefix in REPORTS_BUCKET; any that are left out use the
+// built-in ones.
+type templateConfig struct {
+	Version  string `json:"version"`
+	HTML     string `json:"html,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+	S3Prefix string `json:"s3_prefix,omitempty"`
+}
+
+// reportTemplates are the compiled templates a report is rendered with.
+type reportTemplates struct {
+	Version string
+	HTML    *template.Template
+	Text    *texttemplate.Template
+	Subject *texttemplate.Template
+}
+
+// builtinTemplates compiles the templates in this binary; they are validated by the tests.
+var builtinTemplates = sync.OnceValues(func() (*reportTemplates, error) {
+	return compileTemplates(builtinTemplateVersion, htmlEmailTemplate, textEmailTemplate, subjectTemplate)
+})
+
+func compileTemplates(version, htmlSrc, textSrc, subjectSrc string) (*reportTemplates, error) {
+	html, err := template.New("email").Funcs(htmlTemplateFuncs).Option("missingkey=error").Parse(htmlSrc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTML template: %w", err)
+	}
+	text, err := texttemplate.New("text").Funcs(textTemplateFuncs).Option("missingkey=error").Parse(textSrc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse text template: %w", err)
+	}
+	subject, err := texttemplate.New("subject").Funcs(textTemplateFuncs).Option("missingkey=error").Parse(subjectSrc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse subject template: %w", err)
+	}
+	return &reportTemplates{Version: version, HTML: html, Text: text, Subject: subject}, nil
+}
+
+// validate renders every sample report so templates referring to fields that do not exist,
+// or that fail on a report variant, are rejected before a real report depends on them.
+func (t *reportTemplates) validate() error {
+	for _, variant := range previewVariants {
+		data := sampleEmailData(variant)
+		if _, err := t.renderHTML(data); err != nil {
+			return fmt.Errorf("%s report: %w", variant, err)
+		}
+		if _, err := t.renderText(data); err != nil {
+			return fmt.Errorf("%s report: %w", variant, err)
+		}
+		if _, err := t.renderSubject(data); err != nil {
+			return fmt.Errorf("%s report: %w", variant, err)
+		}
+	}
+	return nil
+}
+
+func (t *reportTemplates) renderHTML(data EmailData) (string, error) {
+	var b strings.Builder
+	if err := t.HTML.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to execute email template: %w", err)
+	}
+	return b.String(), nil
+}
+
+func (t *reportTemplates) renderText(data EmailData) (string, error) {
+	var b strings.Builder
+	if err := t.Text.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to execute text template: %w", err)
+	}
+	return b.String(), nil
+}
+
+func (t *reportTemplates) renderSubject(data EmailData) (string, error) {
+	var b strings.Builder
+	if err := t.Subject.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to execute subject template: %w", err)
+	}
+	subject := strings.TrimSpace(b.String())
+	switch {
+	case subject == "":
+		return "", fmt.Errorf("subject template rendered an empty subject")
+	case strings.ContainsAny(subject, "\r\n"):
+		return "", fmt.Errorf("subject template rendered more than one line")
+	case len(subject) > maxSubjectLength:
+		return "", fmt.Errorf("subject is longer than %d characters", maxSubjectLength)
+	}
+	return subject, nil
+}
+
+// loadTemplates compiles and validates the configured templates. Without configuration, or
+// when the configured ones cannot be loaded, the built-in templates are used and the error
+// is returned alongside them for logging.
+func loadTemplates(ctx context.Context, s3c s3API, bucket string, cfg *templateConfig) (*reportTemplates, error) {
+	builtin, err := builtinTemplates()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return builtin, nil
+	}
+
+	custom, err := compileTemplateConfig(ctx, s3c, bucket, cfg)
+	if err != nil {
+		return builtin, fmt.Errorf("templates %q: %w", cfg.Version, err)
+	}
+	return custom, nil
+}
+
+func compileTemplateConfig(ctx context.Context, s3c s3API, bucket string, cfg *templateConfig) (*reportTemplates, error) {
+	if cfg.Version == "" {
+		return nil, fmt.Errorf("version is required")
+	}
+	stored, err := storedTemplates(ctx, s3c, bucket, cfg.S3Prefix)
+	if err != nil {
+		return nil, err
+	}
+	html, err := templateSource(ctx, s3c, bucket, stored, cfg.HTML, templateHTMLObject, htmlEmailTemplate)
+	if err != nil {
+		return nil, err
+	}
+	text, err := templateSource(ctx, s3c, bucket, stored, cfg.Text, templateTextObject, textEmailTemplate)
+	if err != nil {
+		return nil, err
+	}
+	subject, err := templateSource(ctx, s3c, bucket, stored, cfg.Subject, templateSubjectObject, subjectTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := compileTemplates(cfg.Version, html, text, subject)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.validate(); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// storedTemplates maps the template object names found under prefix to their keys. The
+// Lambda may only list and read that prefix, so S3 answers AccessDenied rather than
+// NoSuchKey for objects that are not there; listing first tells the two apart.
+func storedTemplates(ctx context.Context, s3c s3API, bucket, prefix string) (map[string]string, error) {
+	if prefix == "" {
+		return nil, nil
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("REPORTS_BUCKET is required for templates in S3")
+	}
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	stored := map[string]string{}
+	err := s3c.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			key := aws.StringValue(obj.Key)
+			stored[strings.TrimPrefix(key, prefix)] = key
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list s3://%s/%s: %w", bucket, prefix, err)
+	}
+	return stored, nil
+}
+
+// templateSource picks one template: inline in AppConfig, then from S3, then the built-in one.
+func templateSource(ctx context.Context, s3c s3API, bucket string, stored map[string]string, inline, object, builtin string) (string, error) {
+	if inline != "" {
+		return inline, nil
+	}
+	key, ok := stored[object]
+	if !ok {
+		return builtin, nil
+	}
+	obj, err := s3c.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if isNoSuchKey(err) {
+		return builtin, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get s3://%s/%s: %w", bucket, key, err)
+	}
+	defer obj.Body.Close()
+	body, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read s3://%s/%s: %w", bucket, key, err)
+	}
+	return string(body), nil
+}
+
+// isNoSuchKey reports whether an S3 error means the object does not exist.
+func isNoSuchKey(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey
+}
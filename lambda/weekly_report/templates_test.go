@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinTemplatesValidate(t *testing.T) {
+	tmpl, err := builtinTemplates()
+	if err != nil {
+		t.Fatalf("built-in templates do not compile: %v", err)
+	}
+	if err := tmpl.validate(); err != nil {
+		t.Fatalf("built-in templates fail on a sample report: %v", err)
+	}
+	subject, err := tmpl.renderSubject(sampleEmailData(previewStructured))
+	if err != nil || subject != "Weekly Nutrition Report - 2025-09-15 to 2025-09-21" {
+		t.Errorf("unexpected subject %q (%v)", subject, err)
+	}
+}
+
+func TestLoadTemplatesInline(t *testing.T) {
+	cfg := &templateConfig{Version: "v2", Subject: "{{.Cadence}} check-in: {{.CurrentWeek.StartDate}}"}
+	tmpl, err := loadTemplates(context.Background(), &mockS3{}, "", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data := sampleEmailData(previewStructured)
+	report, err := renderReport(nil, data.CurrentWeek, data.PreviousWeek, reportExtras{Templates: tmpl})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Subject != "Weekly check-in: 2025-09-15" || report.TemplateVersion != "v2" {
+		t.Errorf("unexpected subject %q, version %q", report.Subject, report.TemplateVersion)
+	}
+	// HTML and text were not overridden, so the built-in ones are used
+	if !strings.Contains(report.HTML, "<!DOCTYPE html>") || !strings.Contains(report.Text, "WEEKLY NUTRITION REPORT") {
+		t.Error("expected the built-in HTML and text templates")
+	}
+}
+
+func TestLoadTemplatesFromS3(t *testing.T) {
+	store := &mockS3{objects: map[string]string{
+		"templates/v3/email.txt.tmpl": "{{.Title}}: {{.CurrentMetrics.TotalCalories}} kcal",
+	}}
+	tmpl, err := loadTemplates(context.Background(), store, "bucket", &templateConfig{Version: "v3", S3Prefix: "templates/v3/"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	text, err := tmpl.renderText(sampleEmailData(previewMetricsOnly))
+	if err != nil || !strings.HasPrefix(text, "Weekly Nutrition Report: ") {
+		t.Errorf("unexpected text %q (%v)", text, err)
+	}
+}
+
+func TestLoadTemplatesOnlyReadsStoredObjects(t *testing.T) {
+	store := &mockS3{denyMissing: true, objects: map[string]string{
+		"templates/v3/subject.txt.tmpl": "{{.Title}} from S3",
+		"templates/v31/email.txt.tmpl":  "another version",
+	}}
+	tmpl, err := loadTemplates(context.Background(), store, "bucket", &templateConfig{Version: "v3", S3Prefix: "templates/v3"})
+	if err != nil {
+		t.Fatalf("templates missing from S3 should use the built-in ones, got %v", err)
+	}
+	subject, err := tmpl.renderSubject(sampleEmailData(previewMetricsOnly))
+	if err != nil || subject != "Weekly Nutrition Report from S3" {
+		t.Errorf("unexpected subject %q (%v)", subject, err)
+	}
+	text, err := tmpl.renderText(sampleEmailData(previewMetricsOnly))
+	if err != nil || !strings.Contains(text, "WEEKLY NUTRITION REPORT") {
+		t.Errorf("expected the built-in text template, got %q (%v)", text, err)
+	}
+}
+
+func TestLoadTemplatesFallsBackToBuiltin(t *testing.T) {
+	for name, cfg := range map[string]*templateConfig{
+		"no version":       {HTML: "<p>{{.Title}}</p>"},
+		"syntax error":     {Version: "v2", HTML: "<p>{{.Title</p>"},
+		"unknown field":    {Version: "v2", Text: "{{.Calories}}"},
+		"fails on variant": {Version: "v2", Text: "{{.Structured.Summary}}"},
+		"empty subject":    {Version: "v2", Subject: "{{if false}}x{{end}}"},
+		"multiline":        {Version: "v2", Subject: "{{.Title}}\nBcc: someone@example.com"},
+		"no bucket":        {Version: "v2", S3Prefix: "templates/"},
+	} {
+		tmpl, err := loadTemplates(context.Background(), &mockS3{}, "", cfg)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if tmpl == nil || tmpl.Version != builtinTemplateVersion {
+			t.Errorf("%s: expected the built-in templates, got %+v", name, tmpl)
+		}
+	}
+}
+
+func TestRunPreview(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, templateSubjectObject), []byte("Your {{lower .Cadence}} numbers"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+
+	var stdout bytes.Buffer
+	if err := runPreview([]string{"-templates", dir, "-variant", previewMonthly, "-out", out}, &stdout); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "Subject: Your monthly numbers") {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+	html, err := os.ReadFile(filepath.Join(out, "email.html"))
+	if err != nil {
+		t.Fatalf("preview not written: %v", err)
+	}
+	if strings.Contains(string(html), "cid:") {
+		t.Error("chart references should point at the chart files")
+	}
+	if entries, _ := filepath.Glob(filepath.Join(out, "*.png")); len(entries) == 0 {
+		t.Error("expected chart images next to the preview")
+	}
+
+	if err := runPreview([]string{"-variant", "yearly", "-out", out}, &stdout); err == nil {
+		t.Error("expected an unknown variant to be rejected")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/appconfigdata"
+)
+
+// defaultUserID matches the user_id partition email_ingest writes for mail to the base
+// recipient address, and is used when AppConfig defines no users.
+const defaultUserID = "default"
+
+// userIDPattern keeps user IDs safe to use in S3 keys and the Athena query.
+var userIDPattern = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+// User is one entry in the AppConfig user registry.
+type User struct {
+	ID          string         `json:"id"`
+	ReportEmail string         `json:"report_email"`
+	Timezone    string         `json:"timezone,omitempty"` // IANA name; defaults to REPORT_TIMEZONE
+	Goals       NutritionGoals `json:"goals,omitempty"`
+	Channels    []Channel      `json:"channels,omitempty"` // where reports go; defaults to email only
+}
+
+// appConfigDocument is the JSON document stored in the AppConfig hosted configuration.
+type appConfigDocument struct {
+	BasePrompt   string          `json:"weekly_report_base_prompt"`
+	SystemPrompt string          `json:"weekly_report_system_prompt"`
+	Goals        NutritionGoals  `json:"goals,omitempty"` // defaults for users without their own
+	Users        []User          `json:"users,omitempty"`
+	Templates    *templateConfig `json:"templates,omitempty"` // built-in templates when unset
+}
+
+func getAppConfigDocument(appConfigClient *appconfigdata.AppConfigData, config *Config) (*appConfigDocument, error) {
+	// Start a configuration session
+	sessionInput := &appconfigdata.StartConfigurationSessionInput{
+		ApplicationIdentifier:          aws.String(config.AppConfigApplication),
+		EnvironmentIdentifier:          aws.String(config.AppConfigEnvironment),
+		ConfigurationProfileIdentifier: aws.String(config.AppConfigConfiguration),
+	}
+
+	sessionResult, err := appConfigClient.StartConfigurationSession(sessionInput)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start configuration session: %w", err)
+	}
+
+	// Get the latest configuration
+	configInput := &appconfigdata.GetLatestConfigurationInput{
+		ConfigurationToken: sessionResult.InitialConfigurationToken,
+	}
+
+	result, err := appConfigClient.GetLatestConfiguration(configInput)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest configuration from AppConfig: %w", err)
+	}
+
+	return parseAppConfigDocument(result.Configuration)
+}
+
+func parseAppConfigDocument(data []byte) (*appConfigDocument, error) {
+	// Decode into a map first so a missing prompt is distinguishable from an empty one
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("failed to parse AppConfig content as JSON: %w", err)
+	}
+	for _, key := range []string{"weekly_report_base_prompt", "weekly_report_system_prompt"} {
+		if _, ok := fields[key]; !ok {
+			return nil, fmt.Errorf("%s field not found in AppConfig", key)
+		}
+	}
+
+	doc := &appConfigDocument{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("failed to parse AppConfig content as JSON: %w", err)
+	}
+	return doc, nil
+}
+
+// resolveUsers validates the registry and returns the users to report on, with unset goals
+// taken from defaultGoals and an unset timezone from defaultTimezone. Without a registry the
+// deployment has a single default user whose report goes to REPORT_EMAIL. A non-empty onlyID
+// restricts the run to that user.
+func resolveUsers(registry []User, defaultGoals NutritionGoals, reportEmail, defaultTimezone, onlyID string) ([]User, error) {
+	if len(registry) == 0 {
+		registry = []User{{ID: defaultUserID, ReportEmail: reportEmail}}
+	}
+
+	seen := map[string]bool{}
+	var users []User
+	for _, user := range registry {
+		if !userIDPattern.MatchString(user.ID) {
+			return nil, fmt.Errorf("invalid user id %q (want lower-case letters, digits, _ or -)", user.ID)
+		}
+		if seen[user.ID] {
+			return nil, fmt.Errorf("duplicate user id %q", user.ID)
+		}
+		seen[user.ID] = true
+
+		emailed := len(user.Channels) == 0
+		for _, c := range user.Channels {
+			if err := c.validate(); err != nil {
+				return nil, fmt.Errorf("user %q has an invalid channel: %w", user.ID, err)
+			}
+			emailed = emailed || c.Type == channelEmail
+		}
+		if emailed && user.ReportEmail == "" {
+			return nil, fmt.Errorf("user %q has no report_email", user.ID)
+		}
+		if user.ReportEmail != "" {
+			addr, err := mail.ParseAddress(user.ReportEmail)
+			if err != nil {
+				return nil, fmt.Errorf("user %q has an invalid report_email: %w", user.ID, err)
+			}
+			user.ReportEmail = addr.Address
+		}
+
+		if user.Timezone == "" {
+			user.Timezone = defaultTimezone
+		}
+		if _, err := time.LoadLocation(user.Timezone); err != nil {
+			return nil, fmt.Errorf("user %q has an invalid timezone: %w", user.ID, err)
+		}
+
+		user.Goals = user.Goals.withDefaults(defaultGoals)
+		if err := user.Goals.validate(); err != nil {
+			return nil, fmt.Errorf("user %q has invalid goals: %w", user.ID, err)
+		}
+
+		if onlyID == "" || onlyID == user.ID {
+			users = append(users, user)
+		}
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("unknown user_id %q", onlyID)
+	}
+	return users, nil
+}
+
+// location returns the user's timezone; resolveUsers has already validated it.
+func (u User) location() *time.Location {
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// configFor returns a copy of config for one user's report.
+func configFor(config *Config, user User) *Config {
+	userConfig := *config
+	userConfig.UserID = user.ID
+	userConfig.ReportEmail = user.ReportEmail
+	if user.Goals.DailyCalories > 0 {
+		userConfig.DailyCalorieTarget = user.Goals.DailyCalories
+	}
+	return &userConfig
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// defaultUserTimezone is the REPORT_TIMEZONE the tests run with.
+const defaultUserTimezone = "Europe/London"
+
+func TestParseAppConfigDocument(t *testing.T) {
+	doc, err := parseAppConfigDocument([]byte(`{
+		"weekly_report_base_prompt": "base",
+		"weekly_report_system_prompt": "system",
+		"users": [{"id": "alice", "report_email": "alice@example.com", "timezone": "America/New_York", "goals": {"daily_calories": 1800}}]
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if doc.BasePrompt != "base" || doc.SystemPrompt != "system" || len(doc.Users) != 1 || doc.Users[0].Goals.DailyCalories != 1800 {
+		t.Errorf("unexpected document: %+v", doc)
+	}
+
+	if _, err := parseAppConfigDocument([]byte(`{"weekly_report_base_prompt": "base"}`)); err == nil ||
+		!strings.Contains(err.Error(), "weekly_report_system_prompt") {
+		t.Errorf("expected missing system prompt error, got %v", err)
+	}
+	if _, err := parseAppConfigDocument([]byte(`not json`)); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
+
+func TestResolveUsers(t *testing.T) {
+	users, err := resolveUsers(nil, NutritionGoals{}, "me@example.com", defaultUserTimezone, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(users) != 1 || users[0].ID != defaultUserID || users[0].ReportEmail != "me@example.com" || users[0].Timezone != defaultUserTimezone {
+		t.Errorf("expected a single default user, got %+v", users)
+	}
+
+	registry := []User{
+		{ID: "alice", ReportEmail: "Alice <alice@example.com>", Timezone: "America/New_York"},
+		{ID: "bob", ReportEmail: "bob@example.com"},
+	}
+	users, err = resolveUsers(registry, NutritionGoals{DailyCalories: 2000, FiberMinG: 30}, "me@example.com", defaultUserTimezone, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(users) != 2 || users[0].ReportEmail != "alice@example.com" || users[0].location().String() != "America/New_York" {
+		t.Errorf("unexpected users: %+v", users)
+	}
+	if users[1].Goals.DailyCalories != 2000 || users[1].Goals.FiberMinG != 30 {
+		t.Errorf("expected default goals for bob, got %+v", users[1].Goals)
+	}
+
+	// Users delivered to chat channels only do not need an email address
+	chatOnly := []User{{ID: "carol", Channels: []Channel{{Type: channelSlack, Secret: "carol-slack"}}}}
+	if users, err := resolveUsers(chatOnly, NutritionGoals{}, "", defaultUserTimezone, ""); err != nil || users[0].ReportEmail != "" {
+		t.Errorf("expected a slack-only user, got %+v, %v", users, err)
+	}
+
+	users, err = resolveUsers(registry, NutritionGoals{}, "", defaultUserTimezone, "bob")
+	if err != nil || len(users) != 1 || users[0].ID != "bob" {
+		t.Errorf("expected only bob, got %+v, %v", users, err)
+	}
+
+	for name, tt := range map[string]struct {
+		registry []User
+		only     string
+	}{
+		"unsafe id":            {[]User{{ID: "a' OR 1=1 --", ReportEmail: "a@example.com"}}, ""},
+		"duplicate id":         {[]User{{ID: "a", ReportEmail: "a@example.com"}, {ID: "a", ReportEmail: "b@example.com"}}, ""},
+		"missing email":        {[]User{{ID: "a"}}, ""},
+		"invalid timezone":     {[]User{{ID: "a", ReportEmail: "a@example.com", Timezone: "Mars/Olympus"}}, ""},
+		"unknown user":         {registry, "carol"},
+		"invalid goals":        {[]User{{ID: "a", ReportEmail: "a@example.com", Goals: NutritionGoals{ProteinGPerKg: 1.6}}}, ""},
+		"unknown channel":      {[]User{{ID: "a", ReportEmail: "a@example.com", Channels: []Channel{{Type: "pager"}}}}, ""},
+		"http webhook":         {[]User{{ID: "a", Channels: []Channel{{Type: channelWebhook, URL: "http://example.com/hook"}}}}, ""},
+		"telegram no chat":     {[]User{{ID: "a", Channels: []Channel{{Type: channelTelegram, Secret: "bot"}}}}, ""},
+		"email no address":     {[]User{{ID: "a", Channels: []Channel{{Type: channelSlack, Secret: "slack"}, {Type: channelEmail}}}}, ""},
+		"page outside pages/":  {[]User{{ID: "a", Channels: []Channel{{Type: channelS3Page, Prefix: "reports/a/"}}}}, ""},
+		"page escaping pages/": {[]User{{ID: "a", Channels: []Channel{{Type: channelS3Page, Prefix: "pages/../reports/"}}}}, ""},
+	} {
+		if _, err := resolveUsers(tt.registry, NutritionGoals{}, "me@example.com", defaultUserTimezone, tt.only); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestConfigFor(t *testing.T) {
+	base := &Config{ReportEmail: "me@example.com", DailyCalorieTarget: 2200}
+	user := User{ID: "alice", ReportEmail: "alice@example.com", Goals: NutritionGoals{DailyCalories: 1800}}
+
+	config := configFor(base, user)
+	if config.UserID != "alice" || config.ReportEmail != "alice@example.com" || config.DailyCalorieTarget != 1800 {
+		t.Errorf("unexpected config: %+v", config)
+	}
+	if base.ReportEmail != "me@example.com" || base.UserID != "" {
+		t.Error("configFor should not modify the shared config")
+	}
+	if configFor(base, User{ID: "bob"}).DailyCalorieTarget != 2200 {
+		t.Error("users without a calorie goal should keep DAILY_CALORIE_TARGET")
+	}
+}